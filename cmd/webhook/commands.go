@@ -0,0 +1,222 @@
+/*
+ * Main - subcommands of the webhook program.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/cloudns"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Output formats of the plan subcommand.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// errDrift is returned by the plan subcommand when the ClouDNS records differ
+// from the desired state.
+var errDrift = errors.New("the records differ from the desired state")
+
+// exitCodeDrift is the exit code of the plan subcommand when there is drift.
+const exitCodeDrift = 2
+
+// command is a subcommand run instead of the webhook server. It receives the
+// arguments following its name and writes its output to stdout.
+type command func(args []string, stdout io.Writer) error
+
+// commands are the subcommands of the webhook program, by name.
+var commands = map[string]command{
+	"export": runExport,
+	"plan":   runPlan,
+}
+
+// newProviderFromEnv creates a provider configured from the same environment
+// variables as the webhook server.
+var newProviderFromEnv = func() (*cloudns.ClouDNSProvider, error) {
+	envConfig, err := cloudns.NewConfiguration()
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration unreadable: %w", err)
+	}
+	providerConfig, err := envConfig.ProviderConfig()
+	if err != nil {
+		return nil, fmt.Errorf("provider configuration invalid: %w", err)
+	}
+	return cloudns.NewClouDNSProvider(*providerConfig)
+}
+
+// runExport writes every zone matching the domain filters as a BIND zone file,
+// either to stdout or, with -dir, to one <zone>.zone file per zone.
+func runExport(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := flags.String("dir", "", "directory the zone files are written to (default: standard output)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	provider, err := newProviderFromEnv()
+	if err != nil {
+		return err
+	}
+	zones, err := provider.ExportZones(context.Background())
+	if err != nil {
+		return err
+	}
+
+	return writeZoneFiles(zones, *dir, stdout)
+}
+
+// writeZoneFiles writes the zone files to the directory, or to stdout one
+// after the other if the directory is empty.
+func writeZoneFiles(zones []cloudns.ZoneExport, dir string, stdout io.Writer) error {
+	for _, zone := range zones {
+		if dir == "" {
+			if err := zone.WriteZoneFile(stdout); err != nil {
+				return err
+			}
+			continue
+		}
+
+		path := filepath.Join(dir, zone.Name+".zone")
+		file, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = zone.WriteZoneFile(file)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// runPlan compares the desired endpoints read from a JSON file, in the format
+// of the webhook API, with the ClouDNS records owned by the TXT registry owner
+// ID and prints the changes that would be applied. If there is any change,
+// errDrift is returned.
+func runPlan(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("plan", flag.ContinueOnError)
+	desiredFile := flags.String("desired", "", "JSON file with the desired endpoints, - for standard input")
+	output := flags.String("output", outputText, "output format: text or json")
+	registry := cloudns.Registry{}
+	flags.StringVar(&registry.OwnerID, "txt-owner-id", "default", "owner ID of the records in the TXT registry, as given to ExternalDNS")
+	flags.StringVar(&registry.Prefix, "txt-prefix", "", "prefix of the TXT registry records, as given to ExternalDNS")
+	flags.StringVar(&registry.Suffix, "txt-suffix", "", "suffix of the TXT registry records, as given to ExternalDNS")
+	flags.StringVar(&registry.WildcardReplacement, "txt-wildcard-replacement", "", "replacement of the wildcard in the TXT registry records, as given to ExternalDNS")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *desiredFile == "" {
+		return fmt.Errorf("the -desired file is required")
+	}
+	if *output != outputText && *output != outputJSON {
+		return fmt.Errorf("unknown output format: '%s'", *output)
+	}
+
+	desired, err := readEndpoints(*desiredFile)
+	if err != nil {
+		return err
+	}
+
+	provider, err := newProviderFromEnv()
+	if err != nil {
+		return err
+	}
+	events, err := provider.Diff(context.Background(), desired, registry)
+	if err != nil {
+		return err
+	}
+
+	if err := writePlan(events, *output, stdout); err != nil {
+		return err
+	}
+	if len(events) > 0 {
+		return errDrift
+	}
+	return nil
+}
+
+// readEndpoints reads a JSON array of endpoints from the file, or from the
+// standard input if the name is "-".
+func readEndpoints(name string) ([]*endpoint.Endpoint, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	if err := json.Unmarshal(data, &endpoints); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+	return endpoints, nil
+}
+
+// writePlan writes the planned changes in the given format.
+func writePlan(events []audit.Event, output string, stdout io.Writer) error {
+	if output == outputJSON {
+		encoder := json.NewEncoder(stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(events)
+	}
+
+	for _, event := range events {
+		host := event.Host
+		if host == "" {
+			host = "@"
+		}
+		line := fmt.Sprintf("%s %s %s (zone %s, host %s", strings.ToUpper(event.Change), event.Name, event.Type, event.Zone, host)
+		if len(event.RecordIDs) > 0 {
+			line += fmt.Sprintf(", record IDs %v", event.RecordIDs)
+		}
+		line += "): " + formatRecordSet(event.Before) + " -> " + formatRecordSet(event.After)
+		if _, err := fmt.Fprintln(stdout, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(stdout, "%d change(s)\n", len(events))
+	return err
+}
+
+// formatRecordSet returns the targets and TTL of a record set, or "-" if it
+// does not exist.
+func formatRecordSet(set *audit.RecordSet) string {
+	if set == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s ttl %d", strings.Join(set.Targets, ","), set.TTL)
+}
@@ -0,0 +1,137 @@
+/*
+ * Main - unit tests of the subcommands
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/cloudns"
+
+	cloudnsapi "github.com/ppmathis/cloudns-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var testZones = []cloudns.ZoneExport{
+	{
+		Name: "alpha.com",
+		SOA:  cloudnsapi.SOA{PrimaryNS: "ns1.cloudns.net", AdminMail: "hostmaster@alpha.com", DefaultTTL: 3600},
+		Records: []cloudnsapi.Record{
+			{Host: "www", Record: "1.2.3.4", RecordType: cloudnsapi.RecordTypeA, TTL: 300, IsActive: true},
+		},
+	},
+	{
+		Name: "beta.com",
+		SOA:  cloudnsapi.SOA{PrimaryNS: "ns1.cloudns.net", AdminMail: "hostmaster@beta.com", DefaultTTL: 3600},
+	},
+}
+
+func Test_writeZoneFiles(t *testing.T) {
+	var stdout bytes.Buffer
+	assert.NoError(t, writeZoneFiles(testZones, "", &stdout))
+	assert.Contains(t, stdout.String(), "$ORIGIN alpha.com.\n")
+	assert.Contains(t, stdout.String(), "www\t300\tIN\tA\t1.2.3.4\n")
+	assert.Contains(t, stdout.String(), "$ORIGIN beta.com.\n")
+
+	dir := t.TempDir()
+	stdout.Reset()
+	assert.NoError(t, writeZoneFiles(testZones, dir, &stdout))
+	assert.Empty(t, stdout.String())
+	alpha, err := os.ReadFile(filepath.Join(dir, "alpha.com.zone"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(alpha), "www\t300\tIN\tA\t1.2.3.4\n")
+	assert.FileExists(t, filepath.Join(dir, "beta.com.zone"))
+
+	err = writeZoneFiles(testZones, filepath.Join(dir, "missing"), &stdout)
+	assert.Error(t, err)
+}
+
+func Test_runExport_errors(t *testing.T) {
+	var stdout bytes.Buffer
+	assert.Error(t, runExport([]string{"-unknown"}, &stdout))
+
+	t.Setenv("CLOUDNS_AUTH_ID", "")
+	t.Setenv("CLOUDNS_AUTH_PASSWORD", "")
+	err := runExport([]string{}, &stdout)
+	assert.ErrorContains(t, err, "provider configuration invalid")
+}
+
+func Test_readEndpoints(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "desired.json")
+	data := `[{"dnsName":"www.alpha.com","targets":["1.2.3.4"],"recordType":"A","recordTTL":300}]`
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	endpoints, err := readEndpoints(path)
+	assert.NoError(t, err)
+	assert.Len(t, endpoints, 1)
+	assert.Equal(t, "www.alpha.com", endpoints[0].DNSName)
+	assert.Equal(t, endpoint.TTL(300), endpoints[0].RecordTTL)
+
+	assert.NoError(t, os.WriteFile(path, []byte("{"), 0o600))
+	_, err = readEndpoints(path)
+	assert.ErrorContains(t, err, "cannot parse")
+
+	_, err = readEndpoints(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+var testPlan = []audit.Event{
+	{
+		Change: "create", Zone: "alpha.com", Name: "alpha.com", Host: "", Type: "A",
+		After: &audit.RecordSet{Targets: []string{"1.2.3.4", "5.6.7.8"}, TTL: 300},
+	},
+	{
+		Change: "update", Zone: "alpha.com", Name: "www.alpha.com", Host: "www", Type: "A", RecordIDs: []int{3},
+		Before: &audit.RecordSet{Targets: []string{"3.3.3.3"}, TTL: 300},
+		After:  &audit.RecordSet{Targets: []string{"4.4.4.4"}, TTL: 3600},
+	},
+	{
+		Change: "delete", Zone: "alpha.com", Name: "old.alpha.com", Host: "old", Type: "A", RecordIDs: []int{2},
+		Before: &audit.RecordSet{Targets: []string{"2.2.2.2"}, TTL: 300},
+	},
+}
+
+func Test_writePlan(t *testing.T) {
+	var stdout bytes.Buffer
+	assert.NoError(t, writePlan(testPlan, outputText, &stdout))
+	expected := `CREATE alpha.com A (zone alpha.com, host @): - -> 1.2.3.4,5.6.7.8 ttl 300
+UPDATE www.alpha.com A (zone alpha.com, host www, record IDs [3]): 3.3.3.3 ttl 300 -> 4.4.4.4 ttl 3600
+DELETE old.alpha.com A (zone alpha.com, host old, record IDs [2]): 2.2.2.2 ttl 300 -> -
+3 change(s)
+`
+	assert.Equal(t, expected, stdout.String())
+
+	stdout.Reset()
+	assert.NoError(t, writePlan(testPlan, outputJSON, &stdout))
+	var events []audit.Event
+	assert.NoError(t, json.Unmarshal(stdout.Bytes(), &events))
+	assert.Equal(t, testPlan, events)
+	assert.NotContains(t, stdout.String(), "seq")
+}
+
+func Test_runPlan_errors(t *testing.T) {
+	var stdout bytes.Buffer
+	assert.ErrorContains(t, runPlan([]string{}, &stdout), "-desired file is required")
+	assert.ErrorContains(t, runPlan([]string{"-desired", "x.json", "-output", "yaml"}, &stdout), "unknown output format")
+	assert.Error(t, runPlan([]string{"-desired", filepath.Join(t.TempDir(), "missing.json")}, &stdout))
+}
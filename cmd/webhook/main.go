@@ -18,15 +18,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"external-dns-cloudns-webhook/internal/audit"
 	"external-dns-cloudns-webhook/internal/cloudns"
+	"external-dns-cloudns-webhook/internal/dryrun"
+	"external-dns-cloudns-webhook/internal/health"
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/override"
+	"external-dns-cloudns-webhook/internal/queue"
+	"external-dns-cloudns-webhook/internal/recordids"
 	"external-dns-cloudns-webhook/internal/server"
+	"external-dns-cloudns-webhook/internal/tracing"
 
 	log "github.com/sirupsen/logrus"
-	"sigs.k8s.io/external-dns/provider/webhook/api"
+	externaldnsprovider "sigs.k8s.io/external-dns/provider"
 
 	"github.com/codingconcepts/env"
 )
@@ -49,20 +61,106 @@ type healthStatus interface {
 	SetReady(bool)
 }
 
-// waitForSignal waits for a SIGTERM or a SIGINT and then shuts down the server.
-func waitForSignal(status healthStatus) {
-	exitSignal := make(chan os.Signal, 1)
-	notify(exitSignal)
+// providerProbe is the interface used by waitForProvider.
+type providerProbe interface {
+	Probe(ctx context.Context) (int, error)
+}
+
+// after returns the channel used to wait between two startup checks.
+var after = time.After
+
+// watchSignals requires the SIGINT and SIGTERM signals. When one of them is
+// received, the returned context is canceled and the signal is delivered on
+// the returned channel.
+func watchSignals() (context.Context, <-chan os.Signal) {
+	sig := make(chan os.Signal, 1)
+	notify(sig)
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan os.Signal, 1)
+	go func() {
+		s := <-sig
+		cancel()
+		received <- s
+	}()
+	return ctx, received
+}
+
+// waitForProvider runs the startup check against ClouDNS. If the check fails
+// and the policy is "exit", the error is returned; otherwise the check is
+// repeated after the retry interval until it succeeds or the context is
+// canceled.
+func waitForProvider(ctx context.Context, probe providerProbe, policy string, interval time.Duration) error {
+	for {
+		zones, err := probe.Probe(ctx)
+		if err == nil {
+			log.Infof("ClouDNS startup check succeeded: %d zone(s) match the domain filter", zones)
+			return nil
+		}
+		if policy == cloudns.StartupPolicyExit {
+			return err
+		}
+		log.Warnf("ClouDNS startup check failed, retrying in %s: %s", interval, err.Error())
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-after(interval):
+		}
+	}
+}
+
+// shutdowner is the interface used by waitForSignal to stop the sockets.
+type shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// waitForSignal waits for a signal on exitSignal and then shuts down the
+// server. The sockets are shut down in the given order: each of them stops
+// accepting new requests and waits for the ones in flight until the timeout
+// expires.
+func waitForSignal(exitSignal <-chan os.Signal, status healthStatus, timeout time.Duration, sockets ...shutdowner) {
 	signal := <-exitSignal
 
 	log.Infof("Signal %s received. Shutting down the webhook.", signal.String())
 	status.SetHealthy(false)
 	status.SetReady(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, socket := range sockets {
+		if err := socket.Shutdown(ctx); err != nil {
+			log.Warn("Requests in flight interrupted while shutting down: ", err.Error())
+		}
+	}
+	log.Info("Shutdown complete")
 }
 
 // main reads the server configuration and starts both the webhook and the
-// metrics socket.
+// metrics socket, unless a subcommand is given as the first argument.
 func main() {
+	// Configure logging first, so that every message uses the chosen format
+	logOptions, err := logging.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read logging configuration from environment:", err.Error())
+	}
+	if err := logging.Configure(*logOptions); err != nil {
+		log.Fatal("Logging configuration invalid:", err.Error())
+	}
+
+	// Run a subcommand instead of the server, if one is given
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			err := cmd(os.Args[2:], os.Stdout)
+			if errors.Is(err, errDrift) {
+				log.Warn(err.Error())
+				os.Exit(exitCodeDrift)
+			}
+			if err != nil {
+				log.Fatalf("Command %s failed: %s", os.Args[1], err.Error())
+			}
+			return
+		}
+	}
+
 	log.Infof("Starting ClouDNS webhook version %s (commit %s)", Version, Gitsha)
 	// Read server options
 	socketOptions, err := server.NewSocketOptions()
@@ -71,12 +169,96 @@ func main() {
 		log.Exit(1)
 	}
 
+	// Set up tracing
+	tracingOptions, err := tracing.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read tracing configuration from environment:", err.Error())
+	}
+	tracer, err := tracing.Setup(context.Background(), *tracingOptions)
+	if err != nil {
+		log.Fatal("Tracing cannot be set up:", err.Error())
+	}
+
+	// Configure the metric names and buckets
+	metricsOptions, err := metrics.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read metrics configuration from environment:", err.Error())
+	}
+	openMetrics, err := metrics.NewOpenMetrics(*metricsOptions)
+	if err != nil {
+		log.Fatal("Metrics configuration invalid:", err.Error())
+	}
+
+	// Set up the audit log of the DNS mutations
+	auditOptions, err := audit.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read audit configuration from environment:", err.Error())
+	}
+	auditor, err := audit.Setup(*auditOptions, openMetrics)
+	if err != nil {
+		log.Fatal("Audit log cannot be set up:", err.Error())
+	}
+
+	// Keep the IDs of the records
+	recordIDOptions, err := recordids.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read record ID store configuration from environment:", err.Error())
+	}
+	recordIDs, err := recordids.Setup(*recordIDOptions)
+	if err != nil {
+		log.Fatal("Record ID store cannot be set up:", err.Error())
+	}
+
+	// Keep the latest dry-run reports for the metrics socket
+	dryRunOptions, err := dryrun.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read dry-run configuration from environment:", err.Error())
+	}
+	dryRunReports := dryrun.NewReports(dryRunOptions.Reports)
+
+	// Keep the status of the batches applied asynchronously
+	queueOptions, err := queue.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read apply queue configuration from environment:", err.Error())
+	}
+	applyQueue := queue.New(queueOptions.History)
+
+	// Keep the one-shot overrides of the deletion guard
+	overrideOptions, err := override.NewOptions()
+	if err != nil {
+		log.Fatal("Cannot read deletion guard override configuration from environment:", err.Error())
+	}
+	deletionOverrides := override.New(overrideOptions.Token, overrideOptions.GetValidity())
+
+	// Track the upstream health with the configured thresholds
+	tracker := health.NewTracker()
+	tracker.SetThresholds(
+		socketOptions.ReadinessMaxFailures,
+		socketOptions.GetLivenessMaxFailureDuration(),
+	)
+
+	// Watch the signals before anything can block, so that a SIGTERM also
+	// stops the startup check
+	ctx, exitSignal := watchSignals()
+
 	// Start health server
 	log.Infof("Starting metrics server with socket address %s", socketOptions.GetMetricsAddress())
 	serverStatus := server.Status{}
 	serverStatus.SetHealthy(true)
-	metricsSocket := server.NewMetricsSocket(&serverStatus)
-	go metricsSocket.Start(nil, *socketOptions)
+	metricsSocket := server.NewMetricsSocket(&serverStatus, tracker, openMetrics, dryRunReports, applyQueue)
+	metricsStartedChan := make(chan struct{})
+	go metricsSocket.Start(metricsStartedChan, *socketOptions)
+	<-metricsStartedChan
+
+	// Start the override server on its loopback address, if the overrides
+	// can be granted
+	overrideSocket := server.NewOverrideSocket(deletionOverrides)
+	if overrideOptions.Token != "" {
+		log.Infof("Starting deletion guard override server with socket address %s", overrideOptions.Address)
+		overrideStartedChan := make(chan struct{})
+		go overrideSocket.Start(overrideStartedChan, overrideOptions.Address, *socketOptions)
+		<-overrideStartedChan
+	}
 
 	// Read provider configuration
 	envConfig := &cloudns.Configuration{}
@@ -92,7 +274,15 @@ func main() {
 		panic(err)
 	}
 
-	// instantiate the ClouDNS provider
+	// instantiate the ClouDNS provider, updating the exposed metrics,
+	// recording the changes in the audit log and the dry-run reports, keeping
+	// the record IDs in the store and using the deletion guard overrides
+	providerConfig.Metrics = openMetrics
+	providerConfig.HealthTracker = tracker
+	providerConfig.Auditor = auditor
+	providerConfig.DryRunReports = dryRunReports
+	providerConfig.RecordIDs = recordIDs
+	providerConfig.DeletionOverrides = deletionOverrides
 	provider, err := cloudns.NewClouDNSProvider(*providerConfig)
 	if err != nil {
 		serverStatus.SetHealthy(false)
@@ -100,20 +290,35 @@ func main() {
 		panic(err)
 	}
 
+	// Queue the changes and apply them in the background, if requested
+	var webhookProvider externaldnsprovider.Provider = provider
+	if queueOptions.Async {
+		log.Info("Applying the changes asynchronously")
+		webhookProvider = applyQueue.Wrap(provider)
+	}
+
 	// Start the webhook
 	log.Infof("Starting webhook server with socket address %s", socketOptions.GetWebhookAddress())
 	startedChan := make(chan struct{})
-	go api.StartHTTPApi(
-		provider, startedChan,
-		socketOptions.GetReadTimeout(),
-		socketOptions.GetWriteTimeout(),
-		socketOptions.GetWebhookAddress(),
-	)
+	webhookSocket := server.NewWebhookSocket(webhookProvider)
+	go webhookSocket.Start(startedChan, *socketOptions)
 
-	// Wait for the HTTP server to start and then set the healthy and ready flags
+	// Wait for the HTTP server to start and for the startup check to succeed,
+	// then set the ready flag. If a signal is received in the meantime, the
+	// webhook is shut down without becoming ready.
 	<-startedChan
-	serverStatus.SetReady(true)
+	err = waitForProvider(ctx, provider, envConfig.StartupPolicy, envConfig.GetStartupRetryInterval())
+	if err != nil && ctx.Err() == nil {
+		serverStatus.SetHealthy(false)
+		log.Fatal("ClouDNS startup check failed - shutting down:", err)
+		log.Exit(1)
+	} else if err == nil {
+		serverStatus.SetReady(true)
+	}
 
-	// Wait until a signal tells us to exit
-	waitForSignal(&serverStatus)
+	// Wait until a signal tells us to exit, then let the webhook complete the
+	// requests in flight and the queue apply the pending changes before closing
+	// the record ID store, flushing the audit log, closing the metrics and
+	// override sockets and flushing the pending spans
+	waitForSignal(exitSignal, &serverStatus, socketOptions.GetShutdownTimeout(), webhookSocket, applyQueue, recordIDs, auditor, metricsSocket, overrideSocket, tracer)
 }
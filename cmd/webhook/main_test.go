@@ -18,6 +18,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"syscall"
 	"testing"
@@ -39,6 +41,20 @@ func (s *mockStatus) SetReady(ready bool) {
 	s.ready = ready
 }
 
+// mockSocket records the shutdown calls in a shared log.
+type mockSocket struct {
+	name     string
+	err      error
+	shutdown *[]string
+	deadline time.Time
+}
+
+func (s *mockSocket) Shutdown(ctx context.Context) error {
+	*s.shutdown = append(*s.shutdown, s.name)
+	s.deadline, _ = ctx.Deadline()
+	return s.err
+}
+
 func Test_waitForSignal(t *testing.T) {
 	name := "wait for signal test"
 	actual := mockStatus{
@@ -46,18 +62,131 @@ func Test_waitForSignal(t *testing.T) {
 		health: true,
 	}
 	expected := mockStatus{}
-	bkpNotify := notify
-	notify = func(sig chan os.Signal) {
-		go func() {
-			time.Sleep(time.Second)
-			sig <- syscall.SIGTERM
-		}()
-	}
+	shutdown := []string{}
+	webhook := &mockSocket{name: "webhook", shutdown: &shutdown, err: context.DeadlineExceeded}
+	metrics := &mockSocket{name: "metrics", shutdown: &shutdown}
+	exitSignal := make(chan os.Signal, 1)
+	go func() {
+		time.Sleep(time.Second)
+		exitSignal <- syscall.SIGTERM
+	}()
 
 	t.Run(name, func(t *testing.T) {
-		waitForSignal(&actual)
+		before := time.Now()
+		waitForSignal(exitSignal, &actual, time.Minute, webhook, metrics)
 		assert.Equal(t, expected, actual)
+		assert.Equal(t, []string{"webhook", "metrics"}, shutdown)
+		assert.WithinDuration(t, before.Add(time.Minute), webhook.deadline, 5*time.Second)
+		assert.Equal(t, webhook.deadline, metrics.deadline)
 	})
+}
 
-	notify = bkpNotify
+func Test_watchSignals(t *testing.T) {
+	bkpNotify := notify
+	defer func() { notify = bkpNotify }()
+	var sig chan os.Signal
+	notify = func(s chan os.Signal) {
+		sig = s
+	}
+
+	ctx, exitSignal := watchSignals()
+	assert.NoError(t, ctx.Err())
+
+	sig <- syscall.SIGTERM
+	assert.Equal(t, syscall.SIGTERM, <-exitSignal)
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+type mockProbe struct {
+	failures int
+	calls    int
+}
+
+func (p *mockProbe) Probe(ctx context.Context) (int, error) {
+	p.calls++
+	if p.calls <= p.failures {
+		return 0, fmt.Errorf("probe failure %d", p.calls)
+	}
+	return 2, nil
+}
+
+func Test_waitForProvider(t *testing.T) {
+	type testCase struct {
+		name     string
+		policy   string
+		canceled bool
+		failures int
+		calls    int
+		sleeps   int
+		err      string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		if tc.canceled {
+			cancel()
+		}
+
+		// The retry interval elapses at once, unless the context is canceled
+		sleeps := 0
+		bkpAfter := after
+		after = func(d time.Duration) <-chan time.Time {
+			assert.Equal(t, 5*time.Second, d)
+			sleeps++
+			elapsed := make(chan time.Time, 1)
+			if !tc.canceled {
+				elapsed <- time.Now()
+			}
+			return elapsed
+		}
+		defer func() { after = bkpAfter }()
+
+		probe := &mockProbe{failures: tc.failures}
+		err := waitForProvider(ctx, probe, tc.policy, 5*time.Second)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tc.calls, probe.calls)
+		assert.Equal(t, tc.sleeps, sleeps)
+	}
+
+	testCases := []testCase{
+		{
+			name:   "success at first attempt",
+			policy: "exit",
+			calls:  1,
+		},
+		{
+			name:     "exit on failure",
+			policy:   "exit",
+			failures: 1,
+			calls:    1,
+			err:      "probe failure 1",
+		},
+		{
+			name:     "retry until success",
+			policy:   "retry",
+			failures: 3,
+			calls:    4,
+			sleeps:   3,
+		},
+		{
+			name:     "canceled while retrying",
+			policy:   "retry",
+			canceled: true,
+			failures: 3,
+			calls:    1,
+			sleeps:   1,
+			err:      "context canceled",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
 }
@@ -0,0 +1,317 @@
+/*
+ * Audit - audit log of the DNS mutations.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Results of the delivery of the events to a sink.
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// maxBatchSize is the maximum number of events written to the sinks at once.
+const maxBatchSize = 100
+
+// RecordSet holds the values of a record set before or after a change.
+type RecordSet struct {
+	Targets []string `json:"targets"`
+	TTL     int64    `json:"ttl"`
+}
+
+// Event is the audit event of a single create, update or delete of a record
+// set. Seq, PrevHash and Hash chain the events together, so that a removed or
+// altered event can be detected.
+type Event struct {
+	Seq       uint64     `json:"seq,omitzero"`
+	Time      time.Time  `json:"time,omitzero"`
+	RequestID string     `json:"requestId,omitempty"`
+	Change    string     `json:"change"`
+	Account   string     `json:"account"`
+	Zone      string     `json:"zone"`
+	Name      string     `json:"name"`
+	Host      string     `json:"host"`
+	Type      string     `json:"type"`
+	RecordIDs []int      `json:"recordIds,omitempty"`
+	Before    *RecordSet `json:"before,omitempty"`
+	After     *RecordSet `json:"after,omitempty"`
+	DryRun    bool       `json:"dryRun"`
+	PrevHash  string     `json:"prevHash,omitzero"`
+	Hash      string     `json:"hash,omitzero"`
+}
+
+// Recorder records audit events.
+type Recorder interface {
+	Record(event Event)
+}
+
+// Auditor is a Recorder that delivers the events asynchronously and must be
+// shut down to flush them.
+type Auditor interface {
+	Recorder
+	Shutdown(ctx context.Context) error
+}
+
+// Sink is a destination of the audit events.
+type Sink interface {
+	// Name identifies the sink in the logs and metrics.
+	Name() string
+	// Write delivers a batch of events.
+	Write(ctx context.Context, events []Event) error
+	// Close releases the resources of the sink.
+	Close() error
+}
+
+// chainSource is implemented by the sinks that can read back the last event
+// they delivered, from which the chain of events is resumed on startup.
+type chainSource interface {
+	LastEvent() (*Event, error)
+}
+
+// Noop is an Auditor that discards the events.
+type Noop struct{}
+
+// Record does nothing.
+func (Noop) Record(Event) {}
+
+// Shutdown does nothing.
+func (Noop) Shutdown(context.Context) error {
+	return nil
+}
+
+// multiRecorder records the events in several recorders.
+type multiRecorder []Recorder
+
+// Multi returns a Recorder recording the events in all the given recorders.
+func Multi(recorders ...Recorder) Recorder {
+	return multiRecorder(recorders)
+}
+
+// Record records the event in every recorder.
+func (m multiRecorder) Record(event Event) {
+	for _, recorder := range m {
+		recorder.Record(event)
+	}
+}
+
+// Memory is a Recorder that keeps the events in memory as they are, without
+// chaining them.
+type Memory struct {
+	m      sync.Mutex
+	events []Event
+}
+
+// Record appends the event to the recorded ones.
+func (r *Memory) Record(event Event) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.events = append(r.events, event)
+}
+
+// Events returns the recorded events.
+func (r *Memory) Events() []Event {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return append([]Event{}, r.events...)
+}
+
+// Log is an Auditor that chains the events and delivers them to its sinks in
+// the background. Events recorded while the buffer is full are dropped.
+type Log struct {
+	sinks   []Sink
+	metrics metrics.Metrics
+	events  chan Event
+	done    chan struct{}
+
+	m        sync.Mutex
+	closed   bool
+	seq      uint64
+	lastHash string
+	now      func() time.Time
+}
+
+// NewLog creates a Log buffering up to bufferSize events and starts the
+// delivery to the sinks. The chain of events continues from the last event
+// delivered before, when a sink can read it back, so that a restart does not
+// break the chain and a truncated log can be told from a restart.
+func NewLog(m metrics.Metrics, bufferSize int, sinks ...Sink) *Log {
+	l := &Log{
+		sinks:   sinks,
+		metrics: m,
+		events:  make(chan Event, bufferSize),
+		done:    make(chan struct{}),
+		now:     time.Now,
+	}
+	l.resume()
+	go l.run()
+	return l
+}
+
+// resume continues the chain from the latest of the last events of the sinks.
+func (l *Log) resume() {
+	for _, sink := range l.sinks {
+		source, ok := sink.(chainSource)
+		if !ok {
+			continue
+		}
+		last, err := source.LastEvent()
+		if err != nil {
+			log.Warnf("Cannot read the last audit event from %s, starting a new chain: %s", sink.Name(), err.Error())
+			continue
+		}
+		if last != nil && last.Seq > l.seq {
+			l.seq, l.lastHash = last.Seq, last.Hash
+		}
+	}
+	if l.seq > 0 {
+		log.Infof("Resuming the audit chain after event %d", l.seq)
+	}
+}
+
+// Record stamps the event, chains it to the previous one and queues it for
+// delivery.
+func (l *Log) Record(event Event) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.closed {
+		log.Warnf("Audit log closed, dropping event for %s %s", event.Name, event.Type)
+		l.metrics.IncAuditEventsDroppedTotal()
+		return
+	}
+
+	l.seq++
+	event.Seq = l.seq
+	event.Time = l.now().UTC()
+	event.PrevHash = l.lastHash
+	event.Hash = ""
+	hash, err := eventHash(event)
+	if err != nil {
+		log.Warnf("Cannot hash audit event for %s %s: %s", event.Name, event.Type, err.Error())
+		l.metrics.IncAuditEventsDroppedTotal()
+		return
+	}
+	event.Hash = hash
+
+	select {
+	case l.events <- event:
+		l.lastHash = hash
+	default:
+		log.Warnf("Audit buffer full, dropping event for %s %s", event.Name, event.Type)
+		l.metrics.IncAuditEventsDroppedTotal()
+	}
+}
+
+// run delivers the queued events in batches until the log is shut down.
+func (l *Log) run() {
+	defer close(l.done)
+	for event := range l.events {
+		batch := []Event{event}
+	fill:
+		for len(batch) < maxBatchSize {
+			select {
+			case next, ok := <-l.events:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+		l.deliver(batch)
+	}
+}
+
+// deliver writes a batch of events to every sink.
+func (l *Log) deliver(batch []Event) {
+	for _, sink := range l.sinks {
+		if err := sink.Write(context.Background(), batch); err != nil {
+			log.Warnf("Cannot deliver %d audit event(s) to %s: %s", len(batch), sink.Name(), err.Error())
+			l.metrics.IncAuditEventsTotal(sink.Name(), resultFailure, len(batch))
+			continue
+		}
+		l.metrics.IncAuditEventsTotal(sink.Name(), resultSuccess, len(batch))
+	}
+}
+
+// Shutdown stops accepting events, waits until the queued ones are delivered
+// or the context expires, and closes the sinks.
+func (l *Log) Shutdown(ctx context.Context) error {
+	l.m.Lock()
+	if !l.closed {
+		l.closed = true
+		close(l.events)
+	}
+	l.m.Unlock()
+
+	select {
+	case <-l.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, sink := range l.sinks {
+		if err := sink.Close(); err != nil {
+			return fmt.Errorf("cannot close audit sink %s: %w", sink.Name(), err)
+		}
+	}
+	return nil
+}
+
+// eventHash returns the hash of an event whose Hash field is empty.
+func eventHash(event Event) (string, error) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify checks that the events form an unbroken chain, starting from the
+// given hash of the event preceding them (empty for the first event ever).
+func Verify(prevHash string, events []Event) error {
+	for _, event := range events {
+		if event.PrevHash != prevHash {
+			return fmt.Errorf("event %d: chain broken, expected previous hash '%s' but was '%s'", event.Seq, prevHash, event.PrevHash)
+		}
+		hash := event.Hash
+		event.Hash = ""
+		expected, err := eventHash(event)
+		if err != nil {
+			return fmt.Errorf("event %d: %w", event.Seq, err)
+		}
+		if hash != expected {
+			return fmt.Errorf("event %d: content altered, expected hash '%s' but was '%s'", event.Seq, expected, hash)
+		}
+		prevHash = hash
+	}
+	return nil
+}
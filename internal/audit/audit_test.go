@@ -0,0 +1,243 @@
+/*
+ * Audit - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// memorySink keeps the events in memory and can be made to block.
+type memorySink struct {
+	m       sync.Mutex
+	events  []Event
+	closed  bool
+	blocked chan struct{}
+}
+
+func (s *memorySink) Name() string {
+	return "memory"
+}
+
+func (s *memorySink) Write(_ context.Context, events []Event) error {
+	if s.blocked != nil {
+		<-s.blocked
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.events = append(s.events, events...)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func testEvent(name string) Event {
+	return Event{
+		RequestID: "req-1",
+		Change:    metrics.ChangeCreate,
+		Account:   "default",
+		Zone:      "alpha.com",
+		Name:      name,
+		Type:      "A",
+		After:     &RecordSet{Targets: []string{"1.2.3.4"}, TTL: 300},
+	}
+}
+
+func newTestMetrics(t *testing.T) *metrics.OpenMetrics {
+	m, err := metrics.NewOpenMetrics(metrics.DefaultOptions())
+	assert.NoError(t, err)
+	return m
+}
+
+func Test_Log_chain(t *testing.T) {
+	sink := &memorySink{}
+	l := NewLog(metrics.NoopMetrics{}, 10, sink)
+	l.now = func() time.Time { return time.Unix(1700000000, 0) }
+
+	l.Record(testEvent("www.alpha.com"))
+	l.Record(testEvent("ftp.alpha.com"))
+	l.Record(testEvent("mail.alpha.com"))
+	assert.NoError(t, l.Shutdown(context.Background()))
+
+	assert.True(t, sink.closed)
+	assert.Len(t, sink.events, 3)
+	for i, event := range sink.events {
+		assert.Equal(t, uint64(i+1), event.Seq)
+		assert.Equal(t, time.Unix(1700000000, 0).UTC(), event.Time)
+		assert.NotEmpty(t, event.Hash)
+	}
+	assert.Empty(t, sink.events[0].PrevHash)
+	assert.Equal(t, sink.events[0].Hash, sink.events[1].PrevHash)
+	assert.NoError(t, Verify("", sink.events))
+
+	// A removed event breaks the chain.
+	err := Verify("", []Event{sink.events[0], sink.events[2]})
+	assert.ErrorContains(t, err, "event 3: chain broken")
+
+	// An altered event does not match its hash.
+	altered := append([]Event{}, sink.events...)
+	altered[1].Name = "evil.alpha.com"
+	err = Verify("", altered)
+	assert.ErrorContains(t, err, "event 2: content altered")
+}
+
+func Test_Log_resume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	for _, name := range []string{"www.alpha.com", "ftp.alpha.com"} {
+		sink, err := NewFileSink(path, 0, 0)
+		assert.NoError(t, err)
+		l := NewLog(metrics.NoopMetrics{}, 10, sink)
+		l.Record(testEvent(name))
+		assert.NoError(t, l.Shutdown(context.Background()))
+	}
+
+	// The chain continues across the restart.
+	events := readEvents(t, path)
+	assert.Len(t, events, 2)
+	assert.Equal(t, uint64(2), events[1].Seq)
+	assert.NoError(t, Verify("", events))
+}
+
+func Test_Log_bufferFull(t *testing.T) {
+	m := newTestMetrics(t)
+	sink := &memorySink{blocked: make(chan struct{})}
+	l := NewLog(m, 1, sink)
+
+	// The first event is taken by the delivery goroutine, which then blocks
+	// in the sink; the second one fills the buffer.
+	l.Record(testEvent("www.alpha.com"))
+	assert.Eventually(t, func() bool { return len(l.events) == 0 }, time.Second, time.Millisecond)
+	l.Record(testEvent("ftp.alpha.com"))
+	l.Record(testEvent("mail.alpha.com"))
+	close(sink.blocked)
+	assert.NoError(t, l.Shutdown(context.Background()))
+
+	assert.Len(t, sink.events, 2)
+	assert.NoError(t, Verify("", sink.events))
+	expected := `
+# HELP cloudns_webhook_audit_events_dropped_total The number of audit events dropped without being delivered
+# TYPE cloudns_webhook_audit_events_dropped_total counter
+cloudns_webhook_audit_events_dropped_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "cloudns_webhook_audit_events_dropped_total"))
+}
+
+func Test_Log_sinkFailure(t *testing.T) {
+	m := newTestMetrics(t)
+	good := &memorySink{}
+	bad := &failingSink{}
+	l := NewLog(m, 10, good, bad)
+
+	l.Record(testEvent("www.alpha.com"))
+	l.Record(testEvent("ftp.alpha.com"))
+	assert.NoError(t, l.Shutdown(context.Background()))
+
+	assert.Len(t, good.events, 2)
+	expected := `
+# HELP cloudns_webhook_audit_events_total The number of audit events delivered to a sink, by result
+# TYPE cloudns_webhook_audit_events_total counter
+cloudns_webhook_audit_events_total{result="failure",sink="failing"} 2
+cloudns_webhook_audit_events_total{result="success",sink="memory"} 2
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "cloudns_webhook_audit_events_total"))
+}
+
+// failingSink always fails.
+type failingSink struct{}
+
+func (failingSink) Name() string {
+	return "failing"
+}
+
+func (failingSink) Write(context.Context, []Event) error {
+	return fmt.Errorf("sink failure")
+}
+
+func (failingSink) Close() error {
+	return nil
+}
+
+func Test_Log_recordAfterShutdown(t *testing.T) {
+	m := newTestMetrics(t)
+	sink := &memorySink{}
+	l := NewLog(m, 10, sink)
+	assert.NoError(t, l.Shutdown(context.Background()))
+	assert.NoError(t, l.Shutdown(context.Background()))
+
+	l.Record(testEvent("www.alpha.com"))
+
+	assert.Empty(t, sink.events)
+	expected := `
+# HELP cloudns_webhook_audit_events_dropped_total The number of audit events dropped without being delivered
+# TYPE cloudns_webhook_audit_events_dropped_total counter
+cloudns_webhook_audit_events_dropped_total 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "cloudns_webhook_audit_events_dropped_total"))
+}
+
+func Test_Log_shutdownTimeout(t *testing.T) {
+	sink := &memorySink{blocked: make(chan struct{})}
+	defer close(sink.blocked)
+	l := NewLog(metrics.NoopMetrics{}, 10, sink)
+	l.Record(testEvent("www.alpha.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, l.Shutdown(ctx), context.DeadlineExceeded)
+	assert.False(t, sink.closed)
+}
+
+func Test_Memory(t *testing.T) {
+	var r Recorder = &Memory{}
+	r.Record(testEvent("www.alpha.com"))
+	r.Record(testEvent("ftp.alpha.com"))
+
+	events := r.(*Memory).Events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, "ftp.alpha.com", events[1].Name)
+	assert.Zero(t, events[1].Seq)
+}
+
+func Test_Multi(t *testing.T) {
+	first, second := &Memory{}, &Memory{}
+	r := Multi(first, Noop{}, second)
+	r.Record(testEvent("www.alpha.com"))
+
+	assert.Len(t, first.Events(), 1)
+	assert.Len(t, second.Events(), 1)
+}
+
+func Test_Noop(t *testing.T) {
+	var a Auditor = Noop{}
+	a.Record(testEvent("www.alpha.com"))
+	assert.NoError(t, a.Shutdown(context.Background()))
+}
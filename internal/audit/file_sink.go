@@ -0,0 +1,204 @@
+/*
+ * Audit - JSON Lines file sink.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLineSize is the maximum size of a line read back from the file.
+const maxLineSize = 1024 * 1024
+
+// FileSink writes the events to a file, one JSON object per line. When the
+// file would grow beyond maxSize bytes it is rotated: path becomes path.1,
+// path.1 becomes path.2 and so on, keeping at most maxBackups old files.
+type FileSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	file *os.File
+	size int64
+}
+
+// NewFileSink opens or creates the file at path in append mode. A maxSize of
+// 0 disables the rotation.
+func NewFileSink(path string, maxSize int64, maxBackups int) (*FileSink, error) {
+	s := &FileSink{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the current file and reads its size.
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Name returns the name of the sink.
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+// Write appends the events to the file, rotating it when required. If the
+// rotation fails, the events are appended to the current file, which is
+// rotated again with the next event.
+func (s *FileSink) Write(_ context.Context, events []Event) error {
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+
+		if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+			if err := s.rotate(); err != nil {
+				if s.file == nil {
+					return fmt.Errorf("cannot rotate %s: %w", s.path, err)
+				}
+				log.Warnf("Cannot rotate %s, appending to it: %s", s.path, err.Error())
+			}
+		}
+
+		n, err := s.file.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return s.file.Sync()
+}
+
+// rotate shifts the old files, moves the current one to path.1 and opens a
+// new one. If the current file cannot be moved, it is opened again, so that
+// the sink keeps working; if it cannot be opened either, the file is nil and
+// Write opens it again.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err == nil {
+		err = s.shift()
+	}
+	if openErr := s.open(); openErr != nil {
+		return errors.Join(err, openErr)
+	}
+	return err
+}
+
+// shift shifts the old files and moves the current one to path.1, or removes
+// it if no old file is kept.
+func (s *FileSink) shift() error {
+	if s.maxBackups > 0 {
+		for i := s.maxBackups - 1; i >= 1; i-- {
+			err := os.Rename(s.backupPath(i), s.backupPath(i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(s.path, s.backupPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+// LastEvent returns the last event written to the file, or to the latest old
+// file if the current one is empty, so that the chain of events is resumed on
+// startup. A line that cannot be decoded, like the one left behind by a crash
+// in the middle of a write, is skipped. It returns nil if there is no event.
+func (s *FileSink) LastEvent() (*Event, error) {
+	paths := []string{s.path}
+	for i := 1; i <= s.maxBackups; i++ {
+		paths = append(paths, s.backupPath(i))
+	}
+
+	for _, path := range paths {
+		event, err := lastEvent(path)
+		if err != nil || event != nil {
+			return event, err
+		}
+	}
+	return nil, nil
+}
+
+// lastEvent returns the last event of a JSON Lines file, nil if the file does
+// not exist or holds no event.
+func lastEvent(path string) (*Event, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var last *Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		last = &event
+	}
+	return last, scanner.Err()
+}
+
+// backupPath returns the path of the i-th old file.
+func (s *FileSink) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Close closes the file.
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
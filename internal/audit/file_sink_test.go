@@ -0,0 +1,159 @@
+/*
+ * Audit - Unit tests of the file sink.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readEvents reads the events from a JSON Lines file.
+func readEvents(t *testing.T, path string) []Event {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	assert.NoError(t, scanner.Err())
+	return events
+}
+
+func Test_FileSink_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileSink(path, 0, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, "file", sink.Name())
+	assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com")}))
+	assert.NoError(t, sink.Close())
+
+	// The file is appended to when reopened.
+	sink, err = NewFileSink(path, 0, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("ftp.alpha.com")}))
+	assert.NoError(t, sink.Close())
+
+	events := readEvents(t, path)
+	assert.Len(t, events, 2)
+	assert.Equal(t, "www.alpha.com", events[0].Name)
+	assert.Equal(t, "ftp.alpha.com", events[1].Name)
+	assert.Equal(t, []string{"1.2.3.4"}, events[0].After.Targets)
+}
+
+func Test_FileSink_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, err := json.Marshal(testEvent("www.alpha.com"))
+	assert.NoError(t, err)
+
+	// Each file holds two events.
+	sink, err := NewFileSink(path, int64(2*(len(line)+1)), 2)
+	assert.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com")}))
+	}
+	assert.NoError(t, sink.Close())
+
+	assert.Len(t, readEvents(t, path), 1)
+	assert.Len(t, readEvents(t, path+".1"), 2)
+	assert.Len(t, readEvents(t, path+".2"), 2)
+	assert.NoFileExists(t, path+".3")
+}
+
+func Test_FileSink_rotateWithoutBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, err := json.Marshal(testEvent("www.alpha.com"))
+	assert.NoError(t, err)
+
+	sink, err := NewFileSink(path, int64(len(line)+1), 0)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com")}))
+	}
+	assert.NoError(t, sink.Close())
+
+	assert.Len(t, readEvents(t, path), 1)
+	assert.NoFileExists(t, path+".1")
+}
+
+func Test_FileSink_rotateRenameFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	line, err := json.Marshal(testEvent("www.alpha.com"))
+	assert.NoError(t, err)
+
+	// A non-empty directory in place of the backup makes the rename fail.
+	assert.NoError(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0o700))
+
+	sink, err := NewFileSink(path, int64(len(line)+1), 1)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com")}))
+	}
+	assert.Len(t, readEvents(t, path), 3)
+
+	// Once the rename works again, the file is rotated.
+	assert.NoError(t, os.RemoveAll(path+".1"))
+	assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com")}))
+	assert.NoError(t, sink.Close())
+	assert.Len(t, readEvents(t, path), 1)
+	assert.Len(t, readEvents(t, path+".1"), 3)
+}
+
+func Test_FileSink_LastEvent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := NewFileSink(path, 0, 1)
+	assert.NoError(t, err)
+
+	last, err := sink.LastEvent()
+	assert.NoError(t, err)
+	assert.Nil(t, last)
+
+	// A partial line left by a crash is skipped.
+	assert.NoError(t, sink.Write(context.Background(), []Event{testEvent("www.alpha.com"), testEvent("ftp.alpha.com")}))
+	_, err = sink.file.WriteString(`{"seq":3,"cha`)
+	assert.NoError(t, err)
+	last, err = sink.LastEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, "ftp.alpha.com", last.Name)
+
+	// The latest old file is read when the current one is empty.
+	assert.NoError(t, sink.Close())
+	assert.NoError(t, os.Rename(path, path+".1"))
+	sink, err = NewFileSink(path, 0, 1)
+	assert.NoError(t, err)
+	last, err = sink.LastEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, "ftp.alpha.com", last.Name)
+	assert.NoError(t, sink.Close())
+}
+
+func Test_NewFileSink_error(t *testing.T) {
+	_, err := NewFileSink(filepath.Join(t.TempDir(), "missing", "audit.log"), 0, 0)
+	assert.Error(t, err)
+}
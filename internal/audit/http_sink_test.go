@@ -0,0 +1,69 @@
+/*
+ * Audit - Unit tests of the HTTP sink.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_HTTPSink_Write(t *testing.T) {
+	var received []Event
+	var contentType string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, time.Second)
+	assert.Equal(t, "http", sink.Name())
+	err := sink.Write(context.Background(), []Event{testEvent("www.alpha.com"), testEvent("ftp.alpha.com")})
+	assert.NoError(t, err)
+	assert.NoError(t, sink.Close())
+
+	assert.Equal(t, "application/json", contentType)
+	assert.Len(t, received, 2)
+	assert.Equal(t, "ftp.alpha.com", received[1].Name)
+}
+
+func Test_HTTPSink_errors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL, time.Second)
+	err := sink.Write(context.Background(), []Event{testEvent("www.alpha.com")})
+	assert.ErrorContains(t, err, "unexpected status 500")
+
+	sink = NewHTTPSink(server.URL+"/slow", 10*time.Millisecond)
+	err = sink.Write(context.Background(), []Event{testEvent("www.alpha.com")})
+	assert.Error(t, err)
+}
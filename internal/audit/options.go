@@ -0,0 +1,81 @@
+/*
+ * Audit - configuration.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"time"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	"github.com/codingconcepts/env"
+)
+
+// Options contains the audit log configuration.
+type Options struct {
+	// Path of the JSON Lines file, empty to disable the file sink
+	File string `env:"AUDIT_FILE"`
+	// Size in MiB after which the file is rotated, 0 to disable the rotation
+	FileMaxSize int `env:"AUDIT_FILE_MAX_SIZE" default:"100"`
+	// Number of rotated files to keep
+	FileMaxBackups int `env:"AUDIT_FILE_MAX_BACKUPS" default:"5"`
+	// URL the events are posted to, empty to disable the HTTP sink
+	WebhookURL string `env:"AUDIT_WEBHOOK_URL"`
+	// Timeout in ms of a post to the HTTP sink
+	WebhookTimeout int `env:"AUDIT_WEBHOOK_TIMEOUT" default:"5000"`
+	// Number of events buffered before new ones are dropped
+	BufferSize int `env:"AUDIT_BUFFER_SIZE" default:"1000"`
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// GetWebhookTimeout returns the timeout of a post to the HTTP sink.
+func (o Options) GetWebhookTimeout() time.Duration {
+	return time.Duration(o.WebhookTimeout) * time.Millisecond
+}
+
+// Setup creates the configured sinks and returns the Auditor delivering the
+// events to them. If no sink is configured, the events are discarded.
+func Setup(options Options, m metrics.Metrics) (Auditor, error) {
+	sinks := []Sink{}
+	if options.File != "" {
+		sink, err := NewFileSink(options.File, int64(options.FileMaxSize)*1024*1024, options.FileMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if options.WebhookURL != "" {
+		sinks = append(sinks, NewHTTPSink(options.WebhookURL, options.GetWebhookTimeout()))
+	}
+
+	if len(sinks) == 0 {
+		return Noop{}, nil
+	}
+	return NewLog(m, options.BufferSize, sinks...), nil
+}
@@ -0,0 +1,64 @@
+/*
+ * Audit - Unit tests of the configuration.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package audit
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewOptions(t *testing.T) {
+	t.Setenv("AUDIT_FILE", "/var/log/audit.log")
+	t.Setenv("AUDIT_WEBHOOK_TIMEOUT", "250")
+
+	options, err := NewOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, "/var/log/audit.log", options.File)
+	assert.Equal(t, 100, options.FileMaxSize)
+	assert.Equal(t, 5, options.FileMaxBackups)
+	assert.Empty(t, options.WebhookURL)
+	assert.Equal(t, 250*time.Millisecond, options.GetWebhookTimeout())
+	assert.Equal(t, 1000, options.BufferSize)
+}
+
+func Test_Setup(t *testing.T) {
+	auditor, err := Setup(Options{}, metrics.NoopMetrics{})
+	assert.NoError(t, err)
+	assert.IsType(t, Noop{}, auditor)
+
+	options := Options{
+		File:       filepath.Join(t.TempDir(), "audit.log"),
+		WebhookURL: "http://localhost:9999/audit",
+		BufferSize: 10,
+	}
+	auditor, err = Setup(options, metrics.NoopMetrics{})
+	assert.NoError(t, err)
+	assert.IsType(t, &Log{}, auditor)
+	assert.Len(t, auditor.(*Log).sinks, 2)
+	assert.NoError(t, auditor.Shutdown(context.Background()))
+
+	options.File = filepath.Join(t.TempDir(), "missing", "audit.log")
+	_, err = Setup(options, metrics.NoopMetrics{})
+	assert.Error(t, err)
+}
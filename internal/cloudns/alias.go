@@ -0,0 +1,69 @@
+package cloudns
+
+import (
+	"strings"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const (
+	// aliasProperty is the provider specific property, set by the
+	// external-dns.alpha.kubernetes.io/webhook-cloudns-alias annotation,
+	// requesting a CNAME endpoint to be written as a ClouDNS ALIAS record.
+	aliasProperty = "webhook/cloudns-alias"
+	// cloudnsAliasProperty is the same request made with the providerSpecific
+	// field of a DNSEndpoint resource.
+	cloudnsAliasProperty = "cloudns/alias"
+)
+
+// aliasRequested returns true if one of the alias properties of the endpoint
+// is true.
+func aliasRequested(ep *endpoint.Endpoint) bool {
+	for _, property := range []string{aliasProperty, cloudnsAliasProperty} {
+		if value, ok := ep.GetProviderSpecificProperty(property); ok && strings.EqualFold(value, "true") {
+			return true
+		}
+	}
+	return false
+}
+
+// isAlias returns true if the CNAME endpoint is written as an ALIAS record:
+// when requested by its properties, or at the zone apex when the apex CNAMEs
+// are turned into ALIAS records.
+func (p *ClouDNSProvider) isAlias(ep *endpoint.Endpoint, isZoneApex bool) bool {
+	if ep.RecordType != endpoint.RecordTypeCNAME {
+		return false
+	}
+	return aliasRequested(ep) || (p.apexAlias && isZoneApex)
+}
+
+// recordType returns the type of the ClouDNS records of the endpoint.
+func (p *ClouDNSProvider) recordType(ep *endpoint.Endpoint, isZoneApex bool) string {
+	if p.isAlias(ep, isZoneApex) {
+		return string(cloudns.RecordTypeALIAS)
+	}
+	return ep.RecordType
+}
+
+// adjustAlias replaces the alias properties of a desired CNAME endpoint with
+// aliasProperty set to true if the endpoint is written as an ALIAS record,
+// the way Records reports the ALIAS records, so that the plan does not update
+// the endpoint at every synchronization.
+func (p *ClouDNSProvider) adjustAlias(ep *endpoint.Endpoint, accountZones []accountZone) {
+	if ep.RecordType != endpoint.RecordTypeCNAME {
+		return
+	}
+
+	isZoneApex := false
+	if az, ok := matchAccountZone(ep.DNSName, accountZones); ok {
+		isZoneApex = isZoneName(ep.DNSName, az.zone.Name)
+	}
+	alias := p.isAlias(ep, isZoneApex)
+
+	ep.DeleteProviderSpecificProperty(cloudnsAliasProperty)
+	ep.DeleteProviderSpecificProperty(aliasProperty)
+	if alias {
+		ep.SetProviderSpecificProperty(aliasProperty, "true")
+	}
+}
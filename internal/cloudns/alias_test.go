@@ -0,0 +1,147 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestAdjustEndpointsAlias(t *testing.T) {
+	mockAPI(t, []cloudns.Zone{mockZones[0]}, nil)
+
+	type testCase struct {
+		name      string
+		apexAlias bool
+		endpoint  *endpoint.Endpoint
+		expected  endpoint.ProviderSpecific
+	}
+
+	testCases := []testCase{
+		{
+			name:     "apex CNAME",
+			endpoint: endpoint.NewEndpoint("test1.com", "CNAME", "lb.example.net"),
+		},
+		{
+			name:      "apex CNAME in apex alias mode",
+			apexAlias: true,
+			endpoint:  endpoint.NewEndpoint("test1.com", "CNAME", "lb.example.net"),
+			expected:  endpoint.ProviderSpecific{{Name: aliasProperty, Value: "true"}},
+		},
+		{
+			name:      "CNAME below the apex in apex alias mode",
+			apexAlias: true,
+			endpoint:  endpoint.NewEndpoint("www.test1.com", "CNAME", "lb.example.net"),
+		},
+		{
+			name:     "CNAME with the DNSEndpoint property",
+			endpoint: endpoint.NewEndpoint("www.test1.com", "CNAME", "lb.example.net").WithProviderSpecific(cloudnsAliasProperty, "True"),
+			expected: endpoint.ProviderSpecific{{Name: aliasProperty, Value: "true"}},
+		},
+		{
+			name:     "CNAME with the annotation property",
+			endpoint: endpoint.NewEndpoint("www.test1.com", "CNAME", "lb.example.net").WithProviderSpecific(aliasProperty, "true"),
+			expected: endpoint.ProviderSpecific{{Name: aliasProperty, Value: "true"}},
+		},
+		{
+			name:     "CNAME with a false property",
+			endpoint: endpoint.NewEndpoint("www.test1.com", "CNAME", "lb.example.net").WithProviderSpecific(aliasProperty, "false"),
+		},
+		{
+			name:     "A record with the property",
+			endpoint: endpoint.NewEndpoint("test1.com", "A", "1.2.3.4").WithProviderSpecific(aliasProperty, "true"),
+			expected: endpoint.ProviderSpecific{{Name: aliasProperty, Value: "true"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, _ := testProvider()
+			provider.apexAlias = tc.apexAlias
+
+			adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{tc.endpoint})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(adjusted) != 1 {
+				t.Fatalf("Want 1 endpoint, got %d", len(adjusted))
+			}
+			if len(tc.expected) == 0 && len(adjusted[0].ProviderSpecific) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(tc.expected, adjusted[0].ProviderSpecific) {
+				t.Errorf("Want properties %v, got %v", tc.expected, adjusted[0].ProviderSpecific)
+			}
+		})
+	}
+}
+
+func TestAlias(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{
+		"test1.com": {
+			1: {ID: 1, Host: "", Record: "lb.example.net", RecordType: cloudns.RecordTypeALIAS, TTL: 300},
+			2: {ID: 2, Host: "www", Record: "lb.example.net", RecordType: cloudns.RecordTypeCNAME, TTL: 300},
+		},
+	})
+
+	provider, _ := testProvider()
+	provider.apexAlias = true
+
+	// The ALIAS record is reported as a CNAME endpoint
+	endpoints, err := provider.Records(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	aliases := map[string]bool{}
+	for _, ep := range endpoints {
+		if ep.RecordType != "CNAME" {
+			t.Errorf("Want CNAME endpoints, got %s for %s", ep.RecordType, ep.DNSName)
+		}
+		aliases[ep.DNSName] = aliasRequested(ep)
+	}
+	if expected := map[string]bool{"test1.com": true, "www.test1.com": false}; !reflect.DeepEqual(expected, aliases) {
+		t.Errorf("Want aliases %v, got %v", expected, aliases)
+	}
+
+	// The desired apex CNAME matches the ALIAS record
+	events, err := provider.Diff(context.Background(), []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test1.com", "CNAME", 300, "lb.example.net"),
+		endpoint.NewEndpointWithTTL("www.test1.com", "CNAME", 300, "lb.example.net"),
+	}, Registry{OwnerID: "default"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Expected no change, got %+v", events)
+	}
+
+	// The apex CNAME and the CNAME with the property are created as ALIAS
+	// records, and the ALIAS record is deleted as the old apex CNAME
+	err = provider.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("api.test1.com", "CNAME", 300, "lb.example.net").WithProviderSpecific(cloudnsAliasProperty, "true"),
+		},
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("test1.com", "CNAME", 300, "lb.example.net").WithProviderSpecific(aliasProperty, "true"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("test1.com", "CNAME", 300, "lb2.example.net"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedCreated := []cloudns.Record{
+		{Host: "api", Record: "lb.example.net", RecordType: cloudns.RecordTypeALIAS, TTL: 300},
+		{Host: "", Record: "lb2.example.net", RecordType: cloudns.RecordTypeALIAS, TTL: 300},
+	}
+	if created := api.createdRecords(); !reflect.DeepEqual(expectedCreated, created) {
+		t.Errorf("Want created %+v, got %+v", expectedCreated, created)
+	}
+	if deleted := api.deletedIDs(); !reflect.DeepEqual([]int{1}, deleted) {
+		t.Errorf("Want deleted [1], got %v", deleted)
+	}
+}
@@ -0,0 +1,96 @@
+package cloudns
+
+import (
+	"context"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// changeSize returns the number of changes, counting an update once.
+func changeSize(changes *plan.Changes) int {
+	return len(changes.Create) + len(changes.Delete) + max(len(changes.UpdateOld), len(changes.UpdateNew))
+}
+
+// groupKey returns the DNS name a change belongs to: the name of the record
+// owned by a registry TXT record, or the name of the endpoint.
+func groupKey(ep *endpoint.Endpoint) string {
+	if owned, ok := ep.Labels[endpoint.OwnedRecordLabelKey]; ok && owned != "" {
+		return owned
+	}
+	return ep.DNSName
+}
+
+// groupChanges splits the changes into groups by DNS name, in the order the
+// names first appear among the creations, deletions and updates. The changes
+// to a DNS name and to the registry TXT records owning it are in the same
+// group.
+func groupChanges(changes *plan.Changes) []*plan.Changes {
+	groups := []*plan.Changes{}
+	byKey := map[string]*plan.Changes{}
+	group := func(ep *endpoint.Endpoint) *plan.Changes {
+		key := groupKey(ep)
+		g, ok := byKey[key]
+		if !ok {
+			g = &plan.Changes{}
+			byKey[key] = g
+			groups = append(groups, g)
+		}
+		return g
+	}
+
+	for _, ep := range changes.Create {
+		c := group(ep)
+		c.Create = append(c.Create, ep)
+	}
+	for _, ep := range changes.Delete {
+		c := group(ep)
+		c.Delete = append(c.Delete, ep)
+	}
+	for _, ep := range changes.UpdateOld {
+		c := group(ep)
+		c.UpdateOld = append(c.UpdateOld, ep)
+	}
+	for _, ep := range changes.UpdateNew {
+		c := group(ep)
+		c.UpdateNew = append(c.UpdateNew, ep)
+	}
+	return groups
+}
+
+// limitChanges returns the changes to apply in this run, at most
+// maxChangesPerBatch of them. The changes to a DNS name and to its registry
+// TXT records are never split, so a group larger than the limit is applied
+// alone. The other changes are deferred: they are not applied, and ExternalDNS
+// plans them again at its next synchronization.
+func (p *ClouDNSProvider) limitChanges(ctx context.Context, changes *plan.Changes) *plan.Changes {
+	if p.maxChangesPerBatch <= 0 || changeSize(changes) <= p.maxChangesPerBatch {
+		p.metrics.SetDeferredChanges(0)
+		return changes
+	}
+
+	batch := &plan.Changes{}
+	size, deferred := 0, 0
+	for _, g := range groupChanges(changes) {
+		if size > 0 && size+changeSize(g) > p.maxChangesPerBatch {
+			deferred += changeSize(g)
+			continue
+		}
+		batch.Create = append(batch.Create, g.Create...)
+		batch.Delete = append(batch.Delete, g.Delete...)
+		batch.UpdateOld = append(batch.UpdateOld, g.UpdateOld...)
+		batch.UpdateNew = append(batch.UpdateNew, g.UpdateNew...)
+		size += changeSize(g)
+	}
+
+	p.metrics.SetDeferredChanges(deferred)
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"changes":  size + deferred,
+		"applied":  size,
+		"deferred": deferred,
+	}).Warnf("Applying %d of %d changes - deferring %d to the next synchronization", size, size+deferred, deferred)
+	return batch
+}
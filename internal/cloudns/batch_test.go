@@ -0,0 +1,135 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// dnsNames returns the names of the endpoints.
+func dnsNames(endpoints []*endpoint.Endpoint) []string {
+	names := []string{}
+	for _, ep := range endpoints {
+		names = append(names, ep.DNSName)
+	}
+	return names
+}
+
+func TestLimitChanges(t *testing.T) {
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("one.test1.com", "A", "1.1.1.1"),
+			registryRecord("one.test1.com"),
+			endpoint.NewEndpoint("two.test1.com", "A", "2.2.2.2"),
+			registryRecord("two.test1.com"),
+			endpoint.NewEndpoint("three.test1.com", "A", "3.3.3.3"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("www.test1.com", "A", "4.4.4.4")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("www.test1.com", "A", "5.5.5.5")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("old.test1.com", "A", "6.6.6.6")},
+	}
+
+	type testCase struct {
+		name      string
+		max       int
+		create    []string
+		delete    []string
+		update    []string
+		deferred  int
+		unchanged bool
+	}
+
+	testCases := []testCase{
+		{name: "no limit", max: 0, unchanged: true},
+		{name: "below the limit", max: 7, unchanged: true},
+		{
+			name:     "registry records kept with their records",
+			max:      3,
+			create:   []string{"one.test1.com", "a-one.test1.com", "three.test1.com"},
+			delete:   []string{},
+			update:   []string{},
+			deferred: 4,
+		},
+		{
+			name:     "filled with smaller groups",
+			max:      5,
+			create:   []string{"one.test1.com", "a-one.test1.com", "two.test1.com", "a-two.test1.com", "three.test1.com"},
+			delete:   []string{},
+			update:   []string{},
+			deferred: 2,
+		},
+		{
+			name:     "group larger than the limit",
+			max:      1,
+			create:   []string{"one.test1.com", "a-one.test1.com"},
+			delete:   []string{},
+			update:   []string{},
+			deferred: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, m := testProvider()
+			provider.maxChangesPerBatch = tc.max
+
+			batch := provider.limitChanges(context.Background(), changes)
+			if tc.unchanged {
+				if batch != changes {
+					t.Errorf("Expected the changes to be applied at once, got %+v", batch)
+				}
+				return
+			}
+
+			if got := dnsNames(batch.Create); !reflect.DeepEqual(tc.create, got) {
+				t.Errorf("Want creations %v, got %v", tc.create, got)
+			}
+			if got := dnsNames(batch.Delete); !reflect.DeepEqual(tc.delete, got) {
+				t.Errorf("Want deletions %v, got %v", tc.delete, got)
+			}
+			if got := dnsNames(batch.UpdateNew); !reflect.DeepEqual(tc.update, got) {
+				t.Errorf("Want updates %v, got %v", tc.update, got)
+			}
+			if deferred := m.value("deferred_changes"); deferred != tc.deferred {
+				t.Errorf("Want %d deferred changes, got %d", tc.deferred, deferred)
+			}
+		})
+	}
+}
+
+func TestApplyChangesMaxChangesPerBatch(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, nil)
+
+	changes := &plan.Changes{}
+	for i := 1; i <= 10; i++ {
+		changes.Create = append(changes.Create, endpoint.NewEndpointWithTTL(fmt.Sprintf("host%d.test1.com", i), "A", 300, "1.1.1.1"))
+	}
+
+	provider, _ := testProvider()
+	provider.maxChangesPerBatch = 4
+	if err := provider.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	created := []string{}
+	for _, record := range api.created {
+		created = append(created, record.Host)
+	}
+	expected := []string{"host1", "host2", "host3", "host4"}
+	if !reflect.DeepEqual(expected, created) {
+		t.Errorf("Want created %v, got %v", expected, created)
+	}
+
+	// The drift check plans every change
+	events, err := provider.PlanChanges(context.Background(), changes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 10 {
+		t.Errorf("Want 10 planned changes, got %d", len(events))
+	}
+}
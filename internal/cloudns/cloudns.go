@@ -16,202 +16,525 @@ package cloudns
 import (
 	"context"
 	"fmt"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/dryrun"
+	"external-dns-cloudns-webhook/internal/health"
+	"external-dns-cloudns-webhook/internal/logging"
 	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/override"
+	"external-dns-cloudns-webhook/internal/recordids"
+	"external-dns-cloudns-webhook/internal/tracing"
 
 	cloudns "github.com/ppmathis/cloudns-go"
 
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
 	"sigs.k8s.io/external-dns/provider"
 )
 
 const (
+	actLogin        = "login"
 	actGetZones     = "get_zones"
 	actGetRecords   = "get_records"
+	actGetSOA       = "get_soa"
 	actCreateRecord = "create_record"
 	actUpdateRecord = "update_record"
 	actDeleteRecord = "delete_record"
 )
 
 // ClouDNSProvider is a struct representing a CloudDNS provider.
-// It embeds the provider.BaseProvider struct and includes fields for the CloudDNS client, context, domain and zone ID filters, owner ID, and flags for dry-run and testing modes.
+// It embeds the provider.BaseProvider struct and includes fields for the ClouDNS accounts, owner ID, and flags for dry-run and testing modes.
 type ClouDNSProvider struct {
 	provider.BaseProvider
-	client       *cloudns.Client
-	domainFilter *endpoint.DomainFilter
-	defaultTTL   int
-	ownerID      string
-	debug        bool
-	dryRun       bool
-	testing      bool
+	accounts   []*account
+	metrics    metrics.Metrics
+	auditor    audit.Recorder
+	reports    dryrun.Recorder
+	defaultTTL int
+	ownerID    string
+	debug      bool
+	dryRun     bool
+	testing    bool
+
+	// zonePolicies are the policies of the zones, by zone name
+	zonePolicies map[string]string
+	// protection lists the records that are never changed
+	protection Protection
+	// deletionGuard limits the deletions of a single request
+	deletionGuard DeletionGuard
+	// overrides are the one-shot overrides of the deletion guard
+	overrides *override.Overrides
+	// maxChangesPerBatch limits the changes applied by a single request
+	maxChangesPerBatch int
+	// recordIDs caches the IDs of the records
+	recordIDs recordids.Store
+	// managedTypes are the managed record types, the default ones if empty
+	managedTypes map[string]bool
+	// apexAlias turns the CNAME endpoints at the zone apex into ALIAS records
+	apexAlias bool
+	// listings are the records of the zones listed while applying a batch,
+	// by zone name; nil outside a batch
+	listings map[string]cloudns.RecordMap
+	// zones is the zone selection of the endpoints created while applying a
+	// batch; nil outside a batch
+	zones *zoneSelection
+	// planning is set when the changes are only planned: the one-shot
+	// overrides of the deletion guard are checked without being used
+	planning bool
 }
 
 // ClouDNSConfig is a struct representing the configuration for a CloudDNS provider.
-// It includes fields for the context, domain and zone ID filters, owner ID, and flags for dry-run and testing modes.
+// It includes fields for the accounts, zone ID filter, owner ID, and flags for dry-run and testing modes.
 type ClouDNSConfig struct {
+	Accounts []ClouDNSAccountConfig
+	// Metrics are the metrics updated by the provider, none if nil
+	Metrics metrics.Metrics
+	// HealthTracker records the outcome of the API calls, none if nil
+	HealthTracker *health.Tracker
+	// Auditor records the changes in the audit log, none if nil
+	Auditor audit.Recorder
+	// DryRunReports receive the changes simulated in dry-run mode, none if
+	// nil
+	DryRunReports dryrun.Recorder
+	ZoneIDFilter  provider.ZoneIDFilter
+	DefaultTTL    int
+	OwnerID       string
+	// ZonePolicies are the policies of the zones, by zone name
+	ZonePolicies map[string]string
+	// Protection lists the records that are never changed
+	Protection Protection
+	// DeletionGuard limits the deletions of a single request
+	DeletionGuard DeletionGuard
+	// DeletionOverrides are the one-shot overrides of the deletion guard,
+	// none if nil
+	DeletionOverrides *override.Overrides
+	// MaxChangesPerBatch is the maximum number of changes applied by a single
+	// ApplyChanges request, 0 for no limit
+	MaxChangesPerBatch int
+	// RecordIDs caches the IDs of the records, none if nil
+	RecordIDs recordids.Store
+	// ManagedRecordTypes are the record types managed by the provider, the
+	// ones supported by ExternalDNS if empty
+	ManagedRecordTypes map[string]bool
+	// ApexAlias turns the CNAME endpoints at the zone apex into ALIAS records
+	ApexAlias bool
+	Debug     bool
+	DryRun    bool
+	Testing   bool
+}
+
+// ClouDNSAccountConfig is the configuration of a single ClouDNS account: its
+// name, the credentials and the domain filter selecting the zones it manages.
+type ClouDNSAccountConfig struct {
+	Name         string
 	Auth         cloudns.Option
 	DomainFilter *endpoint.DomainFilter
-	ZoneIDFilter provider.ZoneIDFilter
-	DefaultTTL   int
-	OwnerID      string
-	Debug        bool
-	DryRun       bool
-	Testing      bool
 }
 
-var listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
-	metrics := metrics.GetOpenMetricsInstance()
-	start := time.Now()
+// account is a ClouDNS account managed by the provider. The metrics and the
+// health tracker are the ones of the provider, updated by the API calls made
+// with the account.
+type account struct {
+	name         string
+	client       *cloudns.Client
+	domainFilter *endpoint.DomainFilter
+	metrics      metrics.Metrics
+	tracker      *health.Tracker
+}
 
-	result, err := client.Zones.List(ctx)
-	if err != nil {
-		metrics.IncFailedApiCallsTotal(actGetZones)
-		return nil, err
+// appliedChange is the change of a record set made, or simulated in dry-run
+// mode, by createRecords or deleteRecords: the ClouDNS zone and host, the
+// targets and TTL written or removed, the IDs of the removed records and
+// whether the change was only simulated.
+type appliedChange struct {
+	account   string
+	zone      string
+	host      string
+	ttl       int64
+	endpoint  *endpoint.Endpoint
+	targets   []string
+	recordIDs []int
+	dryRun    bool
+}
+
+// accountZone is a zone together with the account that owns it.
+type accountZone struct {
+	account *account
+	zone    cloudns.Zone
+}
+
+// startApiCall starts the span of a ClouDNS API call. The zone is empty for
+// calls that are not related to a zone.
+func startApiCall(ctx context.Context, acc *account, action, zone string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		tracing.AccountKey.String(acc.name),
+		tracing.ActionKey.String(action),
+	}
+	if zone != "" {
+		attrs = append(attrs, tracing.ZoneKey.String(zone))
 	}
+	return tracing.Tracer().Start(ctx, "cloudns."+action,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...),
+	)
+}
 
+// recordApiCall updates the metrics and the upstream health with the outcome
+// of a ClouDNS API call started at the given time, and logs it at debug level.
+func recordApiCall(ctx context.Context, acc *account, action string, start time.Time, err error) {
+	metrics := acc.metrics
+	tracker := acc.tracker
 	delay := time.Since(start)
-	metrics.IncSuccessfulApiCallsTotal(actGetZones)
-	metrics.AddApiDelayHist(actGetZones, delay.Milliseconds())
+	logger := logging.FromContext(ctx).WithFields(log.Fields{
+		"account":  acc.name,
+		"action":   action,
+		"duration": delay.Milliseconds(),
+	})
 
-	return result, nil
+	tracing.RecordError(trace.SpanFromContext(ctx), err)
+	if err != nil {
+		metrics.IncFailedApiCallsTotal(acc.name, action)
+		if tracker != nil {
+			tracker.RecordFailure(acc.name, action, err)
+		}
+		logger.WithError(err).Debug("ClouDNS API call failed")
+		return
+	}
+
+	metrics.IncSuccessfulApiCallsTotal(acc.name, action)
+	metrics.AddApiCallDuration(acc.name, action, delay)
+	if tracker != nil {
+		tracker.RecordSuccess(acc.name, action)
+	}
+	logger.Debug("ClouDNS API call succeeded")
 }
 
-var listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
-	metrics := metrics.GetOpenMetricsInstance()
+var login = func(acc *account, ctx context.Context) error {
+	ctx, span := startApiCall(ctx, acc, actLogin, "")
+	defer span.End()
 	start := time.Now()
 
-	result, err := client.Records.List(ctx, zoneName)
+	_, err := acc.client.Account.Login(ctx)
+	recordApiCall(ctx, acc, actLogin, start, err)
+
+	return err
+}
+
+var listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+	ctx, span := startApiCall(ctx, acc, actGetZones, "")
+	defer span.End()
+	start := time.Now()
+
+	result, err := acc.client.Zones.List(ctx)
+	recordApiCall(ctx, acc, actGetZones, start, err)
 	if err != nil {
-		metrics.IncFailedApiCallsTotal(actGetRecords)
 		return nil, err
 	}
 
-	delay := time.Since(start)
-	metrics.IncSuccessfulApiCallsTotal(actGetRecords)
-	metrics.AddApiDelayHist(actGetRecords, delay.Milliseconds())
-
 	return result, nil
 }
 
-var createRecord = func(client *cloudns.Client, ctx context.Context, zoneName string, record cloudns.Record) error {
-	metrics := metrics.GetOpenMetricsInstance()
+var listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+	ctx, span := startApiCall(ctx, acc, actGetRecords, zoneName)
+	defer span.End()
 	start := time.Now()
 
-	_, err := client.Records.Create(ctx, zoneName, record)
+	result, err := acc.client.Records.List(ctx, zoneName)
+	recordApiCall(ctx, acc, actGetRecords, start, err)
 	if err != nil {
-		metrics.IncFailedApiCallsTotal(actCreateRecord)
-		return err
+		return nil, err
 	}
 
-	delay := time.Since(start)
-	metrics.IncSuccessfulApiCallsTotal(actCreateRecord)
-	metrics.AddApiDelayHist(actCreateRecord, delay.Milliseconds())
+	return result, nil
+}
 
-	return nil
+var getSOA = func(acc *account, ctx context.Context, zoneName string) (cloudns.SOA, error) {
+	ctx, span := startApiCall(ctx, acc, actGetSOA, zoneName)
+	defer span.End()
+	start := time.Now()
+
+	result, err := acc.client.Records.GetSOA(ctx, zoneName)
+	recordApiCall(ctx, acc, actGetSOA, start, err)
+
+	return result, err
 }
 
-var deleteRecord = func(client *cloudns.Client, ctx context.Context, zoneName string, recordID int) error {
-	metrics := metrics.GetOpenMetricsInstance()
+var createRecord = func(acc *account, ctx context.Context, zoneName string, record cloudns.Record) error {
+	ctx, span := startApiCall(ctx, acc, actCreateRecord, zoneName)
+	defer span.End()
 	start := time.Now()
 
-	_, err := client.Records.Delete(ctx, zoneName, recordID)
-	if err != nil {
-		metrics.IncFailedApiCallsTotal(actDeleteRecord)
-		return err
-	}
+	_, err := acc.client.Records.Create(ctx, zoneName, record)
+	recordApiCall(ctx, acc, actCreateRecord, start, err)
 
-	delay := time.Since(start)
-	metrics.IncSuccessfulApiCallsTotal(actDeleteRecord)
-	metrics.AddApiDelayHist(actDeleteRecord, delay.Milliseconds())
+	return err
+}
 
-	return nil
+var updateRecord = func(acc *account, ctx context.Context, zoneName string, recordID int, record cloudns.Record) error {
+	ctx, span := startApiCall(ctx, acc, actUpdateRecord, zoneName)
+	defer span.End()
+	start := time.Now()
+
+	_, err := acc.client.Records.Update(ctx, zoneName, recordID, record)
+	recordApiCall(ctx, acc, actUpdateRecord, start, err)
+
+	return err
+}
+
+var deleteRecord = func(acc *account, ctx context.Context, zoneName string, recordID int) error {
+	ctx, span := startApiCall(ctx, acc, actDeleteRecord, zoneName)
+	defer span.End()
+	start := time.Now()
+
+	_, err := acc.client.Records.Delete(ctx, zoneName, recordID)
+	recordApiCall(ctx, acc, actDeleteRecord, start, err)
+
+	return err
 }
 
 // NewClouDNSProvider creates and returns a new ClouDNSProvider struct based on the given configuration.
-// The function authenticates with the CloudDNS service using the login type, user or sub-user ID, and user password specified in the environment variables.
-// If an error occurs while authenticating or creating the ClouDNS client, it is returned.
+// A ClouDNS client is created for every configured account, using the credentials of that account.
+// If an error occurs while creating one of the ClouDNS clients, or if two accounts share the same name, it is returned.
 func NewClouDNSProvider(config ClouDNSConfig) (*ClouDNSProvider, error) {
-	var logLevel log.Level
-	if config.Debug {
-		logLevel = log.DebugLevel
-	} else {
-		logLevel = log.InfoLevel
+	log.Info("Creating ClouDNS Provider")
+
+	if len(config.Accounts) == 0 {
+		return nil, fmt.Errorf("no ClouDNS account configured")
 	}
-	log.SetLevel(logLevel)
 
-	log.Info("Creating ClouDNS Provider")
+	m := config.Metrics
+	if m == nil {
+		m = metrics.NoopMetrics{}
+	}
+
+	auditor := config.Auditor
+	if auditor == nil {
+		auditor = audit.Noop{}
+	}
 
-	client, error := cloudns.New(config.Auth)
-	if error != nil {
-		return nil, fmt.Errorf("error creating ClouDNS client: %s", error)
+	accounts := make([]*account, 0, len(config.Accounts))
+	names := map[string]bool{}
+	for _, accountConfig := range config.Accounts {
+		if names[accountConfig.Name] {
+			return nil, fmt.Errorf("duplicate ClouDNS account name: '%s'", accountConfig.Name)
+		}
+		names[accountConfig.Name] = true
+
+		client, error := cloudns.New(accountConfig.Auth)
+		if error != nil {
+			return nil, fmt.Errorf("error creating ClouDNS client for account '%s': %s", accountConfig.Name, error)
+		}
+
+		accounts = append(accounts, &account{
+			name:         accountConfig.Name,
+			client:       client,
+			domainFilter: accountConfig.DomainFilter,
+			metrics:      m,
+			tracker:      config.HealthTracker,
+		})
 	}
 
 	provider := &ClouDNSProvider{
-		client:       client,
-		domainFilter: config.DomainFilter,
-		defaultTTL:   config.DefaultTTL,
-		ownerID:      config.OwnerID,
-		debug:        config.Debug,
-		dryRun:       config.DryRun,
-		testing:      config.Testing,
+		accounts:   accounts,
+		metrics:    m,
+		auditor:    auditor,
+		reports:    config.DryRunReports,
+		defaultTTL: config.DefaultTTL,
+		ownerID:    config.OwnerID,
+		debug:      config.Debug,
+		dryRun:     config.DryRun,
+		testing:    config.Testing,
+
+		zonePolicies: config.ZonePolicies,
+		protection:   config.Protection,
+
+		deletionGuard:      config.DeletionGuard,
+		overrides:          config.DeletionOverrides,
+		maxChangesPerBatch: config.MaxChangesPerBatch,
+		recordIDs:          config.RecordIDs,
+		managedTypes:       config.ManagedRecordTypes,
+		apexAlias:          config.ApexAlias,
+	}
+
+	for zone, policy := range config.ZonePolicies {
+		log.WithFields(log.Fields{"zone": zone, "policy": policy}).Infof("Zone %s is %s", zone, policy)
 	}
 
 	return provider, nil
 }
 
-// Zones retrieves the DNS zone from the ClouDNS provider,
-// applies the defined domainFilter and returns the result
-func (p *ClouDNSProvider) Zones(ctx context.Context) ([]cloudns.Zone, error) {
-	metrics := metrics.GetOpenMetricsInstance()
-	result := []cloudns.Zone{}
+// Probe verifies that every account can authenticate against the ClouDNS API
+// and list its zones. It logs how many zones of each account match the domain
+// filter and returns the total number of matching zones.
+// If an account cannot authenticate or list its zones, the error is returned.
+func (p *ClouDNSProvider) Probe(ctx context.Context) (int, error) {
+	logger := logging.FromContext(ctx)
+	for _, acc := range p.accounts {
+		if err := login(acc, ctx); err != nil {
+			return 0, fmt.Errorf("account %s: authentication failed: %w", acc.name, err)
+		}
+	}
+
+	accountZones, err := p.accountZones(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error getting zones: %w", err)
+	}
+
+	matchedZones := map[string]int{}
+	for _, az := range accountZones {
+		matchedZones[az.account.name]++
+	}
+	for _, acc := range p.accounts {
+		logger.WithField("account", acc.name).Infof("Account %s: %d zone(s) match the domain filter", acc.name, matchedZones[acc.name])
+	}
+	if len(accountZones) == 0 {
+		logger.Warn("No zone matches the domain filter - no records will be managed")
+	}
+
+	return len(accountZones), nil
+}
 
-	zones, err := listZones(p.client, ctx)
+// Zones retrieves the DNS zones of all the accounts from the ClouDNS provider,
+// applies the domainFilter of each account and returns the merged result
+func (p *ClouDNSProvider) Zones(ctx context.Context) ([]cloudns.Zone, error) {
+	accountZones, err := p.accountZones(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	filteredOutZones := 0
-	for _, zone := range zones {
-		if p.domainFilter.Match(zone.Name) {
-			result = append(result, zone)
-		} else {
-			filteredOutZones++
-		}
+	result := []cloudns.Zone{}
+	for _, az := range accountZones {
+		result = append(result, az.zone)
 	}
-	metrics.SetFilteredOutZones(filteredOutZones)
 
 	return result, nil
 }
 
+// accountZones retrieves the DNS zones of every account, applies the
+// domainFilter of the account and returns the zones together with the account
+// owning them. If a zone is visible from more than one account, it is assigned
+// to the first account that has been configured.
+func (p *ClouDNSProvider) accountZones(ctx context.Context) ([]accountZone, error) {
+	result, _, err := p.allAccountZones(ctx)
+	return result, err
+}
+
+// allAccountZones implements accountZones, and returns the zones excluded by
+// the domainFilter of every account as well, unless another account manages
+// them.
+func (p *ClouDNSProvider) allAccountZones(ctx context.Context) ([]accountZone, []accountZone, error) {
+	metrics := p.metrics
+	logger := logging.FromContext(ctx)
+	result := []accountZone{}
+	excluded := []accountZone{}
+	owners := map[string]string{}
+
+	for _, acc := range p.accounts {
+		zones, err := listZones(acc, ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("account %s: %w", acc.name, err)
+		}
+
+		filteredOutZones := 0
+		for _, zone := range zones {
+			if !acc.domainFilter.Match(zone.Name) {
+				filteredOutZones++
+				excluded = append(excluded, accountZone{account: acc, zone: zone})
+				continue
+			}
+			if owner, ok := owners[zone.Name]; ok {
+				logger.WithField("zone", zone.Name).Warnf("Zone %s is managed by accounts %s and %s - using %s", zone.Name, owner, acc.name, owner)
+				continue
+			}
+			owners[zone.Name] = acc.name
+			result = append(result, accountZone{account: acc, zone: zone})
+		}
+		metrics.SetFilteredOutZones(acc.name, filteredOutZones)
+	}
+
+	unmanaged := []accountZone{}
+	for _, az := range excluded {
+		if _, ok := owners[az.zone.Name]; !ok {
+			unmanaged = append(unmanaged, az)
+		}
+	}
+
+	return result, unmanaged, nil
+}
+
+// matchAccountZone finds the zone that should contain the given domain name
+// and returns it together with the account that owns it. If no zone matches,
+// false is returned.
+func matchAccountZone(domain string, accountZones []accountZone) (accountZone, bool) {
+	zones := make([]cloudns.Zone, len(accountZones))
+	for i, az := range accountZones {
+		zones[i] = az.zone
+	}
+
+	zoneName := findZoneForDomain(domain, zones)
+	for _, az := range accountZones {
+		if zoneName != "" && az.zone.Name == zoneName {
+			return az, true
+		}
+	}
+
+	return accountZone{}, false
+}
+
 // Records retrieves the DNS records from the CloudDNS provider and returns them as a slice of endpoint.Endpoint structs.
 // The function retrieves all zones and their corresponding records and filters out unsupported record types.
 // If an error occurs while retrieving the zones or records, it is returned.
 func (p *ClouDNSProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
-	log.Info("Getting Records from ClouDNS")
+	ctx, span := tracing.Tracer().Start(ctx, "cloudns.Records")
+	defer span.End()
+
+	endpoints, err := p.records(ctx)
+	tracing.RecordError(span, err)
+	span.SetAttributes(attribute.Int("cloudns.endpoints", len(endpoints)))
+
+	return endpoints, err
+}
+
+// records implements Records within its span.
+func (p *ClouDNSProvider) records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	logger := logging.FromContext(ctx)
+	logger.Info("Getting Records from ClouDNS")
 
 	var endpoints []*endpoint.Endpoint
 
-	zones, err := p.Zones(ctx)
+	accountZones, err := p.accountZones(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("error getting zones: %s", err)
 	}
 
-	for _, zone := range zones {
+	for _, az := range accountZones {
+		zone := az.zone
 
-		records, err := listRecords(p.client, ctx, zone.Name)
+		records, err := listRecords(az.account, ctx, zone.Name)
 		if err != nil {
 			return nil, fmt.Errorf("error getting records: %s", err)
 		}
+		p.storeRecordIDs(zone.Name, records)
 
 		skippedRecords := 0
-		// Add only endpoints from supported types.
+		managedRecords := map[string]int{}
+		// Add only endpoints from managed types.
 		for _, record := range records {
-			if provider.SupportedRecordType(string(record.RecordType)) {
+			// The ALIAS records are reported as CNAME endpoints
+			alias := record.RecordType == cloudns.RecordTypeALIAS
+			if alias {
+				record.RecordType = cloudns.RecordTypeCNAME
+			}
+			if p.isManagedType(string(record.RecordType)) {
+				managedRecords[string(record.RecordType)]++
 				name := ""
 
 				if record.Host == "" || record.Host == "@" {
@@ -226,21 +549,32 @@ func (p *ClouDNSProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, er
 					}
 				}
 
-				endpoints = append(endpoints, endpoint.NewEndpointWithTTL(
+				ep := endpoint.NewEndpointWithTTL(
 					name,
 					string(record.RecordType),
 					endpoint.TTL(record.TTL),
-					record.Record,
-				))
+					recordTarget(record),
+				)
+				if alias {
+					ep.SetProviderSpecificProperty(aliasProperty, "true")
+				}
+				endpoints = append(endpoints, ep)
 			} else {
 				skippedRecords++
 			}
 		}
-		m := metrics.GetOpenMetricsInstance()
-		m.SetSkippedRecords(zone.Name, skippedRecords)
+		m := p.metrics
+		m.SetSkippedRecords(az.account.name, zone.Name, skippedRecords)
+		m.SetManagedRecords(az.account.name, zone.Name, managedRecords)
+		m.SetZonePolicy(az.account.name, zone.Name, p.zonePolicy(zone.Name))
 	}
 
 	merged := mergeEndpointsByNameType(endpoints)
+	for _, e := range merged {
+		if _, ok := e.GetProviderSpecificProperty(mixedTTLProperty); ok {
+			logger.WithFields(log.Fields{"host": e.DNSName, "type": e.RecordType}).Warnf("Record set %s %s has mixed TTLs - reporting the lowest, %d, until the next update normalizes it", e.DNSName, e.RecordType, e.RecordTTL)
+		}
+	}
 
 	out := "Found:"
 	for _, e := range merged {
@@ -248,33 +582,168 @@ func (p *ClouDNSProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, er
 			out = out + " [" + e.DNSName + " " + e.RecordType + " " + e.Targets[0] + " " + fmt.Sprint(e.RecordTTL) + "]"
 		}
 	}
-	log.Debugf("%s", out)
+	logger.Debugf("%s", out)
+	p.metrics.SetLastSuccess(metrics.OperationRecords, time.Now())
 
 	return merged, nil
 }
 
+// AdjustEndpoints adjusts the desired endpoints before the plan is computed,
+// like AdjustEndpointsContext does without a request context.
+func (p *ClouDNSProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	return p.AdjustEndpointsContext(context.Background(), endpoints)
+}
+
+// AdjustEndpointsContext adjusts the desired endpoints before the plan is
+// computed. The endpoints that ClouDNS cannot represent, or whose records would
+// be written in a parent of the zone they belong to, are dropped, or fixed when
+// possible, so that a single invalid endpoint does not make ApplyChanges fail;
+// see validateEndpoint. The alias properties of the CNAME endpoints and the
+// targets of the extended record types are set as Records reports them.
+// If the zones cannot be retrieved, the endpoints are passed through without
+// being validated: ApplyChanges refuses the invalid ones anyway.
+func (p *ClouDNSProvider) AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "cloudns.AdjustEndpoints", trace.WithAttributes(
+		attribute.Int("cloudns.endpoints", len(endpoints)),
+	))
+	defer span.End()
+
+	zones, err := p.zoneSelection(ctx, endpoints)
+	if err != nil {
+		tracing.RecordError(span, err)
+		logging.FromContext(ctx).Warnf("Cannot get the zones, passing the endpoints through without validating them: %s", err)
+		for _, ep := range endpoints {
+			if p.isManagedType(ep.RecordType) {
+				canonicalizeTargets(ep)
+			}
+		}
+		return endpoints, nil
+	}
+
+	adjusted := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		if !p.validateEndpoint(ctx, ep, zones) {
+			continue
+		}
+		p.adjustAlias(ep, zones.managed)
+		if p.isManagedType(ep.RecordType) {
+			canonicalizeTargets(ep)
+		}
+		adjusted = append(adjusted, ep)
+	}
+
+	return adjusted, nil
+}
+
 // ApplyChanges applies the given DNS changes to the CloudDNS provider.
 // The function retrieves the zones, creates new records, deletes old records, and updates existing records as needed.
 // If the provider is in dry-run mode, the changes are not applied but the details of the changes are logged.
 // If an error occurs while retrieving the zones or applying the changes, it is returned.
 func (p *ClouDNSProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	ctx, span := tracing.Tracer().Start(ctx, "cloudns.ApplyChanges", trace.WithAttributes(
+		attribute.Int("cloudns.changes.create", len(changes.Create)),
+		attribute.Int("cloudns.changes.update", len(changes.UpdateNew)),
+		attribute.Int("cloudns.changes.delete", len(changes.Delete)),
+		attribute.Bool("cloudns.dry_run", p.dryRun),
+	))
+	defer span.End()
+
+	start := time.Now()
+	var err error
+	if p.dryRun && p.reports != nil {
+		err = p.applyDryRun(ctx, changes)
+	} else {
+		err = p.applyChanges(ctx, changes)
+	}
+	tracing.RecordError(span, err)
+
+	m := p.metrics
+	m.AddApplyChangesDuration(time.Since(start))
+	if err == nil {
+		m.SetLastSuccess(metrics.OperationApplyChanges, time.Now())
+	}
+
+	return err
+}
+
+// ValidateChanges checks the changes before they are queued to be applied
+// asynchronously: the batch is refused if it exceeds the deletion guard limits.
+func (p *ClouDNSProvider) ValidateChanges(ctx context.Context, changes *plan.Changes) error {
+	return p.checkDeletions(ctx, changes, false)
+}
+
+// applyDryRun simulates the changes in dry-run mode and adds the report of the
+// changes that would have been applied to the dry-run reports.
+func (p *ClouDNSProvider) applyDryRun(ctx context.Context, changes *plan.Changes) error {
+	recorder := &audit.Memory{}
+	err := p.recording(recorder).applyChanges(ctx, changes)
+
+	report := dryrun.Report{
+		Time:      time.Now().UTC(),
+		RequestID: logging.CorrelationID(ctx),
+		Changes:   recorder.Events(),
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	p.reports.Add(report)
+
+	return err
+}
+
+// recording returns a copy of the provider that records the audit events in
+// the given recorder as well.
+func (p *ClouDNSProvider) recording(recorder audit.Recorder) *ClouDNSProvider {
+	clone := *p
+	clone.auditor = audit.Multi(p.auditor, recorder)
+	return &clone
+}
+
+// batch returns a copy of the provider applying a single batch of changes,
+// which lists each zone at most once.
+func (p *ClouDNSProvider) batch() *ClouDNSProvider {
+	clone := *p
+	clone.listings = map[string]cloudns.RecordMap{}
+	return &clone
+}
+
+// applyChanges implements ApplyChanges within its span.
+func (p *ClouDNSProvider) applyChanges(ctx context.Context, changes *plan.Changes) error {
+	logger := logging.FromContext(ctx)
 	infoString := "Creating " + fmt.Sprint(len(changes.Create)) + " Record(s), Updating " + fmt.Sprint(len(changes.UpdateNew)) + " Record(s), Deleting " + fmt.Sprint(len(changes.Delete)) + " Record(s)"
 
 	if len(changes.Create) == 0 && len(changes.Delete) == 0 && len(changes.UpdateNew) == 0 && len(changes.UpdateOld) == 0 {
-		log.Info("No Changes")
+		logger.Info("No Changes")
 		return nil
 	} else if p.dryRun {
-		log.Info("DRY RUN: " + infoString)
+		logger.WithField("dry_run", true).Info("DRY RUN: " + infoString)
 	} else {
-		log.Info(infoString)
+		logger.Info(infoString)
 	}
 
-	err := p.createRecords(ctx, changes.Create)
+	if err := p.checkDeletions(ctx, changes, !p.planning); err != nil {
+		return err
+	}
+	changes = p.limitChanges(ctx, changes)
+	p = p.batch()
+	zones, err := p.zoneSelection(ctx, append(slices.Clone(changes.Create), changes.UpdateNew...))
 	if err != nil {
 		return err
 	}
+	p.zones = zones
 
-	err = p.deleteRecords(ctx, changes.Delete)
+	created, err := p.createRecords(ctx, metrics.ChangeCreate, changes.Create)
+	for _, c := range created {
+		p.recordChange(ctx, metrics.ChangeCreate, nil, &c)
+	}
+	if err != nil {
+		return err
+	}
+
+	deleted, err := p.deleteRecords(ctx, metrics.ChangeDelete, changes.Delete)
+	for _, c := range deleted {
+		p.recordChange(ctx, metrics.ChangeDelete, &c, nil)
+	}
 	if err != nil {
 		return err
 	}
@@ -288,58 +757,84 @@ func (p *ClouDNSProvider) ApplyChanges(ctx context.Context, changes *plan.Change
 }
 
 // createRecords creates DNS records in the CloudDNS provider for the given endpoints.
-// The function takes in a context and a slice of endpoint.Endpoint structs.
-// If an error occurs while creating the records, it is returned.
-func (p *ClouDNSProvider) createRecords(ctx context.Context, endpoints []*endpoint.Endpoint) error {
+// The function takes in a context, the kind of change the records are created for and a slice of endpoint.Endpoint
+// structs, and returns the changes applied. The endpoints whose records belong to an excluded zone or a delegation, the
+// endpoints of zones whose policy refuses the change and, for an update, the protected endpoints are skipped, while the records of dry-run zones are not created.
+// If an error occurs while creating the records, it is returned together with the changes applied until then.
+func (p *ClouDNSProvider) createRecords(ctx context.Context, kind string, endpoints []*endpoint.Endpoint) ([]appliedChange, error) {
+	logger := logging.FromContext(ctx)
+	applied := []appliedChange{}
 	for _, ep := range endpoints {
 
 		dnsParts := strings.Split(ep.DNSName, ".")
 		partLength := len(dnsParts)
 
-		zones, err := p.Zones(ctx)
-		if err != nil {
-			return err
+		az, ok := matchAccountZone(ep.DNSName, p.zones.managed)
+		if !ok {
+			logger.WithField("host", ep.DNSName).Warnf("Skipping %s - no matching zone found", ep.DNSName)
+			continue
 		}
+		acc := az.account
+		matchedZone := az.zone.Name
+		// The queued or planned changes may not have been adjusted by
+		// AdjustEndpoints, so the zone of the records is checked again
+		if reason, err := zoneError(ctx, ep, p.zones); reason != "" {
+			logger.WithFields(log.Fields{"host": ep.DNSName, "type": ep.RecordType, "reason": reason}).Warnf("Skipping %s %s - %s", ep.DNSName, ep.RecordType, err)
+			continue
+		} else if err != nil {
+			return applied, err
+		}
+		logger.Debugf("Matched %s to zone %s of account %s (len=%d)", ep.DNSName, matchedZone, acc.name, partLength)
 
-		matchedZone := findZoneForDomain(ep.DNSName, zones)
-		if matchedZone == "" {
-			log.Warnf("Skipping %s - no matching zone found", ep.DNSName)
+		policy, ok := p.checkZonePolicy(ctx, kind, matchedZone, ep)
+		if !ok {
 			continue
 		}
-		log.Debugf("Matched %s to zone %s (len=%d)", ep.DNSName, matchedZone, partLength)
+		// The protection covers the records modified by an update, not the
+		// ones created
+		if kind != metrics.ChangeCreate {
+			if ok, err := p.checkProtection(ctx, kind, acc, matchedZone, ep); err != nil {
+				return applied, err
+			} else if !ok {
+				continue
+			}
+		}
+		if !p.isManagedType(ep.RecordType) {
+			logger.WithFields(log.Fields{"host": ep.DNSName, "type": ep.RecordType}).Warnf("Skipping %s %s - record type not managed", ep.DNSName, ep.RecordType)
+			continue
+		}
+		for _, target := range ep.Targets {
+			if _, err := newRecord(ep.RecordType, "", target, 0); err != nil {
+				return applied, fmt.Errorf("%s for %s", err, ep.DNSName)
+			}
+		}
+		dryRun := p.isDryRun(policy)
+		change := appliedChange{account: acc.name, zone: matchedZone, endpoint: ep, dryRun: dryRun}
 
 		if ep.RecordType == "TXT" {
-			if !p.dryRun {
-				if partLength == 2 && dnsParts[0][0:2] == "a-" {
-					err := createRecord(p.client, ctx, matchedZone[2:], cloudns.Record{
-						Host:       "adash",
-						Record:     ep.Targets[0],
-						RecordType: cloudns.RecordType("TXT"),
-						TTL:        60,
-					})
-					if err != nil {
-						return err
-					}
-				} else {
-					hostName := removeLastOccurrance(ep.DNSName, "."+matchedZone)
-					if hostName == matchedZone {
-						hostName = ""
-					}
-
-					err := createRecord(p.client, ctx, matchedZone, cloudns.Record{
-						Host:       hostName,
-						Record:     ep.Targets[0],
-						RecordType: cloudns.RecordType("TXT"),
-						TTL:        60,
-					})
-					if err != nil {
-						return err
-					}
+			txtZone := matchedZone
+			hostName := removeLastOccurrance(ep.DNSName, "."+matchedZone)
+			if partLength == 2 && dnsParts[0][0:2] == "a-" {
+				txtZone = matchedZone[2:]
+				hostName = "adash"
+			} else if hostName == matchedZone {
+				hostName = ""
+			}
+			change.zone, change.host, change.ttl = txtZone, hostName, 60
+
+			if !dryRun {
+				err := createRecord(acc, ctx, txtZone, cloudns.Record{
+					Host:       hostName,
+					Record:     ep.Targets[0],
+					RecordType: cloudns.RecordType("TXT"),
+					TTL:        60,
+				})
+				if err != nil {
+					return appendChange(applied, change), err
 				}
-				log.Infof("CREATE %s %s %s %s", ep.DNSName, ep.RecordType, ep.Targets[0], fmt.Sprint(ep.RecordTTL))
-			} else {
-				log.Infof("DRY RUN: CREATE %s %s %s %s", ep.DNSName, ep.RecordType, ep.Targets[0], fmt.Sprint(ep.RecordTTL))
 			}
+			p.logChange(ctx, dryRun, actCreateRecord, matchedZone, ep, ep.Targets[0], 0)
+			change.targets = append(change.targets, ep.Targets[0])
 		}
 
 		if ep.RecordTTL == endpoint.TTL(0) {
@@ -347,74 +842,118 @@ func (p *ClouDNSProvider) createRecords(ctx context.Context, endpoints []*endpoi
 		}
 
 		if !isValidTTL(strconv.Itoa(int(ep.RecordTTL))) && !(ep.RecordType == "TXT") { //nolint:staticcheck
-			return fmt.Errorf("invalid TTL %s (still) for %s - must be one of '60', '300', '900', '1800', '3600', '21600', '43200', '86400', '172800', '259200', '604800', '1209600', '2592000'", fmt.Sprint(ep.RecordTTL), ep.DNSName)
+			return applied, fmt.Errorf("invalid TTL %s (still) for %s - must be one of '60', '300', '900', '1800', '3600', '21600', '43200', '86400', '172800', '259200', '604800', '1209600', '2592000'", fmt.Sprint(ep.RecordTTL), ep.DNSName)
 		}
 
 		// Calculate the number of zone parts to determine if this is a zone apex record
 		zoneParts := len(strings.Split(matchedZone, "."))
 		isZoneApex := partLength == zoneParts
+		if ep.RecordType != "TXT" {
+			change.ttl = int64(ep.RecordTTL)
+		}
+		recordType := p.recordType(ep, isZoneApex)
 
 		if isZoneApex && !(ep.RecordType == "TXT") { //nolint:staticcheck
 			for _, target := range ep.Targets {
-				if !p.dryRun {
-					err := createRecord(p.client, ctx, matchedZone, cloudns.Record{
-						Host:       "",
-						Record:     target,
-						RecordType: cloudns.RecordType(ep.RecordType),
-						TTL:        int(ep.RecordTTL),
-					})
+				if !dryRun {
+					record, err := newRecord(recordType, "", target, int(ep.RecordTTL))
+					if err == nil {
+						err = createRecord(acc, ctx, matchedZone, record)
+					}
 					if err != nil {
-						return err
+						return appendChange(applied, change), err
 					}
-
-					log.Infof("CREATE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
-				} else {
-					log.Infof("DRY RUN: CREATE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
 				}
+				p.logChange(ctx, dryRun, actCreateRecord, matchedZone, ep, target, 0)
+				change.targets = append(change.targets, target)
 			}
 		} else if !isZoneApex && !(ep.RecordType == "TXT") { //nolint:staticcheck
 
 			hostName := removeLastOccurrance(ep.DNSName, "."+matchedZone)
+			change.host = hostName
 
 			for _, target := range ep.Targets {
-				if !p.dryRun {
-					err := createRecord(p.client, ctx, matchedZone, cloudns.Record{
-						Host:       hostName,
-						Record:     target,
-						RecordType: cloudns.RecordType(ep.RecordType),
-						TTL:        int(ep.RecordTTL),
-					})
+				if !dryRun {
+					record, err := newRecord(recordType, hostName, target, int(ep.RecordTTL))
+					if err == nil {
+						err = createRecord(acc, ctx, matchedZone, record)
+					}
 					if err != nil {
-						return err
+						return appendChange(applied, change), err
 					}
-
-					log.Infof("CREATE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
-				} else {
-					log.Infof("DRY RUN: CREATE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
 				}
+				p.logChange(ctx, dryRun, actCreateRecord, matchedZone, ep, target, 0)
+				change.targets = append(change.targets, target)
 			}
 		}
+
+		applied = appendChange(applied, change)
 	}
 
-	return nil
+	return applied, nil
+}
+
+// logChange logs a record change at info level, with the details as structured
+// fields. If the change is only simulated the message is prefixed with "DRY RUN".
+func (p *ClouDNSProvider) logChange(ctx context.Context, dryRun bool, action, zone string, ep *endpoint.Endpoint, target string, recordID int) {
+	fields := log.Fields{
+		"action":  action,
+		"zone":    zone,
+		"host":    ep.DNSName,
+		"type":    ep.RecordType,
+		"target":  target,
+		"ttl":     int64(ep.RecordTTL),
+		"dry_run": dryRun,
+	}
+	if recordID != 0 {
+		fields["record_id"] = recordID
+	}
+
+	verb := "CREATE"
+	if action == actDeleteRecord {
+		verb = "DELETE"
+	}
+	msg := fmt.Sprintf("%s %s %s %s %d", verb, ep.DNSName, ep.RecordType, target, ep.RecordTTL)
+	if dryRun {
+		msg = "DRY RUN: " + msg
+	}
+
+	logging.FromContext(ctx).WithFields(fields).Info(msg)
 }
 
 // deleteRecords deletes DNS records from the CloudDNS provider for the given endpoints.
-// The function takes in a context and a slice of endpoint.Endpoint structs.
-// If an error occurs while deleting the records, it is returned.
-func (p *ClouDNSProvider) deleteRecords(ctx context.Context, endpoints []*endpoint.Endpoint) error {
+// The function takes in a context, the kind of change the records are deleted for and a slice of endpoint.Endpoint
+// structs, and returns the changes applied. The endpoints of zones whose policy refuses the change and the protected
+// endpoints are skipped, while the records of dry-run zones are not deleted.
+// If an error occurs while deleting the records, it is returned together with the changes applied until then.
+func (p *ClouDNSProvider) deleteRecords(ctx context.Context, kind string, endpoints []*endpoint.Endpoint) ([]appliedChange, error) {
+	logger := logging.FromContext(ctx)
+	applied := []appliedChange{}
 	for _, ep := range endpoints {
-		zones, err := p.Zones(ctx)
+		accountZones, err := p.accountZones(ctx)
 		if err != nil {
-			return err
+			return applied, err
 		}
 
-		matchedZone := findZoneForDomain(ep.DNSName, zones)
-		if matchedZone == "" {
-			log.Warnf("Skipping %s - no matching zone found", ep.DNSName)
+		az, ok := matchAccountZone(ep.DNSName, accountZones)
+		if !ok {
+			logger.WithField("host", ep.DNSName).Warnf("Skipping %s - no matching zone found", ep.DNSName)
 			continue
 		}
-		log.Debugf("Matched %s to zone %s for deletion", ep.DNSName, matchedZone)
+		acc := az.account
+		matchedZone := az.zone.Name
+		logger.Debugf("Matched %s to zone %s of account %s for deletion", ep.DNSName, matchedZone, acc.name)
+
+		policy, ok := p.checkZonePolicy(ctx, kind, matchedZone, ep)
+		if !ok {
+			continue
+		}
+		if ok, err := p.checkProtection(ctx, kind, acc, matchedZone, ep); err != nil {
+			return applied, err
+		} else if !ok {
+			continue
+		}
+		dryRun := p.isDryRun(policy)
 
 		hostName := ""
 		if len(matchedZone) >= 2 && matchedZone[0:2] == "a-" && ep.RecordType == "TXT" {
@@ -424,30 +963,70 @@ func (p *ClouDNSProvider) deleteRecords(ctx context.Context, endpoints []*endpoi
 			hostName = removeRootZone(ep.DNSName, matchedZone)
 		}
 
+		recordType := p.recordType(ep, hostName == "")
+		change := appliedChange{account: acc.name, zone: matchedZone, host: hostName, ttl: int64(ep.RecordTTL), endpoint: ep, dryRun: dryRun}
 		for _, target := range ep.Targets {
 
-			id, zone, err := p.recordFromTarget(ctx, ep, target, matchedZone, hostName)
+			id, err := p.deleteTarget(ctx, acc, recordType, target, matchedZone, hostName, dryRun)
 			if err != nil {
-				return err
+				return appendChange(applied, change), err
 			}
 
 			if id == 0 {
-				log.Infof("Record not found: %s %s %s", ep.DNSName, ep.RecordType, target)
+				logger.WithFields(log.Fields{"zone": matchedZone, "host": ep.DNSName, "type": ep.RecordType, "target": target}).Infof("Record not found: %s %s %s", ep.DNSName, ep.RecordType, target)
 				continue
-			} else if !p.dryRun {
-				err := deleteRecord(p.client, ctx, zone, id)
-				if err != nil {
-					return err
-				}
-				log.Infof("DELETE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
-			} else {
-				log.Infof("DRY RUN: DELETE %s %s %s %s", ep.DNSName, ep.RecordType, target, fmt.Sprint(ep.RecordTTL))
 			}
+			p.logChange(ctx, dryRun, actDeleteRecord, matchedZone, ep, target, id)
+			change.targets = append(change.targets, target)
+			change.recordIDs = append(change.recordIDs, id)
 
 		}
+
+		applied = appendChange(applied, change)
 	}
 
-	return nil
+	return applied, nil
+}
+
+// appendChange appends a change to the applied ones, unless no record has
+// been written or removed.
+func appendChange(applied []appliedChange, change appliedChange) []appliedChange {
+	if len(change.targets) == 0 {
+		return applied
+	}
+	return append(applied, change)
+}
+
+// recordChange counts an applied change and records its audit event. The
+// before and after record sets are nil when the change created or deleted the
+// record set. Simulated changes are audited but not counted.
+func (p *ClouDNSProvider) recordChange(ctx context.Context, change string, before, after *appliedChange) {
+	target := after
+	if target == nil {
+		target = before
+	}
+	if !target.dryRun {
+		p.metrics.IncAppliedChangesTotal(target.account, target.zone, change)
+	}
+
+	event := audit.Event{
+		RequestID: logging.CorrelationID(ctx),
+		Change:    change,
+		Account:   target.account,
+		Zone:      target.zone,
+		Name:      target.endpoint.DNSName,
+		Host:      target.host,
+		Type:      target.endpoint.RecordType,
+		DryRun:    target.dryRun,
+	}
+	if before != nil {
+		event.RecordIDs = before.recordIDs
+		event.Before = &audit.RecordSet{Targets: before.targets, TTL: before.ttl}
+	}
+	if after != nil {
+		event.After = &audit.RecordSet{Targets: after.targets, TTL: after.ttl}
+	}
+	p.auditor.Record(event)
 }
 
 // updateRecords updates the records in the ClouDNS provider by first creating the records in the updateNew slice
@@ -455,14 +1034,25 @@ func (p *ClouDNSProvider) deleteRecords(ctx context.Context, endpoints []*endpoi
 // it is returned.
 //
 // The updateNew slice should contain the updated records that need to be created, and the updateOld slice should
-// contain the old records that need to be deleted.
+// contain the old records that need to be deleted. Each update is counted and audited once, pairing the new records
+// with the old ones of the same name and type. The record sets with mixed TTLs are normalized first: the records
+// of the targets kept by the update are rewritten in place with the new TTL; see normalizeTTLs.
 func (p *ClouDNSProvider) updateRecords(ctx context.Context, updateOld, updateNew []*endpoint.Endpoint) error {
-	err := p.createRecords(ctx, updateNew)
+	updateOld, updateNew, normalizedOld, normalizedNew, err := p.normalizeTTLs(ctx, updateOld, updateNew)
 	if err != nil {
+		p.recordUpdates(ctx, normalizedOld, normalizedNew)
 		return err
 	}
 
-	err = p.deleteRecords(ctx, updateOld)
+	created, err := p.createRecords(ctx, metrics.ChangeUpdate, updateNew)
+	created = mergeChanges(normalizedNew, created)
+	if err != nil {
+		p.recordUpdates(ctx, normalizedOld, created)
+		return err
+	}
+
+	deleted, err := p.deleteRecords(ctx, metrics.ChangeUpdate, updateOld)
+	p.recordUpdates(ctx, mergeChanges(normalizedOld, deleted), created)
 	if err != nil {
 		return err
 	}
@@ -470,20 +1060,49 @@ func (p *ClouDNSProvider) updateRecords(ctx context.Context, updateOld, updateNe
 	return nil
 }
 
+// changeKey returns the key pairing the old and new record sets of an update.
+func changeKey(c appliedChange) string {
+	return endpointKey(c.endpoint)
+}
+
+// recordUpdates records the updates made by updateRecords, pairing the deleted
+// old record sets with the created new ones.
+func (p *ClouDNSProvider) recordUpdates(ctx context.Context, deleted, created []appliedChange) {
+	olds := map[string]*appliedChange{}
+	for i := range deleted {
+		olds[changeKey(deleted[i])] = &deleted[i]
+	}
+
+	for i := range created {
+		k := changeKey(created[i])
+		p.recordChange(ctx, metrics.ChangeUpdate, olds[k], &created[i])
+		delete(olds, k)
+	}
+	for i := range deleted {
+		if _, ok := olds[changeKey(deleted[i])]; ok {
+			p.recordChange(ctx, metrics.ChangeUpdate, &deleted[i], nil)
+		}
+	}
+}
+
 // recordFromTarget returns the ID and zone name of a record in the ClouDNS provider
-// that matches the given endpoint, target, and zone name. If no matching record is found,
+// that matches the given record type, target, and zone name. If no matching record is found,
 // the ID is returned as 0 and the zone name is returned as an empty string.
 //
 // The function first retrieves a map of zones and their corresponding records from the ClouDNS provider.
 // It then iterates over the records, checking if the record type, hostname, zone name, and target
-// match the given endpoint and target. If a match is found, the ID and zone name of the record
+// match the given record type and target. If a match is found, the ID and zone name of the record
 // are returned. If no match is found, the ID is returned as 0 and the zone name is returned as an empty string.
+// The IDs of the listed records are kept in the record ID store.
 // If an error occurs while retrieving the map of zones and records, it is returned.
-func (p *ClouDNSProvider) recordFromTarget(ctx context.Context, ep *endpoint.Endpoint, target string, epZoneName string, epHostName string) (int, string, error) {
+func (p *ClouDNSProvider) recordFromTarget(ctx context.Context, recordType, target string, epZoneName string, epHostName string) (int, string, error) {
 	zoneRecordMap, err := p.zoneRecordMap(ctx)
 	if err != nil {
 		return 0, "", err
 	}
+	for zoneName, recordMap := range zoneRecordMap {
+		p.storeRecordIDs(zoneName, recordMap)
+	}
 
 	for zoneName, recordMap := range zoneRecordMap {
 		for _, record := range recordMap {
@@ -496,10 +1115,10 @@ func (p *ClouDNSProvider) recordFromTarget(ctx context.Context, ep *endpoint.End
 					epHostName = "a-"
 				}
 
-				if string(record.RecordType) == ep.RecordType && record.Host == epHostName && zoneName == epZoneName && record.Record == strings.Trim(target, "\\\"") {
+				if string(record.RecordType) == recordType && record.Host == epHostName && zoneName == epZoneName && record.Record == strings.Trim(target, "\\\"") {
 					return record.ID, zoneName, nil
 				}
-			} else if string(record.RecordType) == ep.RecordType && record.Host == epHostName && zoneName == epZoneName && record.Record == target {
+			} else if string(record.RecordType) == recordType && record.Host == epHostName && zoneName == epZoneName && recordTarget(record) == target {
 				return record.ID, zoneName, nil
 			}
 		}
@@ -510,17 +1129,19 @@ func (p *ClouDNSProvider) recordFromTarget(ctx context.Context, ep *endpoint.End
 
 // zoneRecordMap returns a map of all zones and their corresponding records in the CloudDNS provider.
 // The map keys are the zone names and the map values are slices of cloudns.Record structs representing the records in the zone.
+// The records of every zone are retrieved using the account owning that zone.
 // If an error occurs while retrieving the zones or records, it is returned.
 func (p *ClouDNSProvider) zoneRecordMap(ctx context.Context) (map[string]cloudns.RecordMap, error) {
 	zoneRecordMap := make(map[string]cloudns.RecordMap)
 
-	zones, err := p.Zones(ctx)
+	accountZones, err := p.accountZones(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, zone := range zones {
-		recordMap, err := listRecords(p.client, ctx, zone.Name)
+	for _, az := range accountZones {
+		zone := az.zone
+		recordMap, err := listRecords(az.account, ctx, zone.Name)
 		if err != nil {
 			return nil, err
 		}
@@ -3,16 +3,38 @@ package cloudns
 import (
 	"context"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/dryrun"
+	"external-dns-cloudns-webhook/internal/health"
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/metrics"
 
 	"github.com/codingconcepts/env"
 	cloudns "github.com/ppmathis/cloudns-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 
 	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
 )
 
 // var mockProvider = &ClouDNSProvider{}
@@ -193,6 +215,211 @@ var expectedEndpointsOne = []*endpoint.Endpoint{
 }
 */
 
+// metricsRecorder is a Metrics implementation recording the values of the
+// metrics checked by the tests, by name and labels. The other metrics are
+// discarded.
+type metricsRecorder struct {
+	metrics.NoopMetrics
+	m      sync.Mutex
+	values map[string]int
+}
+
+// testProvider returns a provider with a single account named "default",
+// whose metrics are recorded by the returned recorder.
+func testProvider() (*ClouDNSProvider, *metricsRecorder) {
+	m := &metricsRecorder{values: map[string]int{}}
+	return &ClouDNSProvider{
+		accounts: []*account{{name: "default", metrics: m}},
+		metrics:  m,
+		auditor:  audit.Noop{},
+	}, m
+}
+
+// metricKey returns the key of a metric with the given label values.
+func metricKey(name string, labels ...string) string {
+	return strings.Join(append([]string{name}, labels...), " ")
+}
+
+// add adds the delta to a metric.
+func (r *metricsRecorder) add(delta int, name string, labels ...string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.values[metricKey(name, labels...)] += delta
+}
+
+// set sets the value of a metric.
+func (r *metricsRecorder) set(value int, name string, labels ...string) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.values[metricKey(name, labels...)] = value
+}
+
+// value returns the value of a metric with the given label values, 0 if it was
+// never recorded.
+func (r *metricsRecorder) value(name string, labels ...string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.values[metricKey(name, labels...)]
+}
+
+// total returns the sum of the values of a metric over all its labels.
+func (r *metricsRecorder) total(name string) int {
+	r.m.Lock()
+	defer r.m.Unlock()
+	total := 0
+	for key, value := range r.values {
+		if key == name || strings.HasPrefix(key, name+" ") {
+			total += value
+		}
+	}
+	return total
+}
+
+func (r *metricsRecorder) SetZonePolicy(account, zone, policy string) {
+	r.set(1, "zone_policy", account, zone, policy)
+}
+
+func (r *metricsRecorder) IncProtectedChangesBlockedTotal(account, zone, reason string) {
+	r.add(1, "protected_changes_blocked_total", account, zone, reason)
+}
+
+func (r *metricsRecorder) IncMassDeletionsBlockedTotal(account, zone string) {
+	r.add(1, "mass_deletions_blocked_total", account, zone)
+}
+
+func (r *metricsRecorder) SetDeferredChanges(num int) {
+	r.set(num, "deferred_changes")
+}
+
+func (r *metricsRecorder) IncRecordIDLookupsTotal(result string) {
+	r.add(1, "record_id_lookups_total", result)
+}
+
+func (r *metricsRecorder) IncInvalidEndpointsTotal(reason string) {
+	r.add(1, "invalid_endpoints_total", reason)
+}
+
+// fakeAPI is a fake ClouDNS API listing the records of its zones and recording
+// the changes made, in the order they are made.
+type fakeAPI struct {
+	zones []cloudns.Zone
+	// records are the records of the zones, by zone name
+	records map[string]cloudns.RecordMap
+	// listings counts the record listings, by zone name
+	listings map[string]int
+	created  []zoneRecord
+	updated  []zoneRecord
+	deleted  []zoneRecord
+}
+
+// zoneRecord is a record changed through the fake API. The record of a
+// deletion is the listed one with the deleted ID.
+type zoneRecord struct {
+	zone string
+	cloudns.Record
+}
+
+// String returns the host, zone, type and value of the record.
+func (r zoneRecord) String() string {
+	return fmt.Sprintf("%s %s %s %s", r.Host, r.zone, r.RecordType, r.Record.Record)
+}
+
+// mockAPI replaces the ClouDNS API calls, until the end of the test, with a
+// fake API listing the given zones and records.
+func mockAPI(t *testing.T, zones []cloudns.Zone, records map[string]cloudns.RecordMap) *fakeAPI {
+	oriListZones, oriListRecords := listZones, listRecords
+	oriCreateRecord, oriUpdateRecord, oriDeleteRecord := createRecord, updateRecord, deleteRecord
+	t.Cleanup(func() {
+		listZones, listRecords = oriListZones, oriListRecords
+		createRecord, updateRecord, deleteRecord = oriCreateRecord, oriUpdateRecord, oriDeleteRecord
+	})
+
+	api := &fakeAPI{zones: zones, records: records, listings: map[string]int{}}
+	listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+		return api.zones, nil
+	}
+	listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+		api.listings[zoneName]++
+		if records, ok := api.records[zoneName]; ok {
+			return records, nil
+		}
+		return cloudns.RecordMap{}, nil
+	}
+	createRecord = func(acc *account, ctx context.Context, zoneName string, record cloudns.Record) error {
+		api.created = append(api.created, zoneRecord{zone: zoneName, Record: record})
+		return nil
+	}
+	updateRecord = func(acc *account, ctx context.Context, zoneName string, recordID int, record cloudns.Record) error {
+		record.ID = recordID
+		api.updated = append(api.updated, zoneRecord{zone: zoneName, Record: record})
+		return nil
+	}
+	deleteRecord = func(acc *account, ctx context.Context, zoneName string, recordID int) error {
+		record, ok := api.records[zoneName][recordID]
+		if !ok {
+			return fmt.Errorf("record %d not found", recordID)
+		}
+		api.deleted = append(api.deleted, zoneRecord{zone: zoneName, Record: record})
+		return nil
+	}
+	return api
+}
+
+// sameRecords returns the records of the zones when they all have the given
+// records.
+func sameRecords(records cloudns.RecordMap, zones ...cloudns.Zone) map[string]cloudns.RecordMap {
+	result := map[string]cloudns.RecordMap{}
+	for _, zone := range zones {
+		result[zone.Name] = records
+	}
+	return result
+}
+
+// changes returns the changes made through the fake API, as the kind of change
+// followed by the record.
+func (api *fakeAPI) changes() []string {
+	changes := []string{}
+	for kind, records := range map[string][]zoneRecord{"create": api.created, "update": api.updated, "delete": api.deleted} {
+		for _, record := range records {
+			changes = append(changes, kind+" "+record.String())
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// createdRecords returns the records created through the fake API.
+func (api *fakeAPI) createdRecords() []cloudns.Record {
+	records := []cloudns.Record{}
+	for _, record := range api.created {
+		records = append(records, record.Record)
+	}
+	return records
+}
+
+// deletedIDs returns the IDs of the records deleted through the fake API.
+func (api *fakeAPI) deletedIDs() []int {
+	ids := []int{}
+	for _, record := range api.deleted {
+		ids = append(ids, record.ID)
+	}
+	return ids
+}
+
+// ownerTXT returns the value of the registry TXT record of the owner, as
+// stored by ClouDNS without the quotes.
+func ownerTXT(owner string) string {
+	return "heritage=external-dns,external-dns/owner=" + owner
+}
+
+// registryRecord returns the registry TXT endpoint owning the record with the
+// given name.
+func registryRecord(name string) *endpoint.Endpoint {
+	ep := endpoint.NewEndpoint("a-"+name, "TXT", "\""+ownerTXT("default")+"\"")
+	ep.Labels[endpoint.OwnedRecordLabelKey] = name
+	return ep
+}
+
 // NewClouDNSProvider creates a new ClouDNSProvider using the specified ClouDNSConfig.
 // It authenticates with ClouDNS using the login type specified in the CLOUDNS_LOGIN_TYPE environment variable,
 // which can be "user-id", "sub-user", or "sub-user-name". If the CLOUDNS_USER_PASSWORD environment variable is not set,
@@ -228,7 +455,7 @@ func TestNewClouDNSProvider(t *testing.T) {
 			userIDType:       "auth-id",
 			userID:           "invalid",
 			userPassword:     "password",
-			expectedError:    "error setting \"AuthID\": strconv.ParseInt: parsing \"invalid\": invalid syntax",
+			expectedError:    "CLOUDNS_AUTH_ID must be numeric when CLOUDNS_AUTH_ID_TYPE is 'auth-id', but was: 'invalid'",
 			expectedErrorNil: false,
 		},
 		{
@@ -243,18 +470,31 @@ func TestNewClouDNSProvider(t *testing.T) {
 			userIDType:       "invalid",
 			userID:           "12345",
 			userPassword:     "password",
-			expectedError:    "CLOUDNS_AUTH_ID_TYPE is not valid. Expected one of 'auth-id' or 'sub-auth-id' but was: 'invalid'",
+			expectedError:    "CLOUDNS_AUTH_ID_TYPE is not valid. Expected one of 'auth-id', 'sub-auth-id' or 'sub-auth-user' but was: 'invalid'",
 			expectedErrorNil: false,
 		},
+		{
+			name:          "valid sub-user name login type",
+			userIDType:    "sub-auth-user",
+			userID:        "tenant-user",
+			userPassword:  "password",
+			expectedError: "",
+		},
 		{
 			name:          "missing user password",
 			userID:        "12345",
-			expectedError: "CLOUDNS_AUTH_PASSWORD environment configuration was missing",
+			expectedError: "CLOUDNS_AUTH_ID_TYPE 'auth-id' requires CLOUDNS_AUTH_PASSWORD to be set",
 		},
 		{
 			name:          "missing user id sub-user",
+			userIDType:    "sub-auth-id",
 			userPassword:  "password",
-			expectedError: "CLOUDNS_AUTH_ID environment configuration was missing",
+			expectedError: "CLOUDNS_AUTH_ID_TYPE 'sub-auth-id' requires CLOUDNS_AUTH_ID to be set",
+		},
+		{
+			name:          "missing user name and password",
+			userIDType:    "sub-auth-user",
+			expectedError: "CLOUDNS_AUTH_ID_TYPE 'sub-auth-user' requires CLOUDNS_AUTH_ID and CLOUDNS_AUTH_PASSWORD to be set",
 		},
 	}
 
@@ -382,15 +622,15 @@ func TestZoneFilter(t *testing.T) {
 	}
 
 	oriListZones := listZones
-	listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+	listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 		return mockZones, nil
 	}
 
-	provider := &ClouDNSProvider{}
+	provider := &ClouDNSProvider{metrics: metrics.NoopMetrics{}}
 
 	for _, test := range tests {
 		t.Run(test.name, func(tt *testing.T) {
-			provider.domainFilter = test.domainFilter
+			provider.accounts = []*account{{name: "default", domainFilter: test.domainFilter}}
 			zones, err := provider.Zones(context.Background())
 
 			errExist := err != nil
@@ -437,11 +677,11 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    map[string]cloudns.RecordMap{},
 			expectingError: false,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return []cloudns.Zone{}, nil
 				}
 
-				listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+				listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
 					return nil, nil
 				}
 			},
@@ -451,11 +691,11 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    map[string]cloudns.RecordMap{},
 			expectingError: false,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return mockZones, nil
 				}
 
-				listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+				listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
 					return nil, nil
 				}
 			},
@@ -465,7 +705,7 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    nil,
 			expectingError: true,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return nil, fmt.Errorf("list zones error")
 				}
 			},
@@ -475,11 +715,11 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    nil,
 			expectingError: true,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return mockZones, nil
 				}
 
-				listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+				listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
 					return nil, fmt.Errorf("list records error")
 				}
 			},
@@ -489,11 +729,11 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    oneZoneRecordMap,
 			expectingError: false,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return mockZones[0:1], nil
 				}
 
-				listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+				listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
 					return zoneOneRecordMap, nil
 				}
 			},
@@ -503,11 +743,11 @@ func TestZoneRecordMap(t *testing.T) {
 			expectedMap:    twoZoneRecordMap,
 			expectingError: false,
 			mockFunc: func() {
-				listZones = func(client *cloudns.Client, ctx context.Context) ([]cloudns.Zone, error) {
+				listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
 					return mockZones, nil
 				}
 
-				listRecords = func(client *cloudns.Client, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+				listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
 					if zoneName == "test1.com" {
 						return zoneOneRecordMap, nil
 					}
@@ -523,7 +763,10 @@ func TestZoneRecordMap(t *testing.T) {
 	oriListZones := listZones
 	oriListRecords := listRecords
 
-	provider := &ClouDNSProvider{}
+	provider := &ClouDNSProvider{
+		accounts: []*account{{name: "default"}},
+		metrics:  metrics.NoopMetrics{},
+	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(tt *testing.T) {
@@ -544,3 +787,486 @@ func TestZoneRecordMap(t *testing.T) {
 	listZones = oriListZones
 	listRecords = oriListRecords
 }
+
+// TestMultiAccount verifies that zones and records of several accounts are
+// merged and that changes are routed to the account owning the zone.
+func TestMultiAccount(t *testing.T) {
+	accountZoneMap := map[string][]cloudns.Zone{
+		"first":  {mockZones[0]},
+		"second": {mockZones[0], mockZones[1]},
+	}
+	recordMaps := map[string]cloudns.RecordMap{
+		"test1.com": {2: mockRecords[0][1]},
+		"test2.com": {7: mockRecords[1][1]},
+	}
+	type call struct {
+		account string
+		zone    string
+		host    string
+		id      int
+	}
+	var created, deleted []call
+
+	oriListZones, oriListRecords := listZones, listRecords
+	oriCreateRecord, oriDeleteRecord := createRecord, deleteRecord
+	defer func() {
+		listZones, listRecords = oriListZones, oriListRecords
+		createRecord, deleteRecord = oriCreateRecord, oriDeleteRecord
+	}()
+
+	listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+		return accountZoneMap[acc.name], nil
+	}
+	listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+		return recordMaps[zoneName], nil
+	}
+	createRecord = func(acc *account, ctx context.Context, zoneName string, record cloudns.Record) error {
+		created = append(created, call{account: acc.name, zone: zoneName, host: record.Host})
+		return nil
+	}
+	deleteRecord = func(acc *account, ctx context.Context, zoneName string, recordID int) error {
+		deleted = append(deleted, call{account: acc.name, zone: zoneName, id: recordID})
+		return nil
+	}
+
+	m, err := metrics.NewOpenMetrics(metrics.DefaultOptions())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	provider := &ClouDNSProvider{
+		accounts: []*account{
+			{name: "first", domainFilter: endpoint.NewDomainFilter([]string{"test1.com"}), metrics: m},
+			{name: "second", metrics: m},
+		},
+		metrics:    m,
+		auditor:    audit.Noop{},
+		defaultTTL: 3600,
+	}
+
+	zones, err := provider.Zones(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(mockZones, zones) {
+		t.Errorf("Want zones %+v, got %+v", mockZones, zones)
+	}
+
+	records, err := provider.Records(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(records) != 2 || records[0].DNSName == records[1].DNSName {
+		t.Errorf("Want records of both zones, got %+v", records)
+	}
+
+	err = provider.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("new.test1.com", "A", "10.0.0.1"),
+			endpoint.NewEndpoint("new.test2.com", "A", "10.0.0.2"),
+		},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("sub2.test1.com", "A", "2.2.2.2"),
+			endpoint.NewEndpoint("sub7.test2.com", "A", "7.7.7.7"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedCreated := []call{
+		{account: "first", zone: "test1.com", host: "new"},
+		{account: "second", zone: "test2.com", host: "new"},
+	}
+	if !reflect.DeepEqual(expectedCreated, created) {
+		t.Errorf("Want created %+v, got %+v", expectedCreated, created)
+	}
+	expectedDeleted := []call{
+		{account: "first", zone: "test1.com", id: 2},
+		{account: "second", zone: "test2.com", id: 7},
+	}
+	if !reflect.DeepEqual(expectedDeleted, deleted) {
+		t.Errorf("Want deleted %+v, got %+v", expectedDeleted, deleted)
+	}
+
+	// The metrics are recorded in the instance of the provider
+	expectedMetrics := `
+# HELP cloudns_webhook_applied_changes_total The number of record changes applied per zone and kind of change
+# TYPE cloudns_webhook_applied_changes_total counter
+cloudns_webhook_applied_changes_total{account="first",change="create",zone="test1.com"} 1
+cloudns_webhook_applied_changes_total{account="first",change="delete",zone="test1.com"} 1
+cloudns_webhook_applied_changes_total{account="second",change="create",zone="test2.com"} 1
+cloudns_webhook_applied_changes_total{account="second",change="delete",zone="test2.com"} 1
+# HELP cloudns_webhook_managed_records The number of records of a supported type per zone and type
+# TYPE cloudns_webhook_managed_records gauge
+cloudns_webhook_managed_records{account="first",type="A",zone="test1.com"} 1
+cloudns_webhook_managed_records{account="second",type="A",zone="test2.com"} 1
+`
+	err = testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expectedMetrics),
+		"cloudns_webhook_applied_changes_total", "cloudns_webhook_managed_records")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestNewClouDNSProviderAccounts verifies the account validation performed by
+// NewClouDNSProvider.
+func TestNewClouDNSProviderAccounts(t *testing.T) {
+	auth := cloudns.AuthUserID(1, "password")
+
+	tests := []struct {
+		name          string
+		accounts      []ClouDNSAccountConfig
+		expectedError string
+	}{
+		{
+			name:          "no accounts",
+			expectedError: "no ClouDNS account configured",
+		},
+		{
+			name: "two accounts",
+			accounts: []ClouDNSAccountConfig{
+				{Name: "first", Auth: auth},
+				{Name: "second", Auth: cloudns.AuthSubUserName("user", "password")},
+			},
+		},
+		{
+			name: "duplicate accounts",
+			accounts: []ClouDNSAccountConfig{
+				{Name: "first", Auth: auth},
+				{Name: "first", Auth: auth},
+			},
+			expectedError: "duplicate ClouDNS account name: 'first'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, err := NewClouDNSProvider(ClouDNSConfig{Accounts: test.accounts})
+			if test.expectedError != "" {
+				if err == nil || err.Error() != test.expectedError {
+					t.Errorf("got error %v, want %q", err, test.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %s", err)
+			}
+			if len(p.accounts) != len(test.accounts) {
+				t.Errorf("got %d accounts, want %d", len(p.accounts), len(test.accounts))
+			}
+		})
+	}
+}
+
+// TestProbe verifies that the startup probe authenticates every account and
+// counts the zones matching the domain filters.
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name          string
+		loginError    error
+		zonesError    error
+		expectedZones int
+		expectedError string
+	}{
+		{
+			name:          "success",
+			expectedZones: 1,
+		},
+		{
+			name:          "authentication failure",
+			loginError:    fmt.Errorf("invalid credentials"),
+			expectedError: "account default: authentication failed: invalid credentials",
+		},
+		{
+			name:          "list zones failure",
+			zonesError:    fmt.Errorf("list zones error"),
+			expectedError: "error getting zones: account default: list zones error",
+		},
+	}
+
+	oriLogin, oriListZones := login, listZones
+	defer func() {
+		login, listZones = oriLogin, oriListZones
+	}()
+
+	provider := &ClouDNSProvider{
+		accounts: []*account{
+			{name: "default", domainFilter: endpoint.NewDomainFilter([]string{"test2.com"}), metrics: metrics.NoopMetrics{}},
+		},
+		metrics: metrics.NoopMetrics{},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			login = func(acc *account, ctx context.Context) error {
+				return test.loginError
+			}
+			listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+				return mockZones, test.zonesError
+			}
+
+			zones, err := provider.Probe(context.Background())
+			if test.expectedError != "" {
+				if err == nil || err.Error() != test.expectedError {
+					t.Errorf("got error %v, want %q", err, test.expectedError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got unexpected error: %s", err)
+			}
+			if zones != test.expectedZones {
+				t.Errorf("got %d zones, want %d", zones, test.expectedZones)
+			}
+		})
+	}
+}
+
+// TestRecordApiCall verifies that the outcome of an API call is reported to
+// the upstream health tracker.
+func TestRecordApiCall(t *testing.T) {
+	tracker := health.NewTracker()
+	acc := &account{name: "health-test", metrics: metrics.NoopMetrics{}, tracker: tracker}
+
+	recordApiCall(context.Background(), acc, actGetZones, time.Now(), fmt.Errorf("unauthorized"))
+	recordApiCall(context.Background(), acc, actGetRecords, time.Now(), nil)
+
+	statuses := map[string]health.ActionStatus{}
+	for _, status := range tracker.Report().Actions {
+		if status.Account == acc.name {
+			statuses[status.Action] = status
+		}
+	}
+	if statuses[actGetZones].LastError != "unauthorized" || statuses[actGetZones].ConsecutiveFailures != 1 {
+		t.Errorf("Unexpected status for %s: %+v", actGetZones, statuses[actGetZones])
+	}
+	if statuses[actGetRecords].LastSuccess == nil || statuses[actGetRecords].ConsecutiveFailures != 0 {
+		t.Errorf("Unexpected status for %s: %+v", actGetRecords, statuses[actGetRecords])
+	}
+}
+
+// TestLogChange verifies that record changes are logged with structured
+// fields and the correlation ID of the request.
+func TestLogChange(t *testing.T) {
+	hook := logtest.NewGlobal()
+	defer hook.Reset()
+
+	p := &ClouDNSProvider{dryRun: true}
+	ctx := logging.WithCorrelationID(context.Background(), "abc123")
+	ep := endpoint.NewEndpointWithTTL("www.test1.com", endpoint.RecordTypeA, 300, "1.2.3.4")
+
+	p.logChange(ctx, p.dryRun, actDeleteRecord, "test1.com", ep, "1.2.3.4", 42)
+
+	entry := hook.LastEntry()
+	if entry == nil {
+		t.Fatal("no log entry written")
+	}
+	if entry.Message != "DRY RUN: DELETE www.test1.com A 1.2.3.4 300" {
+		t.Errorf("unexpected message: %s", entry.Message)
+	}
+	expected := log.Fields{
+		"action":                   actDeleteRecord,
+		"zone":                     "test1.com",
+		"host":                     "www.test1.com",
+		"type":                     "A",
+		"target":                   "1.2.3.4",
+		"ttl":                      int64(300),
+		"dry_run":                  true,
+		"record_id":                42,
+		logging.CorrelationIDField: "abc123",
+	}
+	if !reflect.DeepEqual(entry.Data, expected) {
+		t.Errorf("got fields %v, want %v", entry.Data, expected)
+	}
+}
+
+// TestTracing verifies the spans of Records and of the wrapped ClouDNS API
+// calls, using an in-memory exporter.
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	bkpProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	oriListZones := listZones
+	defer func() {
+		otel.SetTracerProvider(bkpProvider)
+		listZones = oriListZones
+	}()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/dns/login.json" {
+			_, _ = w.Write([]byte(`{"status":"Failed","statusDescription":"Invalid authentication"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+	defer srv.Close()
+	client, err := cloudns.New(cloudns.BaseURL(srv.URL))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	acc := &account{name: "tracing-test", client: client, metrics: metrics.NoopMetrics{}}
+	listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+		return []cloudns.Zone{mockZones[0]}, nil
+	}
+	provider := &ClouDNSProvider{accounts: []*account{acc}, metrics: metrics.NoopMetrics{}}
+
+	if _, err := provider.Records(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := login(acc, context.Background()); err == nil {
+		t.Fatal("expected login error")
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	getRecords, records, loginSpan := spans[0], spans[1], spans[2]
+
+	if getRecords.Name != "cloudns.get_records" || getRecords.SpanKind != trace.SpanKindClient {
+		t.Errorf("unexpected span %s of kind %s", getRecords.Name, getRecords.SpanKind)
+	}
+	for _, attr := range []attribute.KeyValue{
+		attribute.String("cloudns.account", "tracing-test"),
+		attribute.String("cloudns.action", actGetRecords),
+		attribute.String("cloudns.zone", "test1.com"),
+	} {
+		if !slices.Contains(getRecords.Attributes, attr) {
+			t.Errorf("attribute %v missing from %v", attr, getRecords.Attributes)
+		}
+	}
+	if records.Name != "cloudns.Records" || getRecords.Parent.SpanID() != records.SpanContext.SpanID() {
+		t.Errorf("get_records is not a child of Records: %+v", getRecords.Parent)
+	}
+	if loginSpan.Name != "cloudns.login" || loginSpan.Status.Code != codes.Error {
+		t.Errorf("unexpected span %s with status %+v", loginSpan.Name, loginSpan.Status)
+	}
+}
+
+// TestAudit verifies that every create, update and delete is recorded in the
+// audit log, with the record sets before and after the change.
+func TestAudit(t *testing.T) {
+	recordMap := cloudns.RecordMap{
+		2: {ID: 2, Host: "old", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300},
+		3: {ID: 3, Host: "www", Record: "3.3.3.3", RecordType: cloudns.RecordTypeA, TTL: 300},
+	}
+
+	mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": recordMap})
+
+	changes := &plan.Changes{
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("new.test1.com", "A", 300, "1.1.1.1")},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "3.3.3.3")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 3600, "4.4.4.4")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("old.test1.com", "A", 300, "2.2.2.2")},
+	}
+	expected := []audit.Event{
+		{
+			RequestID: "abc123",
+			Change:    metrics.ChangeCreate,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "new.test1.com",
+			Host:      "new",
+			Type:      "A",
+			After:     &audit.RecordSet{Targets: []string{"1.1.1.1"}, TTL: 300},
+		},
+		{
+			RequestID: "abc123",
+			Change:    metrics.ChangeDelete,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "old.test1.com",
+			Host:      "old",
+			Type:      "A",
+			RecordIDs: []int{2},
+			Before:    &audit.RecordSet{Targets: []string{"2.2.2.2"}, TTL: 300},
+		},
+		{
+			RequestID: "abc123",
+			Change:    metrics.ChangeUpdate,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "www.test1.com",
+			Host:      "www",
+			Type:      "A",
+			RecordIDs: []int{3},
+			Before:    &audit.RecordSet{Targets: []string{"3.3.3.3"}, TTL: 300},
+			After:     &audit.RecordSet{Targets: []string{"4.4.4.4"}, TTL: 3600},
+		},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dryRun=%v", dryRun), func(t *testing.T) {
+			recorder := &audit.Memory{}
+			provider, _ := testProvider()
+			provider.auditor = recorder
+			provider.dryRun = dryRun
+
+			ctx := logging.WithCorrelationID(context.Background(), "abc123")
+			if err := provider.ApplyChanges(ctx, changes); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			want := slices.Clone(expected)
+			for i := range want {
+				want[i].DryRun = dryRun
+			}
+			if !reflect.DeepEqual(want, recorder.Events()) {
+				t.Errorf("Want events %+v, got %+v", want, recorder.Events())
+			}
+		})
+	}
+}
+
+// TestDryRunReports verifies that every ApplyChanges run in dry-run mode adds
+// a report of the changes that would have been applied.
+func TestDryRunReports(t *testing.T) {
+	recordMap := cloudns.RecordMap{
+		2: {ID: 2, Host: "old", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300},
+	}
+
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": recordMap})
+
+	reports := dryrun.NewReports(5)
+	recorder := &audit.Memory{}
+	provider, _ := testProvider()
+	provider.auditor = recorder
+	provider.reports = reports
+	provider.dryRun = true
+
+	ctx := logging.WithCorrelationID(context.Background(), "abc123")
+	err := provider.ApplyChanges(ctx, &plan.Changes{
+		Delete: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("old.test1.com", "A", 300, "2.2.2.2")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = provider.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("bad.test1.com", "A", 42, "1.1.1.1")},
+	})
+	if err == nil {
+		t.Fatal("expected an invalid TTL error")
+	}
+
+	list := reports.List()
+	if len(list) != 2 {
+		t.Fatalf("Want 2 reports, got %+v", list)
+	}
+	if list[0].Error == "" || len(list[0].Changes) != 0 {
+		t.Errorf("Want the failed run first, got %+v", list[0])
+	}
+	report := list[1]
+	if report.RequestID != "abc123" || report.Time.IsZero() || report.Error != "" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if len(report.Changes) != 1 || !reflect.DeepEqual(report.Changes[0].RecordIDs, []int{2}) || report.Changes[0].Host != "old" {
+		t.Errorf("Unexpected changes %+v", report.Changes)
+	}
+	// The changes are still recorded in the audit log
+	if !reflect.DeepEqual(report.Changes, recorder.Events()) {
+		t.Errorf("Want audit events %+v, got %+v", report.Changes, recorder.Events())
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("Expected no record to be written in dry-run mode, got %v", changes)
+	}
+}
@@ -20,7 +20,9 @@ package cloudns
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	cloudns "github.com/ppmathis/cloudns-go"
 
@@ -29,11 +31,43 @@ import (
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
+const (
+	// authIDTypeUserID authenticates with the numeric auth-id of the main user.
+	authIDTypeUserID = "auth-id"
+	// authIDTypeSubUserID authenticates with the numeric sub-auth-id of a sub-user.
+	authIDTypeSubUserID = "sub-auth-id"
+	// authIDTypeSubUserName authenticates with the user name of a sub-user.
+	authIDTypeSubUserName = "sub-auth-user"
+
+	envAuthIDType   = "CLOUDNS_AUTH_ID_TYPE"
+	envAuthID       = "CLOUDNS_AUTH_ID"
+	envAuthPassword = "CLOUDNS_AUTH_PASSWORD"
+
+	// StartupPolicyExit makes the webhook exit when the startup check fails.
+	StartupPolicyExit = "exit"
+	// StartupPolicyRetry makes the webhook repeat the startup check until it
+	// succeeds.
+	StartupPolicyRetry = "retry"
+
+	// defaultAccountName is the name of the account configured through the
+	// unprefixed variables when CLOUDNS_ACCOUNTS is not set.
+	defaultAccountName = "default"
+)
+
 // Configuration contains the ClouDNS provider's configuration.
+//
+// AuthID is read as a string, since its meaning depends on AuthIDType: it is
+// a numeric ID for 'auth-id' and 'sub-auth-id' and a user name for
+// 'sub-auth-user'. The credentials are validated by GetAuth.
+//
+// If Accounts is empty, the credentials and domain filters in this struct
+// describe the only account. Otherwise every listed account is read from
+// the environment with its own prefix; see AccountConfiguration.
 type Configuration struct {
+	Accounts             []string `env:"CLOUDNS_ACCOUNTS" default:""`
 	AuthIDType           string   `env:"CLOUDNS_AUTH_ID_TYPE" default:"auth-id"`
-	AuthID               int      `env:"CLOUDNS_AUTH_ID" required:"true"`
-	AuthPassword         string   `env:"CLOUDNS_AUTH_PASSWORD" required:"true"`
+	AuthID               string   `env:"CLOUDNS_AUTH_ID"`
+	AuthPassword         string   `env:"CLOUDNS_AUTH_PASSWORD"`
 	DryRun               bool     `env:"DRY_RUN" default:"false"`
 	Debug                bool     `env:"CLOUDNS_DEBUG" default:"false"`
 	DefaultTTL           int      `env:"DEFAULT_TTL" default:"3600"`
@@ -41,6 +75,37 @@ type Configuration struct {
 	ExcludeDomains       []string `env:"EXCLUDE_DOMAIN_FILTER" default:""`
 	RegexDomainFilter    string   `env:"REGEXP_DOMAIN_FILTER" default:""`
 	RegexDomainExclusion string   `env:"REGEXP_DOMAIN_FILTER_EXCLUSION" default:""`
+	StartupPolicy        string   `env:"STARTUP_POLICY" default:"retry"`
+	StartupRetryInterval int      `env:"STARTUP_RETRY_INTERVAL" default:"10000"`
+	ZonePolicies         []string `env:"ZONE_POLICIES" default:""`
+	ProtectedNames       []string `env:"PROTECTED_NAMES" default:""`
+	ProtectedTypes       []string `env:"PROTECTED_TYPES" default:""`
+	ProtectedRecordIDs   []int    `env:"PROTECTED_RECORD_IDS"`
+	ProtectUnmanaged     bool     `env:"PROTECT_UNMANAGED_RECORDS" default:"false"`
+	MaxDeletions         int      `env:"MAX_DELETIONS_PER_ZONE" default:"0"`
+	MaxDeletionPercent   float64  `env:"MAX_DELETION_PERCENT" default:"0"`
+	AllowMassDeletion    bool     `env:"ALLOW_MASS_DELETION" default:"false"`
+	MaxChangesPerBatch   int      `env:"MAX_CHANGES_PER_BATCH" default:"0"`
+	ManagedRecordTypes   []string `env:"MANAGED_RECORD_TYPES" default:"A,AAAA,CNAME,SRV,TXT,NS"`
+	ApexCNAMEAsAlias     bool     `env:"APEX_CNAME_AS_ALIAS" default:"false"`
+}
+
+// AccountConfiguration contains the credentials and the domain filters of a
+// single ClouDNS account. In multi-account mode every variable is prefixed
+// with the upper-cased account name, e.g. TENANT_CLOUDNS_AUTH_ID for the
+// account "tenant".
+type AccountConfiguration struct {
+	AuthIDType           string   `env:"CLOUDNS_AUTH_ID_TYPE" default:"auth-id"`
+	AuthID               string   `env:"CLOUDNS_AUTH_ID"`
+	AuthPassword         string   `env:"CLOUDNS_AUTH_PASSWORD"`
+	DomainFilter         []string `env:"DOMAIN_FILTER" default:""`
+	ExcludeDomains       []string `env:"EXCLUDE_DOMAIN_FILTER" default:""`
+	RegexDomainFilter    string   `env:"REGEXP_DOMAIN_FILTER" default:""`
+	RegexDomainExclusion string   `env:"REGEXP_DOMAIN_FILTER_EXCLUSION" default:""`
+
+	// envPrefix is the prefix of the environment variables, used in the
+	// error messages.
+	envPrefix string
 }
 
 func NewConfiguration() (*Configuration, error) {
@@ -54,8 +119,59 @@ func NewConfiguration() (*Configuration, error) {
 	return cfg, nil
 }
 
+// accountEnvPrefix returns the environment variable prefix for the named
+// account.
+func accountEnvPrefix(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// GetAccounts returns the configuration of every ClouDNS account. Without
+// CLOUDNS_ACCOUNTS a single account named "default" is built from the
+// unprefixed variables; otherwise the prefixed variables of every listed
+// account are read from the environment.
+func (c *Configuration) GetAccounts() (map[string]AccountConfiguration, []string, error) {
+	accounts := map[string]AccountConfiguration{}
+	names := []string{}
+
+	if len(c.Accounts) == 0 {
+		accounts[defaultAccountName] = AccountConfiguration{
+			AuthIDType:           c.AuthIDType,
+			AuthID:               c.AuthID,
+			AuthPassword:         c.AuthPassword,
+			DomainFilter:         c.DomainFilter,
+			ExcludeDomains:       c.ExcludeDomains,
+			RegexDomainFilter:    c.RegexDomainFilter,
+			RegexDomainExclusion: c.RegexDomainExclusion,
+		}
+		return accounts, []string{defaultAccountName}, nil
+	}
+
+	for _, name := range c.Accounts {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if _, ok := accounts[name]; ok {
+			return nil, nil, fmt.Errorf("account '%s' is listed more than once in CLOUDNS_ACCOUNTS", name)
+		}
+
+		accountConfig := AccountConfiguration{envPrefix: accountEnvPrefix(name)}
+		if err := env.SetPrefix(&accountConfig, accountConfig.envPrefix); err != nil {
+			return nil, nil, fmt.Errorf("account '%s': %w", name, err)
+		}
+		accounts[name] = accountConfig
+		names = append(names, name)
+	}
+
+	if len(names) == 0 {
+		return nil, nil, fmt.Errorf("CLOUDNS_ACCOUNTS does not contain any account name")
+	}
+
+	return accounts, names, nil
+}
+
 // GetDomainFilter returns the domain filter from the configuration.
-func GetDomainFilter(config Configuration) *endpoint.DomainFilter {
+func GetDomainFilter(config AccountConfiguration) *endpoint.DomainFilter {
 	var domainFilter *endpoint.DomainFilter
 	createMsg := "Creating ClouDNS provider with "
 
@@ -86,34 +202,147 @@ func GetDomainFilter(config Configuration) *endpoint.DomainFilter {
 	return domainFilter
 }
 
-// GetAuth returns an options object for authentication
-func GetAuth(config Configuration) (cloudns.Option, error) {
-	var auth cloudns.Option
+// GetAuth returns an options object for authentication. The credentials are
+// validated against the chosen CLOUDNS_AUTH_ID_TYPE and the returned error
+// lists every variable that is missing for that mode.
+func GetAuth(config AccountConfiguration) (cloudns.Option, error) {
+	prefix := config.envPrefix
 
 	switch config.AuthIDType {
-	case "auth-id":
-		auth = cloudns.AuthUserID(config.AuthID, config.AuthPassword)
-	case "sub-auth-id":
-		auth = cloudns.AuthSubUserID(config.AuthID, config.AuthPassword)
+	case authIDTypeUserID, authIDTypeSubUserID, authIDTypeSubUserName:
 	default:
-		return nil, fmt.Errorf("CLOUDNS_AUTH_ID_TYPE is not valid. Expected one of 'auth-id' or 'sub-auth-id' but was: '%s'", config.AuthIDType)
+		return nil, fmt.Errorf("%s%s is not valid. Expected one of '%s', '%s' or '%s' but was: '%s'", prefix, envAuthIDType, authIDTypeUserID, authIDTypeSubUserID, authIDTypeSubUserName, config.AuthIDType)
 	}
 
-	return auth, nil
+	if missing := missingAuthVariables(config); len(missing) > 0 {
+		return nil, fmt.Errorf("%s%s '%s' requires %s to be set", prefix, envAuthIDType, config.AuthIDType, strings.Join(missing, " and "))
+	}
+
+	if config.AuthIDType == authIDTypeSubUserName {
+		return cloudns.AuthSubUserName(config.AuthID, config.AuthPassword), nil
+	}
+
+	id, err := strconv.Atoi(config.AuthID)
+	if err != nil {
+		return nil, fmt.Errorf("%s%s must be numeric when %s%s is '%s', but was: '%s'", prefix, envAuthID, prefix, envAuthIDType, config.AuthIDType, config.AuthID)
+	}
+
+	if config.AuthIDType == authIDTypeSubUserID {
+		return cloudns.AuthSubUserID(id, config.AuthPassword), nil
+	}
+	return cloudns.AuthUserID(id, config.AuthPassword), nil
+}
+
+// missingAuthVariables returns the names of the credential variables that are
+// empty in the configuration.
+func missingAuthVariables(config AccountConfiguration) []string {
+	missing := []string{}
+	if config.AuthID == "" {
+		missing = append(missing, config.envPrefix+envAuthID)
+	}
+	if config.AuthPassword == "" {
+		missing = append(missing, config.envPrefix+envAuthPassword)
+	}
+	return missing
+}
+
+// GetStartupRetryInterval returns the interval between two startup checks.
+func (c *Configuration) GetStartupRetryInterval() time.Duration {
+	return time.Duration(c.StartupRetryInterval) * time.Millisecond
+}
+
+// validateStartupPolicy checks that the startup policy is one of the known
+// values.
+func (c *Configuration) validateStartupPolicy() error {
+	switch c.StartupPolicy {
+	case StartupPolicyExit, StartupPolicyRetry:
+		return nil
+	default:
+		return fmt.Errorf("STARTUP_POLICY is not valid. Expected one of '%s' or '%s' but was: '%s'", StartupPolicyExit, StartupPolicyRetry, c.StartupPolicy)
+	}
+}
+
+// GetProtection returns the protected records, ignoring the empty entries.
+func (c *Configuration) GetProtection() Protection {
+	protection := Protection{RecordIDs: c.ProtectedRecordIDs, Unmanaged: c.ProtectUnmanaged}
+	for _, name := range c.ProtectedNames {
+		if name = strings.TrimSpace(name); name != "" {
+			protection.Names = append(protection.Names, name)
+		}
+	}
+	for _, recordType := range c.ProtectedTypes {
+		if recordType = strings.TrimSpace(recordType); recordType != "" {
+			protection.Types = append(protection.Types, strings.ToUpper(recordType))
+		}
+	}
+	return protection
 }
 
 // ProviderConfig returns the configuration as expected by the provider
 func (c *Configuration) ProviderConfig() (*ClouDNSConfig, error) {
-	auth, err := GetAuth(*c)
+	if err := c.validateStartupPolicy(); err != nil {
+		return nil, err
+	}
+
+	zonePolicies, err := ParseZonePolicies(c.ZonePolicies)
+	if err != nil {
+		return nil, err
+	}
+
+	protection := c.GetProtection()
+	if err := protection.Validate(); err != nil {
+		return nil, err
+	}
+
+	deletionGuard := DeletionGuard{
+		MaxDeletions:       c.MaxDeletions,
+		MaxDeletionPercent: c.MaxDeletionPercent,
+		Override:           c.AllowMassDeletion,
+	}
+	if err := deletionGuard.Validate(); err != nil {
+		return nil, err
+	}
+
+	if c.MaxChangesPerBatch < 0 {
+		return nil, fmt.Errorf("MAX_CHANGES_PER_BATCH must not be negative, but was: %d", c.MaxChangesPerBatch)
+	}
+
+	managedTypes, err := ParseManagedRecordTypes(c.ManagedRecordTypes)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts, names, err := c.GetAccounts()
 	if err != nil {
 		return nil, err
 	}
 
+	accountConfigs := make([]ClouDNSAccountConfig, 0, len(names))
+	for _, name := range names {
+		accountConfig := accounts[name]
+		auth, err := GetAuth(accountConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		log.Infof("Configuring ClouDNS account %s", name)
+		accountConfigs = append(accountConfigs, ClouDNSAccountConfig{
+			Name:         name,
+			Auth:         auth,
+			DomainFilter: GetDomainFilter(accountConfig),
+		})
+	}
+
 	return &ClouDNSConfig{
-		Auth:         auth,
-		DomainFilter: GetDomainFilter(*c),
-		DefaultTTL:   c.DefaultTTL,
-		DryRun:       c.DryRun,
-		Debug:        c.Debug,
+		Accounts:           accountConfigs,
+		DefaultTTL:         c.DefaultTTL,
+		ZonePolicies:       zonePolicies,
+		Protection:         protection,
+		DeletionGuard:      deletionGuard,
+		MaxChangesPerBatch: c.MaxChangesPerBatch,
+		ManagedRecordTypes: managedTypes,
+		ApexAlias:          c.ApexCNAMEAsAlias,
+		DryRun:             c.DryRun,
+		Debug:              c.Debug,
 	}, nil
 }
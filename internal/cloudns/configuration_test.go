@@ -18,9 +18,14 @@
 package cloudns
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"regexp"
 	"testing"
 
+	cloudns "github.com/ppmathis/cloudns-go"
 	"github.com/stretchr/testify/assert"
 	"sigs.k8s.io/external-dns/endpoint"
 )
@@ -30,7 +35,7 @@ import (
 func Test_GetDomainFilter(t *testing.T) {
 	type testCase struct {
 		name     string
-		config   Configuration
+		config   AccountConfiguration
 		expected *endpoint.DomainFilter
 	}
 
@@ -44,26 +49,26 @@ func Test_GetDomainFilter(t *testing.T) {
 	testCases := []testCase{
 		{
 			name:     "No domain filters",
-			config:   Configuration{},
+			config:   AccountConfiguration{},
 			expected: &endpoint.DomainFilter{},
 		},
 		{
 			name: "Simple domain filter",
-			config: Configuration{
+			config: AccountConfiguration{
 				DomainFilter: []string{"example.com"},
 			},
 			expected: endpoint.NewDomainFilter([]string{"example.com"}),
 		},
 		{
 			name: "Exclusion domain filter",
-			config: Configuration{
+			config: AccountConfiguration{
 				ExcludeDomains: []string{"example.com"},
 			},
 			expected: endpoint.NewDomainFilterWithExclusions(nil, []string{"example.com"}),
 		},
 		{
 			name: "Both domain filters",
-			config: Configuration{
+			config: AccountConfiguration{
 				DomainFilter:   []string{"example-included.com"},
 				ExcludeDomains: []string{"example-excluded.com"},
 			},
@@ -74,7 +79,7 @@ func Test_GetDomainFilter(t *testing.T) {
 		},
 		{
 			name: "Regular expression domain filters",
-			config: Configuration{
+			config: AccountConfiguration{
 				RegexDomainFilter:    `example-[a-z]+\.com`,
 				RegexDomainExclusion: `[a-z]+-excluded\.com`,
 			},
@@ -91,3 +96,395 @@ func Test_GetDomainFilter(t *testing.T) {
 		})
 	}
 }
+
+// Test_GetAuth tests that the credentials are validated according to the
+// authentication type.
+func Test_GetAuth(t *testing.T) {
+	type testCase struct {
+		name     string
+		config   AccountConfiguration
+		expected map[string]any
+		err      string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		auth, err := GetAuth(tc.config)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			assert.Nil(t, auth)
+			return
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, sentAuthParams(t, auth))
+	}
+
+	testCases := []testCase{
+		{
+			name: "auth-id",
+			config: AccountConfiguration{
+				AuthIDType:   "auth-id",
+				AuthID:       "123",
+				AuthPassword: "secret",
+			},
+			expected: map[string]any{"auth-id": float64(123), "auth-password": "secret"},
+		},
+		{
+			name: "sub-auth-id",
+			config: AccountConfiguration{
+				AuthIDType:   "sub-auth-id",
+				AuthID:       "456",
+				AuthPassword: "secret",
+			},
+			expected: map[string]any{"sub-auth-id": float64(456), "auth-password": "secret"},
+		},
+		{
+			name: "sub-auth-user",
+			config: AccountConfiguration{
+				AuthIDType:   "sub-auth-user",
+				AuthID:       "tenant",
+				AuthPassword: "secret",
+			},
+			expected: map[string]any{"sub-auth-user": "tenant", "auth-password": "secret"},
+		},
+		{
+			name: "sub-auth-user with numeric name",
+			config: AccountConfiguration{
+				AuthIDType:   "sub-auth-user",
+				AuthID:       "789",
+				AuthPassword: "secret",
+			},
+			expected: map[string]any{"sub-auth-user": "789", "auth-password": "secret"},
+		},
+		{
+			name: "sub-auth-id with user name",
+			config: AccountConfiguration{
+				AuthIDType:   "sub-auth-id",
+				AuthID:       "tenant",
+				AuthPassword: "secret",
+			},
+			err: "CLOUDNS_AUTH_ID must be numeric when CLOUDNS_AUTH_ID_TYPE is 'sub-auth-id', but was: 'tenant'",
+		},
+		{
+			name: "sub-auth-user without password",
+			config: AccountConfiguration{
+				AuthIDType: "sub-auth-user",
+				AuthID:     "tenant",
+			},
+			err: "CLOUDNS_AUTH_ID_TYPE 'sub-auth-user' requires CLOUDNS_AUTH_PASSWORD to be set",
+		},
+		{
+			name: "auth-id without credentials",
+			config: AccountConfiguration{
+				AuthIDType: "auth-id",
+			},
+			err: "CLOUDNS_AUTH_ID_TYPE 'auth-id' requires CLOUDNS_AUTH_ID and CLOUDNS_AUTH_PASSWORD to be set",
+		},
+		{
+			name: "unknown type",
+			config: AccountConfiguration{
+				AuthIDType:   "token",
+				AuthID:       "123",
+				AuthPassword: "secret",
+			},
+			err: "CLOUDNS_AUTH_ID_TYPE is not valid. Expected one of 'auth-id', 'sub-auth-id' or 'sub-auth-user' but was: 'token'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+// sentAuthParams returns the parameters that a client configured with the
+// given authentication option sends to the ClouDNS API.
+func sentAuthParams(t *testing.T, auth cloudns.Option) map[string]any {
+	var params map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&params))
+		_, _ = w.Write([]byte(`{"status":"Success"}`))
+	}))
+	defer srv.Close()
+
+	client, err := cloudns.New(auth, cloudns.BaseURL(srv.URL))
+	assert.NoError(t, err)
+	_, err = client.Account.Login(context.Background())
+	assert.NoError(t, err)
+	return params
+}
+
+// Test_Configuration_GetAccounts tests that the accounts are read from the
+// unprefixed variables or from the prefixed variables of every account.
+func Test_Configuration_GetAccounts(t *testing.T) {
+	type testCase struct {
+		name     string
+		config   Configuration
+		env      map[string]string
+		names    []string
+		expected map[string]AccountConfiguration
+		err      string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		for k, v := range tc.env {
+			t.Setenv(k, v)
+		}
+		accounts, names, err := tc.config.GetAccounts()
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			return
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, tc.names, names)
+		assert.Equal(t, tc.expected, accounts)
+	}
+
+	testCases := []testCase{
+		{
+			name: "single account",
+			config: Configuration{
+				AuthIDType:   "auth-id",
+				AuthID:       "123",
+				AuthPassword: "secret",
+				DomainFilter: []string{"example.com"},
+			},
+			names: []string{"default"},
+			expected: map[string]AccountConfiguration{
+				"default": {
+					AuthIDType:   "auth-id",
+					AuthID:       "123",
+					AuthPassword: "secret",
+					DomainFilter: []string{"example.com"},
+				},
+			},
+		},
+		{
+			name: "two accounts",
+			config: Configuration{
+				Accounts: []string{"main", "tenant-a"},
+				AuthID:   "ignored",
+			},
+			env: map[string]string{
+				"MAIN_CLOUDNS_AUTH_ID":           "123",
+				"MAIN_CLOUDNS_AUTH_PASSWORD":     "secret",
+				"MAIN_DOMAIN_FILTER":             "example.com",
+				"TENANT_A_CLOUDNS_AUTH_ID_TYPE":  "sub-auth-user",
+				"TENANT_A_CLOUDNS_AUTH_ID":       "tenant",
+				"TENANT_A_CLOUDNS_AUTH_PASSWORD": "other",
+			},
+			names: []string{"main", "tenant-a"},
+			expected: map[string]AccountConfiguration{
+				"main": {
+					AuthIDType:   "auth-id",
+					AuthID:       "123",
+					AuthPassword: "secret",
+					DomainFilter: []string{"example.com"},
+					envPrefix:    "MAIN_",
+				},
+				"tenant-a": {
+					AuthIDType:   "sub-auth-user",
+					AuthID:       "tenant",
+					AuthPassword: "other",
+					envPrefix:    "TENANT_A_",
+				},
+			},
+		},
+		{
+			name: "duplicate account",
+			config: Configuration{
+				Accounts: []string{"main", "main"},
+			},
+			err: "account 'main' is listed more than once in CLOUDNS_ACCOUNTS",
+		},
+		{
+			name: "empty account list",
+			config: Configuration{
+				Accounts: []string{" "},
+			},
+			err: "CLOUDNS_ACCOUNTS does not contain any account name",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+// Test_GetAuth_prefixed tests that the errors of a prefixed account name the
+// prefixed variables.
+func Test_GetAuth_prefixed(t *testing.T) {
+	_, err := GetAuth(AccountConfiguration{AuthIDType: "sub-auth-id", envPrefix: "TENANT_"})
+	assert.EqualError(t, err, "TENANT_CLOUDNS_AUTH_ID_TYPE 'sub-auth-id' requires TENANT_CLOUDNS_AUTH_ID and TENANT_CLOUDNS_AUTH_PASSWORD to be set")
+}
+
+// Test_Configuration_startupPolicy tests the validation of the startup policy.
+func Test_Configuration_startupPolicy(t *testing.T) {
+	type testCase struct {
+		name   string
+		policy string
+		err    string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		config := Configuration{
+			AuthIDType:    "auth-id",
+			AuthID:        "123",
+			AuthPassword:  "secret",
+			StartupPolicy: tc.policy,
+		}
+		_, err := config.ProviderConfig()
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+		} else {
+			assert.NoError(t, err)
+		}
+	}
+
+	testCases := []testCase{
+		{name: "exit", policy: "exit"},
+		{name: "retry", policy: "retry"},
+		{
+			name:   "invalid",
+			policy: "ignore",
+			err:    "STARTUP_POLICY is not valid. Expected one of 'exit' or 'retry' but was: 'ignore'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+// Test_Configuration_zonePolicies tests that the zone policies are parsed
+// into the provider configuration.
+func Test_Configuration_zonePolicies(t *testing.T) {
+	config := Configuration{
+		AuthIDType:    "auth-id",
+		AuthID:        "123",
+		AuthPassword:  "secret",
+		StartupPolicy: "retry",
+		ZonePolicies:  []string{"alpha.com=read-only", "beta.com=upsert-only"},
+	}
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"alpha.com": "read-only", "beta.com": "upsert-only"}, providerConfig.ZonePolicies)
+
+	config.ZonePolicies = []string{"alpha.com=observe"}
+	_, err = config.ProviderConfig()
+	assert.EqualError(t, err, "ZONE_POLICIES entry 'alpha.com=observe' is not valid. Expected one of 'live', 'dry-run', 'read-only', 'create-only', 'upsert-only' but was: 'observe'")
+}
+
+// Test_Configuration_protection tests that the protected records are read from
+// the environment into the provider configuration.
+func Test_Configuration_protection(t *testing.T) {
+	t.Setenv("CLOUDNS_AUTH_ID", "123")
+	t.Setenv("CLOUDNS_AUTH_PASSWORD", "secret")
+	t.Setenv("PROTECTED_NAMES", "_dmarc.*, alpha.com")
+	t.Setenv("PROTECTED_TYPES", "ns,MX")
+	t.Setenv("PROTECTED_RECORD_IDS", "42,43")
+	t.Setenv("PROTECT_UNMANAGED_RECORDS", "true")
+
+	config, err := NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, Protection{
+		Names:     []string{"_dmarc.*", "alpha.com"},
+		Types:     []string{"NS", "MX"},
+		RecordIDs: []int{42, 43},
+		Unmanaged: true,
+	}, providerConfig.Protection)
+
+	config.ProtectedNames = []string{"[alpha.com"}
+	_, err = config.ProviderConfig()
+	assert.ErrorContains(t, err, "PROTECTED_NAMES entry '[alpha.com' is not a valid glob")
+}
+
+// Test_Configuration_deletionGuard tests that the deletion guard is read from
+// the environment into the provider configuration.
+func Test_Configuration_deletionGuard(t *testing.T) {
+	t.Setenv("CLOUDNS_AUTH_ID", "123")
+	t.Setenv("CLOUDNS_AUTH_PASSWORD", "secret")
+	t.Setenv("MAX_DELETIONS_PER_ZONE", "20")
+	t.Setenv("MAX_DELETION_PERCENT", "25.5")
+
+	config, err := NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, DeletionGuard{MaxDeletions: 20, MaxDeletionPercent: 25.5}, providerConfig.DeletionGuard)
+
+	config.MaxDeletionPercent = 150
+	_, err = config.ProviderConfig()
+	assert.EqualError(t, err, "MAX_DELETION_PERCENT must be between 0 and 100, but was: 150")
+}
+
+// Test_Configuration_maxChangesPerBatch tests the validation of the maximum
+// number of changes applied at once.
+func Test_Configuration_maxChangesPerBatch(t *testing.T) {
+	config := Configuration{
+		AuthIDType:         "auth-id",
+		AuthID:             "123",
+		AuthPassword:       "secret",
+		StartupPolicy:      "retry",
+		MaxChangesPerBatch: 100,
+	}
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, 100, providerConfig.MaxChangesPerBatch)
+
+	config.MaxChangesPerBatch = -1
+	_, err = config.ProviderConfig()
+	assert.EqualError(t, err, "MAX_CHANGES_PER_BATCH must not be negative, but was: -1")
+}
+
+// Test_Configuration_managedRecordTypes tests that the managed record types
+// are read from the environment into the provider configuration.
+func Test_Configuration_managedRecordTypes(t *testing.T) {
+	t.Setenv("CLOUDNS_AUTH_ID", "123")
+	t.Setenv("CLOUDNS_AUTH_PASSWORD", "secret")
+
+	config, err := NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"A": true, "AAAA": true, "CNAME": true, "SRV": true, "TXT": true, "NS": true}, providerConfig.ManagedRecordTypes)
+
+	t.Setenv("MANAGED_RECORD_TYPES", "A, txt,CAA,TLSA")
+	config, err = NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err = config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"A": true, "TXT": true, "CAA": true, "TLSA": true}, providerConfig.ManagedRecordTypes)
+
+	config.ManagedRecordTypes = []string{"A", "DS"}
+	_, err = config.ProviderConfig()
+	assert.EqualError(t, err, "MANAGED_RECORD_TYPES cannot contain DS: the ClouDNS client does not support the fields of DS records")
+
+	config.ManagedRecordTypes = []string{"WR"}
+	_, err = config.ProviderConfig()
+	assert.EqualError(t, err, "MANAGED_RECORD_TYPES entry 'WR' is not valid. Expected one of 'A', 'AAAA', 'CNAME', 'SRV', 'TXT', 'NS', 'CAA', 'NAPTR', 'SSHFP', 'TLSA'")
+}
+
+func Test_Configuration_apexCNAMEAsAlias(t *testing.T) {
+	t.Setenv("CLOUDNS_AUTH_ID", "123")
+	t.Setenv("CLOUDNS_AUTH_PASSWORD", "secret")
+
+	config, err := NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err := config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.False(t, providerConfig.ApexAlias)
+
+	t.Setenv("APEX_CNAME_AS_ALIAS", "true")
+	config, err = NewConfiguration()
+	assert.NoError(t, err)
+	providerConfig, err = config.ProviderConfig()
+	assert.NoError(t, err)
+	assert.True(t, providerConfig.ApexAlias)
+}
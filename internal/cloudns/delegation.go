@@ -0,0 +1,166 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// zoneSelection selects the zone of the desired endpoints. Besides the zones
+// managed by the accounts, it knows the zones excluded by the domain filters
+// and the subdomains delegated by NS records, so that a record is not written
+// in a parent zone where it would shadow a child zone or a delegation.
+type zoneSelection struct {
+	managed  []accountZone
+	excluded []accountZone
+	// delegations are the names delegated by the NS records of the managed
+	// zones with their name servers, by zone name. The zones are listed the
+	// first time they are needed.
+	delegations map[string]map[string][]string
+	// desired are the names delegated by the desired NS endpoints with their
+	// name servers, by zone name.
+	desired map[string]map[string][]string
+	// list lists the records of a zone
+	list func(ctx context.Context, acc *account, zone string) (cloudns.RecordMap, error)
+}
+
+// zoneSelection returns the zone selection of the desired endpoints: the
+// names delegated by their NS endpoints are added to the ones of the records.
+// If an error occurs while retrieving the zones, it is returned.
+func (p *ClouDNSProvider) zoneSelection(ctx context.Context, endpoints []*endpoint.Endpoint) (*zoneSelection, error) {
+	managed, excluded, err := p.allAccountZones(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sel := &zoneSelection{
+		managed:     managed,
+		excluded:    excluded,
+		delegations: map[string]map[string][]string{},
+		desired:     map[string]map[string][]string{},
+		list:        p.listZoneRecords,
+	}
+	for _, ep := range endpoints {
+		if ep.RecordType != endpoint.RecordTypeNS {
+			continue
+		}
+		az, ok := matchAccountZone(ep.DNSName, managed)
+		if !ok || isZoneName(ep.DNSName, az.zone.Name) {
+			continue
+		}
+		if sel.desired[az.zone.Name] == nil {
+			sel.desired[az.zone.Name] = map[string][]string{}
+		}
+		name := normalizeName(ep.DNSName)
+		for _, target := range ep.Targets {
+			sel.desired[az.zone.Name][name] = append(sel.desired[az.zone.Name][name], normalizeName(target))
+		}
+	}
+
+	return sel, nil
+}
+
+// excludedZone returns the zone excluded by the domain filters that contains
+// the domain and is a child of the managed zone it matches: the records of
+// the domain belong to that zone, not to the managed one. If there is none,
+// false is returned.
+func excludedZone(domain, matchedZone string, excluded []accountZone) (string, bool) {
+	domain = normalizeName(domain)
+	names := []string{}
+	for _, az := range excluded {
+		name := az.zone.Name
+		if len(name) > len(matchedZone) && strings.HasSuffix(name, "."+matchedZone) && (domain == name || strings.HasSuffix(domain, "."+name)) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	return names[0], true
+}
+
+// delegation returns the deepest delegated name of the zone the domain is
+// strictly below, either delegated by an NS record of the zone or by a desired NS
+// endpoint. The A and AAAA records of a name server of the delegation are the
+// glue records of the delegation, which belong to the zone, so they are not
+// considered below it. The records of the zone are listed the first time they
+// are needed, and only when the domain is at least two labels below the zone
+// apex, since a domain one label below the apex cannot be below a delegation.
+// If no delegation contains the domain, false is returned. If an error occurs
+// while retrieving the records, it is returned once: the delegations of the
+// zone are then ignored for the rest of the selection.
+func (sel *zoneSelection) delegation(ctx context.Context, domain, recordType string, az accountZone) (string, bool, error) {
+	domain = normalizeName(domain)
+	zone := az.zone.Name
+	if strings.Count(strings.TrimSuffix(domain, "."+zone), ".") < 1 || isZoneName(domain, zone) {
+		return "", false, nil
+	}
+
+	delegations, ok := sel.delegations[zone]
+	if !ok {
+		records, err := sel.list(ctx, az.account, zone)
+		if err != nil {
+			sel.delegations[zone] = nil
+			return "", false, fmt.Errorf("error getting records: %s", err)
+		}
+		delegations = zoneDelegations(zone, records)
+		sel.delegations[zone] = delegations
+	}
+
+	glue := recordType == endpoint.RecordTypeA || recordType == endpoint.RecordTypeAAAA
+	names := []string{}
+	for _, all := range []map[string][]string{delegations, sel.desired[zone]} {
+		for name, nameservers := range all {
+			if !strings.HasSuffix(domain, "."+name) {
+				continue
+			}
+			if glue && slices.Contains(nameservers, domain) {
+				return "", false, nil
+			}
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "", false, nil
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+	return names[0], true, nil
+}
+
+// zoneDelegations returns the names delegated by the NS records of a zone,
+// that is the NS records that are not at the zone apex, with their name
+// servers.
+func zoneDelegations(zone string, records cloudns.RecordMap) map[string][]string {
+	delegations := map[string][]string{}
+	for _, record := range records {
+		if record.RecordType != cloudns.RecordTypeNS || record.Host == "" || record.Host == "@" {
+			continue
+		}
+		name := strings.ToLower(record.Host) + "." + zone
+		delegations[name] = append(delegations[name], normalizeName(record.Record))
+	}
+	for _, nameservers := range delegations {
+		sort.Strings(nameservers)
+	}
+	return delegations
+}
+
+// isZoneName returns true if the domain is the name of the zone.
+func isZoneName(domain, zone string) bool {
+	return normalizeName(domain) == zone
+}
+
+// normalizeName returns the domain in lower case without the trailing dot.
+func normalizeName(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
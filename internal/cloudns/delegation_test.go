@@ -0,0 +1,277 @@
+package cloudns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"testing"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// hierarchyZones is a multi-level zone hierarchy: k8s.example.com is excluded
+// by the domain filter of the tests, while its child dev.k8s.example.com is
+// managed.
+var hierarchyZones = []cloudns.Zone{
+	{Name: "example.com", Type: 1, Kind: 1, IsActive: true},
+	{Name: "team.example.com", Type: 1, Kind: 1, IsActive: true},
+	{Name: "k8s.example.com", Type: 1, Kind: 1, IsActive: true},
+	{Name: "dev.k8s.example.com", Type: 1, Kind: 1, IsActive: true},
+}
+
+// hierarchyRecords are the records of the zone hierarchy: example.com
+// delegates legacy.example.com and dns.example.com, whose name server has a
+// glue record, and team.example.com delegates ops.team.example.com.
+var hierarchyRecords = map[string]cloudns.RecordMap{
+	"example.com": {
+		1: {ID: 1, Host: "", Record: "ns1.cloudns.net", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+		2: {ID: 2, Host: "legacy", Record: "ns1.legacy.net", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+		3: {ID: 3, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300},
+		5: {ID: 5, Host: "dns", Record: "ns1.dns.example.com.", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+		6: {ID: 6, Host: "ns1.dns", Record: "7.7.7.7", RecordType: cloudns.RecordTypeA, TTL: 3600},
+	},
+	"team.example.com": {
+		4: {ID: 4, Host: "ops", Record: "ns1.ops.net", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+	},
+	"dev.k8s.example.com": {},
+}
+
+// hierarchyFilter is the domain filter of the zone hierarchy, which excludes
+// k8s.example.com, but not dev.k8s.example.com.
+var hierarchyFilter = endpoint.NewRegexDomainFilter(regexp.MustCompile(`\.com$`), regexp.MustCompile(`^k8s\.example\.com$`))
+
+func TestExcludedZone(t *testing.T) {
+	excluded := []accountZone{{zone: cloudns.Zone{Name: "k8s.example.com"}}, {zone: cloudns.Zone{Name: "example.net"}}}
+
+	type testCase struct {
+		domain   string
+		matched  string
+		expected string
+	}
+
+	testCases := []testCase{
+		{domain: "x.k8s.example.com", matched: "example.com", expected: "k8s.example.com"},
+		{domain: "k8s.example.com", matched: "example.com", expected: "k8s.example.com"},
+		{domain: "X.K8S.example.com.", matched: "example.com", expected: "k8s.example.com"},
+		{domain: "x.dev.k8s.example.com", matched: "dev.k8s.example.com"},
+		{domain: "xk8s.example.com", matched: "example.com"},
+		{domain: "www.example.com", matched: "example.com"},
+		{domain: "www.example.net", matched: "example.com"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.domain, func(t *testing.T) {
+			zone, ok := excludedZone(tc.domain, tc.matched, excluded)
+			if zone != tc.expected || ok != (tc.expected != "") {
+				t.Errorf("Want %q, got %q (%v)", tc.expected, zone, ok)
+			}
+		})
+	}
+}
+
+func TestZoneDelegations(t *testing.T) {
+	delegations := zoneDelegations("example.com", cloudns.RecordMap{
+		1: {Host: "", Record: "ns1.cloudns.net", RecordType: cloudns.RecordTypeNS},
+		2: {Host: "@", Record: "ns2.cloudns.net", RecordType: cloudns.RecordTypeNS},
+		3: {Host: "Legacy", Record: "ns2.legacy.net", RecordType: cloudns.RecordTypeNS},
+		4: {Host: "a.b", Record: "ns.a.b.example.com.", RecordType: cloudns.RecordTypeNS},
+		5: {Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA},
+		6: {Host: "legacy", Record: "NS1.legacy.net", RecordType: cloudns.RecordTypeNS},
+	})
+	expected := map[string][]string{
+		"a.b.example.com":    {"ns.a.b.example.com"},
+		"legacy.example.com": {"ns1.legacy.net", "ns2.legacy.net"},
+	}
+	if !reflect.DeepEqual(expected, delegations) {
+		t.Errorf("Want %v, got %v", expected, delegations)
+	}
+}
+
+func TestAdjustEndpointsZoneHierarchy(t *testing.T) {
+	api := mockAPI(t, hierarchyZones, hierarchyRecords)
+
+	provider, m := testProvider()
+	provider.accounts[0].domainFilter = hierarchyFilter
+
+	adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+		// example.com
+		endpoint.NewEndpointWithTTL("example.com", "A", 300, "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("www.example.com", "A", 300, "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("a.b.example.com", "A", 300, "1.1.1.1"),
+		// k8s.example.com is excluded by the domain filter
+		endpoint.NewEndpointWithTTL("x.k8s.example.com", "A", 300, "2.2.2.2"),
+		endpoint.NewEndpointWithTTL("k8s.example.com", "A", 300, "2.2.2.2"),
+		// dev.k8s.example.com is managed below the excluded zone
+		endpoint.NewEndpointWithTTL("app.dev.k8s.example.com", "A", 300, "3.3.3.3"),
+		// legacy.example.com is delegated by example.com
+		endpoint.NewEndpointWithTTL("legacy.example.com", "NS", 3600, "ns2.legacy.net"),
+		endpoint.NewEndpointWithTTL("h.legacy.example.com", "A", 300, "4.4.4.4"),
+		endpoint.NewEndpointWithTTL("a.b.legacy.example.com", "CNAME", 300, "www.example.com"),
+		// dns.example.com is delegated by example.com to an in-bailiwick name
+		// server, whose glue record is kept
+		endpoint.NewEndpointWithTTL("ns1.dns.example.com", "A", 3600, "7.7.7.7"),
+		endpoint.NewEndpointWithTTL("ns1.dns.example.com", "TXT", 3600, "glue"),
+		endpoint.NewEndpointWithTTL("ns2.dns.example.com", "A", 3600, "8.8.8.8"),
+		// ops.team.example.com is delegated by team.example.com
+		endpoint.NewEndpointWithTTL("db.ops.team.example.com", "A", 300, "5.5.5.5"),
+		// sub.team.example.com is delegated by a desired NS endpoint
+		endpoint.NewEndpointWithTTL("sub.team.example.com", "NS", 3600, "ns1.sub.net", "NS.sub.team.example.com."),
+		endpoint.NewEndpointWithTTL("w.sub.team.example.com", "A", 300, "6.6.6.6"),
+		endpoint.NewEndpointWithTTL("ns.sub.team.example.com", "AAAA", 300, "2001:db8::1"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	names := []string{}
+	for _, ep := range adjusted {
+		names = append(names, ep.DNSName+" "+ep.RecordType)
+	}
+	sort.Strings(names)
+	expected := []string{
+		"a.b.example.com A",
+		"app.dev.k8s.example.com A",
+		"example.com A",
+		"legacy.example.com NS",
+		"ns.sub.team.example.com AAAA",
+		"ns1.dns.example.com A",
+		"sub.team.example.com NS",
+		"www.example.com A",
+	}
+	if !reflect.DeepEqual(expected, names) {
+		t.Errorf("Want %v, got %v", expected, names)
+	}
+
+	// The records of a zone are listed once, and only for the names that can
+	// be below a delegation
+	if expectedListings := map[string]int{"example.com": 1, "team.example.com": 1}; !reflect.DeepEqual(expectedListings, api.listings) {
+		t.Errorf("Want listings %v, got %v", expectedListings, api.listings)
+	}
+
+	for reason, expected := range map[string]int{invalidDelegated: 6, invalidExcluded: 2} {
+		if count := m.value("invalid_endpoints_total", reason); count != expected {
+			t.Errorf("Want %d endpoints dropped as %s, got %d", expected, reason, count)
+		}
+	}
+}
+
+func TestAdjustEndpointsDelegationError(t *testing.T) {
+	api := mockAPI(t, hierarchyZones, hierarchyRecords)
+	listRecords = func(acc *account, ctx context.Context, zoneName string) (cloudns.RecordMap, error) {
+		api.listings[zoneName]++
+		return nil, errors.New("rate limited")
+	}
+
+	// The endpoints are kept without checking the delegations, and the zone is
+	// not listed again
+	provider, _ := testProvider()
+	provider.accounts[0].domainFilter = hierarchyFilter
+	adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("a.b.example.com", "A", 300, "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("h.legacy.example.com", "A", 300, "4.4.4.4"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(adjusted) != 2 {
+		t.Errorf("Want the endpoints kept, got %v", adjusted)
+	}
+	if expected := map[string]int{"example.com": 1}; !reflect.DeepEqual(expected, api.listings) {
+		t.Errorf("Want listings %v, got %v", expected, api.listings)
+	}
+}
+
+func TestAdjustEndpointsZonesError(t *testing.T) {
+	mockAPI(t, hierarchyZones, hierarchyRecords)
+	listZones = func(acc *account, ctx context.Context) ([]cloudns.Zone, error) {
+		return nil, errors.New("rate limited")
+	}
+
+	// The endpoints are passed through, with the canonical targets
+	provider, m := testProvider()
+	provider.accounts[0].domainFilter = hierarchyFilter
+	provider.managedTypes = map[string]bool{"A": true, "CAA": true}
+	endpoints := []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("www.example.com", "A", 300, "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("example.com", "CAA", 300, "0 ISSUE letsencrypt.org"),
+		endpoint.NewEndpointWithTTL("", "A", 300),
+	}
+	adjusted, err := provider.AdjustEndpoints(endpoints)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(endpoints, adjusted) {
+		t.Errorf("Want the endpoints passed through, got %v", adjusted)
+	}
+	if target := adjusted[1].Targets[0]; target != "0 issue \"letsencrypt.org\"" {
+		t.Errorf("Want the canonical CAA target, got %s", target)
+	}
+	if m.total("invalid_endpoints_total") != 0 {
+		t.Error("Want no endpoint counted as invalid")
+	}
+}
+
+// TestApplyChangesZoneHierarchy verifies that the changes queued or planned
+// without being adjusted do not write records in an excluded zone or below a
+// delegation either.
+func TestApplyChangesZoneHierarchy(t *testing.T) {
+	api := mockAPI(t, hierarchyZones, hierarchyRecords)
+
+	provider, _ := testProvider()
+	provider.accounts[0].domainFilter = hierarchyFilter
+	err := provider.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("x.k8s.example.com", "A", 300, "2.2.2.2"),
+			endpoint.NewEndpointWithTTL("app.dev.k8s.example.com", "A", 300, "3.3.3.3"),
+			endpoint.NewEndpointWithTTL("x.team.example.com", "A", 300, "4.4.4.4"),
+			endpoint.NewEndpointWithTTL("h.legacy.example.com", "A", 300, "4.4.4.4"),
+			endpoint.NewEndpointWithTTL("ns1.dns.example.com", "A", 3600, "7.7.7.7"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("db.ops.team.example.com", "A", 300, "5.5.5.5")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("db.ops.team.example.com", "A", 300, "6.6.6.6")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{
+		"create app dev.k8s.example.com A 3.3.3.3",
+		"create ns1.dns example.com A 7.7.7.7",
+		"create x team.example.com A 4.4.4.4",
+	}
+	if changes := api.changes(); !reflect.DeepEqual(expected, changes) {
+		t.Errorf("Want changes %v, got %v", expected, changes)
+	}
+}
+
+func TestDelegation(t *testing.T) {
+	az := accountZone{zone: cloudns.Zone{Name: "example.com"}}
+	sel := &zoneSelection{
+		delegations: map[string]map[string][]string{
+			"example.com": {"b.example.com": {"ns1.b.net"}},
+		},
+		desired: map[string]map[string][]string{
+			"example.com": {"c.b.example.com": {"ns1.c.net"}},
+		},
+	}
+
+	// The deepest delegation containing the name is returned
+	for domain, expected := range map[string]string{
+		"x.c.b.example.com": "c.b.example.com",
+		"x.b.example.com":   "b.example.com",
+	} {
+		delegated, ok, err := sel.delegation(context.Background(), domain, "A", az)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !ok || delegated != expected {
+			t.Errorf("Want %s delegated as %s, got %s", domain, expected, delegated)
+		}
+	}
+	if _, ok, _ := sel.delegation(context.Background(), "x.a.example.com", "A", az); ok {
+		t.Error("Want x.a.example.com not delegated")
+	}
+}
@@ -0,0 +1,129 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// DeletionGuard limits the number of records a single ApplyChanges request
+// deletes from a zone, as an absolute number and as a percentage of the
+// records of the zone. A zero limit is disabled.
+//
+// The guard is overridden for every request with Override, or for a single
+// request with a one-shot override granted on the metrics socket; see
+// override.Overrides.
+type DeletionGuard struct {
+	MaxDeletions       int
+	MaxDeletionPercent float64
+	Override           bool
+}
+
+// Validate checks that the limits are not negative and that the percentage
+// is not above 100.
+func (g DeletionGuard) Validate() error {
+	if g.MaxDeletions < 0 {
+		return fmt.Errorf("MAX_DELETIONS_PER_ZONE must not be negative, but was: %d", g.MaxDeletions)
+	}
+	if g.MaxDeletionPercent < 0 || g.MaxDeletionPercent > 100 {
+		return fmt.Errorf("MAX_DELETION_PERCENT must be between 0 and 100, but was: %v", g.MaxDeletionPercent)
+	}
+	return nil
+}
+
+// enabled returns true if at least one limit is set.
+func (g DeletionGuard) enabled() bool {
+	return g.MaxDeletions > 0 || g.MaxDeletionPercent > 0
+}
+
+// exceeded returns true if deleting the given number of records out of the
+// total ones of a zone exceeds a limit.
+func (g DeletionGuard) exceeded(deletions, total int) bool {
+	if g.MaxDeletions > 0 && deletions > g.MaxDeletions {
+		return true
+	}
+	if g.MaxDeletionPercent > 0 && total > 0 && float64(deletions)*100/float64(total) > g.MaxDeletionPercent {
+		return true
+	}
+	return false
+}
+
+// checkDeletions evaluates the deletions of the changes against the deletion
+// guard, zone by zone. The deletions refused by the zone policies are not
+// counted. If a limit is exceeded and the guard is not overridden, the changes
+// are refused with an error before any of them is applied.
+//
+// The one-shot overrides of the zones exceeding a limit are used only if use
+// is true, so that the changes checked before being queued are let through
+// again when they are applied.
+func (p *ClouDNSProvider) checkDeletions(ctx context.Context, changes *plan.Changes, use bool) error {
+	if !p.deletionGuard.enabled() || len(changes.Delete) == 0 {
+		return nil
+	}
+	logger := logging.FromContext(ctx)
+
+	accountZones, err := p.accountZones(ctx)
+	if err != nil {
+		return err
+	}
+
+	deletions := map[string]int{}
+	zones := map[string]accountZone{}
+	for _, ep := range changes.Delete {
+		az, ok := matchAccountZone(ep.DNSName, accountZones)
+		if !ok || !zonePolicyAllows(p.zonePolicy(az.zone.Name), metrics.ChangeDelete) {
+			continue
+		}
+		deletions[az.zone.Name] += len(ep.Targets)
+		zones[az.zone.Name] = az
+	}
+
+	names := make([]string, 0, len(zones))
+	for name := range zones {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	exceeded := []string{}
+	totals := map[string]int{}
+	for _, name := range names {
+		records, err := listRecords(zones[name].account, ctx, name)
+		if err != nil {
+			return err
+		}
+		totals[name] = len(records)
+		if p.deletionGuard.exceeded(deletions[name], len(records)) {
+			exceeded = append(exceeded, name)
+		}
+	}
+	if len(exceeded) == 0 {
+		return nil
+	}
+
+	overridden := p.deletionGuard.Override
+	if !overridden && use {
+		overridden = p.overrides.Use(exceeded)
+	} else if !overridden {
+		overridden = p.overrides.Granted(exceeded)
+	}
+	for _, name := range exceeded {
+		az := zones[name]
+		fields := log.Fields{"account": az.account.name, "zone": name, "deletions": deletions[name], "records": totals[name]}
+		if overridden {
+			logger.WithFields(fields).Warnf("Deleting %d of the %d records of zone %s - deletion guard overridden", deletions[name], totals[name], name)
+			continue
+		}
+
+		p.metrics.IncMassDeletionsBlockedTotal(az.account.name, name)
+		logger.WithFields(fields).Errorf("Refusing to delete %d of the %d records of zone %s - deletion guard limits exceeded", deletions[name], totals[name], name)
+		return fmt.Errorf("refusing to delete %d of the %d records of zone %s: the deletion guard limits are exceeded", deletions[name], totals[name], name)
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/override"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestDeletionGuardExceeded(t *testing.T) {
+	type testCase struct {
+		guard     DeletionGuard
+		deletions int
+		total     int
+		expected  bool
+	}
+
+	testCases := []testCase{
+		{guard: DeletionGuard{}, deletions: 100, total: 100, expected: false},
+		{guard: DeletionGuard{MaxDeletions: 5}, deletions: 5, total: 100, expected: false},
+		{guard: DeletionGuard{MaxDeletions: 5}, deletions: 6, total: 100, expected: true},
+		{guard: DeletionGuard{MaxDeletionPercent: 50}, deletions: 5, total: 10, expected: false},
+		{guard: DeletionGuard{MaxDeletionPercent: 50}, deletions: 6, total: 10, expected: true},
+		{guard: DeletionGuard{MaxDeletionPercent: 50}, deletions: 1, total: 0, expected: false},
+		{guard: DeletionGuard{MaxDeletions: 10, MaxDeletionPercent: 50}, deletions: 6, total: 10, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v %d/%d", tc.guard, tc.deletions, tc.total), func(t *testing.T) {
+			if exceeded := tc.guard.exceeded(tc.deletions, tc.total); exceeded != tc.expected {
+				t.Errorf("Want %v, got %v", tc.expected, exceeded)
+			}
+		})
+	}
+}
+
+func TestDeletionGuardValidate(t *testing.T) {
+	for _, guard := range []DeletionGuard{{MaxDeletions: -1}, {MaxDeletionPercent: -1}, {MaxDeletionPercent: 101}} {
+		if err := guard.Validate(); err == nil {
+			t.Errorf("Expected an error for %+v", guard)
+		}
+	}
+	if err := (DeletionGuard{MaxDeletions: 10, MaxDeletionPercent: 100}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestApplyChangesDeletionGuard(t *testing.T) {
+	recordMap := cloudns.RecordMap{}
+	for i := 1; i <= 10; i++ {
+		recordMap[i] = cloudns.Record{ID: i, Host: fmt.Sprintf("host%d", i), Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300}
+	}
+
+	zones := []cloudns.Zone{{Name: "test1.com"}, {Name: "test2.com"}}
+	api := mockAPI(t, zones, sameRecords(recordMap, zones...))
+
+	deletions := func(zone string, num int) []*endpoint.Endpoint {
+		result := []*endpoint.Endpoint{}
+		for i := 1; i <= num; i++ {
+			result = append(result, endpoint.NewEndpointWithTTL(fmt.Sprintf("host%d.%s", i, zone), "A", 300, "1.1.1.1"))
+		}
+		return result
+	}
+	guard := DeletionGuard{MaxDeletions: 5, MaxDeletionPercent: 50}
+
+	type testCase struct {
+		name         string
+		changes      *plan.Changes
+		guard        DeletionGuard
+		zonePolicies map[string]string
+		grants       []string
+		deleted      int
+		refused      bool
+	}
+
+	testCases := []testCase{
+		{
+			name:    "below the limits",
+			changes: &plan.Changes{Delete: append(deletions("test1.com", 4), deletions("test2.com", 4)...)},
+			guard:   guard,
+			deleted: 8,
+		},
+		{
+			name:    "limits exceeded",
+			changes: &plan.Changes{Delete: append(deletions("test1.com", 4), deletions("test2.com", 6)...)},
+			guard:   guard,
+			refused: true,
+		},
+		{
+			name:    "disabled",
+			changes: &plan.Changes{Delete: deletions("test2.com", 10)},
+			deleted: 10,
+		},
+		{
+			name:         "deletions refused by the zone policy",
+			changes:      &plan.Changes{Delete: deletions("test2.com", 10)},
+			guard:        guard,
+			zonePolicies: map[string]string{"test2.com": ZonePolicyUpsertOnly},
+		},
+		{
+			name:    "overridden by the environment",
+			changes: &plan.Changes{Delete: deletions("test2.com", 6)},
+			guard:   DeletionGuard{MaxDeletions: 5, Override: true},
+			deleted: 6,
+		},
+		{
+			name:    "overridden for the zone",
+			changes: &plan.Changes{Delete: deletions("test2.com", 6)},
+			guard:   guard,
+			grants:  []string{"test2.com"},
+			deleted: 6,
+		},
+		{
+			name:    "overridden for every zone",
+			changes: &plan.Changes{Delete: deletions("test2.com", 6)},
+			guard:   guard,
+			grants:  []string{""},
+			deleted: 6,
+		},
+		{
+			name:    "overridden for another zone",
+			changes: &plan.Changes{Delete: deletions("test2.com", 6)},
+			guard:   guard,
+			grants:  []string{"test1.com"},
+			refused: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api.deleted = nil
+			overrides := override.New("s3cret", time.Minute)
+			for _, zone := range tc.grants {
+				overrides.Grant(zone)
+			}
+			provider, m := testProvider()
+			provider.zonePolicies = tc.zonePolicies
+			provider.deletionGuard = tc.guard
+			provider.overrides = overrides
+
+			err := provider.ApplyChanges(context.Background(), tc.changes)
+			if tc.refused {
+				if err == nil || !strings.Contains(err.Error(), "refusing to delete 6 of the 10 records of zone test2.com") {
+					t.Errorf("Expected the changes to be refused, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if deleted := len(api.deleted); deleted != tc.deleted {
+				t.Errorf("Want %d records deleted, got %d", tc.deleted, deleted)
+			}
+			expected := 0
+			if tc.refused {
+				expected = 1
+			}
+			if blocked := m.value("mass_deletions_blocked_total", "default", "test2.com"); blocked != expected || m.total("mass_deletions_blocked_total") != expected {
+				t.Errorf("Want %d batches blocked for test2.com, got %d", expected, blocked)
+			}
+		})
+	}
+}
+
+func TestDeletionOverrideOneShot(t *testing.T) {
+	recordMap := cloudns.RecordMap{}
+	for i := 1; i <= 10; i++ {
+		recordMap[i] = cloudns.Record{ID: i, Host: fmt.Sprintf("host%d", i), Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300}
+	}
+
+	mockAPI(t, []cloudns.Zone{{Name: "test1.com"}}, map[string]cloudns.RecordMap{"test1.com": recordMap})
+
+	overrides := override.New("s3cret", time.Minute)
+	overrides.Grant("test1.com")
+	provider, _ := testProvider()
+	provider.deletionGuard = DeletionGuard{MaxDeletions: 5}
+	provider.overrides = overrides
+	changes := &plan.Changes{}
+	for i := 1; i <= 6; i++ {
+		changes.Delete = append(changes.Delete, endpoint.NewEndpointWithTTL(fmt.Sprintf("host%d.test1.com", i), "A", 300, "1.1.1.1"))
+	}
+
+	// Validating the changes before they are queued does not use the override
+	if err := provider.ValidateChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := provider.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The override is used by the first batch only
+	if err := provider.ApplyChanges(context.Background(), changes); err == nil {
+		t.Error("Expected the second batch to be refused")
+	}
+}
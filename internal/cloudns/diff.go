@@ -0,0 +1,114 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"external-dns-cloudns-webhook/internal/audit"
+
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/pkg/apis/externaldns"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/registry/txt"
+)
+
+// Registry is the configuration of the ExternalDNS TXT registry the ownership
+// of the records is resolved with, as given by the --txt-owner-id,
+// --txt-prefix, --txt-suffix and --txt-wildcard-replacement flags.
+type Registry struct {
+	OwnerID             string
+	Prefix              string
+	Suffix              string
+	WildcardReplacement string
+}
+
+// Diff compares the desired endpoints with the records in ClouDNS and returns
+// the changes a synchronization of ExternalDNS would make to reach the desired
+// state, without applying them. As in ExternalDNS, the ownership of the
+// records is resolved from the TXT registry records: only the records owned by
+// the owner ID are updated or deleted, and the registry records follow the
+// records they own.
+// If an error occurs while retrieving the records or resolving the changes, it is returned.
+func (p *ClouDNSProvider) Diff(ctx context.Context, desired []*endpoint.Endpoint, registry Registry) ([]audit.Event, error) {
+	planner, recorder := p.planner()
+	txtRegistry, err := txt.New(&externaldns.Config{
+		TXTOwnerID:             registry.OwnerID,
+		TXTPrefix:              registry.Prefix,
+		TXTSuffix:              registry.Suffix,
+		TXTWildcardReplacement: registry.WildcardReplacement,
+		ManagedDNSRecordTypes:  p.managedRecordTypes(),
+	}, planner)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TXT registry configuration: %w", err)
+	}
+
+	current, err := txtRegistry.Records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	desired, err = planner.AdjustEndpointsContext(ctx, desired)
+	if err != nil {
+		return nil, err
+	}
+
+	calculated := (&plan.Plan{
+		Current:        current,
+		Desired:        desired,
+		Policies:       []plan.Policy{&plan.SyncPolicy{}},
+		ManagedRecords: recordTypes(current, desired),
+		OwnerID:        txtRegistry.OwnerID(),
+	}).Calculate()
+	if !calculated.Changes.HasChanges() {
+		return recorder.Events(), nil
+	}
+
+	if err := txtRegistry.ApplyChanges(ctx, calculated.Changes); err != nil {
+		return nil, fmt.Errorf("error planning changes: %w", err)
+	}
+	return recorder.Events(), nil
+}
+
+// PlanChanges resolves the changes to the ClouDNS zones, hosts and record IDs
+// by running ApplyChanges in dry-run mode, and returns the changes as the
+// audit events that would be recorded. All the changes are planned, even if
+// ApplyChanges would defer some of them.
+func (p *ClouDNSProvider) PlanChanges(ctx context.Context, changes *plan.Changes) ([]audit.Event, error) {
+	planner, recorder := p.planner()
+	if err := planner.applyChanges(ctx, changes); err != nil {
+		return nil, fmt.Errorf("error planning changes: %w", err)
+	}
+	return recorder.Events(), nil
+}
+
+// planner returns a copy of the provider that only plans the changes: they are
+// applied in dry-run mode and recorded by the returned recorder alone, none is
+// deferred and the one-shot overrides of the deletion guard are checked
+// without being used.
+func (p *ClouDNSProvider) planner() (*ClouDNSProvider, *audit.Memory) {
+	recorder := &audit.Memory{}
+	planner := *p
+	planner.dryRun = true
+	planner.planning = true
+	planner.auditor = recorder
+	planner.reports = nil
+	planner.maxChangesPerBatch = 0
+	return &planner, recorder
+}
+
+// recordTypes returns the sorted record types of the endpoints.
+func recordTypes(endpointLists ...[]*endpoint.Endpoint) []string {
+	found := map[string]bool{}
+	for _, endpoints := range endpointLists {
+		for _, ep := range endpoints {
+			found[ep.RecordType] = true
+		}
+	}
+
+	result := make([]string, 0, len(found))
+	for recordType := range found {
+		result = append(result, recordType)
+	}
+	sort.Strings(result)
+	return result
+}
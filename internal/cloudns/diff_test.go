@@ -0,0 +1,182 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/override"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// diffRecords are the records of test1.com: old, www and same are owned by
+// the default owner, other by another owner, while the apex NS, manual and
+// _dmarc records are not managed by ExternalDNS.
+var diffRecords = cloudns.RecordMap{
+	1:  {ID: 1, Host: "", Record: "ns1.cloudns.net", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+	2:  {ID: 2, Host: "old", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300},
+	3:  {ID: 3, Host: "a-old", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	4:  {ID: 4, Host: "www", Record: "3.3.3.3", RecordType: cloudns.RecordTypeA, TTL: 300},
+	5:  {ID: 5, Host: "a-www", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	6:  {ID: 6, Host: "same", Record: "4.4.4.4", RecordType: cloudns.RecordTypeA, TTL: 300},
+	7:  {ID: 7, Host: "a-same", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	8:  {ID: 8, Host: "other", Record: "6.6.6.6", RecordType: cloudns.RecordTypeA, TTL: 300},
+	9:  {ID: 9, Host: "a-other", Record: ownerTXT("other"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	10: {ID: 10, Host: "manual", Record: "9.9.9.9", RecordType: cloudns.RecordTypeA, TTL: 300},
+	11: {ID: 11, Host: "_dmarc", Record: "v=DMARC1; p=none", RecordType: cloudns.RecordTypeTXT, TTL: 300},
+}
+
+// TestDiff verifies that the differences between the desired endpoints and
+// the ClouDNS records owned by the registry owner are resolved to zones, hosts
+// and record IDs without changing anything.
+func TestDiff(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": diffRecords})
+
+	provider, _ := testProvider()
+	provider.defaultTTL = 3600
+
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("new.test1.com", "A", 300, "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "5.5.5.5"),
+		endpoint.NewEndpointWithTTL("same.test1.com", "A", 300, "4.4.4.4"),
+	}
+	events, err := provider.Diff(context.Background(), desired, Registry{OwnerID: "default"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The records of other owners and the unmanaged ones are left alone,
+	// while the registry records follow the records they own
+	owner := "\"" + ownerTXT("default") + "\""
+	expected := []audit.Event{
+		{
+			Change:  metrics.ChangeCreate,
+			Account: "default",
+			Zone:    "test1.com",
+			Name:    "new.test1.com",
+			Host:    "new",
+			Type:    "A",
+			After:   &audit.RecordSet{Targets: []string{"1.1.1.1"}, TTL: 300},
+			DryRun:  true,
+		},
+		{
+			Change:  metrics.ChangeCreate,
+			Account: "default",
+			Zone:    "test1.com",
+			Name:    "a-new.test1.com",
+			Host:    "a-new",
+			Type:    "TXT",
+			After:   &audit.RecordSet{Targets: []string{owner}, TTL: 60},
+			DryRun:  true,
+		},
+		{
+			Change:    metrics.ChangeDelete,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "old.test1.com",
+			Host:      "old",
+			Type:      "A",
+			RecordIDs: []int{2},
+			Before:    &audit.RecordSet{Targets: []string{"2.2.2.2"}, TTL: 300},
+			DryRun:    true,
+		},
+		{
+			Change:    metrics.ChangeDelete,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "a-old.test1.com",
+			Host:      "a-old",
+			Type:      "TXT",
+			RecordIDs: []int{3},
+			Before:    &audit.RecordSet{Targets: []string{owner}},
+			DryRun:    true,
+		},
+		{
+			Change:    metrics.ChangeUpdate,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "www.test1.com",
+			Host:      "www",
+			Type:      "A",
+			RecordIDs: []int{4},
+			Before:    &audit.RecordSet{Targets: []string{"3.3.3.3"}, TTL: 300},
+			After:     &audit.RecordSet{Targets: []string{"5.5.5.5"}, TTL: 300},
+			DryRun:    true,
+		},
+		{
+			Change:    metrics.ChangeUpdate,
+			Account:   "default",
+			Zone:      "test1.com",
+			Name:      "a-www.test1.com",
+			Host:      "a-www",
+			Type:      "TXT",
+			RecordIDs: []int{5},
+			Before:    &audit.RecordSet{Targets: []string{owner}},
+			After:     &audit.RecordSet{Targets: []string{owner}, TTL: 60},
+			DryRun:    true,
+		},
+	}
+	if !reflect.DeepEqual(expected, events) {
+		t.Errorf("Want events %+v, got %+v", expected, events)
+	}
+	if provider.dryRun {
+		t.Error("the provider must not be left in dry-run mode")
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("Expected no record to be written, got %v", changes)
+	}
+
+	// No drift when the desired state matches the owned records
+	desired = []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("old.test1.com", "A", 300, "2.2.2.2"),
+		endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "3.3.3.3"),
+		endpoint.NewEndpointWithTTL("same.test1.com", "A", 300, "4.4.4.4"),
+	}
+	events, err = provider.Diff(context.Background(), desired, Registry{OwnerID: "default"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(events) != 0 {
+		t.Errorf("Want no events, got %+v", events)
+	}
+}
+
+func TestDiffRegistryError(t *testing.T) {
+	provider, _ := testProvider()
+	if _, err := provider.Diff(context.Background(), nil, Registry{}); err == nil {
+		t.Error("Expected an error for an empty owner ID")
+	}
+}
+
+// TestDiffOverrides verifies that planning checks the one-shot overrides of
+// the deletion guard without using them.
+func TestDiffOverrides(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": diffRecords})
+
+	overrides := override.New("s3cret", time.Minute)
+	overrides.Grant("test1.com")
+	provider, _ := testProvider()
+	provider.deletionGuard = DeletionGuard{MaxDeletions: 1}
+	provider.overrides = overrides
+
+	for i := 0; i < 2; i++ {
+		events, err := provider.Diff(context.Background(), nil, Registry{OwnerID: "default"})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(events) != 6 {
+			t.Errorf("Want the owned records and their registry records deleted, got %+v", events)
+		}
+	}
+	if !overrides.Granted([]string{"test1.com"}) {
+		t.Error("the override must not be used by planning")
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("Expected no record to be written, got %v", changes)
+	}
+}
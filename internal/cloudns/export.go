@@ -0,0 +1,187 @@
+package cloudns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+)
+
+// maxTXTStringLength is the maximum length of a single character string in a
+// TXT record (RFC 1035, section 3.3).
+const maxTXTStringLength = 255
+
+// ZoneExport is the snapshot of a zone managed by the provider: its SOA and
+// all of its records.
+type ZoneExport struct {
+	Name    string
+	SOA     cloudns.SOA
+	Records []cloudns.Record
+}
+
+// ExportZones returns a snapshot of every zone matching the domain filters,
+// with the records sorted by host, type and value.
+// If an error occurs while retrieving the zones, the records or the SOA, it is returned.
+func (p *ClouDNSProvider) ExportZones(ctx context.Context) ([]ZoneExport, error) {
+	zoneRecordMap, err := p.zoneRecordMap(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting records: %w", err)
+	}
+
+	accountZones, err := p.accountZones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting zones: %w", err)
+	}
+
+	result := []ZoneExport{}
+	for _, az := range accountZones {
+		soa, err := getSOA(az.account, ctx, az.zone.Name)
+		if err != nil {
+			return nil, fmt.Errorf("error getting SOA of %s: %w", az.zone.Name, err)
+		}
+
+		records := []cloudns.Record{}
+		for _, record := range zoneRecordMap[az.zone.Name] {
+			records = append(records, record)
+		}
+		sort.Slice(records, func(i, j int) bool {
+			a, b := records[i], records[j]
+			if zoneFileHost(a.Host) != zoneFileHost(b.Host) {
+				return zoneFileHost(a.Host) < zoneFileHost(b.Host)
+			}
+			if a.RecordType != b.RecordType {
+				return a.RecordType < b.RecordType
+			}
+			if a.Record != b.Record {
+				return a.Record < b.Record
+			}
+			return a.ID < b.ID
+		})
+
+		result = append(result, ZoneExport{Name: az.zone.Name, SOA: soa, Records: records})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// WriteZoneFile writes the zone in the RFC 1035 master file format. Records
+// that cannot be represented in that format, such as web redirects, and
+// disabled records are written as comments.
+func (z ZoneExport) WriteZoneFile(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "$ORIGIN %s\n", fqdn(z.Name))
+	fmt.Fprintf(bw, "$TTL %d\n", z.SOA.DefaultTTL)
+	fmt.Fprintf(bw, "@\t%d\tIN\tSOA\t%s %s (\n", z.SOA.DefaultTTL, fqdn(z.SOA.PrimaryNS), mailboxName(z.SOA.AdminMail))
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; serial\n", z.SOA.Serial)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; refresh\n", z.SOA.Refresh)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; retry\n", z.SOA.Retry)
+	fmt.Fprintf(bw, "\t\t\t\t%d\t; expire\n", z.SOA.Expire)
+	fmt.Fprintf(bw, "\t\t\t\t%d )\t; minimum\n", z.SOA.DefaultTTL)
+
+	for _, record := range z.Records {
+		data, ok := zoneFileData(record)
+		line := fmt.Sprintf("%s\t%d\tIN\t%s\t%s", zoneFileHost(record.Host), record.TTL, record.RecordType, data)
+		switch {
+		case !ok:
+			line = "; unsupported: " + line
+		case !bool(record.IsActive):
+			line = "; disabled: " + line
+		}
+		fmt.Fprintln(bw, line)
+	}
+
+	return bw.Flush()
+}
+
+// zoneFileHost returns the owner name of a record relative to the origin.
+func zoneFileHost(host string) string {
+	if host == "" {
+		return "@"
+	}
+	return host
+}
+
+// zoneFileData returns the RDATA of a record in the master file format, and
+// false if the record type has no such representation.
+func zoneFileData(record cloudns.Record) (string, bool) {
+	switch record.RecordType {
+	case cloudns.RecordTypeA, cloudns.RecordTypeAAAA:
+		return record.Record, true
+	case cloudns.RecordTypeCNAME, cloudns.RecordTypeNS, cloudns.RecordTypePTR:
+		return fqdn(record.Record), true
+	case cloudns.RecordTypeMX:
+		return fmt.Sprintf("%d %s", record.Priority, fqdn(record.Record)), true
+	case cloudns.RecordTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, fqdn(record.Record)), true
+	case cloudns.RecordTypeTXT, "SPF":
+		return quoteTXT(record.Record), true
+	case cloudns.RecordTypeCAA:
+		return fmt.Sprintf("%d %s %s", record.CAA.Flag, record.CAA.Type, quoteString(record.CAA.Value)), true
+	case cloudns.RecordTypeSSHFP:
+		return fmt.Sprintf("%d %d %s", record.SSHFP.Algorithm, record.SSHFP.Type, record.Record), true
+	case cloudns.RecordTypeTLSA:
+		return fmt.Sprintf("%d %d %d %s", record.TLSA.Usage, record.TLSA.Selector, record.TLSA.MatchingType, record.Record), true
+	case cloudns.RecordTypeNAPTR:
+		replacement := "."
+		if record.NAPTR.Replacement != "" {
+			replacement = fqdn(record.NAPTR.Replacement)
+		}
+		return fmt.Sprintf("%d %d %s %s %s %s", record.NAPTR.Order, record.NAPTR.Preference,
+			quoteString(record.NAPTR.Flags), quoteString(record.NAPTR.Service), quoteString(record.NAPTR.Regexp), replacement), true
+	case cloudns.RecordTypeRP:
+		return fmt.Sprintf("%s %s", mailboxName(record.RP.Mail), fqdn(record.RP.TXT)), true
+	default:
+		return record.Record, false
+	}
+}
+
+// fqdn returns the name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// mailboxName returns the domain name form of an e-mail address, escaping the
+// dots of the local part (RFC 1035, section 8).
+func mailboxName(mail string) string {
+	local, domain, ok := strings.Cut(mail, "@")
+	if !ok {
+		return fqdn(mail)
+	}
+	return strings.ReplaceAll(local, ".", "\\.") + "." + fqdn(domain)
+}
+
+// quoteTXT returns the value of a TXT record as one or more quoted character
+// strings of at most 255 bytes each. A value already enclosed in quotes, as
+// written by ExternalDNS for its ownership records, is quoted only once.
+func quoteTXT(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, "\"") && strings.HasSuffix(value, "\"") {
+		value = value[1 : len(value)-1]
+	}
+
+	chunks := []string{}
+	for len(value) > maxTXTStringLength {
+		chunks = append(chunks, quoteString(value[:maxTXTStringLength]))
+		value = value[maxTXTStringLength:]
+	}
+	chunks = append(chunks, quoteString(value))
+	return strings.Join(chunks, " ")
+}
+
+// quoteString returns the value as a quoted character string, escaping
+// backslashes and quotes.
+func quoteString(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return "\"" + value + "\""
+}
@@ -0,0 +1,147 @@
+package cloudns
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// exportRecordMaps are the records of the zones exported in TestExportZones.
+var exportRecordMaps = map[string]cloudns.RecordMap{
+	"example.com": {
+		1:  {ID: 1, Host: "", Record: "1.2.3.4", RecordType: cloudns.RecordTypeA, TTL: 3600, IsActive: true},
+		2:  {ID: 2, Host: "", Record: "ns1.cloudns.net", RecordType: cloudns.RecordTypeNS, TTL: 3600, IsActive: true},
+		3:  {ID: 3, Host: "", Record: "ns2.cloudns.net.", RecordType: cloudns.RecordTypeNS, TTL: 3600, IsActive: true},
+		4:  {ID: 4, Host: "", Record: "mail.example.com", RecordType: cloudns.RecordTypeMX, TTL: 3600, Priority: 10, IsActive: true},
+		5:  {ID: 5, Host: "www", Record: "example.com", RecordType: cloudns.RecordTypeCNAME, TTL: 300, IsActive: true},
+		6:  {ID: 6, Host: "_sip._tcp", Record: "sip.example.com", RecordType: cloudns.RecordTypeSRV, TTL: 300, Priority: 10, SRV: cloudns.SRV{Weight: 60, Port: 5060}, IsActive: true},
+		7:  {ID: 7, Host: "", Record: "v=spf1 include:_spf.example.com ~all", RecordType: cloudns.RecordTypeTXT, TTL: 3600, IsActive: true},
+		8:  {ID: 8, Host: "www", Record: "\"heritage=external-dns,external-dns/owner=default\"", RecordType: cloudns.RecordTypeTXT, TTL: 60, IsActive: true},
+		9:  {ID: 9, Host: "quote", Record: `say "hi" \o/`, RecordType: cloudns.RecordTypeTXT, TTL: 60, IsActive: true},
+		10: {ID: 10, Host: "long", Record: strings.Repeat("a", 300), RecordType: cloudns.RecordTypeTXT, TTL: 60, IsActive: true},
+		11: {ID: 11, Host: "", Record: "", RecordType: cloudns.RecordTypeCAA, TTL: 3600, CAA: cloudns.CAA{Flag: 0, Type: "issue", Value: "letsencrypt.org"}, IsActive: true},
+		12: {ID: 12, Host: "old", Record: "5.6.7.8", RecordType: cloudns.RecordTypeA, TTL: 300, IsActive: false},
+		13: {ID: 13, Host: "go", Record: "https://example.org", RecordType: cloudns.RecordTypeWebRedirect, TTL: 300, IsActive: true},
+		14: {ID: 14, Host: "", Record: "2001:db8::1", RecordType: cloudns.RecordTypeAAAA, TTL: 3600, IsActive: true},
+	},
+	"sub.example.com": {
+		21: {ID: 21, Host: "api", Record: "10.0.0.1", RecordType: cloudns.RecordTypeA, TTL: 60, IsActive: true},
+	},
+}
+
+// exportSOAs are the SOA records of the zones exported in TestExportZones.
+var exportSOAs = map[string]cloudns.SOA{
+	"example.com": {
+		Serial:     2024010101,
+		PrimaryNS:  "ns1.cloudns.net",
+		AdminMail:  "dns.admin@example.com",
+		Refresh:    7200,
+		Retry:      1800,
+		Expire:     1209600,
+		DefaultTTL: 3600,
+	},
+	"sub.example.com": {
+		Serial:     2024010102,
+		PrimaryNS:  "ns1.cloudns.net.",
+		AdminMail:  "hostmaster@example.com",
+		Refresh:    7200,
+		Retry:      1800,
+		Expire:     1209600,
+		DefaultTTL: 300,
+	},
+}
+
+// TestExportZones compares the exported zone files with the golden files in
+// testdata/export. Run the test with -update to regenerate them.
+func TestExportZones(t *testing.T) {
+	mockAPI(t, []cloudns.Zone{{Name: "sub.example.com"}, {Name: "example.com"}, {Name: "other.com"}}, exportRecordMaps)
+	oriGetSOA := getSOA
+	defer func() { getSOA = oriGetSOA }()
+	getSOA = func(acc *account, ctx context.Context, zoneName string) (cloudns.SOA, error) {
+		return exportSOAs[zoneName], nil
+	}
+
+	provider := &ClouDNSProvider{
+		accounts: []*account{
+			{name: "default", domainFilter: endpoint.NewDomainFilter([]string{"example.com"}), metrics: metrics.NoopMetrics{}},
+		},
+		metrics: metrics.NoopMetrics{},
+	}
+
+	zones, err := provider.ExportZones(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(zones) != 2 || zones[0].Name != "example.com" || zones[1].Name != "sub.example.com" {
+		t.Fatalf("unexpected zones: %+v", zones)
+	}
+
+	for _, zone := range zones {
+		t.Run(zone.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := zone.WriteZoneFile(&buf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			golden := filepath.Join("testdata", "export", zone.Name+".zone")
+			if *update {
+				if err := os.WriteFile(golden, buf.Bytes(), 0o644); err != nil {
+					t.Fatalf("cannot update golden file: %v", err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("cannot read golden file: %v", err)
+			}
+			if buf.String() != string(expected) {
+				t.Errorf("zone file differs from %s:\n%s", golden, buf.String())
+			}
+		})
+	}
+}
+
+// TestExportZonesError verifies that a failure to read the SOA is returned.
+func TestExportZonesError(t *testing.T) {
+	mockAPI(t, []cloudns.Zone{{Name: "example.com"}}, nil)
+	oriGetSOA := getSOA
+	defer func() { getSOA = oriGetSOA }()
+	getSOA = func(acc *account, ctx context.Context, zoneName string) (cloudns.SOA, error) {
+		return cloudns.SOA{}, os.ErrPermission
+	}
+
+	provider := &ClouDNSProvider{
+		accounts: []*account{{name: "default", metrics: metrics.NoopMetrics{}}},
+		metrics:  metrics.NoopMetrics{},
+	}
+
+	_, err := provider.ExportZones(context.Background())
+	if err == nil || err.Error() != "error getting SOA of example.com: permission denied" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestMailboxName tests the conversion of e-mail addresses to domain names.
+func TestMailboxName(t *testing.T) {
+	tests := map[string]string{
+		"hostmaster@example.com":  "hostmaster.example.com.",
+		"dns.admin@example.com":   "dns\\.admin.example.com.",
+		"hostmaster.example.com":  "hostmaster.example.com.",
+		"hostmaster.example.com.": "hostmaster.example.com.",
+	}
+	for mail, expected := range tests {
+		if got := mailboxName(mail); got != expected {
+			t.Errorf("mailboxName(%q): want %q, got %q", mail, expected, got)
+		}
+	}
+}
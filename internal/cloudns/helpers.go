@@ -2,6 +2,7 @@ package cloudns
 
 import (
 	"fmt"
+	"slices"
 	"sort"
 	"strings"
 
@@ -12,6 +13,8 @@ import (
 // mergeEndpointsByNameType takes a slice of endpoints and returns a new slice of endpoints
 // with the endpoints merged based on their DNS name and record type. If no merge occurs,
 // the original slice of endpoints is returned.
+// A merged endpoint has the lowest TTL of its records. If the TTLs of the records differ, the endpoint
+// is marked with mixedTTLProperty, except for the TXT records, whose TTL is not managed.
 // From pkg/digitalocean/provider.go
 func mergeEndpointsByNameType(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
 	endpointsByNameType := map[string][]*endpoint.Endpoint{}
@@ -38,27 +41,39 @@ func mergeEndpointsByNameType(endpoints []*endpoint.Endpoint) []*endpoint.Endpoi
 		dnsName := endpoints[0].DNSName
 		recordType := endpoints[0].RecordType
 		ttl := endpoints[0].RecordTTL
+		mixed := false
 
 		targets := make([]string, len(endpoints))
 		for i, ep := range endpoints {
 			targets[i] = ep.Targets[0]
+			if ep.RecordTTL != ttl {
+				mixed = true
+			}
+			if ep.RecordTTL < ttl {
+				ttl = ep.RecordTTL
+			}
 		}
 
 		e := endpoint.NewEndpoint(dnsName, recordType, targets...)
 		e.RecordTTL = ttl
+		e.ProviderSpecific = slices.Clone(endpoints[0].ProviderSpecific)
+		if mixed && recordType != endpoint.RecordTypeTXT {
+			e.SetProviderSpecificProperty(mixedTTLProperty, "true")
+		}
 		result = append(result, e)
 	}
 
 	return result
 }
 
+// validTTLs are the TTL values accepted by ClouDNS, in ascending order.
+var validTTLs = []string{"60", "300", "900", "1800", "3600", "21600", "43200", "86400", "172800", "259200", "604800", "1209600", "2592000"}
+
 // isValidTTL checks if the given time-to-live (TTL) value is valid.
 // A valid TTL value is a string representation of a positive integer that is one of the following values:
 // "60", "300", "900", "1800", "3600", "21600", "43200", "86400", "172800", "259200", "604800", "1209600", "2592000".
 // The function returns true if the given TTL value is valid and false otherwise.
 func isValidTTL(ttl string) bool {
-	validTTLs := []string{"60", "300", "900", "1800", "3600", "21600", "43200", "86400", "172800", "259200", "604800", "1209600", "2592000"}
-
 	for _, validTTL := range validTTLs {
 		if ttl == validTTL {
 			return true
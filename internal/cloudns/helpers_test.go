@@ -413,3 +413,32 @@ func TestFindZoneForDomainSingleZone(t *testing.T) {
 		})
 	}
 }
+
+// TestMergeEndpointsByNameTypeMixedTTLs tests that a merged endpoint has the
+// lowest TTL of its records, and that mixed TTLs are marked.
+func TestMergeEndpointsByNameTypeMixedTTLs(t *testing.T) {
+	merged := mergeEndpointsByNameType([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("example.com", "A", 3600, "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("example.com", "A", 300, "5.6.7.8"),
+		endpoint.NewEndpointWithTTL("example.com", "A", 900, "9.10.11.12"),
+		endpoint.NewEndpointWithTTL("www.example.com", "A", 300, "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("www.example.com", "A", 300, "5.6.7.8"),
+		endpoint.NewEndpointWithTTL("txt.example.com", "TXT", 60, "\"a\""),
+		endpoint.NewEndpointWithTTL("txt.example.com", "TXT", 300, "\"b\""),
+	})
+	if len(merged) != 3 {
+		t.Fatalf("Expected mergeEndpointsByNameType to return 3 endpoints, got %d", len(merged))
+	}
+
+	type expectation struct {
+		ttl   endpoint.TTL
+		mixed bool
+	}
+	expected := []expectation{{ttl: 300, mixed: true}, {ttl: 300}, {ttl: 60}}
+	for i, ep := range merged {
+		_, mixed := ep.GetProviderSpecificProperty(mixedTTLProperty)
+		if ep.RecordTTL != expected[i].ttl || mixed != expected[i].mixed {
+			t.Errorf("Want TTL %d and mixed %v for %s, got %d and %v", expected[i].ttl, expected[i].mixed, ep.DNSName, ep.RecordTTL, mixed)
+		}
+	}
+}
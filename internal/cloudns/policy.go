@@ -0,0 +1,122 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Zone policies, restricting the changes ApplyChanges makes to a zone.
+const (
+	// ZonePolicyLive applies every change.
+	ZonePolicyLive = "live"
+	// ZonePolicyDryRun logs and audits the changes without applying them.
+	ZonePolicyDryRun = "dry-run"
+	// ZonePolicyReadOnly reports the records but refuses every change.
+	ZonePolicyReadOnly = "read-only"
+	// ZonePolicyCreateOnly applies the creations and refuses updates and
+	// deletions.
+	ZonePolicyCreateOnly = "create-only"
+	// ZonePolicyUpsertOnly applies the creations and updates and refuses the
+	// deletions.
+	ZonePolicyUpsertOnly = "upsert-only"
+)
+
+// zonePolicies are the valid zone policies.
+var zonePolicies = []string{ZonePolicyLive, ZonePolicyDryRun, ZonePolicyReadOnly, ZonePolicyCreateOnly, ZonePolicyUpsertOnly}
+
+// ParseZonePolicies parses a list of zone=policy entries, as given in
+// ZONE_POLICIES, into a map from the zone name to its policy.
+// If an entry is malformed, names an unknown policy or repeats a zone, an error is returned.
+func ParseZonePolicies(entries []string) (map[string]string, error) {
+	policies := map[string]string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		zone, policy, ok := strings.Cut(entry, "=")
+		zone = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(zone)), ".")
+		policy = strings.TrimSpace(policy)
+		if !ok || zone == "" {
+			return nil, fmt.Errorf("ZONE_POLICIES entry '%s' is not valid. Expected <zone>=<policy>", entry)
+		}
+		if !isValidZonePolicy(policy) {
+			return nil, fmt.Errorf("ZONE_POLICIES entry '%s' is not valid. Expected one of '%s' but was: '%s'", entry, strings.Join(zonePolicies, "', '"), policy)
+		}
+		if _, ok := policies[zone]; ok {
+			return nil, fmt.Errorf("zone '%s' is listed more than once in ZONE_POLICIES", zone)
+		}
+		policies[zone] = policy
+	}
+	return policies, nil
+}
+
+// isValidZonePolicy returns true if the policy is one of the known ones.
+func isValidZonePolicy(policy string) bool {
+	for _, p := range zonePolicies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// zonePolicy returns the policy of a zone. Zones without a policy of their
+// own are live, or dry-run when the whole provider is in dry-run mode.
+func (p *ClouDNSProvider) zonePolicy(zone string) string {
+	if policy, ok := p.zonePolicies[zone]; ok {
+		return policy
+	}
+	if p.dryRun {
+		return ZonePolicyDryRun
+	}
+	return ZonePolicyLive
+}
+
+// isDryRun returns true if the changes to a zone with the given policy are
+// only simulated. In dry-run mode the changes to every zone are.
+func (p *ClouDNSProvider) isDryRun(policy string) bool {
+	return p.dryRun || policy == ZonePolicyDryRun
+}
+
+// zonePolicyAllows returns true if the policy allows a change of the given
+// kind. The creations and deletions made by an update are both of kind
+// metrics.ChangeUpdate.
+func zonePolicyAllows(policy, change string) bool {
+	switch policy {
+	case ZonePolicyReadOnly:
+		return false
+	case ZonePolicyCreateOnly:
+		return change == metrics.ChangeCreate
+	case ZonePolicyUpsertOnly:
+		return change != metrics.ChangeDelete
+	default:
+		return true
+	}
+}
+
+// checkZonePolicy returns the policy of the zone and whether it allows the
+// change of the endpoint. Refused changes are logged.
+func (p *ClouDNSProvider) checkZonePolicy(ctx context.Context, change, zone string, ep *endpoint.Endpoint) (string, bool) {
+	policy := p.zonePolicy(zone)
+	if zonePolicyAllows(policy, change) {
+		return policy, true
+	}
+
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"zone":   zone,
+		"host":   ep.DNSName,
+		"type":   ep.RecordType,
+		"change": change,
+		"policy": policy,
+	}).Warnf("Refusing to %s %s %s - zone %s is %s", change, ep.DNSName, ep.RecordType, zone, policy)
+	return policy, false
+}
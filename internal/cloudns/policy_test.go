@@ -0,0 +1,160 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/audit"
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestParseZonePolicies(t *testing.T) {
+	policies, err := ParseZonePolicies([]string{"test1.com=read-only", " Test2.com. = dry-run ", ""})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := map[string]string{"test1.com": ZonePolicyReadOnly, "test2.com": ZonePolicyDryRun}
+	if !reflect.DeepEqual(expected, policies) {
+		t.Errorf("Want %v, got %v", expected, policies)
+	}
+
+	for _, entries := range [][]string{
+		{"test1.com"},
+		{"=live"},
+		{"test1.com=observe"},
+		{"test1.com=live", "test1.com=dry-run"},
+	} {
+		if _, err := ParseZonePolicies(entries); err == nil {
+			t.Errorf("Expected an error for %v", entries)
+		}
+	}
+}
+
+func TestZonePolicyAllows(t *testing.T) {
+	expected := map[string][]string{
+		ZonePolicyLive:       {metrics.ChangeCreate, metrics.ChangeDelete, metrics.ChangeUpdate},
+		ZonePolicyDryRun:     {metrics.ChangeCreate, metrics.ChangeDelete, metrics.ChangeUpdate},
+		ZonePolicyReadOnly:   {},
+		ZonePolicyCreateOnly: {metrics.ChangeCreate},
+		ZonePolicyUpsertOnly: {metrics.ChangeCreate, metrics.ChangeUpdate},
+	}
+	for policy, allowed := range expected {
+		got := []string{}
+		for _, change := range []string{metrics.ChangeCreate, metrics.ChangeDelete, metrics.ChangeUpdate} {
+			if zonePolicyAllows(policy, change) {
+				got = append(got, change)
+			}
+		}
+		if !reflect.DeepEqual(allowed, got) {
+			t.Errorf("Policy %s: want %v allowed, got %v", policy, allowed, got)
+		}
+	}
+}
+
+func TestZonePolicy(t *testing.T) {
+	provider := &ClouDNSProvider{zonePolicies: map[string]string{"test1.com": ZonePolicyCreateOnly}}
+	if policy := provider.zonePolicy("test1.com"); policy != ZonePolicyCreateOnly || provider.isDryRun(policy) {
+		t.Errorf("Want live create-only, got %s (dry run %v)", policy, provider.isDryRun(policy))
+	}
+	if policy := provider.zonePolicy("test2.com"); policy != ZonePolicyLive {
+		t.Errorf("Want live, got %s", policy)
+	}
+
+	// In dry-run mode the restrictions are kept, but nothing is applied
+	provider.dryRun = true
+	if policy := provider.zonePolicy("test1.com"); policy != ZonePolicyCreateOnly || !provider.isDryRun(policy) {
+		t.Errorf("Want dry-run create-only, got %s (dry run %v)", policy, provider.isDryRun(policy))
+	}
+	if policy := provider.zonePolicy("test2.com"); policy != ZonePolicyDryRun {
+		t.Errorf("Want dry-run, got %s", policy)
+	}
+}
+
+func TestApplyChangesZonePolicies(t *testing.T) {
+	zones := []cloudns.Zone{{Name: "live.com"}, {Name: "dry.com"}, {Name: "ro.com"}, {Name: "create.com"}, {Name: "upsert.com"}}
+	recordMap := cloudns.RecordMap{
+		2: {ID: 2, Host: "old", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300},
+		3: {ID: 3, Host: "www", Record: "3.3.3.3", RecordType: cloudns.RecordTypeA, TTL: 300},
+	}
+
+	api := mockAPI(t, zones, sameRecords(recordMap, zones...))
+
+	changes := &plan.Changes{}
+	for _, zone := range zones {
+		changes.Create = append(changes.Create, endpoint.NewEndpointWithTTL("new."+zone.Name, "A", 300, "1.1.1.1"))
+		changes.UpdateOld = append(changes.UpdateOld, endpoint.NewEndpointWithTTL("www."+zone.Name, "A", 300, "3.3.3.3"))
+		changes.UpdateNew = append(changes.UpdateNew, endpoint.NewEndpointWithTTL("www."+zone.Name, "A", 3600, "4.4.4.4"))
+		changes.Delete = append(changes.Delete, endpoint.NewEndpointWithTTL("old."+zone.Name, "A", 300, "2.2.2.2"))
+	}
+
+	recorder := &audit.Memory{}
+	provider, m := testProvider()
+	provider.auditor = recorder
+	provider.zonePolicies = map[string]string{
+		"dry.com":    ZonePolicyDryRun,
+		"ro.com":     ZonePolicyReadOnly,
+		"create.com": ZonePolicyCreateOnly,
+		"upsert.com": ZonePolicyUpsertOnly,
+	}
+
+	if err := provider.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedApplied := []string{
+		"create new create.com A 1.1.1.1",
+		"create new live.com A 1.1.1.1",
+		"create new upsert.com A 1.1.1.1",
+		"create www live.com A 4.4.4.4",
+		"create www upsert.com A 4.4.4.4",
+		"delete old live.com A 2.2.2.2",
+		"delete www live.com A 3.3.3.3",
+		"delete www upsert.com A 3.3.3.3",
+	}
+	if applied := api.changes(); !reflect.DeepEqual(expectedApplied, applied) {
+		t.Errorf("Want applied %v, got %v", expectedApplied, applied)
+	}
+
+	audited := map[string]int{}
+	for _, event := range recorder.Events() {
+		key := event.Zone + " " + event.Change
+		if event.DryRun {
+			key += " dry-run"
+		}
+		audited[key]++
+	}
+	expectedAudited := map[string]int{
+		"live.com create":        1,
+		"live.com update":        1,
+		"live.com delete":        1,
+		"dry.com create dry-run": 1,
+		"dry.com update dry-run": 1,
+		"dry.com delete dry-run": 1,
+		"create.com create":      1,
+		"upsert.com create":      1,
+		"upsert.com update":      1,
+	}
+	if !reflect.DeepEqual(expectedAudited, audited) {
+		t.Errorf("Want audited %v, got %v", expectedAudited, audited)
+	}
+
+	if _, err := provider.Records(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for zone, policy := range map[string]string{
+		"create.com": ZonePolicyCreateOnly,
+		"dry.com":    ZonePolicyDryRun,
+		"live.com":   ZonePolicyLive,
+		"ro.com":     ZonePolicyReadOnly,
+		"upsert.com": ZonePolicyUpsertOnly,
+	} {
+		if m.value("zone_policy", "default", zone, policy) != 1 {
+			t.Errorf("Expected zone %s to be reported as %s", zone, policy)
+		}
+	}
+}
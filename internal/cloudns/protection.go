@@ -0,0 +1,205 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Reasons why a change is refused as protected.
+const (
+	protectedByName      = "name"
+	protectedByType      = "type"
+	protectedByRecordID  = "record_id"
+	protectedByUnmanaged = "unmanaged"
+)
+
+// registryHeritage marks the TXT records written by the ExternalDNS registry.
+const registryHeritage = "heritage=external-dns"
+
+// Protection is the list of records that ApplyChanges never modifies or
+// deletes. New records are created regardless of it.
+//
+// Names are globs matched against the DNS names, as in path.Match, e.g.
+// "_dmarc.*" or "example.com" for the apex only. Types are record types, e.g.
+// "NS". RecordIDs are the IDs of existing ClouDNS records. With Unmanaged, the
+// existing records that do not look created by ExternalDNS are protected: the
+// records without a registry TXT record with the same name, with or without
+// the record type prefix.
+type Protection struct {
+	Names     []string
+	Types     []string
+	RecordIDs []int
+	Unmanaged bool
+}
+
+// Validate checks that the name globs are well formed.
+func (pr Protection) Validate() error {
+	for _, name := range pr.Names {
+		if _, err := path.Match(name, ""); err != nil {
+			return fmt.Errorf("PROTECTED_NAMES entry '%s' is not a valid glob: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// needsRecords returns true if the existing records are needed to decide
+// whether a change is protected.
+func (pr Protection) needsRecords() bool {
+	return len(pr.RecordIDs) > 0 || pr.Unmanaged
+}
+
+// matchName returns true if the DNS name matches one of the protected globs.
+func (pr Protection) matchName(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, pattern := range pr.Names {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// matchType returns true if the record type is protected.
+func (pr Protection) matchType(recordType string) bool {
+	for _, t := range pr.Types {
+		if strings.EqualFold(t, recordType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRecordID returns true if the ID of one of the records is protected.
+func (pr Protection) matchRecordID(records []cloudns.Record) bool {
+	for _, record := range records {
+		for _, id := range pr.RecordIDs {
+			if record.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// reason returns why a change of the endpoint is protected, or an empty string
+// if it is not. The records are the ones of the zone, only needed when the
+// record IDs or the unmanaged records are protected.
+func (pr Protection) reason(ep *endpoint.Endpoint, host string, zoneRecords cloudns.RecordMap) string {
+	if pr.matchName(ep.DNSName) {
+		return protectedByName
+	}
+	if pr.matchType(ep.RecordType) {
+		return protectedByType
+	}
+
+	existing := []cloudns.Record{}
+	for _, record := range zoneRecords {
+		if record.Host == host && string(record.RecordType) == ep.RecordType {
+			existing = append(existing, record)
+		}
+	}
+	if pr.matchRecordID(existing) {
+		return protectedByRecordID
+	}
+	if pr.Unmanaged && len(existing) > 0 && !isManagedRecordSet(ep.RecordType, host, existing, zoneRecords) {
+		return protectedByUnmanaged
+	}
+	return ""
+}
+
+// isManagedRecordSet returns true if the existing records of a host and type
+// look created by ExternalDNS: they are registry TXT records, or a registry
+// TXT record exists for the host, with or without the record type prefix.
+func isManagedRecordSet(recordType, host string, existing []cloudns.Record, zoneRecords cloudns.RecordMap) bool {
+	for _, record := range existing {
+		if record.RecordType == cloudns.RecordTypeTXT && strings.Contains(record.Record, registryHeritage) {
+			return true
+		}
+	}
+
+	owners := ownerHosts(recordType, host)
+	for _, record := range zoneRecords {
+		if record.RecordType != cloudns.RecordTypeTXT || !strings.Contains(record.Record, registryHeritage) {
+			continue
+		}
+		if slices.Contains(owners, record.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerHosts returns the hosts under which the registry TXT records owning the
+// records of a host and type are stored: the host itself, and the host with
+// the record type prefix. The owner of the A records at the zone apex, named
+// "a-" followed by the zone name, is stored under the "adash" host.
+func ownerHosts(recordType, host string) []string {
+	if host == "" {
+		if recordType == endpoint.RecordTypeA {
+			return []string{"", "adash"}
+		}
+		return []string{""}
+	}
+	return []string{host, strings.ToLower(recordType) + "-" + host}
+}
+
+// checkProtection returns true if the change of the endpoint in the zone is
+// allowed by the protection list. Blocked changes are logged and counted.
+// While applying a batch, the records of a zone are listed once for all its
+// endpoints. If an error occurs while retrieving the records of the zone, it
+// is returned.
+func (p *ClouDNSProvider) checkProtection(ctx context.Context, change string, acc *account, zone string, ep *endpoint.Endpoint) (bool, error) {
+	host := ""
+	if ep.DNSName != zone {
+		host = strings.TrimSuffix(ep.DNSName, "."+zone)
+	}
+
+	var zoneRecords cloudns.RecordMap
+	if p.protection.needsRecords() {
+		records, err := p.listZoneRecords(ctx, acc, zone)
+		if err != nil {
+			return false, err
+		}
+		zoneRecords = records
+	}
+
+	reason := p.protection.reason(ep, host, zoneRecords)
+	if reason == "" {
+		return true, nil
+	}
+
+	p.metrics.IncProtectedChangesBlockedTotal(acc.name, zone, reason)
+	logging.FromContext(ctx).WithFields(log.Fields{
+		"zone":   zone,
+		"host":   ep.DNSName,
+		"type":   ep.RecordType,
+		"change": change,
+		"reason": reason,
+	}).Warnf("Refusing to %s %s %s - protected by %s", change, ep.DNSName, ep.RecordType, reason)
+	return false, nil
+}
+
+// listZoneRecords returns the records of the zone. While applying a batch the
+// listing is kept, so that the zone is listed once per batch.
+func (p *ClouDNSProvider) listZoneRecords(ctx context.Context, acc *account, zone string) (cloudns.RecordMap, error) {
+	if records, ok := p.listings[zone]; ok {
+		return records, nil
+	}
+	records, err := listRecords(acc, ctx, zone)
+	if err != nil {
+		return nil, err
+	}
+	if p.listings != nil {
+		p.listings[zone] = records
+	}
+	return records, nil
+}
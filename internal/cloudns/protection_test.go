@@ -0,0 +1,220 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var protectionRecords = cloudns.RecordMap{
+	1:  {ID: 1, Host: "", Record: "ns1.cloudns.net", RecordType: cloudns.RecordTypeNS, TTL: 3600},
+	2:  {ID: 2, Host: "", Record: "10 mail.test1.com", RecordType: cloudns.RecordTypeMX, TTL: 3600},
+	3:  {ID: 3, Host: "_dmarc", Record: "v=DMARC1; p=none", RecordType: cloudns.RecordTypeTXT, TTL: 3600},
+	4:  {ID: 4, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300},
+	5:  {ID: 5, Host: "a-www", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	6:  {ID: 6, Host: "api", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300},
+	7:  {ID: 7, Host: "api", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	8:  {ID: 8, Host: "legacy", Record: "3.3.3.3", RecordType: cloudns.RecordTypeA, TTL: 300},
+	9:  {ID: 9, Host: "", Record: "7.7.7.7", RecordType: cloudns.RecordTypeA, TTL: 300},
+	10: {ID: 10, Host: "adash", Record: ownerTXT("default"), RecordType: cloudns.RecordTypeTXT, TTL: 300},
+	11: {ID: 11, Host: "", Record: "2001:db8::7", RecordType: cloudns.RecordTypeAAAA, TTL: 300},
+}
+
+func TestProtectionReason(t *testing.T) {
+	type testCase struct {
+		name       string
+		protection Protection
+		ep         *endpoint.Endpoint
+		host       string
+		expected   string
+	}
+
+	testCases := []testCase{
+		{
+			name:       "name glob",
+			protection: Protection{Names: []string{"_dmarc.*"}},
+			ep:         endpoint.NewEndpoint("_dmarc.test1.com", "TXT", "v=DMARC1; p=reject"),
+			host:       "_dmarc",
+			expected:   protectedByName,
+		},
+		{
+			name:       "apex name",
+			protection: Protection{Names: []string{"Test1.com"}},
+			ep:         endpoint.NewEndpoint("test1.com", "A", "1.2.3.4"),
+			expected:   protectedByName,
+		},
+		{
+			name:       "apex name does not match subdomains",
+			protection: Protection{Names: []string{"test1.com"}},
+			ep:         endpoint.NewEndpoint("www.test1.com", "A", "1.2.3.4"),
+			host:       "www",
+		},
+		{
+			name:       "type",
+			protection: Protection{Types: []string{"NS", "MX"}},
+			ep:         endpoint.NewEndpoint("test1.com", "MX", "20 backup.test1.com"),
+			expected:   protectedByType,
+		},
+		{
+			name:       "record ID",
+			protection: Protection{RecordIDs: []int{8}},
+			ep:         endpoint.NewEndpoint("legacy.test1.com", "A", "3.3.3.3"),
+			host:       "legacy",
+			expected:   protectedByRecordID,
+		},
+		{
+			name:       "other record ID",
+			protection: Protection{RecordIDs: []int{8}},
+			ep:         endpoint.NewEndpoint("www.test1.com", "A", "1.1.1.1"),
+			host:       "www",
+		},
+		{
+			name:       "unmanaged",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("legacy.test1.com", "A", "3.3.3.3"),
+			host:       "legacy",
+			expected:   protectedByUnmanaged,
+		},
+		{
+			name:       "managed with prefixed registry record",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("www.test1.com", "A", "1.1.1.1"),
+			host:       "www",
+		},
+		{
+			name:       "managed with registry record",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("api.test1.com", "A", "2.2.2.2"),
+			host:       "api",
+		},
+		{
+			name:       "apex managed with registry record",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("test1.com", "A", "7.7.7.7"),
+		},
+		{
+			name:       "apex unmanaged",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("test1.com", "AAAA", "2001:db8::7"),
+			expected:   protectedByUnmanaged,
+		},
+		{
+			name:       "registry record",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("a-www.test1.com", "TXT", "\"heritage=external-dns,external-dns/owner=default\""),
+			host:       "a-www",
+		},
+		{
+			name:       "new record",
+			protection: Protection{Unmanaged: true},
+			ep:         endpoint.NewEndpoint("new.test1.com", "A", "4.4.4.4"),
+			host:       "new",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if reason := tc.protection.reason(tc.ep, tc.host, protectionRecords); reason != tc.expected {
+				t.Errorf("Want reason '%s', got '%s'", tc.expected, reason)
+			}
+		})
+	}
+}
+
+func TestProtectionValidate(t *testing.T) {
+	if err := (Protection{Names: []string{"*.test1.com", "_dmarc.*"}}).Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := (Protection{Names: []string{"[test1.com"}}).Validate(); err == nil {
+		t.Error("Expected an error for a malformed glob")
+	}
+}
+
+func TestApplyChangesProtection(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": protectionRecords})
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("new.test1.com", "A", 300, "4.4.4.4"),
+			endpoint.NewEndpointWithTTL("test1.com", "NS", 3600, "ns2.cloudns.net"),
+		},
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1"),
+			endpoint.NewEndpointWithTTL("legacy.test1.com", "A", 300, "3.3.3.3"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "5.5.5.5"),
+			endpoint.NewEndpointWithTTL("legacy.test1.com", "A", 300, "6.6.6.6"),
+		},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("api.test1.com", "A", 300, "2.2.2.2"),
+			endpoint.NewEndpointWithTTL("test1.com", "MX", 3600, "10 mail.test1.com"),
+			endpoint.NewEndpointWithTTL("_dmarc.test1.com", "TXT", 3600, "v=DMARC1; p=none"),
+		},
+	}
+
+	provider, m := testProvider()
+	provider.defaultTTL = 3600
+	provider.protection = Protection{
+		Names:     []string{"_dmarc.*"},
+		Types:     []string{"NS", "MX"},
+		Unmanaged: true,
+	}
+
+	if err := provider.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The creations are not protected
+	expected := []string{
+		"create  test1.com NS ns2.cloudns.net",
+		"create new test1.com A 4.4.4.4",
+		"create www test1.com A 5.5.5.5",
+		"delete api test1.com A 2.2.2.2",
+		"delete www test1.com A 1.1.1.1",
+	}
+	if applied := api.changes(); !reflect.DeepEqual(expected, applied) {
+		t.Errorf("Want applied %v, got %v", expected, applied)
+	}
+
+	// The update of legacy is refused as a whole, once for its new and once
+	// for its old records
+	blocked := map[string]int{protectedByName: 1, protectedByType: 1, protectedByUnmanaged: 2}
+	for reason, expected := range blocked {
+		if count := m.value("protected_changes_blocked_total", "default", "test1.com", reason); count != expected {
+			t.Errorf("Want %d changes blocked by %s, got %d", expected, reason, count)
+		}
+	}
+}
+
+func TestCheckProtectionListings(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": protectionRecords})
+
+	provider, _ := testProvider()
+	provider.protection = Protection{Unmanaged: true}
+	acc := &account{name: "default"}
+	endpoints := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.test1.com", "A", "1.1.1.1"),
+		endpoint.NewEndpoint("legacy.test1.com", "A", "3.3.3.3"),
+	}
+
+	// Outside a batch the zone is listed for every endpoint, within a batch
+	// only once
+	for p, expected := range map[*ClouDNSProvider]int{provider: len(endpoints), provider.batch(): 1} {
+		api.listings = map[string]int{}
+		for _, ep := range endpoints {
+			if _, err := p.checkProtection(context.Background(), metrics.ChangeDelete, acc, "test1.com", ep); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+		if listings := api.listings["test1.com"]; listings != expected {
+			t.Errorf("Want %d listings, got %d", expected, listings)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cloudns
+
+import (
+	"context"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/recordids"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Results of the lookups in the record ID store.
+const (
+	lookupHit   = "hit"
+	lookupMiss  = "miss"
+	lookupStale = "stale"
+)
+
+// recordIDStore returns the record ID store of the provider, or a store that
+// keeps no ID if there is none.
+func (p *ClouDNSProvider) recordIDStore() recordids.Store {
+	if p.recordIDs == nil {
+		return recordids.Noop{}
+	}
+	return p.recordIDs
+}
+
+// recordKey returns the key of the record of a target in the record ID store.
+// The quotes are trimmed from the TXT targets, which ClouDNS stores without
+// them.
+func recordKey(zone, host, recordType, target string) recordids.Key {
+	if recordType == endpoint.RecordTypeTXT {
+		target = strings.Trim(target, "\\\"")
+	}
+	return recordids.Key{Zone: zone, Host: host, Type: recordType, Target: target}
+}
+
+// storeRecordIDs replaces the IDs of the records of a zone in the record ID
+// store with the listed ones, forgetting the records that do not exist anymore.
+// The ClouDNS API does not return the ID of a created record, so the records
+// are stored when their zone is listed.
+func (p *ClouDNSProvider) storeRecordIDs(zone string, records cloudns.RecordMap) {
+	ids := make(map[recordids.Key]int, len(records))
+	for _, record := range records {
+		ids[recordids.Key{Zone: zone, Host: record.Host, Type: string(record.RecordType), Target: recordTarget(record)}] = record.ID
+	}
+	p.recordIDStore().ReplaceZone(zone, ids)
+}
+
+// withRecordID calls call with the ID of the record of a target and returns
+// the ID, or 0 if the record does not exist.
+//
+// The ID is taken from the record ID store when it is known, without listing
+// any zone: the IDs are replaced at every Records call, which precedes the
+// changes. If the call fails with a stored ID, the ID may be stale, for
+// example because the record was edited or deleted by hand, so it is
+// forgotten and the call is retried once with the ID found by listing the
+// records. Otherwise the record is looked up by listing the records of all the
+// zones. The lookup is counted only when a store is configured.
+func (p *ClouDNSProvider) withRecordID(ctx context.Context, recordType, target, zone, host string, call func(id int) error) (int, error) {
+	store := p.recordIDStore()
+	key := recordKey(zone, host, recordType, target)
+	lookup := lookupMiss
+	if id, ok := store.Get(key); ok {
+		err := call(id)
+		if err == nil {
+			p.countRecordIDLookup(lookupHit)
+			return id, nil
+		}
+		store.Delete(key)
+		logging.FromContext(ctx).WithFields(log.Fields{"zone": zone, "host": host, "type": recordType, "target": target, "record_id": id}).Debugf("Stale record ID %d for %s %s %s: %s", id, host, recordType, target, err)
+		lookup = lookupStale
+	}
+	p.countRecordIDLookup(lookup)
+
+	id, _, err := p.recordFromTarget(ctx, recordType, target, zone, host)
+	if err != nil || id == 0 {
+		return 0, err
+	}
+	if err := call(id); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// countRecordIDLookup counts a lookup in the record ID store, if there is one.
+func (p *ClouDNSProvider) countRecordIDLookup(result string) {
+	if p.recordIDs != nil {
+		p.metrics.IncRecordIDLookupsTotal(result)
+	}
+}
+
+// deleteTarget deletes the record of the given type of a target and returns
+// its ID, or 0 if the record does not exist. In dry-run mode the record is
+// only looked up. See withRecordID for how the ID is found.
+func (p *ClouDNSProvider) deleteTarget(ctx context.Context, acc *account, recordType, target, zone, host string, dryRun bool) (int, error) {
+	return p.withRecordID(ctx, recordType, target, zone, host, func(id int) error {
+		if dryRun {
+			return nil
+		}
+		if err := deleteRecord(acc, ctx, zone, id); err != nil {
+			return err
+		}
+		p.recordIDStore().Delete(recordKey(zone, host, recordType, target))
+		return nil
+	})
+}
+
+// updateTarget rewrites the record of the given type of a target with the
+// given record and returns its ID, or 0 if the record does not exist. In
+// dry-run mode the record is only looked up. See withRecordID for how the ID
+// is found.
+func (p *ClouDNSProvider) updateTarget(ctx context.Context, acc *account, recordType, target, zone, host string, record cloudns.Record, dryRun bool) (int, error) {
+	return p.withRecordID(ctx, recordType, target, zone, host, func(id int) error {
+		if dryRun {
+			return nil
+		}
+		return updateRecord(acc, ctx, zone, id, record)
+	})
+}
@@ -0,0 +1,178 @@
+package cloudns
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/recordids"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestRecordKey(t *testing.T) {
+	key := recordKey("test1.com", "txt", "TXT", "\"heritage=external-dns\"")
+	if key.Target != "heritage=external-dns" {
+		t.Errorf("Expected the quotes to be trimmed, got %s", key.Target)
+	}
+	key = recordKey("test1.com", "www", "A", "1.2.3.4")
+	if expected := (recordids.Key{Zone: "test1.com", Host: "www", Type: "A", Target: "1.2.3.4"}); key != expected {
+		t.Errorf("Want %+v, got %+v", expected, key)
+	}
+}
+
+func TestDeleteRecordsRecordIDStore(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, nil)
+	deleteListed := deleteRecord
+	deleteRecord = func(acc *account, ctx context.Context, zoneName string, recordID int) error {
+		if recordID == 3 {
+			return errors.New("rate limited")
+		}
+		return deleteListed(acc, ctx, zoneName, recordID)
+	}
+
+	type testCase struct {
+		name     string
+		noStore  bool
+		stored   map[recordids.Key]int
+		records  cloudns.RecordMap
+		deleted  []int
+		lists    int
+		result   string
+		expected string
+	}
+
+	www := recordids.Key{Zone: "test1.com", Host: "www", Type: "A", Target: "1.1.1.1"}
+	testCases := []testCase{
+		{
+			name:    "stored ID",
+			stored:  map[recordids.Key]int{www: 1},
+			records: cloudns.RecordMap{1: {ID: 1, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA}},
+			deleted: []int{1},
+			result:  lookupHit,
+		},
+		{
+			name:    "unknown ID",
+			records: cloudns.RecordMap{1: {ID: 1, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA}},
+			deleted: []int{1},
+			lists:   1,
+			result:  lookupMiss,
+		},
+		{
+			name:    "no store",
+			noStore: true,
+			records: cloudns.RecordMap{1: {ID: 1, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA}},
+			deleted: []int{1},
+			lists:   1,
+		},
+		{
+			name:    "stale ID",
+			stored:  map[recordids.Key]int{www: 7},
+			records: cloudns.RecordMap{2: {ID: 2, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA}},
+			deleted: []int{2},
+			lists:   1,
+			result:  lookupStale,
+		},
+		{
+			name:    "stale ID of a deleted record",
+			stored:  map[recordids.Key]int{www: 7},
+			records: cloudns.RecordMap{},
+			deleted: []int{},
+			lists:   1,
+			result:  lookupStale,
+		},
+		{
+			name:     "failed deletion",
+			stored:   map[recordids.Key]int{www: 3},
+			records:  cloudns.RecordMap{3: {ID: 3, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA}},
+			deleted:  []int{},
+			lists:    1,
+			result:   lookupStale,
+			expected: "rate limited",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			api.records = map[string]cloudns.RecordMap{"test1.com": tc.records}
+			api.listings, api.deleted = map[string]int{}, nil
+			store := recordids.NewMemory()
+			store.ReplaceZone("test1.com", tc.stored)
+			provider, m := testProvider()
+			if !tc.noStore {
+				provider.recordIDs = store
+			}
+
+			_, err := provider.deleteRecords(context.Background(), metrics.ChangeDelete, []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1")})
+			if tc.expected == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			} else if tc.expected != "" && (err == nil || err.Error() != tc.expected) {
+				t.Fatalf("Want error %s, got %v", tc.expected, err)
+			}
+
+			if deleted := api.deletedIDs(); !reflect.DeepEqual(tc.deleted, deleted) {
+				t.Errorf("Want deleted %v, got %v", tc.deleted, deleted)
+			}
+			if lists := api.listings["test1.com"]; lists != tc.lists {
+				t.Errorf("Want %d record listings, got %d", tc.lists, lists)
+			}
+			// The ID of a record that failed to be deleted is stored again
+			// when the zone is listed
+			if _, ok := store.Get(www); ok && !tc.noStore && tc.expected == "" {
+				t.Error("Expected the ID of the deleted or stale record to be forgotten")
+			}
+
+			// The lookups are counted only when there is a store
+			expected := 1
+			if tc.noStore {
+				expected = 0
+			}
+			if m.value("record_id_lookups_total", tc.result) != expected || m.total("record_id_lookups_total") != expected {
+				t.Errorf("Want %d %s lookup, got %d of %d", expected, tc.result, m.value("record_id_lookups_total", tc.result), m.total("record_id_lookups_total"))
+			}
+		})
+	}
+}
+
+func TestRecordsRecordIDStore(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{
+		"test1.com": {
+			10: {ID: 10, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300},
+			11: {ID: 11, Host: "txt", Record: "heritage=external-dns", RecordType: cloudns.RecordTypeTXT, TTL: 60},
+		},
+	})
+
+	store := recordids.NewMemory()
+	store.ReplaceZone("test1.com", map[recordids.Key]int{{Zone: "test1.com", Host: "gone", Type: "A", Target: "2.2.2.2"}: 5})
+	provider, _ := testProvider()
+	provider.recordIDs = store
+	if _, err := provider.Records(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if id, _ := store.Get(recordKey("test1.com", "www", "A", "1.1.1.1")); id != 10 {
+		t.Errorf("Want ID 10, got %d", id)
+	}
+	if id, _ := store.Get(recordKey("test1.com", "txt", "TXT", "\"heritage=external-dns\"")); id != 11 {
+		t.Errorf("Want ID 11, got %d", id)
+	}
+	if _, ok := store.Get(recordids.Key{Zone: "test1.com", Host: "gone", Type: "A", Target: "2.2.2.2"}); ok {
+		t.Error("Expected the ID of a record not listed anymore to be forgotten")
+	}
+
+	// The update deletes the old record by its stored ID
+	err := provider.ApplyChanges(context.Background(), &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "3.3.3.3")},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if deleted := api.deletedIDs(); !reflect.DeepEqual([]int{10}, deleted) {
+		t.Errorf("Want deleted [10], got %v", deleted)
+	}
+}
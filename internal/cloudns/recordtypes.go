@@ -0,0 +1,334 @@
+package cloudns
+
+import (
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// defaultManagedRecordTypes are the record types managed when
+// MANAGED_RECORD_TYPES is not set, the ones supported by every ExternalDNS
+// provider.
+var defaultManagedRecordTypes = []string{"A", "AAAA", "CNAME", "SRV", "TXT", "NS"}
+
+// extendedRecordTypes are the record types that can be managed in addition to
+// the default ones. Their targets are in the zone file format, for example
+// `0 issue "letsencrypt.org"` for a CAA record.
+var extendedRecordTypes = []string{
+	string(cloudns.RecordTypeCAA),
+	string(cloudns.RecordTypeNAPTR),
+	string(cloudns.RecordTypeSSHFP),
+	string(cloudns.RecordTypeTLSA),
+}
+
+// caaTags are the CAA property tags accepted by ClouDNS.
+var caaTags = []string{"issue", "issuewild", "iodef"}
+
+// naptrFlagsPattern matches the flags of a NAPTR record.
+var naptrFlagsPattern = regexp.MustCompile(`^[A-Za-z0-9]*$`)
+
+// ParseManagedRecordTypes parses the record types given in
+// MANAGED_RECORD_TYPES into a set of upper-cased types.
+// If a type is neither a default nor an extended one, an error is returned.
+func ParseManagedRecordTypes(types []string) (map[string]bool, error) {
+	managed := map[string]bool{}
+	for _, recordType := range types {
+		recordType = strings.ToUpper(strings.TrimSpace(recordType))
+		if recordType == "" {
+			continue
+		}
+		if recordType == "DS" {
+			return nil, fmt.Errorf("MANAGED_RECORD_TYPES cannot contain DS: the ClouDNS client does not support the fields of DS records")
+		}
+		if !isDefaultRecordType(recordType) && !isExtendedRecordType(recordType) {
+			return nil, fmt.Errorf("MANAGED_RECORD_TYPES entry '%s' is not valid. Expected one of '%s'", recordType,
+				strings.Join(append(append([]string{}, defaultManagedRecordTypes...), extendedRecordTypes...), "', '"))
+		}
+		managed[recordType] = true
+	}
+	return managed, nil
+}
+
+// isDefaultRecordType returns true if the record type is managed by default.
+func isDefaultRecordType(recordType string) bool {
+	return provider.SupportedRecordType(recordType)
+}
+
+// isExtendedRecordType returns true if the record type can be managed in
+// addition to the default ones.
+func isExtendedRecordType(recordType string) bool {
+	for _, t := range extendedRecordTypes {
+		if t == recordType {
+			return true
+		}
+	}
+	return false
+}
+
+// isManagedType returns true if the records of the type are managed: the
+// configured types, or the default ones if none is configured.
+func (p *ClouDNSProvider) isManagedType(recordType string) bool {
+	if len(p.managedTypes) == 0 {
+		return isDefaultRecordType(recordType)
+	}
+	return p.managedTypes[recordType]
+}
+
+// recordTarget returns the target of the endpoint of a record: the value of
+// the record, or the zone file data of the records of an extended type.
+func recordTarget(record cloudns.Record) string {
+	if isExtendedRecordType(string(record.RecordType)) {
+		data, _ := zoneFileData(record)
+		return data
+	}
+	return record.Record
+}
+
+// canonicalizeTargets rewrites the targets of a desired endpoint of an
+// extended record type in the zone file format Records reports them in, for
+// example with the CAA value quoted and the hexadecimal data in lower case, so
+// that the plan does not update the endpoint at every synchronization. The
+// targets that become duplicates are dropped, and the invalid ones are kept as
+// they are.
+func canonicalizeTargets(ep *endpoint.Endpoint) {
+	if !isExtendedRecordType(ep.RecordType) {
+		return
+	}
+	targets := make(endpoint.Targets, 0, len(ep.Targets))
+	for _, target := range ep.Targets {
+		if record, err := newRecord(ep.RecordType, "", target, 0); err == nil {
+			target = recordTarget(record)
+		}
+		if !contains(targets, target) {
+			targets = append(targets, target)
+		}
+	}
+	ep.Targets = targets
+}
+
+// newRecord returns the ClouDNS record of a target of an endpoint. The target
+// of an extended record type is parsed and validated.
+// If the target is not valid for the record type, an error is returned.
+func newRecord(recordType, host, target string, ttl int) (cloudns.Record, error) {
+	record := cloudns.Record{
+		Host:       host,
+		Record:     target,
+		RecordType: cloudns.RecordType(recordType),
+		TTL:        ttl,
+	}
+
+	var err error
+	switch cloudns.RecordType(recordType) {
+	case cloudns.RecordTypeCAA:
+		err = parseCAA(&record, target)
+	case cloudns.RecordTypeNAPTR:
+		err = parseNAPTR(&record, target)
+	case cloudns.RecordTypeSSHFP:
+		err = parseSSHFP(&record, target)
+	case cloudns.RecordTypeTLSA:
+		err = parseTLSA(&record, target)
+	}
+	if err != nil {
+		return cloudns.Record{}, fmt.Errorf("invalid %s target '%s': %w", recordType, target, err)
+	}
+	return record, nil
+}
+
+// parseCAA parses a `<flag> <tag> "<value>"` target.
+func parseCAA(record *cloudns.Record, target string) error {
+	fields, err := splitTarget(target, 3)
+	if err != nil {
+		return err
+	}
+	flag, err := parseUint(fields[0], "flag", 255)
+	if err != nil {
+		return err
+	}
+	tag := strings.ToLower(fields[1])
+	if !contains(caaTags, tag) {
+		return fmt.Errorf("tag must be one of '%s', but was: %s", strings.Join(caaTags, "', '"), fields[1])
+	}
+	if fields[2] == "" {
+		return fmt.Errorf("value must not be empty")
+	}
+	record.Record = ""
+	record.CAA = cloudns.CAA{Flag: uint8(flag), Type: tag, Value: fields[2]}
+	return nil
+}
+
+// parseNAPTR parses a `<order> <preference> "<flags>" "<service>" "<regexp>"
+// <replacement>` target.
+func parseNAPTR(record *cloudns.Record, target string) error {
+	fields, err := splitTarget(target, 6)
+	if err != nil {
+		return err
+	}
+	order, err := parseUint(fields[0], "order", 65535)
+	if err != nil {
+		return err
+	}
+	preference, err := parseUint(fields[1], "preference", 65535)
+	if err != nil {
+		return err
+	}
+	if !naptrFlagsPattern.MatchString(fields[2]) {
+		return fmt.Errorf("flags must be alphanumeric, but were: %s", fields[2])
+	}
+	if fields[4] != "" && fields[5] != "." {
+		return fmt.Errorf("either the regexp or the replacement must be empty")
+	}
+	replacement := strings.TrimSuffix(fields[5], ".")
+	record.Record = ""
+	record.NAPTR = cloudns.NAPTR{
+		Order:       uint16(order),
+		Preference:  uint16(preference),
+		Flags:       strings.ToUpper(fields[2]),
+		Service:     fields[3],
+		Regexp:      fields[4],
+		Replacement: replacement,
+	}
+	return nil
+}
+
+// parseSSHFP parses a `<algorithm> <fingerprint type> <fingerprint>` target.
+func parseSSHFP(record *cloudns.Record, target string) error {
+	fields, err := splitTarget(target, 3)
+	if err != nil {
+		return err
+	}
+	algorithm, err := parseUint(fields[0], "algorithm", 6)
+	if err != nil {
+		return err
+	}
+	if algorithm == 0 || algorithm == 5 {
+		return fmt.Errorf("algorithm must be 1, 2, 3, 4 or 6, but was: %d", algorithm)
+	}
+	fpType, err := parseUint(fields[1], "fingerprint type", 2)
+	if err != nil || fpType == 0 {
+		return fmt.Errorf("fingerprint type must be 1 or 2, but was: %s", fields[1])
+	}
+	fingerprint, err := parseHex(fields[2], map[uint64]int{1: 20, 2: 32}[fpType])
+	if err != nil {
+		return err
+	}
+	record.Record = fingerprint
+	record.SSHFP = cloudns.SSHFP{Algorithm: uint8(algorithm), Type: uint8(fpType)}
+	return nil
+}
+
+// parseTLSA parses a `<usage> <selector> <matching type> <data>` target.
+func parseTLSA(record *cloudns.Record, target string) error {
+	fields, err := splitTarget(target, 4)
+	if err != nil {
+		return err
+	}
+	usage, err := parseUint(fields[0], "usage", 3)
+	if err != nil {
+		return err
+	}
+	selector, err := parseUint(fields[1], "selector", 1)
+	if err != nil {
+		return err
+	}
+	matchingType, err := parseUint(fields[2], "matching type", 2)
+	if err != nil {
+		return err
+	}
+	data, err := parseHex(fields[3], map[uint64]int{1: 32, 2: 64}[matchingType])
+	if err != nil {
+		return err
+	}
+	record.Record = data
+	record.TLSA = cloudns.TLSA{Usage: uint8(usage), Selector: uint8(selector), MatchingType: uint8(matchingType)}
+	return nil
+}
+
+// splitTarget splits a target into exactly n fields separated by whitespace.
+// A field enclosed in double quotes can contain whitespace and escaped quotes
+// or backslashes; the quotes are removed.
+func splitTarget(target string, n int) ([]string, error) {
+	fields := []string{}
+	var field strings.Builder
+	inField, quoted, escaped := false, false, false
+	for _, r := range target {
+		switch {
+		case escaped:
+			field.WriteRune(r)
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case quoted && r == '"':
+			quoted = false
+		case !quoted && r == '"' && !inField:
+			quoted, inField = true, true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quoted string")
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	if len(fields) != n {
+		return nil, fmt.Errorf("expected %d fields, but found %d", n, len(fields))
+	}
+	return fields, nil
+}
+
+// parseUint parses a decimal field of the target not greater than max.
+func parseUint(field, name string, max uint64) (uint64, error) {
+	value, err := strconv.ParseUint(field, 10, 64)
+	if err != nil || value > max {
+		return 0, fmt.Errorf("%s must be a number between 0 and %d, but was: %s", name, max, field)
+	}
+	return value, nil
+}
+
+// parseHex validates a hexadecimal field of the target, which must encode
+// size bytes unless size is 0, and returns it in lower case.
+func parseHex(field string, size int) (string, error) {
+	data, err := hex.DecodeString(field)
+	if err != nil || len(data) == 0 {
+		return "", fmt.Errorf("data must be hexadecimal, but was: %s", field)
+	}
+	if size > 0 && len(data) != size {
+		return "", fmt.Errorf("data must be %d bytes long, but was %d bytes long", size, len(data))
+	}
+	return strings.ToLower(field), nil
+}
+
+// contains returns true if the values contain the value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// managedRecordTypes returns the sorted managed record types: the configured
+// types, or the default ones if none is configured.
+func (p *ClouDNSProvider) managedRecordTypes() []string {
+	if len(p.managedTypes) == 0 {
+		return slices.Sorted(slices.Values(defaultManagedRecordTypes))
+	}
+	return slices.Sorted(maps.Keys(p.managedTypes))
+}
@@ -0,0 +1,243 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+const (
+	testSHA1   = "123456789abcdef67890123456789abcdef67890"
+	testSHA256 = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+// recordTypeTestCase is a target of an extended record type, the record it is
+// parsed into, or the expected error.
+type recordTypeTestCase struct {
+	target   string
+	expected cloudns.Record
+	err      string
+}
+
+// testRecordType checks that the targets are parsed into the expected records
+// and that the records are turned back into the same targets.
+func testRecordType(t *testing.T, recordType string, testCases []recordTypeTestCase) {
+	for _, tc := range testCases {
+		t.Run(tc.target, func(t *testing.T) {
+			record, err := newRecord(recordType, "host", tc.target, 3600)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("Want error containing %q, got %v", tc.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			tc.expected.Host, tc.expected.RecordType, tc.expected.TTL = "host", cloudns.RecordType(recordType), 3600
+			if !reflect.DeepEqual(tc.expected, record) {
+				t.Errorf("Want %+v, got %+v", tc.expected, record)
+			}
+			if target := recordTarget(record); !strings.EqualFold(target, tc.target) {
+				t.Errorf("Want target %s, got %s", tc.target, target)
+			}
+		})
+	}
+}
+
+func TestNewRecordCAA(t *testing.T) {
+	testRecordType(t, "CAA", []recordTypeTestCase{
+		{target: `0 issue "letsencrypt.org"`, expected: cloudns.Record{CAA: cloudns.CAA{Flag: 0, Type: "issue", Value: "letsencrypt.org"}}},
+		{target: `128 issuewild "ca.example.net; account=230123"`, expected: cloudns.Record{CAA: cloudns.CAA{Flag: 128, Type: "issuewild", Value: "ca.example.net; account=230123"}}},
+		{target: `0 iodef "mailto:security@example.com"`, expected: cloudns.Record{CAA: cloudns.CAA{Type: "iodef", Value: "mailto:security@example.com"}}},
+		{target: `0 issue`, err: "expected 3 fields, but found 2"},
+		{target: `256 issue "letsencrypt.org"`, err: "flag must be a number between 0 and 255"},
+		{target: `0 tbs "letsencrypt.org"`, err: "tag must be one of 'issue', 'issuewild', 'iodef'"},
+		{target: `0 issue ""`, err: "value must not be empty"},
+		{target: `0 issue "letsencrypt.org`, err: "unterminated quoted string"},
+	})
+}
+
+func TestNewRecordNAPTR(t *testing.T) {
+	testRecordType(t, "NAPTR", []recordTypeTestCase{
+		{
+			target:   `100 10 "S" "SIP+D2U" "" _sip._udp.example.com.`,
+			expected: cloudns.Record{NAPTR: cloudns.NAPTR{Order: 100, Preference: 10, Flags: "S", Service: "SIP+D2U", Replacement: "_sip._udp.example.com"}},
+		},
+		{
+			target:   `10 100 "U" "E2U+sip" "!^.*$!sip:info@example.com!" .`,
+			expected: cloudns.Record{NAPTR: cloudns.NAPTR{Order: 10, Preference: 100, Flags: "U", Service: "E2U+sip", Regexp: "!^.*$!sip:info@example.com!"}},
+		},
+		{target: `100 10 "S" "SIP+D2U" ""`, err: "expected 6 fields, but found 5"},
+		{target: `65536 10 "S" "SIP+D2U" "" _sip._udp.example.com.`, err: "order must be a number between 0 and 65535"},
+		{target: `100 x "S" "SIP+D2U" "" _sip._udp.example.com.`, err: "preference must be a number between 0 and 65535"},
+		{target: `100 10 "S+" "SIP+D2U" "" _sip._udp.example.com.`, err: "flags must be alphanumeric"},
+		{target: `100 10 "U" "E2U+sip" "!^.*$!sip:info@example.com!" sip.example.com.`, err: "either the regexp or the replacement must be empty"},
+	})
+}
+
+func TestNewRecordSSHFP(t *testing.T) {
+	testRecordType(t, "SSHFP", []recordTypeTestCase{
+		{target: "1 1 " + testSHA1, expected: cloudns.Record{Record: testSHA1, SSHFP: cloudns.SSHFP{Algorithm: 1, Type: 1}}},
+		{target: "4 2 " + strings.ToUpper(testSHA256), expected: cloudns.Record{Record: testSHA256, SSHFP: cloudns.SSHFP{Algorithm: 4, Type: 2}}},
+		{target: "1 1", err: "expected 3 fields, but found 2"},
+		{target: "5 1 " + testSHA1, err: "algorithm must be 1, 2, 3, 4 or 6"},
+		{target: "1 3 " + testSHA1, err: "fingerprint type must be 1 or 2"},
+		{target: "1 1 xyz", err: "data must be hexadecimal"},
+		{target: "1 2 " + testSHA1, err: "data must be 32 bytes long, but was 20 bytes long"},
+	})
+}
+
+func TestNewRecordTLSA(t *testing.T) {
+	testRecordType(t, "TLSA", []recordTypeTestCase{
+		{target: "3 1 1 " + testSHA256, expected: cloudns.Record{Record: testSHA256, TLSA: cloudns.TLSA{Usage: 3, Selector: 1, MatchingType: 1}}},
+		{target: "2 0 0 308201", expected: cloudns.Record{Record: "308201", TLSA: cloudns.TLSA{Usage: 2}}},
+		{target: "3 1 1", err: "expected 4 fields, but found 3"},
+		{target: "4 1 1 " + testSHA256, err: "usage must be a number between 0 and 3"},
+		{target: "3 2 1 " + testSHA256, err: "selector must be a number between 0 and 1"},
+		{target: "3 1 3 " + testSHA256, err: "matching type must be a number between 0 and 2"},
+		{target: "3 1 2 " + testSHA256, err: "data must be 64 bytes long, but was 32 bytes long"},
+		{target: "3 1 1 zz", err: "data must be hexadecimal"},
+	})
+}
+
+func TestNewRecordDefaultTypes(t *testing.T) {
+	record, err := newRecord("A", "www", "1.2.3.4", 300)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := cloudns.Record{Host: "www", Record: "1.2.3.4", RecordType: cloudns.RecordTypeA, TTL: 300}
+	if !reflect.DeepEqual(expected, record) {
+		t.Errorf("Want %+v, got %+v", expected, record)
+	}
+}
+
+func TestManagedRecordTypes(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{
+		"test1.com": {
+			1: {ID: 1, Host: "", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300},
+			2: {ID: 2, Host: "", RecordType: cloudns.RecordTypeCAA, TTL: 3600, CAA: cloudns.CAA{Flag: 0, Type: "issue", Value: "letsencrypt.org"}},
+			3: {ID: 3, Host: "_443._tcp.www", Record: testSHA256, RecordType: cloudns.RecordTypeTLSA, TTL: 3600, TLSA: cloudns.TLSA{Usage: 3, Selector: 1, MatchingType: 1}},
+		},
+	})
+
+	provider, _ := testProvider()
+	provider.managedTypes = map[string]bool{"A": true, "CAA": true}
+
+	// The records of the types not managed are skipped
+	endpoints, err := provider.Records(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	targets := map[string]string{}
+	for _, ep := range endpoints {
+		targets[ep.DNSName+" "+ep.RecordType] = strings.Join(ep.Targets, ",")
+	}
+	expected := map[string]string{"test1.com A": "1.1.1.1", "test1.com CAA": `0 issue "letsencrypt.org"`}
+	if !reflect.DeepEqual(expected, targets) {
+		t.Errorf("Want %v, got %v", expected, targets)
+	}
+
+	// The CAA record is updated, while the TLSA one is not managed
+	err = provider.ApplyChanges(context.Background(), &plan.Changes{
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("_443._tcp.api.test1.com", "TLSA", 3600, "3 1 1 "+testSHA256)},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("test1.com", "CAA", 3600, `0 issue "letsencrypt.org"`)},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("test1.com", "CAA", 3600, `0 issue "pki.goog"`)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedCreated := []cloudns.Record{{RecordType: cloudns.RecordTypeCAA, TTL: 3600, CAA: cloudns.CAA{Type: "issue", Value: "pki.goog"}}}
+	if created := api.createdRecords(); !reflect.DeepEqual(expectedCreated, created) {
+		t.Errorf("Want created %+v, got %+v", expectedCreated, created)
+	}
+	if deleted := api.deletedIDs(); !reflect.DeepEqual([]int{2}, deleted) {
+		t.Errorf("Want deleted [2], got %v", deleted)
+	}
+
+	// An invalid target is refused before any record is created
+	api.created = nil
+	err = provider.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("test1.com", "CAA", 3600, `0 issue "pki.goog"`, `0 sell "pki.goog"`)},
+	})
+	if err == nil || err.Error() != `invalid CAA target '0 sell "pki.goog"': tag must be one of 'issue', 'issuewild', 'iodef', but was: sell for test1.com` {
+		t.Errorf("Expected the invalid target to be refused, got %v", err)
+	}
+	if len(api.created) != 0 {
+		t.Errorf("Expected no record to be created, got %+v", api.created)
+	}
+}
+
+func TestAdjustEndpointsCanonicalTargets(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, nil)
+
+	type testCase struct {
+		recordType string
+		targets    []string
+		expected   []string
+	}
+
+	testCases := []testCase{
+		{
+			recordType: "CAA",
+			targets:    []string{"0 ISSUE letsencrypt.org", `0 issue "letsencrypt.org"`},
+			expected:   []string{`0 issue "letsencrypt.org"`},
+		},
+		{
+			recordType: "NAPTR",
+			targets:    []string{`100 10 s SIP+D2U "" _sip._udp.test1.com`},
+			expected:   []string{`100 10 "S" "SIP+D2U" "" _sip._udp.test1.com.`},
+		},
+		{
+			recordType: "SSHFP",
+			targets:    []string{"1 1 " + strings.ToUpper(testSHA1)},
+			expected:   []string{"1 1 " + testSHA1},
+		},
+		{
+			recordType: "TLSA",
+			targets:    []string{"3 1 1 " + strings.ToUpper(testSHA256)},
+			expected:   []string{"3 1 1 " + testSHA256},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.recordType, func(t *testing.T) {
+			provider, _ := testProvider()
+			provider.managedTypes = map[string]bool{tc.recordType: true}
+
+			adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpointWithTTL("x.test1.com", tc.recordType, 3600, tc.targets...)})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(adjusted) != 1 || !reflect.DeepEqual(tc.expected, []string(adjusted[0].Targets)) {
+				t.Fatalf("Want targets %v, got %v", tc.expected, adjusted)
+			}
+
+			// The records created from the adjusted targets are reported with
+			// the same targets
+			recordMap := cloudns.RecordMap{}
+			for i, target := range adjusted[0].Targets {
+				record, err := newRecord(tc.recordType, "x", target, 3600)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				record.ID = i + 1
+				recordMap[record.ID] = record
+			}
+			api.records = map[string]cloudns.RecordMap{"test1.com": recordMap}
+			current, err := provider.Records(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(current) != 1 || !reflect.DeepEqual(tc.expected, []string(current[0].Targets)) {
+				t.Errorf("Want reported targets %v, got %v", tc.expected, current)
+			}
+		})
+	}
+}
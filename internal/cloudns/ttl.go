@@ -0,0 +1,182 @@
+package cloudns
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/metrics"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// mixedTTLProperty is the provider specific property marking the endpoints
+// reported by Records whose records have different TTLs. The desired endpoints
+// never have it, so ExternalDNS plans an update of the record set, which
+// normalizes its TTLs.
+const mixedTTLProperty = "webhook/cloudns-mixed-ttl"
+
+// normalizeTTLs normalizes the record sets with mixed TTLs updated by the
+// changes: the records of the targets that are both in the old and in the new
+// record set are rewritten in place with the TTL of the new one. Creating them
+// again next to the old records would duplicate them.
+//
+// It returns the updates without the rewritten targets, dropping the record
+// sets left without targets, and the rewritten record sets as the changes
+// before and after the update. The updates refused by the zone policy or the
+// protection, or whose TTL is not valid, are left unchanged, so that
+// createRecords and deleteRecords report them.
+// If an error occurs while rewriting the records, it is returned together with
+// the record sets rewritten until then.
+func (p *ClouDNSProvider) normalizeTTLs(ctx context.Context, updateOld, updateNew []*endpoint.Endpoint) ([]*endpoint.Endpoint, []*endpoint.Endpoint, []appliedChange, []appliedChange, error) {
+	olds := map[string]*endpoint.Endpoint{}
+	for _, ep := range updateOld {
+		if _, ok := ep.GetProviderSpecificProperty(mixedTTLProperty); ok {
+			olds[endpointKey(ep)] = ep
+		}
+	}
+	if len(olds) == 0 {
+		return updateOld, updateNew, nil, nil, nil
+	}
+
+	before, after := []appliedChange{}, []appliedChange{}
+	normalized := map[string][]string{}
+	for _, ep := range updateNew {
+		old, ok := olds[endpointKey(ep)]
+		if !ok {
+			continue
+		}
+		oldChange, newChange, err := p.normalizeTTL(ctx, old, ep)
+		before, after = appendChange(before, oldChange), appendChange(after, newChange)
+		if err != nil {
+			return updateOld, updateNew, before, after, err
+		}
+		normalized[endpointKey(ep)] = newChange.targets
+	}
+
+	return withoutTargets(updateOld, normalized), withoutTargets(updateNew, normalized), before, after, nil
+}
+
+// normalizeTTL rewrites with the TTL of the new record set the records of the
+// targets of the old record set that are kept, and returns the changes of the
+// record set before and after the update.
+func (p *ClouDNSProvider) normalizeTTL(ctx context.Context, old, ep *endpoint.Endpoint) (appliedChange, appliedChange, error) {
+	ttl := ep.RecordTTL
+	if ttl == 0 {
+		ttl = endpoint.TTL(p.defaultTTL)
+	}
+	if !isValidTTL(strconv.Itoa(int(ttl))) || !p.isManagedType(ep.RecordType) {
+		return appliedChange{}, appliedChange{}, nil
+	}
+
+	accountZones, err := p.accountZones(ctx)
+	if err != nil {
+		return appliedChange{}, appliedChange{}, err
+	}
+	az, ok := matchAccountZone(ep.DNSName, accountZones)
+	if !ok {
+		return appliedChange{}, appliedChange{}, nil
+	}
+	acc, zone := az.account, az.zone.Name
+	policy := p.zonePolicy(zone)
+	if !zonePolicyAllows(policy, metrics.ChangeUpdate) {
+		return appliedChange{}, appliedChange{}, nil
+	}
+
+	host := ""
+	if ep.DNSName != zone {
+		host = strings.TrimSuffix(ep.DNSName, "."+zone)
+	}
+	var zoneRecords cloudns.RecordMap
+	if p.protection.needsRecords() {
+		if zoneRecords, err = p.listZoneRecords(ctx, acc, zone); err != nil {
+			return appliedChange{}, appliedChange{}, err
+		}
+	}
+	if p.protection.reason(old, host, zoneRecords) != "" || p.protection.reason(ep, host, zoneRecords) != "" {
+		return appliedChange{}, appliedChange{}, nil
+	}
+
+	oldType, newType := p.recordType(old, host == ""), p.recordType(ep, host == "")
+	if oldType != newType {
+		return appliedChange{}, appliedChange{}, nil
+	}
+
+	dryRun := p.isDryRun(policy)
+	before := appliedChange{account: acc.name, zone: zone, host: host, ttl: int64(old.RecordTTL), endpoint: old, dryRun: dryRun}
+	after := appliedChange{account: acc.name, zone: zone, host: host, ttl: int64(ttl), endpoint: ep, dryRun: dryRun}
+	for _, target := range ep.Targets {
+		if !contains(old.Targets, target) {
+			continue
+		}
+		record, err := newRecord(newType, host, target, int(ttl))
+		if err != nil {
+			return before, after, err
+		}
+		id, err := p.updateTarget(ctx, acc, newType, target, zone, host, record, dryRun)
+		if err != nil {
+			return before, after, err
+		}
+		if id == 0 {
+			continue
+		}
+		p.logChange(ctx, dryRun, actUpdateRecord, zone, ep, target, id)
+		before.targets = append(before.targets, target)
+		before.recordIDs = append(before.recordIDs, id)
+		after.targets = append(after.targets, target)
+	}
+
+	return before, after, nil
+}
+
+// withoutTargets returns the endpoints without the given targets, by endpoint
+// key, dropping the endpoints left without targets.
+func withoutTargets(endpoints []*endpoint.Endpoint, targets map[string][]string) []*endpoint.Endpoint {
+	result := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		removed, ok := targets[endpointKey(ep)]
+		if !ok || len(removed) == 0 {
+			result = append(result, ep)
+			continue
+		}
+
+		rest := *ep
+		rest.Targets = endpoint.Targets{}
+		for _, target := range ep.Targets {
+			if !contains(removed, target) {
+				rest.Targets = append(rest.Targets, target)
+			}
+		}
+		if len(rest.Targets) > 0 {
+			result = append(result, &rest)
+		}
+	}
+	return result
+}
+
+// mergeChanges merges the changes of the same record set, which are made in
+// two steps by updateRecords, into a single change.
+func mergeChanges(first, second []appliedChange) []appliedChange {
+	result := append([]appliedChange{}, first...)
+	for _, c := range second {
+		merged := false
+		for i := range result {
+			if changeKey(result[i]) == changeKey(c) {
+				result[i].targets = append(result[i].targets, c.targets...)
+				result[i].recordIDs = append(result[i].recordIDs, c.recordIDs...)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// endpointKey returns the key pairing the old and new endpoints of an update.
+func endpointKey(ep *endpoint.Endpoint) string {
+	return ep.DNSName + " " + ep.RecordType + " " + ep.SetIdentifier
+}
@@ -0,0 +1,133 @@
+package cloudns
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/audit"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// mixedTTLRecords is a record set with mixed TTLs.
+var mixedTTLRecords = cloudns.RecordMap{
+	1: {ID: 1, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300},
+	2: {ID: 2, Host: "www", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 3600},
+}
+
+func TestRecordsMixedTTLs(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": mixedTTLRecords})
+
+	provider, _ := testProvider()
+
+	// The record set is reported deterministically with the lowest TTL
+	current, err := provider.Records(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(current) != 1 || current[0].RecordTTL != 300 {
+		t.Fatalf("Want a single record set with TTL 300, got %v", current)
+	}
+	if value, ok := current[0].GetProviderSpecificProperty(mixedTTLProperty); !ok || value != "true" {
+		t.Errorf("Expected the record set to be marked with mixed TTLs, got %v", current[0].ProviderSpecific)
+	}
+
+	// The desired record set with the lowest TTL is updated all the same
+	desired, err := provider.AdjustEndpoints([]*endpoint.Endpoint{endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1", "2.2.2.2")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	changes := (&plan.Plan{
+		Current:        current,
+		Desired:        desired,
+		Policies:       []plan.Policy{&plan.SyncPolicy{}},
+		ManagedRecords: []string{"A"},
+	}).Calculate().Changes
+	if len(changes.UpdateNew) != 1 {
+		t.Fatalf("Want one update, got %+v", changes)
+	}
+
+	// The records are rewritten in place with the new TTL
+	if err := provider.ApplyChanges(context.Background(), changes); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expectedUpdated := []zoneRecord{
+		{zone: "test1.com", Record: cloudns.Record{ID: 1, Host: "www", Record: "1.1.1.1", RecordType: cloudns.RecordTypeA, TTL: 300}},
+		{zone: "test1.com", Record: cloudns.Record{ID: 2, Host: "www", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 300}},
+	}
+	if !reflect.DeepEqual(expectedUpdated, api.updated) {
+		t.Errorf("Want updated %+v, got %+v", expectedUpdated, api.updated)
+	}
+	if len(api.created) != 0 || len(api.deleted) != 0 {
+		t.Errorf("Expected no record to be created or deleted, got %+v and %+v", api.created, api.deleted)
+	}
+}
+
+func TestUpdateRecordsMixedTTLs(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": mixedTTLRecords})
+
+	recorder := &audit.Memory{}
+	provider, _ := testProvider()
+	provider.auditor = recorder
+
+	err := provider.ApplyChanges(context.Background(), &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1", "2.2.2.2").WithProviderSpecific(mixedTTLProperty, "true"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 900, "2.2.2.2", "3.3.3.3"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The kept target is rewritten, the new one created and the old one deleted
+	if expected := []zoneRecord{{zone: "test1.com", Record: cloudns.Record{ID: 2, Host: "www", Record: "2.2.2.2", RecordType: cloudns.RecordTypeA, TTL: 900}}}; !reflect.DeepEqual(expected, api.updated) {
+		t.Errorf("Want updated %+v, got %+v", expected, api.updated)
+	}
+	if expected := []cloudns.Record{{Host: "www", Record: "3.3.3.3", RecordType: cloudns.RecordTypeA, TTL: 900}}; !reflect.DeepEqual(expected, api.createdRecords()) {
+		t.Errorf("Want created %+v, got %+v", expected, api.created)
+	}
+	if deleted := api.deletedIDs(); !reflect.DeepEqual([]int{1}, deleted) {
+		t.Errorf("Want deleted [1], got %v", deleted)
+	}
+
+	// The update is audited once, with the whole record sets
+	events := recorder.Events()
+	if len(events) != 1 {
+		t.Fatalf("Want 1 audit event, got %+v", events)
+	}
+	event := events[0]
+	if !reflect.DeepEqual([]string{"2.2.2.2", "1.1.1.1"}, event.Before.Targets) || event.Before.TTL != 300 || !reflect.DeepEqual([]int{2, 1}, event.RecordIDs) {
+		t.Errorf("Unexpected record set before the update: %+v, %v", event.Before, event.RecordIDs)
+	}
+	if !reflect.DeepEqual([]string{"2.2.2.2", "3.3.3.3"}, event.After.Targets) || event.After.TTL != 900 {
+		t.Errorf("Unexpected record set after the update: %+v", event.After)
+	}
+}
+
+func TestUpdateRecordsMixedTTLsReadOnlyZone(t *testing.T) {
+	api := mockAPI(t, []cloudns.Zone{mockZones[0]}, map[string]cloudns.RecordMap{"test1.com": mixedTTLRecords})
+
+	provider, _ := testProvider()
+	provider.zonePolicies = map[string]string{"test1.com": ZonePolicyReadOnly}
+
+	err := provider.ApplyChanges(context.Background(), &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1", "2.2.2.2").WithProviderSpecific(mixedTTLProperty, "true"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.1.1.1", "2.2.2.2"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if changes := api.changes(); len(changes) != 0 {
+		t.Errorf("Expected no record to be written, got %v", changes)
+	}
+}
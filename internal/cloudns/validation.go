@@ -0,0 +1,142 @@
+package cloudns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// Reasons why a desired endpoint is dropped or fixed by AdjustEndpoints.
+const (
+	invalidNoTargets    = "no_targets"
+	invalidName         = "invalid_name"
+	invalidNoZone       = "no_zone"
+	invalidCNAMETargets = "multiple_cname_targets"
+	invalidTarget       = "invalid_target"
+	invalidTTL          = "invalid_ttl"
+	invalidExcluded     = "excluded_zone"
+	invalidDelegated    = "delegated"
+)
+
+// Limits of the length of DNS names.
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+// validateEndpoint checks that ClouDNS can represent a desired endpoint, so
+// that createRecords does not fail in the middle of a batch, and that its
+// records would be written in the zone the name belongs to. It returns false
+// if the endpoint must be dropped. A TTL that ClouDNS does not accept is fixed
+// instead, raised to the nearest accepted one. Every dropped or fixed endpoint
+// is logged with a warning and counted by reason. If the records of the zone
+// cannot be retrieved, the endpoint is kept without checking the delegations.
+func (p *ClouDNSProvider) validateEndpoint(ctx context.Context, ep *endpoint.Endpoint, zones *zoneSelection) bool {
+	logger := logging.FromContext(ctx).WithFields(log.Fields{"host": ep.DNSName, "type": ep.RecordType})
+
+	reason, err := p.endpointError(ep, zones.managed)
+	if err == nil {
+		reason, err = zoneError(ctx, ep, zones)
+		if reason == "" && err != nil {
+			logger.Warnf("Keeping %s %s without checking the delegations - %s", ep.DNSName, ep.RecordType, err)
+			err = nil
+		}
+	}
+	if err != nil {
+		p.metrics.IncInvalidEndpointsTotal(reason)
+		logger.WithField("reason", reason).Warnf("Dropping %s %s - %s", ep.DNSName, ep.RecordType, err)
+		return false
+	}
+
+	if ep.RecordTTL != 0 && ep.RecordType != endpoint.RecordTypeTXT && !isValidTTL(strconv.Itoa(int(ep.RecordTTL))) {
+		ttl := nearestValidTTL(ep.RecordTTL)
+		p.metrics.IncInvalidEndpointsTotal(invalidTTL)
+		logger.WithField("reason", invalidTTL).Warnf("Adjusting %s %s - TTL %d is not accepted by ClouDNS, using %d", ep.DNSName, ep.RecordType, ep.RecordTTL, ttl)
+		ep.RecordTTL = ttl
+	}
+
+	return true
+}
+
+// endpointError returns the reason and the error for which ClouDNS cannot
+// represent the endpoint, or a nil error if it can.
+func (p *ClouDNSProvider) endpointError(ep *endpoint.Endpoint, accountZones []accountZone) (string, error) {
+	if len(ep.Targets) == 0 {
+		return invalidNoTargets, fmt.Errorf("no target")
+	}
+	if err := validateName(ep.DNSName); err != nil {
+		return invalidName, err
+	}
+	if _, ok := matchAccountZone(ep.DNSName, accountZones); !ok {
+		return invalidNoZone, fmt.Errorf("no matching zone found")
+	}
+	if ep.RecordType == endpoint.RecordTypeCNAME && len(ep.Targets) > 1 {
+		return invalidCNAMETargets, fmt.Errorf("a CNAME must have a single target, but has %d: %s", len(ep.Targets), strings.Join(ep.Targets, ", "))
+	}
+	if p.isManagedType(ep.RecordType) {
+		for _, target := range ep.Targets {
+			if _, err := newRecord(ep.RecordType, "", target, 0); err != nil {
+				return invalidTarget, err
+			}
+		}
+	}
+	return "", nil
+}
+
+// zoneError returns the reason and the error for which the records of the
+// endpoint would be written in the wrong zone: a child zone excluded by the
+// domain filters, or a subdomain delegated by an NS record, contains the name.
+// The glue records of a delegation are kept in the zone.
+// If an error occurs while retrieving the records of the zone, it is returned
+// with an empty reason.
+func zoneError(ctx context.Context, ep *endpoint.Endpoint, zones *zoneSelection) (string, error) {
+	az, _ := matchAccountZone(ep.DNSName, zones.managed)
+	if zone, ok := excludedZone(ep.DNSName, az.zone.Name, zones.excluded); ok {
+		return invalidExcluded, fmt.Errorf("name belongs to zone %s, which is excluded by the domain filter, not to %s", zone, az.zone.Name)
+	}
+	delegated, ok, err := zones.delegation(ctx, ep.DNSName, ep.RecordType, az)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return invalidDelegated, fmt.Errorf("name is below %s, which zone %s delegates with an NS record", delegated, az.zone.Name)
+	}
+	return "", nil
+}
+
+// validateName checks that a DNS name is not longer than 253 characters and
+// that its labels are neither empty nor longer than 63 characters.
+func validateName(name string) error {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) > maxNameLength {
+		return fmt.Errorf("name is %d characters long, more than %d", len(name), maxNameLength)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return fmt.Errorf("name contains an empty label")
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("label '%s' is %d characters long, more than %d", label, len(label), maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// nearestValidTTL returns the lowest TTL accepted by ClouDNS that is not lower
+// than the given one, or the highest accepted TTL.
+func nearestValidTTL(ttl endpoint.TTL) endpoint.TTL {
+	for _, validTTL := range validTTLs {
+		value, _ := strconv.Atoi(validTTL)
+		if endpoint.TTL(value) >= ttl {
+			return endpoint.TTL(value)
+		}
+	}
+	value, _ := strconv.Atoi(validTTLs[len(validTTLs)-1])
+	return endpoint.TTL(value)
+}
@@ -0,0 +1,148 @@
+package cloudns
+
+import (
+	"strings"
+	"testing"
+
+	cloudns "github.com/ppmathis/cloudns-go"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestNearestValidTTL(t *testing.T) {
+	testCases := map[endpoint.TTL]endpoint.TTL{
+		1:       60,
+		60:      60,
+		61:      300,
+		3000:    3600,
+		2592000: 2592000,
+		9999999: 2592000,
+	}
+	for ttl, expected := range testCases {
+		if actual := nearestValidTTL(ttl); actual != expected {
+			t.Errorf("Want %d for %d, got %d", expected, ttl, actual)
+		}
+	}
+}
+
+func TestAdjustEndpointsValidation(t *testing.T) {
+	mockAPI(t, []cloudns.Zone{mockZones[0]}, nil)
+
+	type testCase struct {
+		name     string
+		endpoint *endpoint.Endpoint
+		kept     bool
+		ttl      endpoint.TTL
+		reason   string
+	}
+
+	longLabel := strings.Repeat("a", 64)
+	testCases := []testCase{
+		{
+			name:     "valid endpoint",
+			endpoint: endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.2.3.4"),
+			kept:     true,
+			ttl:      300,
+		},
+		{
+			name:     "default TTL",
+			endpoint: endpoint.NewEndpoint("www.test1.com", "A", "1.2.3.4"),
+			kept:     true,
+		},
+		{
+			name:     "invalid TTL",
+			endpoint: endpoint.NewEndpointWithTTL("www.test1.com", "A", 120, "1.2.3.4"),
+			kept:     true,
+			ttl:      300,
+			reason:   invalidTTL,
+		},
+		{
+			name:     "TXT TTL",
+			endpoint: endpoint.NewEndpointWithTTL("txt.test1.com", "TXT", 120, "\"text\""),
+			kept:     true,
+			ttl:      120,
+		},
+		{
+			name:     "no target",
+			endpoint: endpoint.NewEndpointWithTTL("www.test1.com", "A", 300),
+			reason:   invalidNoTargets,
+		},
+		{
+			name:     "CNAME with multiple targets",
+			endpoint: endpoint.NewEndpointWithTTL("www.test1.com", "CNAME", 300, "lb1.example.net", "lb2.example.net"),
+			reason:   invalidCNAMETargets,
+		},
+		{
+			name: "label too long",
+			// NewEndpoint refuses the long labels, but the endpoints
+			// received by the webhook are decoded from JSON
+			endpoint: &endpoint.Endpoint{DNSName: longLabel + ".test1.com", RecordType: "A", RecordTTL: 300, Targets: endpoint.Targets{"1.2.3.4"}},
+			reason:   invalidName,
+		},
+		{
+			name:     "empty label",
+			endpoint: endpoint.NewEndpointWithTTL("www..test1.com", "A", 300, "1.2.3.4"),
+			reason:   invalidName,
+		},
+		{
+			name:     "name outside the zones",
+			endpoint: endpoint.NewEndpointWithTTL("www.example.com", "A", 300, "1.2.3.4"),
+			reason:   invalidNoZone,
+		},
+		{
+			name:     "invalid target",
+			endpoint: endpoint.NewEndpointWithTTL("test1.com", "CAA", 300, `0 sell "pki.goog"`),
+			reason:   invalidTarget,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			provider, m := testProvider()
+			provider.managedTypes = map[string]bool{"A": true, "CNAME": true, "TXT": true, "CAA": true}
+
+			adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{tc.endpoint})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.kept {
+				if len(adjusted) != 0 {
+					t.Errorf("Expected the endpoint to be dropped, got %v", adjusted)
+				}
+			} else if len(adjusted) != 1 {
+				t.Errorf("Expected the endpoint to be kept, got %v", adjusted)
+			} else if adjusted[0].RecordTTL != tc.ttl {
+				t.Errorf("Want TTL %d, got %d", tc.ttl, adjusted[0].RecordTTL)
+			}
+
+			expected := 0
+			if tc.reason != "" {
+				expected = 1
+			}
+			if m.value("invalid_endpoints_total", tc.reason) != expected || m.total("invalid_endpoints_total") != expected {
+				t.Errorf("Want %d invalid endpoint with reason '%s', got %d of %d", expected, tc.reason, m.value("invalid_endpoints_total", tc.reason), m.total("invalid_endpoints_total"))
+			}
+		})
+	}
+}
+
+func TestAdjustEndpointsKeepsValidEndpoints(t *testing.T) {
+	mockAPI(t, mockZones, nil)
+
+	provider, _ := testProvider()
+
+	adjusted, err := provider.AdjustEndpoints([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("www.test1.com", "A", 300, "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("bad.test1.com", "A", 300),
+		endpoint.NewEndpointWithTTL("www.test2.com", "CNAME", 300, "www.test1.com"),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	names := []string{}
+	for _, ep := range adjusted {
+		names = append(names, ep.DNSName)
+	}
+	if strings.Join(names, ",") != "www.test1.com,www.test2.com" {
+		t.Errorf("Want www.test1.com,www.test2.com, got %v", names)
+	}
+}
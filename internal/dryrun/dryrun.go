@@ -0,0 +1,112 @@
+/*
+ * Dry run - reports of the changes simulated in dry-run mode.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package dryrun
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/audit"
+
+	"github.com/codingconcepts/env"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options contains the dry-run reports configuration.
+type Options struct {
+	// Number of reports kept in memory
+	Reports int `env:"DRY_RUN_REPORTS" default:"10"`
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// Report is the outcome of an ApplyChanges run in dry-run mode: the changes
+// that would have been applied, with the record IDs that would have been
+// deleted, and the error that stopped the run, if any.
+type Report struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"requestId,omitempty"`
+	Changes   []audit.Event `json:"changes"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// Recorder records dry-run reports.
+type Recorder interface {
+	Add(report Report)
+}
+
+// Reports keeps the latest dry-run reports in memory. It is safe for
+// concurrent use.
+type Reports struct {
+	m       sync.Mutex
+	size    int
+	reports []Report
+}
+
+// NewReports creates a Reports instance keeping at most size reports.
+func NewReports(size int) *Reports {
+	return &Reports{size: size}
+}
+
+// Add adds a report, discarding the oldest one if there are too many.
+func (r *Reports) Add(report Report) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.size <= 0 {
+		return
+	}
+	if report.Changes == nil {
+		report.Changes = []audit.Event{}
+	}
+	r.reports = append(r.reports, report)
+	if len(r.reports) > r.size {
+		r.reports = r.reports[len(r.reports)-r.size:]
+	}
+}
+
+// List returns the reports, the latest first.
+func (r *Reports) List() []Report {
+	r.m.Lock()
+	defer r.m.Unlock()
+	result := make([]Report, 0, len(r.reports))
+	for i := len(r.reports) - 1; i >= 0; i-- {
+		result = append(result, r.reports[i])
+	}
+	return result
+}
+
+// Handler serves the reports as a JSON array, the latest first.
+func (r *Reports) Handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(r.List()); err != nil {
+		log.Warn("Could not answer to a dry-run reports request: ", err.Error())
+	}
+}
@@ -0,0 +1,90 @@
+/*
+ * Dry run - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package dryrun
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"external-dns-cloudns-webhook/internal/audit"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Reports(t *testing.T) {
+	r := NewReports(2)
+	assert.Empty(t, r.List())
+
+	r.Add(Report{RequestID: "first"})
+	r.Add(Report{RequestID: "second"})
+	r.Add(Report{RequestID: "third", Changes: []audit.Event{{Change: "create", Name: "www.alpha.com"}}})
+
+	reports := r.List()
+	assert.Len(t, reports, 2)
+	assert.Equal(t, "third", reports[0].RequestID)
+	assert.Equal(t, "second", reports[1].RequestID)
+	assert.NotNil(t, reports[1].Changes)
+}
+
+func Test_Reports_disabled(t *testing.T) {
+	r := NewReports(0)
+	r.Add(Report{RequestID: "first"})
+	assert.Empty(t, r.List())
+}
+
+func Test_Reports_Handler(t *testing.T) {
+	r := NewReports(5)
+	r.Add(Report{RequestID: "first"})
+	r.Add(Report{
+		RequestID: "second",
+		Changes: []audit.Event{{
+			Change:    "delete",
+			Zone:      "alpha.com",
+			Name:      "www.alpha.com",
+			Host:      "www",
+			Type:      "A",
+			RecordIDs: []int{42},
+			Before:    &audit.RecordSet{Targets: []string{"1.2.3.4"}, TTL: 300},
+			DryRun:    true,
+		}},
+	})
+
+	rec := httptest.NewRecorder()
+	r.Handler(rec, httptest.NewRequest(http.MethodGet, "/debug/dryrun", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var reports []Report
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &reports))
+	assert.Len(t, reports, 2)
+	assert.Equal(t, []int{42}, reports[0].Changes[0].RecordIDs)
+	assert.Empty(t, reports[1].Changes)
+}
+
+func Test_NewOptions(t *testing.T) {
+	options, err := NewOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, 10, options.Reports)
+
+	t.Setenv("DRY_RUN_REPORTS", "3")
+	options, err = NewOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, 3, options.Reports)
+}
@@ -0,0 +1,237 @@
+/*
+ * Health - ClouDNS API health tracking.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package health
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Tracker records the outcome of the calls to the ClouDNS API and derives the
+// upstream health from them. The failures are tracked by account, so that a
+// working account does not hide another one that keeps failing.
+type Tracker struct {
+	m sync.Mutex
+
+	// maxConsecutiveFailures is the number of consecutive failures after
+	// which the webhook is not ready; 0 disables the check.
+	maxConsecutiveFailures int
+	// maxFailureDuration is how long the API may keep failing before the
+	// webhook is not healthy; 0 disables the check.
+	maxFailureDuration time.Duration
+
+	accounts map[string]*accountStatus
+	actions  map[actionKey]*ActionStatus
+
+	// now returns the current time.
+	now func() time.Time
+}
+
+// accountStatus is the health of the API calls of an account.
+type accountStatus struct {
+	consecutiveFailures int
+	lastSuccess         time.Time
+	failingSince        time.Time
+}
+
+// actionKey identifies an API action of an account.
+type actionKey struct {
+	account string
+	action  string
+}
+
+// ActionStatus is the health of a single API action of an account.
+type ActionStatus struct {
+	Account             string     `json:"account"`
+	Action              string     `json:"action"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorTime       *time.Time `json:"lastErrorTime,omitempty"`
+}
+
+// AccountStatus is the health of the API calls of an account.
+type AccountStatus struct {
+	Account             string     `json:"account"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	FailingSince        *time.Time `json:"failingSince,omitempty"`
+}
+
+// Report is a snapshot of the upstream health. The consecutive failures and
+// the failing time are the ones of the account failing the most, and the last
+// success is the latest of all the accounts.
+type Report struct {
+	ConsecutiveFailures int             `json:"consecutiveFailures"`
+	LastSuccess         *time.Time      `json:"lastSuccess,omitempty"`
+	FailingSince        *time.Time      `json:"failingSince,omitempty"`
+	Accounts            []AccountStatus `json:"accounts"`
+	Actions             []ActionStatus  `json:"actions"`
+}
+
+// NewTracker returns a new Tracker with all the checks disabled.
+func NewTracker() *Tracker {
+	return &Tracker{
+		accounts: map[string]*accountStatus{},
+		actions:  map[actionKey]*ActionStatus{},
+		now:      time.Now,
+	}
+}
+
+// SetThresholds sets the thresholds used by IsReady and IsHealthy. A value of
+// 0 disables the corresponding check.
+func (t *Tracker) SetThresholds(maxConsecutiveFailures int, maxFailureDuration time.Duration) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.maxConsecutiveFailures = maxConsecutiveFailures
+	t.maxFailureDuration = maxFailureDuration
+}
+
+// RecordSuccess records a successful API call of an account, which resets the
+// failures of that account only.
+func (t *Tracker) RecordSuccess(account, action string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := t.now()
+	acc := t.account(account)
+	acc.consecutiveFailures = 0
+	acc.lastSuccess = now
+	acc.failingSince = time.Time{}
+
+	status := t.action(account, action)
+	status.ConsecutiveFailures = 0
+	status.LastSuccess = &now
+}
+
+// RecordFailure records a failed API call of an account together with its
+// error.
+func (t *Tracker) RecordFailure(account, action string, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	now := t.now()
+	acc := t.account(account)
+	acc.consecutiveFailures++
+	if acc.failingSince.IsZero() {
+		acc.failingSince = now
+	}
+
+	status := t.action(account, action)
+	status.ConsecutiveFailures++
+	status.LastError = err.Error()
+	status.LastErrorTime = &now
+}
+
+// account returns the status of the given account, creating it if required.
+// The caller must hold the lock.
+func (t *Tracker) account(account string) *accountStatus {
+	status, ok := t.accounts[account]
+	if !ok {
+		status = &accountStatus{}
+		t.accounts[account] = status
+	}
+	return status
+}
+
+// action returns the status of the given action, creating it if required.
+// The caller must hold the lock.
+func (t *Tracker) action(account, action string) *ActionStatus {
+	key := actionKey{account: account, action: action}
+	status, ok := t.actions[key]
+	if !ok {
+		status = &ActionStatus{Account: account, Action: action}
+		t.actions[key] = status
+	}
+	return status
+}
+
+// IsReady returns false if the number of consecutive failed API calls of an
+// account reached the configured threshold.
+func (t *Tracker) IsReady() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.maxConsecutiveFailures == 0 {
+		return true
+	}
+	for _, acc := range t.accounts {
+		if acc.consecutiveFailures >= t.maxConsecutiveFailures {
+			return false
+		}
+	}
+	return true
+}
+
+// IsHealthy returns false if the API calls of an account have been failing,
+// without any success in between, for longer than the configured duration.
+func (t *Tracker) IsHealthy() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.maxFailureDuration == 0 {
+		return true
+	}
+	for _, acc := range t.accounts {
+		if !acc.failingSince.IsZero() && t.now().Sub(acc.failingSince) > t.maxFailureDuration {
+			return false
+		}
+	}
+	return true
+}
+
+// Report returns a snapshot of the upstream health. The accounts are sorted by
+// name, and the actions by account and action.
+func (t *Tracker) Report() Report {
+	t.m.Lock()
+	defer t.m.Unlock()
+	report := Report{
+		Accounts: make([]AccountStatus, 0, len(t.accounts)),
+		Actions:  make([]ActionStatus, 0, len(t.actions)),
+	}
+	for name, acc := range t.accounts {
+		status := AccountStatus{Account: name, ConsecutiveFailures: acc.consecutiveFailures}
+		if !acc.lastSuccess.IsZero() {
+			lastSuccess := acc.lastSuccess
+			status.LastSuccess = &lastSuccess
+			if report.LastSuccess == nil || lastSuccess.After(*report.LastSuccess) {
+				report.LastSuccess = &lastSuccess
+			}
+		}
+		if !acc.failingSince.IsZero() {
+			failingSince := acc.failingSince
+			status.FailingSince = &failingSince
+			if report.FailingSince == nil || failingSince.Before(*report.FailingSince) {
+				report.FailingSince = &failingSince
+			}
+		}
+		report.ConsecutiveFailures = max(report.ConsecutiveFailures, acc.consecutiveFailures)
+		report.Accounts = append(report.Accounts, status)
+	}
+	sort.Slice(report.Accounts, func(i, j int) bool {
+		return report.Accounts[i].Account < report.Accounts[j].Account
+	})
+	for _, status := range t.actions {
+		report.Actions = append(report.Actions, *status)
+	}
+	sort.Slice(report.Actions, func(i, j int) bool {
+		a, b := report.Actions[i], report.Actions[j]
+		if a.Account != b.Account {
+			return a.Account < b.Account
+		}
+		return a.Action < b.Action
+	})
+	return report
+}
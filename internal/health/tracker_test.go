@@ -0,0 +1,157 @@
+/*
+ * Health - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package health
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testAccount = "default"
+	testAction  = "get_zones"
+)
+
+// testClock returns a tracker whose clock can be moved forward by the test.
+func testClock() (*Tracker, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	t := NewTracker()
+	t.now = func() time.Time { return now }
+	return t, &now
+}
+
+func Test_NewTracker(t *testing.T) {
+	first, second := NewTracker(), NewTracker()
+	first.SetThresholds(1, 0)
+	second.SetThresholds(1, 0)
+	first.RecordFailure(testAccount, testAction, fmt.Errorf("failure"))
+
+	assert.False(t, first.IsReady())
+	assert.True(t, second.IsReady())
+	assert.Empty(t, second.Report().Actions)
+}
+
+func Test_Tracker_IsReady(t *testing.T) {
+	type testCase struct {
+		name      string
+		threshold int
+		failures  int
+		success   string
+		expected  bool
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		tr, _ := testClock()
+		tr.SetThresholds(tc.threshold, 0)
+		for i := 0; i < tc.failures; i++ {
+			tr.RecordFailure(testAccount, testAction, fmt.Errorf("failure"))
+		}
+		if tc.success != "" {
+			tr.RecordSuccess(tc.success, testAction)
+		}
+		assert.Equal(t, tc.expected, tr.IsReady())
+	}
+
+	testCases := []testCase{
+		{name: "no calls", threshold: 3, expected: true},
+		{name: "below threshold", threshold: 3, failures: 2, expected: true},
+		{name: "threshold reached", threshold: 3, failures: 3, expected: false},
+		{name: "recovered", threshold: 3, failures: 5, success: testAccount, expected: true},
+		{name: "other account working", threshold: 3, failures: 5, success: "other", expected: false},
+		{name: "check disabled", threshold: 0, failures: 100, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_Tracker_IsHealthy(t *testing.T) {
+	type testCase struct {
+		name      string
+		threshold time.Duration
+		failing   time.Duration
+		success   string
+		expected  bool
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		tr, now := testClock()
+		tr.SetThresholds(0, tc.threshold)
+		tr.RecordFailure(testAccount, testAction, fmt.Errorf("failure"))
+		*now = now.Add(tc.failing)
+		tr.RecordFailure(testAccount, testAction, fmt.Errorf("failure"))
+		if tc.success != "" {
+			tr.RecordSuccess(tc.success, testAction)
+		}
+		assert.Equal(t, tc.expected, tr.IsHealthy())
+	}
+
+	testCases := []testCase{
+		{name: "failing within threshold", threshold: time.Hour, failing: time.Minute, expected: true},
+		{name: "failing beyond threshold", threshold: time.Hour, failing: 2 * time.Hour, expected: false},
+		{name: "recovered", threshold: time.Hour, failing: 2 * time.Hour, success: testAccount, expected: true},
+		{name: "other account working", threshold: time.Hour, failing: 2 * time.Hour, success: "other", expected: false},
+		{name: "check disabled", threshold: 0, failing: 24 * time.Hour, expected: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_Tracker_Report(t *testing.T) {
+	tr, now := testClock()
+	start := *now
+	tr.RecordSuccess("second", "get_records")
+	*now = now.Add(time.Minute)
+	failure := *now
+	tr.RecordFailure("first", "get_zones", fmt.Errorf("timeout"))
+	tr.RecordFailure("first", "get_zones", fmt.Errorf("unauthorized"))
+
+	report := tr.Report()
+
+	assert.Equal(t, 2, report.ConsecutiveFailures)
+	assert.Equal(t, &start, report.LastSuccess)
+	assert.Equal(t, &failure, report.FailingSince)
+	assert.Equal(t, []AccountStatus{
+		{Account: "first", ConsecutiveFailures: 2, FailingSince: &failure},
+		{Account: "second", LastSuccess: &start},
+	}, report.Accounts)
+	assert.Equal(t, []ActionStatus{
+		{
+			Account:             "first",
+			Action:              "get_zones",
+			ConsecutiveFailures: 2,
+			LastError:           "unauthorized",
+			LastErrorTime:       &failure,
+		},
+		{
+			Account:     "second",
+			Action:      "get_records",
+			LastSuccess: &start,
+		},
+	}, report.Actions)
+}
@@ -0,0 +1,114 @@
+/*
+ * Logging - log configuration and correlation IDs.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/codingconcepts/env"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// FormatText is the human readable log format.
+	FormatText = "text"
+	// FormatJSON is the structured log format.
+	FormatJSON = "json"
+
+	// CorrelationIDField is the name of the log field holding the
+	// correlation ID of the webhook request.
+	CorrelationIDField = "correlation_id"
+)
+
+// Options contains the logging configuration.
+type Options struct {
+	// Log format, either "text" or "json"
+	Format string `env:"LOG_FORMAT" default:"text"`
+	// Enables debugging messages
+	Debug bool `env:"CLOUDNS_DEBUG" default:"false"`
+}
+
+// correlationIDKey is the context key of the correlation ID.
+type correlationIDKey struct{}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// Configure sets the format and the level of the standard logger.
+func Configure(options Options) error {
+	switch options.Format {
+	case FormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case FormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("LOG_FORMAT is not valid. Expected one of '%s' or '%s' but was: '%s'", FormatText, FormatJSON, options.Format)
+	}
+
+	if options.Debug {
+		log.SetLevel(log.DebugLevel)
+	} else {
+		log.SetLevel(log.InfoLevel)
+	}
+
+	return nil
+}
+
+// NewCorrelationID returns a new random correlation ID.
+func NewCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Warn("Could not generate a correlation ID: ", err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// WithCorrelationID returns a copy of the context carrying the correlation ID.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationID returns the correlation ID carried by the context, or an
+// empty string if there is none.
+func CorrelationID(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// FromContext returns a log entry of the standard logger that includes the
+// correlation ID carried by the context, if any.
+func FromContext(ctx context.Context) *log.Entry {
+	entry := log.NewEntry(log.StandardLogger())
+	if id := CorrelationID(ctx); id != "" {
+		entry = entry.WithField(CorrelationIDField, id)
+	}
+	return entry
+}
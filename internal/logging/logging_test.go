@@ -0,0 +1,131 @@
+/*
+ * Logging - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewOptions(t *testing.T) {
+	t.Setenv("LOG_FORMAT", "json")
+	t.Setenv("CLOUDNS_DEBUG", "true")
+
+	actual, err := NewOptions()
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Options{Format: "json", Debug: true}, actual)
+}
+
+func Test_Configure(t *testing.T) {
+	type testCase struct {
+		name      string
+		options   Options
+		formatter log.Formatter
+		level     log.Level
+		err       string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		bkpFormatter, bkpLevel := log.StandardLogger().Formatter, log.GetLevel()
+		defer func() {
+			log.SetFormatter(bkpFormatter)
+			log.SetLevel(bkpLevel)
+		}()
+
+		err := Configure(tc.options)
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err)
+			return
+		}
+		assert.NoError(t, err)
+		assert.IsType(t, tc.formatter, log.StandardLogger().Formatter)
+		assert.Equal(t, tc.level, log.GetLevel())
+	}
+
+	testCases := []testCase{
+		{
+			name:      "text",
+			options:   Options{Format: "text"},
+			formatter: &log.TextFormatter{},
+			level:     log.InfoLevel,
+		},
+		{
+			name:      "json with debug",
+			options:   Options{Format: "json", Debug: true},
+			formatter: &log.JSONFormatter{},
+			level:     log.DebugLevel,
+		},
+		{
+			name:    "invalid format",
+			options: Options{Format: "xml"},
+			err:     "LOG_FORMAT is not valid. Expected one of 'text' or 'json' but was: 'xml'",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_NewCorrelationID(t *testing.T) {
+	first := NewCorrelationID()
+	second := NewCorrelationID()
+
+	assert.Len(t, first, 16)
+	assert.NotEqual(t, first, second)
+}
+
+func Test_CorrelationID(t *testing.T) {
+	ctx := WithCorrelationID(context.Background(), "abc")
+
+	assert.Equal(t, "abc", CorrelationID(ctx))
+	assert.Equal(t, "", CorrelationID(context.Background()))
+}
+
+func Test_FromContext(t *testing.T) {
+	buf := &bytes.Buffer{}
+	bkpOut, bkpFormatter := log.StandardLogger().Out, log.StandardLogger().Formatter
+	log.SetOutput(buf)
+	log.SetFormatter(&log.JSONFormatter{})
+	defer func() {
+		log.SetOutput(bkpOut)
+		log.SetFormatter(bkpFormatter)
+	}()
+
+	FromContext(WithCorrelationID(context.Background(), "abc")).WithField("zone", "example.com").Info("CREATE")
+
+	var fields map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.Equal(t, "abc", fields[CorrelationIDField])
+	assert.Equal(t, "example.com", fields["zone"])
+	assert.Equal(t, "CREATE", fields["msg"])
+
+	buf.Reset()
+	FromContext(context.Background()).Info("no request")
+	fields = nil
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+	assert.NotContains(t, fields, CorrelationIDField)
+}
@@ -18,103 +18,522 @@
 package metrics
 
 import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/codingconcepts/env"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// metrics instance
-var metrics *OpenMetrics
+// Kinds of applied changes.
+const (
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// Provider operations whose last success is tracked.
+const (
+	OperationRecords      = "records"
+	OperationApplyChanges = "apply_changes"
+)
+
+// DefaultNamespace is the default prefix of the metric names.
+const DefaultNamespace = "cloudns_webhook"
 
+// defaultApiDurationBuckets are the default buckets in seconds of the
+// api_call_duration_seconds histogram.
+var defaultApiDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// namePattern matches the valid namespaces and subsystems.
+var namePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Options contains the metrics configuration.
+type Options struct {
+	// Namespace prepended to the metric names
+	Namespace string `env:"METRICS_NAMESPACE" default:"cloudns_webhook"`
+	// Subsystem inserted between the namespace and the metric names
+	Subsystem string `env:"METRICS_SUBSYSTEM"`
+	// Buckets in seconds of the API call duration histogram
+	ApiDurationBuckets []float64 `env:"METRICS_API_DURATION_BUCKETS" default:"0.05,0.1,0.25,0.5,1,2.5,5,10,30"`
+	// Also emit the metrics under their legacy, unprefixed names
+	LegacyNames bool `env:"METRICS_LEGACY_NAMES" default:"false"`
+}
+
+// Metrics is the interface used by the provider and the metrics socket to
+// update and expose the metrics.
+type Metrics interface {
+	// GetRegistry returns the registry the metrics are exposed from.
+	GetRegistry() *prometheus.Registry
+	IncSuccessfulApiCallsTotal(account, action string)
+	IncFailedApiCallsTotal(account, action string)
+	SetFilteredOutZones(account string, num int)
+	SetSkippedRecords(account, zone string, num int)
+	AddApiCallDuration(account, action string, duration time.Duration)
+	SetManagedRecords(account, zone string, numByType map[string]int)
+	IncAppliedChangesTotal(account, zone, change string)
+	SetLastSuccess(operation string, t time.Time)
+	AddApplyChangesDuration(duration time.Duration)
+	IncAuditEventsTotal(sink, result string, num int)
+	IncAuditEventsDroppedTotal()
+	SetZonePolicy(account, zone, policy string)
+	IncProtectedChangesBlockedTotal(account, zone, reason string)
+	IncMassDeletionsBlockedTotal(account, zone string)
+	SetDeferredChanges(num int)
+	IncRecordIDLookupsTotal(result string)
+	IncInvalidEndpointsTotal(reason string)
+}
+
+// OpenMetrics implements Metrics with Prometheus collectors registered in a
+// registry of its own. It is safe for concurrent use.
 type OpenMetrics struct {
 	registry *prometheus.Registry
 
 	successfulApiCallsTotal *prometheus.CounterVec
 	failedApiCallsTotal     *prometheus.CounterVec
 
-	filteredOutZones prometheus.Gauge
-	skippedRecords   *prometheus.GaugeVec
-	apiDelayHist     *prometheus.HistogramVec
-}
-
-// GetOpenMetricsInstance returns the current OpenMetrics instance or creates a
-// new one if required.
-func GetOpenMetricsInstance() *OpenMetrics {
-	if metrics == nil {
-		reg := prometheus.NewRegistry()
-		metrics = &OpenMetrics{
-			registry: reg,
-			successfulApiCallsTotal: prometheus.NewCounterVec(
-				prometheus.CounterOpts{
-					Name: "successful_api_calls_total",
-					Help: "The number of successful CLouDNS API calls",
-				},
-				[]string{"action"},
-			),
-			failedApiCallsTotal: prometheus.NewCounterVec(
-				prometheus.CounterOpts{
-					Name: "failed_api_calls_total",
-					Help: "The number of CLouDNS API calls that returned an error",
-				},
-				[]string{"action"},
-			),
-			filteredOutZones: prometheus.NewGauge(prometheus.GaugeOpts{
-				Name: "filtered_out_zones",
-				Help: "The number of zones excluded by the domain filter",
-			}),
-			skippedRecords: prometheus.NewGaugeVec(
-				prometheus.GaugeOpts{
-					Name: "skipped_records",
-					Help: "The number of skipped records per domain",
-				},
-				[]string{"zone"},
-			),
-			apiDelayHist: prometheus.NewHistogramVec(
-				prometheus.HistogramOpts{
-					Name:    "api_delay_hist",
-					Help:    "Histogram of the delay in milliseconds when calling the CLouDNS API",
-					Buckets: []float64{10, 100, 250, 500, 1000, 1500, 2000},
-				},
-				[]string{"action"},
-			),
+	filteredOutZones    *prometheus.GaugeVec
+	skippedRecords      *prometheus.GaugeVec
+	apiCallDurationHist *prometheus.HistogramVec
+
+	managedRecords       *prometheus.GaugeVec
+	appliedChangesTotal  *prometheus.CounterVec
+	lastSuccessTimestamp *prometheus.GaugeVec
+	applyChangesDuration prometheus.Histogram
+
+	auditEventsTotal        *prometheus.CounterVec
+	auditEventsDroppedTotal prometheus.Counter
+
+	zonePolicy                   *prometheus.GaugeVec
+	protectedChangesBlockedTotal *prometheus.CounterVec
+	massDeletionsBlockedTotal    *prometheus.CounterVec
+	deferredChanges              prometheus.Gauge
+	recordIDLookupsTotal         *prometheus.CounterVec
+	invalidEndpointsTotal        *prometheus.CounterVec
+
+	// legacy is only set in compatibility mode
+	legacy *legacyMetrics
+}
+
+// legacyMetrics are the metrics emitted under their legacy names, before the
+// introduction of the namespace.
+type legacyMetrics struct {
+	successfulApiCallsTotal *prometheus.CounterVec
+	failedApiCallsTotal     *prometheus.CounterVec
+	filteredOutZones        *prometheus.GaugeVec
+	skippedRecords          *prometheus.GaugeVec
+	apiDelayHist            *prometheus.HistogramVec
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// DefaultOptions returns the options used when the metrics are not
+// configured through the environment.
+func DefaultOptions() Options {
+	return Options{
+		Namespace:          DefaultNamespace,
+		ApiDurationBuckets: defaultApiDurationBuckets,
+	}
+}
+
+// Validate checks the metric name prefix and the histogram buckets.
+func (o Options) Validate() error {
+	if o.Namespace != "" && !namePattern.MatchString(o.Namespace) {
+		return fmt.Errorf("METRICS_NAMESPACE is not a valid metric name prefix: '%s'", o.Namespace)
+	}
+	if o.Subsystem != "" && !namePattern.MatchString(o.Subsystem) {
+		return fmt.Errorf("METRICS_SUBSYSTEM is not a valid metric name prefix: '%s'", o.Subsystem)
+	}
+	if len(o.ApiDurationBuckets) == 0 {
+		return fmt.Errorf("METRICS_API_DURATION_BUCKETS must contain at least one bucket")
+	}
+	for i := 1; i < len(o.ApiDurationBuckets); i++ {
+		if o.ApiDurationBuckets[i] <= o.ApiDurationBuckets[i-1] {
+			return fmt.Errorf("METRICS_API_DURATION_BUCKETS must be in increasing order, but was: %v", o.ApiDurationBuckets)
 		}
-		reg.MustRegister(metrics.successfulApiCallsTotal)
-		reg.MustRegister(metrics.failedApiCallsTotal)
-		reg.MustRegister(metrics.filteredOutZones)
-		reg.MustRegister(metrics.skippedRecords)
-		reg.MustRegister(metrics.apiDelayHist)
 	}
-	return metrics
+	return nil
+}
+
+// NewOpenMetrics returns a new OpenMetrics instance configured with the given
+// options. Every instance has its own registry, so that any number of them
+// can be created concurrently.
+func NewOpenMetrics(options Options) (*OpenMetrics, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	return newOpenMetrics(options), nil
+}
+
+// newOpenMetrics creates and registers the metrics. The options must be valid.
+func newOpenMetrics(options Options) *OpenMetrics {
+	ns, sub := options.Namespace, options.Subsystem
+	reg := prometheus.NewRegistry()
+	m := &OpenMetrics{
+		registry: reg,
+		successfulApiCallsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "successful_api_calls_total",
+				Help:      "The number of successful CLouDNS API calls",
+			},
+			[]string{"account", "action"},
+		),
+		failedApiCallsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "failed_api_calls_total",
+				Help:      "The number of CLouDNS API calls that returned an error",
+			},
+			[]string{"account", "action"},
+		),
+		filteredOutZones: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "filtered_out_zones",
+				Help:      "The number of zones excluded by the domain filter",
+			},
+			[]string{"account"},
+		),
+		skippedRecords: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "skipped_records",
+				Help:      "The number of skipped records per domain",
+			},
+			[]string{"account", "zone"},
+		),
+		apiCallDurationHist: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "api_call_duration_seconds",
+				Help:      "Histogram of the duration in seconds of the CLouDNS API calls",
+				Buckets:   options.ApiDurationBuckets,
+			},
+			[]string{"account", "action"},
+		),
+		managedRecords: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "managed_records",
+				Help:      "The number of records of a supported type per zone and type",
+			},
+			[]string{"account", "zone", "type"},
+		),
+		appliedChangesTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "applied_changes_total",
+				Help:      "The number of record changes applied per zone and kind of change",
+			},
+			[]string{"account", "zone", "change"},
+		),
+		lastSuccessTimestamp: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "last_success_timestamp_seconds",
+				Help:      "The Unix time of the last successful provider operation",
+			},
+			[]string{"operation"},
+		),
+		applyChangesDuration: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "apply_changes_duration_seconds",
+				Help:      "Histogram of the duration in seconds of a whole ApplyChanges run",
+				Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+			},
+		),
+		auditEventsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "audit_events_total",
+				Help:      "The number of audit events delivered to a sink, by result",
+			},
+			[]string{"sink", "result"},
+		),
+		auditEventsDroppedTotal: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "audit_events_dropped_total",
+				Help:      "The number of audit events dropped without being delivered",
+			},
+		),
+		zonePolicy: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "zone_policy",
+				Help:      "The policy applied to the changes of a zone, set to 1 for the current policy",
+			},
+			[]string{"account", "zone", "policy"},
+		),
+		protectedChangesBlockedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "protected_changes_blocked_total",
+				Help:      "The number of changes refused because the records are protected, by reason",
+			},
+			[]string{"account", "zone", "reason"},
+		),
+		massDeletionsBlockedTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "mass_deletions_blocked_total",
+				Help:      "The number of change batches refused because they delete too many records of a zone",
+			},
+			[]string{"account", "zone"},
+		),
+		deferredChanges: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "deferred_changes",
+				Help:      "The number of changes deferred to the next synchronization by the last ApplyChanges run",
+			},
+		),
+		recordIDLookupsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "record_id_lookups_total",
+				Help:      "The number of record ID lookups in the record ID store, by result",
+			},
+			[]string{"result"},
+		),
+		invalidEndpointsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: ns,
+				Subsystem: sub,
+				Name:      "invalid_endpoints_total",
+				Help:      "The number of desired endpoints dropped or fixed because ClouDNS cannot represent them, by reason",
+			},
+			[]string{"reason"},
+		),
+	}
+	reg.MustRegister(m.successfulApiCallsTotal)
+	reg.MustRegister(m.failedApiCallsTotal)
+	reg.MustRegister(m.filteredOutZones)
+	reg.MustRegister(m.skippedRecords)
+	reg.MustRegister(m.apiCallDurationHist)
+	reg.MustRegister(m.managedRecords)
+	reg.MustRegister(m.appliedChangesTotal)
+	reg.MustRegister(m.lastSuccessTimestamp)
+	reg.MustRegister(m.applyChangesDuration)
+	reg.MustRegister(m.auditEventsTotal)
+	reg.MustRegister(m.auditEventsDroppedTotal)
+	reg.MustRegister(m.zonePolicy)
+	reg.MustRegister(m.protectedChangesBlockedTotal)
+	reg.MustRegister(m.massDeletionsBlockedTotal)
+	reg.MustRegister(m.deferredChanges)
+	reg.MustRegister(m.recordIDLookupsTotal)
+	reg.MustRegister(m.invalidEndpointsTotal)
+
+	if options.LegacyNames {
+		m.legacy = newLegacyMetrics(reg)
+	}
+
+	return m
+}
+
+// newLegacyMetrics creates and registers the metrics under their legacy names.
+func newLegacyMetrics(reg *prometheus.Registry) *legacyMetrics {
+	l := &legacyMetrics{
+		successfulApiCallsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "successful_api_calls_total",
+				Help: "The number of successful CLouDNS API calls (deprecated)",
+			},
+			[]string{"account", "action"},
+		),
+		failedApiCallsTotal: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "failed_api_calls_total",
+				Help: "The number of CLouDNS API calls that returned an error (deprecated)",
+			},
+			[]string{"account", "action"},
+		),
+		filteredOutZones: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "filtered_out_zones",
+				Help: "The number of zones excluded by the domain filter (deprecated)",
+			},
+			[]string{"account"},
+		),
+		skippedRecords: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "skipped_records",
+				Help: "The number of skipped records per domain (deprecated)",
+			},
+			[]string{"account", "zone"},
+		),
+		apiDelayHist: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "api_delay_hist",
+				Help:    "Histogram of the delay in milliseconds when calling the CLouDNS API (deprecated)",
+				Buckets: []float64{10, 100, 250, 500, 1000, 1500, 2000},
+			},
+			[]string{"account", "action"},
+		),
+	}
+	reg.MustRegister(l.successfulApiCallsTotal)
+	reg.MustRegister(l.failedApiCallsTotal)
+	reg.MustRegister(l.filteredOutZones)
+	reg.MustRegister(l.skippedRecords)
+	reg.MustRegister(l.apiDelayHist)
+	return l
 }
 
-// GetRegistry returns the current prometheus registry.
-func (m OpenMetrics) GetRegistry() *prometheus.Registry {
+// GetRegistry returns the prometheus registry of the instance.
+func (m *OpenMetrics) GetRegistry() *prometheus.Registry {
 	return m.registry
 }
 
 // IncSuccessfulApiCallsTotal increments the successful_api_calls_total counter.
-func (m *OpenMetrics) IncSuccessfulApiCallsTotal(action string) {
-	label := prometheus.Labels{"action": action}
+func (m *OpenMetrics) IncSuccessfulApiCallsTotal(account, action string) {
+	label := prometheus.Labels{"account": account, "action": action}
 	m.successfulApiCallsTotal.With(label).Inc()
+	if m.legacy != nil {
+		m.legacy.successfulApiCallsTotal.With(label).Inc()
+	}
 }
 
 // IncFailedApiCallsTotal increments the failed_api_calls_total counter.
-func (m *OpenMetrics) IncFailedApiCallsTotal(action string) {
-	label := prometheus.Labels{"action": action}
+func (m *OpenMetrics) IncFailedApiCallsTotal(account, action string) {
+	label := prometheus.Labels{"account": account, "action": action}
 	m.failedApiCallsTotal.With(label).Inc()
+	if m.legacy != nil {
+		m.legacy.failedApiCallsTotal.With(label).Inc()
+	}
 }
 
 // SetFilteredOutZones sets the value for the filtered_out_zones gauge.
-func (m *OpenMetrics) SetFilteredOutZones(num int) {
-	m.filteredOutZones.Set(float64(num))
+func (m *OpenMetrics) SetFilteredOutZones(account string, num int) {
+	label := prometheus.Labels{"account": account}
+	m.filteredOutZones.With(label).Set(float64(num))
+	if m.legacy != nil {
+		m.legacy.filteredOutZones.With(label).Set(float64(num))
+	}
 }
 
 // SetSkippedRecords sets the value for the skipped_records gauge.
-func (m *OpenMetrics) SetSkippedRecords(zone string, num int) {
-	label := prometheus.Labels{"zone": zone}
+func (m *OpenMetrics) SetSkippedRecords(account, zone string, num int) {
+	label := prometheus.Labels{"account": account, "zone": zone}
 	m.skippedRecords.With(label).Set(float64(num))
+	if m.legacy != nil {
+		m.legacy.skippedRecords.With(label).Set(float64(num))
+	}
+}
+
+// AddApiCallDuration adds a value to the api_call_duration_seconds histogram
+// and, in compatibility mode, to the legacy api_delay_hist one.
+func (m *OpenMetrics) AddApiCallDuration(account, action string, duration time.Duration) {
+	label := prometheus.Labels{"account": account, "action": action}
+	m.apiCallDurationHist.With(label).Observe(duration.Seconds())
+	if m.legacy != nil {
+		m.legacy.apiDelayHist.With(label).Observe(float64(duration.Milliseconds()))
+	}
+}
+
+// SetManagedRecords sets the managed_records gauge of a zone from the number
+// of records per type. Types missing from the map are removed from the zone.
+func (m *OpenMetrics) SetManagedRecords(account, zone string, numByType map[string]int) {
+	m.managedRecords.DeletePartialMatch(prometheus.Labels{"account": account, "zone": zone})
+	for recordType, num := range numByType {
+		label := prometheus.Labels{"account": account, "zone": zone, "type": recordType}
+		m.managedRecords.With(label).Set(float64(num))
+	}
+}
+
+// IncAppliedChangesTotal increments the applied_changes_total counter.
+func (m *OpenMetrics) IncAppliedChangesTotal(account, zone, change string) {
+	label := prometheus.Labels{"account": account, "zone": zone, "change": change}
+	m.appliedChangesTotal.With(label).Inc()
+}
+
+// SetLastSuccess sets the last_success_timestamp_seconds gauge of an
+// operation.
+func (m *OpenMetrics) SetLastSuccess(operation string, t time.Time) {
+	label := prometheus.Labels{"operation": operation}
+	m.lastSuccessTimestamp.With(label).Set(float64(t.UnixNano()) / 1e9)
+}
+
+// AddApplyChangesDuration adds a value to the apply_changes_duration_seconds
+// histogram.
+func (m *OpenMetrics) AddApplyChangesDuration(duration time.Duration) {
+	m.applyChangesDuration.Observe(duration.Seconds())
+}
+
+// IncAuditEventsTotal adds the number of events delivered to a sink to the
+// audit_events_total counter.
+func (m *OpenMetrics) IncAuditEventsTotal(sink, result string, num int) {
+	label := prometheus.Labels{"sink": sink, "result": result}
+	m.auditEventsTotal.With(label).Add(float64(num))
+}
+
+// IncAuditEventsDroppedTotal increments the audit_events_dropped_total
+// counter.
+func (m *OpenMetrics) IncAuditEventsDroppedTotal() {
+	m.auditEventsDroppedTotal.Inc()
+}
+
+// SetZonePolicy sets the zone_policy gauge of a zone to 1 for the given
+// policy, removing the policy the zone had before.
+func (m *OpenMetrics) SetZonePolicy(account, zone, policy string) {
+	m.zonePolicy.DeletePartialMatch(prometheus.Labels{"account": account, "zone": zone})
+	m.zonePolicy.With(prometheus.Labels{"account": account, "zone": zone, "policy": policy}).Set(1)
+}
+
+// IncProtectedChangesBlockedTotal increments the
+// protected_changes_blocked_total counter.
+func (m *OpenMetrics) IncProtectedChangesBlockedTotal(account, zone, reason string) {
+	label := prometheus.Labels{"account": account, "zone": zone, "reason": reason}
+	m.protectedChangesBlockedTotal.With(label).Inc()
+}
+
+// IncMassDeletionsBlockedTotal increments the mass_deletions_blocked_total
+// counter.
+func (m *OpenMetrics) IncMassDeletionsBlockedTotal(account, zone string) {
+	label := prometheus.Labels{"account": account, "zone": zone}
+	m.massDeletionsBlockedTotal.With(label).Inc()
+}
+
+// SetDeferredChanges sets the deferred_changes gauge.
+func (m *OpenMetrics) SetDeferredChanges(num int) {
+	m.deferredChanges.Set(float64(num))
+}
+
+// IncRecordIDLookupsTotal increments the record_id_lookups_total counter.
+func (m *OpenMetrics) IncRecordIDLookupsTotal(result string) {
+	m.recordIDLookupsTotal.With(prometheus.Labels{"result": result}).Inc()
 }
 
-// AddApiDelayHist adds a value to the api_delay_hist histogram.
-func (m *OpenMetrics) AddApiDelayHist(action string, delay int64) {
-	label := prometheus.Labels{"action": action}
-	m.apiDelayHist.With(label).Observe(float64(delay))
+// IncInvalidEndpointsTotal increments the invalid_endpoints_total counter.
+func (m *OpenMetrics) IncInvalidEndpointsTotal(reason string) {
+	m.invalidEndpointsTotal.With(prometheus.Labels{"reason": reason}).Inc()
 }
@@ -18,88 +18,549 @@
 package metrics
 
 import (
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
 const (
-	testAction = "test_action"
-	testZone   = "alpha.com"
+	testAccount = "default"
+	testAction  = "test_action"
+	testZone    = "alpha.com"
 )
 
-func Test_GetOpenMetricsInstance(t *testing.T) {
-	type testCase struct {
-		name    string
-		metrics *OpenMetrics
-	}
+// legacyOptions returns the default options with the legacy names enabled.
+func legacyOptions() Options {
+	options := DefaultOptions()
+	options.LegacyNames = true
+	return options
+}
 
-	run := func(t *testing.T, tc testCase) {
-		actual := GetOpenMetricsInstance()
-		if tc.metrics != nil {
-			assert.EqualValues(t, metrics, actual)
-		} else {
-			assert.NotNil(t, metrics)
-		}
-	}
+func Test_NewOpenMetrics(t *testing.T) {
+	first, err := NewOpenMetrics(DefaultOptions())
+	assert.NoError(t, err)
+	assert.NotNil(t, first)
+	second, err := NewOpenMetrics(DefaultOptions())
+	assert.NoError(t, err)
 
-	testCases := []testCase{
-		{
-			name:    "new instance required",
-			metrics: nil,
-		},
-		{
-			name:    "existing instance",
-			metrics: &OpenMetrics{},
-		},
-	}
+	// Instances do not share their registry
+	first.IncSuccessfulApiCallsTotal(testAccount, testAction)
+	assert.Equal(t, float64(1), testutil.ToFloat64(first.successfulApiCallsTotal))
+	assert.Equal(t, float64(0), testutil.ToFloat64(second.successfulApiCallsTotal.WithLabelValues(testAccount, testAction)))
+	assert.NotSame(t, first.GetRegistry(), second.GetRegistry())
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			run(t, tc)
-		})
+	_, err = NewOpenMetrics(Options{})
+	assert.EqualError(t, err, "METRICS_API_DURATION_BUCKETS must contain at least one bucket")
+}
+
+func Test_NewOpenMetrics_concurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m, err := NewOpenMetrics(DefaultOptions())
+			assert.NoError(t, err)
+			m.IncFailedApiCallsTotal(testAccount, testAction)
+			assert.Equal(t, float64(1), testutil.ToFloat64(m.failedApiCallsTotal))
+		}()
 	}
+	wg.Wait()
+}
+
+func Test_NoopMetrics(t *testing.T) {
+	var m Metrics = NoopMetrics{}
+
+	m.IncSuccessfulApiCallsTotal(testAccount, testAction)
+	m.SetManagedRecords(testAccount, testZone, map[string]int{"A": 1})
+
+	families, err := m.GetRegistry().Gather()
+	assert.NoError(t, err)
+	assert.Empty(t, families)
 }
 
 func Test_OpenMetrics_IncSuccessfulApiCallsTotal(t *testing.T) {
-	metrics = nil
+	m := newOpenMetrics(legacyOptions())
 	expected := float64(1)
 
-	GetOpenMetricsInstance().IncSuccessfulApiCallsTotal(testAction)
-	actual := testutil.ToFloat64(metrics.successfulApiCallsTotal)
+	m.IncSuccessfulApiCallsTotal(testAccount, testAction)
+	actual := testutil.ToFloat64(m.successfulApiCallsTotal)
 
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected, testutil.ToFloat64(m.legacy.successfulApiCallsTotal))
 }
 
 func Test_OpenMetrics_IncFailedApiCallsTotal(t *testing.T) {
-	metrics = nil
+	m := newOpenMetrics(legacyOptions())
 	expected := float64(1)
 
-	GetOpenMetricsInstance().IncFailedApiCallsTotal(testAction)
-	actual := testutil.ToFloat64(metrics.failedApiCallsTotal)
+	m.IncFailedApiCallsTotal(testAccount, testAction)
+	actual := testutil.ToFloat64(m.failedApiCallsTotal)
 
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected, testutil.ToFloat64(m.legacy.failedApiCallsTotal))
 }
 
 func Test_OpenMetrics_SetFilteredOutZones(t *testing.T) {
-	metrics = nil
+	m := newOpenMetrics(legacyOptions())
 	const val = 5
 	expected := float64(val)
 
-	GetOpenMetricsInstance().SetFilteredOutZones(val)
-	actual := testutil.ToFloat64(metrics.filteredOutZones)
+	m.SetFilteredOutZones(testAccount, val)
+	actual := testutil.ToFloat64(m.filteredOutZones)
 
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected, testutil.ToFloat64(m.legacy.filteredOutZones))
 }
 
 func Test_OpenMetrics_SetSkippedRecords(t *testing.T) {
-	metrics = nil
+	m := newOpenMetrics(legacyOptions())
 	const val = 5
 	expected := float64(val)
 
-	GetOpenMetricsInstance().SetSkippedRecords(testZone, val)
-	actual := testutil.ToFloat64(metrics.skippedRecords)
+	m.SetSkippedRecords(testAccount, testZone, val)
+	actual := testutil.ToFloat64(m.skippedRecords)
 
 	assert.Equal(t, expected, actual)
+	assert.Equal(t, expected, testutil.ToFloat64(m.legacy.skippedRecords))
+}
+
+func Test_OpenMetrics_accountLabel(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncSuccessfulApiCallsTotal("first", testAction)
+	m.IncSuccessfulApiCallsTotal("second", testAction)
+	m.IncSuccessfulApiCallsTotal("second", testAction)
+	m.AddApiCallDuration("second", testAction, 20*time.Millisecond)
+	m.SetFilteredOutZones("first", 1)
+	m.SetFilteredOutZones("second", 3)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.successfulApiCallsTotal.WithLabelValues("first", testAction)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.successfulApiCallsTotal.WithLabelValues("second", testAction)))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.apiCallDurationHist))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.filteredOutZones.WithLabelValues("first")))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.filteredOutZones.WithLabelValues("second")))
+}
+
+func Test_OpenMetrics_SetManagedRecords(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.SetManagedRecords(testAccount, testZone, map[string]int{"A": 3, "TXT": 2})
+	m.SetManagedRecords(testAccount, "beta.com", map[string]int{"A": 1})
+	assert.Equal(t, 3, testutil.CollectAndCount(m.managedRecords))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.managedRecords.WithLabelValues(testAccount, testZone, "A")))
+
+	// Types no longer present are removed, other zones are left alone
+	m.SetManagedRecords(testAccount, testZone, map[string]int{"A": 4})
+	assert.Equal(t, 2, testutil.CollectAndCount(m.managedRecords))
+	assert.Equal(t, float64(4), testutil.ToFloat64(m.managedRecords.WithLabelValues(testAccount, testZone, "A")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.managedRecords.WithLabelValues(testAccount, "beta.com", "A")))
+}
+
+func Test_OpenMetrics_IncAppliedChangesTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncAppliedChangesTotal(testAccount, testZone, ChangeCreate)
+	m.IncAppliedChangesTotal(testAccount, testZone, ChangeCreate)
+	m.IncAppliedChangesTotal(testAccount, testZone, ChangeDelete)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.appliedChangesTotal.WithLabelValues(testAccount, testZone, ChangeCreate)))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.appliedChangesTotal.WithLabelValues(testAccount, testZone, ChangeDelete)))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.appliedChangesTotal.WithLabelValues(testAccount, testZone, ChangeUpdate)))
+}
+
+func Test_OpenMetrics_SetLastSuccess(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.SetLastSuccess(OperationRecords, time.Unix(1700000000, 500000000))
+
+	assert.Equal(t, 1700000000.5, testutil.ToFloat64(m.lastSuccessTimestamp.WithLabelValues(OperationRecords)))
+	assert.Equal(t, 1, testutil.CollectAndCount(m.lastSuccessTimestamp))
+}
+
+func Test_OpenMetrics_AddApplyChangesDuration(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.AddApplyChangesDuration(1500 * time.Millisecond)
+
+	expected := `
+# HELP cloudns_webhook_apply_changes_duration_seconds Histogram of the duration in seconds of a whole ApplyChanges run
+# TYPE cloudns_webhook_apply_changes_duration_seconds histogram
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="0.1"} 0
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="0.5"} 0
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="1"} 0
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="2.5"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="5"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="10"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="30"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="60"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="120"} 1
+cloudns_webhook_apply_changes_duration_seconds_bucket{le="+Inf"} 1
+cloudns_webhook_apply_changes_duration_seconds_sum 1.5
+cloudns_webhook_apply_changes_duration_seconds_count 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "cloudns_webhook_apply_changes_duration_seconds"))
+}
+
+func Test_OpenMetrics_IncAuditEventsTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncAuditEventsTotal("file", "success", 3)
+	m.IncAuditEventsTotal("file", "success", 2)
+	m.IncAuditEventsTotal("http", "failure", 1)
+
+	assert.Equal(t, float64(5), testutil.ToFloat64(m.auditEventsTotal.WithLabelValues("file", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.auditEventsTotal.WithLabelValues("http", "failure")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.auditEventsTotal.WithLabelValues("http", "success")))
+}
+
+func Test_OpenMetrics_IncAuditEventsDroppedTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncAuditEventsDroppedTotal()
+	m.IncAuditEventsDroppedTotal()
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.auditEventsDroppedTotal))
+}
+
+func Test_OpenMetrics_SetZonePolicy(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.SetZonePolicy(testAccount, testZone, "dry-run")
+	m.SetZonePolicy(testAccount, "beta.com", "live")
+	m.SetZonePolicy(testAccount, testZone, "read-only")
+
+	assert.Equal(t, 2, testutil.CollectAndCount(m.zonePolicy))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.zonePolicy.WithLabelValues(testAccount, testZone, "read-only")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.zonePolicy.WithLabelValues(testAccount, "beta.com", "live")))
+}
+
+func Test_OpenMetrics_IncProtectedChangesBlockedTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncProtectedChangesBlockedTotal(testAccount, testZone, "type")
+	m.IncProtectedChangesBlockedTotal(testAccount, testZone, "type")
+	m.IncProtectedChangesBlockedTotal(testAccount, testZone, "name")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.protectedChangesBlockedTotal.WithLabelValues(testAccount, testZone, "type")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.protectedChangesBlockedTotal.WithLabelValues(testAccount, testZone, "name")))
+}
+
+func Test_OpenMetrics_IncMassDeletionsBlockedTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncMassDeletionsBlockedTotal(testAccount, testZone)
+	m.IncMassDeletionsBlockedTotal(testAccount, testZone)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.massDeletionsBlockedTotal.WithLabelValues(testAccount, testZone)))
+}
+
+func Test_OpenMetrics_SetDeferredChanges(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.SetDeferredChanges(42)
+	assert.Equal(t, float64(42), testutil.ToFloat64(m.deferredChanges))
+	m.SetDeferredChanges(0)
+	assert.Equal(t, float64(0), testutil.ToFloat64(m.deferredChanges))
+}
+
+func Test_OpenMetrics_IncRecordIDLookupsTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncRecordIDLookupsTotal("hit")
+	m.IncRecordIDLookupsTotal("hit")
+	m.IncRecordIDLookupsTotal("miss")
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.recordIDLookupsTotal.WithLabelValues("hit")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.recordIDLookupsTotal.WithLabelValues("miss")))
+}
+
+func Test_OpenMetrics_IncInvalidEndpointsTotal(t *testing.T) {
+	m := newOpenMetrics(DefaultOptions())
+
+	m.IncInvalidEndpointsTotal("no_targets")
+	m.IncInvalidEndpointsTotal("invalid_ttl")
+	m.IncInvalidEndpointsTotal("invalid_ttl")
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.invalidEndpointsTotal.WithLabelValues("no_targets")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.invalidEndpointsTotal.WithLabelValues("invalid_ttl")))
+}
+
+// metricNames returns the names of the metrics gathered from the registry.
+func metricNames(t *testing.T, reg *prometheus.Registry) []string {
+	families, err := reg.Gather()
+	assert.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		names = append(names, family.GetName())
+	}
+	return names
+}
+
+func Test_OpenMetrics_names(t *testing.T) {
+	type testCase struct {
+		name     string
+		options  Options
+		expected []string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		m := newOpenMetrics(tc.options)
+		m.IncSuccessfulApiCallsTotal(testAccount, testAction)
+		m.AddApiCallDuration(testAccount, testAction, time.Second)
+
+		assert.ElementsMatch(t, tc.expected, metricNames(t, m.GetRegistry()))
+	}
+
+	testCases := []testCase{
+		{
+			name:    "default namespace",
+			options: DefaultOptions(),
+			expected: []string{
+				"cloudns_webhook_successful_api_calls_total",
+				"cloudns_webhook_api_call_duration_seconds",
+				"cloudns_webhook_apply_changes_duration_seconds",
+				"cloudns_webhook_audit_events_dropped_total",
+				"cloudns_webhook_deferred_changes",
+			},
+		},
+		{
+			name: "namespace and subsystem",
+			options: Options{
+				Namespace:          "dns",
+				Subsystem:          "cloudns",
+				ApiDurationBuckets: defaultApiDurationBuckets,
+			},
+			expected: []string{
+				"dns_cloudns_successful_api_calls_total",
+				"dns_cloudns_api_call_duration_seconds",
+				"dns_cloudns_apply_changes_duration_seconds",
+				"dns_cloudns_audit_events_dropped_total",
+				"dns_cloudns_deferred_changes",
+			},
+		},
+		{
+			name: "legacy names",
+			options: Options{
+				Namespace:          DefaultNamespace,
+				ApiDurationBuckets: defaultApiDurationBuckets,
+				LegacyNames:        true,
+			},
+			expected: []string{
+				"cloudns_webhook_successful_api_calls_total",
+				"cloudns_webhook_api_call_duration_seconds",
+				"cloudns_webhook_apply_changes_duration_seconds",
+				"cloudns_webhook_audit_events_dropped_total",
+				"cloudns_webhook_deferred_changes",
+				"successful_api_calls_total",
+				"api_delay_hist",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_OpenMetrics_legacyValues(t *testing.T) {
+	m := newOpenMetrics(legacyOptions())
+
+	m.IncFailedApiCallsTotal(testAccount, testAction)
+	m.SetFilteredOutZones(testAccount, 2)
+	m.SetSkippedRecords(testAccount, testZone, 3)
+	m.AddApiCallDuration(testAccount, testAction, 1500*time.Millisecond)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(m.legacy.failedApiCallsTotal))
+	assert.Equal(t, float64(2), testutil.ToFloat64(m.legacy.filteredOutZones))
+	assert.Equal(t, float64(3), testutil.ToFloat64(m.legacy.skippedRecords))
+
+	expected := `
+# HELP api_delay_hist Histogram of the delay in milliseconds when calling the CLouDNS API (deprecated)
+# TYPE api_delay_hist histogram
+api_delay_hist_bucket{account="default",action="test_action",le="10"} 0
+api_delay_hist_bucket{account="default",action="test_action",le="100"} 0
+api_delay_hist_bucket{account="default",action="test_action",le="250"} 0
+api_delay_hist_bucket{account="default",action="test_action",le="500"} 0
+api_delay_hist_bucket{account="default",action="test_action",le="1000"} 0
+api_delay_hist_bucket{account="default",action="test_action",le="1500"} 1
+api_delay_hist_bucket{account="default",action="test_action",le="2000"} 1
+api_delay_hist_bucket{account="default",action="test_action",le="+Inf"} 1
+api_delay_hist_sum{account="default",action="test_action"} 1500
+api_delay_hist_count{account="default",action="test_action"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "api_delay_hist"))
+}
+
+func Test_OpenMetrics_legacyAccountLabel(t *testing.T) {
+	type testCase struct {
+		name     string
+		record   func(m *OpenMetrics)
+		expected string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		m := newOpenMetrics(legacyOptions())
+		tc.record(m)
+
+		assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(tc.expected), tc.name))
+	}
+
+	testCases := []testCase{
+		{
+			name: "successful_api_calls_total",
+			record: func(m *OpenMetrics) {
+				m.IncSuccessfulApiCallsTotal("first", testAction)
+				m.IncSuccessfulApiCallsTotal("second", testAction)
+				m.IncSuccessfulApiCallsTotal("second", testAction)
+			},
+			expected: `
+# HELP successful_api_calls_total The number of successful CLouDNS API calls (deprecated)
+# TYPE successful_api_calls_total counter
+successful_api_calls_total{account="first",action="test_action"} 1
+successful_api_calls_total{account="second",action="test_action"} 2
+`,
+		},
+		{
+			name: "failed_api_calls_total",
+			record: func(m *OpenMetrics) {
+				m.IncFailedApiCallsTotal("first", testAction)
+				m.IncFailedApiCallsTotal("second", testAction)
+			},
+			expected: `
+# HELP failed_api_calls_total The number of CLouDNS API calls that returned an error (deprecated)
+# TYPE failed_api_calls_total counter
+failed_api_calls_total{account="first",action="test_action"} 1
+failed_api_calls_total{account="second",action="test_action"} 1
+`,
+		},
+		{
+			name: "filtered_out_zones",
+			record: func(m *OpenMetrics) {
+				m.SetFilteredOutZones("first", 1)
+				m.SetFilteredOutZones("second", 3)
+			},
+			expected: `
+# HELP filtered_out_zones The number of zones excluded by the domain filter (deprecated)
+# TYPE filtered_out_zones gauge
+filtered_out_zones{account="first"} 1
+filtered_out_zones{account="second"} 3
+`,
+		},
+		{
+			name: "skipped_records",
+			record: func(m *OpenMetrics) {
+				m.SetSkippedRecords("first", testZone, 2)
+				m.SetSkippedRecords("second", testZone, 4)
+			},
+			expected: `
+# HELP skipped_records The number of skipped records per domain (deprecated)
+# TYPE skipped_records gauge
+skipped_records{account="first",zone="alpha.com"} 2
+skipped_records{account="second",zone="alpha.com"} 4
+`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_OpenMetrics_apiDurationBuckets(t *testing.T) {
+	options := DefaultOptions()
+	options.ApiDurationBuckets = []float64{1, 60}
+	m := newOpenMetrics(options)
+
+	m.AddApiCallDuration(testAccount, testAction, 45*time.Second)
+
+	expected := `
+# HELP cloudns_webhook_api_call_duration_seconds Histogram of the duration in seconds of the CLouDNS API calls
+# TYPE cloudns_webhook_api_call_duration_seconds histogram
+cloudns_webhook_api_call_duration_seconds_bucket{account="default",action="test_action",le="1"} 0
+cloudns_webhook_api_call_duration_seconds_bucket{account="default",action="test_action",le="60"} 1
+cloudns_webhook_api_call_duration_seconds_bucket{account="default",action="test_action",le="+Inf"} 1
+cloudns_webhook_api_call_duration_seconds_sum{account="default",action="test_action"} 45
+cloudns_webhook_api_call_duration_seconds_count{account="default",action="test_action"} 1
+`
+	assert.NoError(t, testutil.GatherAndCompare(m.GetRegistry(), strings.NewReader(expected), "cloudns_webhook_api_call_duration_seconds"))
+}
+
+func Test_Options_Validate(t *testing.T) {
+	type testCase struct {
+		name    string
+		options Options
+		err     string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		err := tc.options.Validate()
+		if tc.err == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, tc.err)
+		}
+	}
+
+	testCases := []testCase{
+		{
+			name:    "defaults",
+			options: DefaultOptions(),
+		},
+		{
+			name:    "no namespace",
+			options: Options{ApiDurationBuckets: []float64{1}},
+		},
+		{
+			name:    "invalid namespace",
+			options: Options{Namespace: "cloudns-webhook", ApiDurationBuckets: []float64{1}},
+			err:     "METRICS_NAMESPACE is not a valid metric name prefix: 'cloudns-webhook'",
+		},
+		{
+			name:    "invalid subsystem",
+			options: Options{Subsystem: "1st", ApiDurationBuckets: []float64{1}},
+			err:     "METRICS_SUBSYSTEM is not a valid metric name prefix: '1st'",
+		},
+		{
+			name:    "no buckets",
+			options: Options{},
+			err:     "METRICS_API_DURATION_BUCKETS must contain at least one bucket",
+		},
+		{
+			name:    "unordered buckets",
+			options: Options{ApiDurationBuckets: []float64{1, 0.5}},
+			err:     "METRICS_API_DURATION_BUCKETS must be in increasing order, but was: [1 0.5]",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_NewOptions(t *testing.T) {
+	t.Setenv("METRICS_SUBSYSTEM", "sub")
+	t.Setenv("METRICS_API_DURATION_BUCKETS", "0.5,2")
+	t.Setenv("METRICS_LEGACY_NAMES", "true")
+
+	options, err := NewOptions()
+
+	assert.NoError(t, err)
+	assert.Equal(t, &Options{
+		Namespace:          DefaultNamespace,
+		Subsystem:          "sub",
+		ApiDurationBuckets: []float64{0.5, 2},
+		LegacyNames:        true,
+	}, options)
 }
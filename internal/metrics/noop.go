@@ -0,0 +1,83 @@
+/*
+ * Metrics - no-op implementation.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NoopMetrics implements Metrics by discarding every update.
+type NoopMetrics struct{}
+
+// GetRegistry returns an empty registry.
+func (NoopMetrics) GetRegistry() *prometheus.Registry {
+	return prometheus.NewRegistry()
+}
+
+// IncSuccessfulApiCallsTotal does nothing.
+func (NoopMetrics) IncSuccessfulApiCallsTotal(account, action string) {}
+
+// IncFailedApiCallsTotal does nothing.
+func (NoopMetrics) IncFailedApiCallsTotal(account, action string) {}
+
+// SetFilteredOutZones does nothing.
+func (NoopMetrics) SetFilteredOutZones(account string, num int) {}
+
+// SetSkippedRecords does nothing.
+func (NoopMetrics) SetSkippedRecords(account, zone string, num int) {}
+
+// AddApiCallDuration does nothing.
+func (NoopMetrics) AddApiCallDuration(account, action string, duration time.Duration) {}
+
+// SetManagedRecords does nothing.
+func (NoopMetrics) SetManagedRecords(account, zone string, numByType map[string]int) {}
+
+// IncAppliedChangesTotal does nothing.
+func (NoopMetrics) IncAppliedChangesTotal(account, zone, change string) {}
+
+// SetLastSuccess does nothing.
+func (NoopMetrics) SetLastSuccess(operation string, t time.Time) {}
+
+// AddApplyChangesDuration does nothing.
+func (NoopMetrics) AddApplyChangesDuration(duration time.Duration) {}
+
+// IncAuditEventsTotal does nothing.
+func (NoopMetrics) IncAuditEventsTotal(sink, result string, num int) {}
+
+// IncAuditEventsDroppedTotal does nothing.
+func (NoopMetrics) IncAuditEventsDroppedTotal() {}
+
+// SetZonePolicy does nothing.
+func (NoopMetrics) SetZonePolicy(account, zone, policy string) {}
+
+// IncProtectedChangesBlockedTotal does nothing.
+func (NoopMetrics) IncProtectedChangesBlockedTotal(account, zone, reason string) {}
+
+// IncMassDeletionsBlockedTotal does nothing.
+func (NoopMetrics) IncMassDeletionsBlockedTotal(account, zone string) {}
+
+// SetDeferredChanges does nothing.
+func (NoopMetrics) SetDeferredChanges(num int) {}
+
+// IncRecordIDLookupsTotal does nothing.
+func (NoopMetrics) IncRecordIDLookupsTotal(result string) {}
+
+// IncInvalidEndpointsTotal does nothing.
+func (NoopMetrics) IncInvalidEndpointsTotal(reason string) {}
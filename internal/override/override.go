@@ -0,0 +1,221 @@
+/*
+ * Override - one-shot overrides of the deletion guard.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package override
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingconcepts/env"
+	log "github.com/sirupsen/logrus"
+)
+
+// Options contains the deletion guard override configuration.
+type Options struct {
+	// Token authorizing the override requests, empty to disable them
+	Token string `env:"MASS_DELETION_OVERRIDE_TOKEN" default:""`
+	// Time in milliseconds an override stays valid if it is not used
+	Validity int `env:"MASS_DELETION_OVERRIDE_VALIDITY" default:"600000"`
+	// Address of the socket granting the overrides, which must be a loopback
+	// address since the token is sent in clear text
+	Address string `env:"MASS_DELETION_OVERRIDE_ADDRESS" default:"127.0.0.1:8081"`
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+	if opt.Token != "" && !isLoopback(opt.Address) {
+		return nil, fmt.Errorf("the override socket address %s is not a loopback address, the token would be sent in clear text over the network", opt.Address)
+	}
+
+	return opt, nil
+}
+
+// isLoopback returns true if the host of the address is localhost or a
+// loopback IP address.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// GetValidity returns how long an override stays valid if it is not used.
+func (o Options) GetValidity() time.Duration {
+	return time.Duration(o.Validity) * time.Millisecond
+}
+
+// Grant is a pending override of the deletion guard for a zone, or for every
+// zone if the zone is empty.
+type Grant struct {
+	Zone    string    `json:"zone,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// Overrides keeps the pending overrides of the deletion guard. An override is
+// granted through Handler and lets through a single change batch exceeding the
+// deletion guard limits, until it expires. It is safe for concurrent use; a
+// nil Overrides never grants anything.
+type Overrides struct {
+	m        sync.Mutex
+	token    string
+	validity time.Duration
+	grants   map[string]time.Time
+	now      func() time.Time
+}
+
+// New creates an Overrides instance whose grants are authorized by the given
+// token and stay valid for the given time.
+func New(token string, validity time.Duration) *Overrides {
+	return &Overrides{
+		token:    token,
+		validity: validity,
+		grants:   map[string]time.Time{},
+		now:      time.Now,
+	}
+}
+
+// Grant grants an override for the given zone, every zone if empty, and
+// returns it.
+func (o *Overrides) Grant(zone string) Grant {
+	o.m.Lock()
+	defer o.m.Unlock()
+	zone = strings.ToLower(strings.TrimSuffix(zone, "."))
+	expires := o.now().Add(o.validity).UTC()
+	o.grants[zone] = expires
+	return Grant{Zone: zone, Expires: expires}
+}
+
+// Granted returns true if every one of the given zones has a pending override,
+// without using them.
+func (o *Overrides) Granted(zones []string) bool {
+	if o == nil {
+		return false
+	}
+	o.m.Lock()
+	defer o.m.Unlock()
+	_, ok := o.match(zones)
+	return ok
+}
+
+// Use uses the pending overrides of the given zones and returns true if every
+// one of them has one. The overrides are used only if all the zones have one,
+// so that a batch refused for one zone does not waste the override of another.
+func (o *Overrides) Use(zones []string) bool {
+	if o == nil {
+		return false
+	}
+	o.m.Lock()
+	defer o.m.Unlock()
+	keys, ok := o.match(zones)
+	if !ok {
+		return false
+	}
+	for _, key := range keys {
+		delete(o.grants, key)
+	}
+	return true
+}
+
+// match returns the keys of the grants covering the given zones, dropping the
+// expired ones, and true if every zone is covered.
+func (o *Overrides) match(zones []string) ([]string, bool) {
+	now := o.now()
+	for key, expires := range o.grants {
+		if !now.Before(expires) {
+			delete(o.grants, key)
+		}
+	}
+
+	keys := []string{}
+	for _, zone := range zones {
+		key := strings.ToLower(zone)
+		if _, ok := o.grants[key]; !ok {
+			key = ""
+		}
+		if _, ok := o.grants[key]; !ok {
+			return nil, false
+		}
+		keys = append(keys, key)
+	}
+	return keys, true
+}
+
+// List returns the pending overrides, sorted by zone.
+func (o *Overrides) List() []Grant {
+	o.m.Lock()
+	defer o.m.Unlock()
+	o.match(nil)
+	result := make([]Grant, 0, len(o.grants))
+	for zone, expires := range o.grants {
+		result = append(result, Grant{Zone: zone, Expires: expires})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Zone < result[j].Zone })
+	return result
+}
+
+// Handler serves the pending overrides as a JSON array on GET, and grants an
+// override on POST, for the zone given by the "zone" query parameter or for
+// every zone. A POST must carry the token as a bearer token; without a token
+// configured, the overrides cannot be granted.
+func (o *Overrides) Handler(w http.ResponseWriter, r *http.Request) {
+	var body any
+	switch r.Method {
+	case http.MethodGet:
+		body = o.List()
+	case http.MethodPost:
+		if o.token == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(o.token)) != 1 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		grant := o.Grant(r.URL.Query().Get("zone"))
+		log.WithFields(log.Fields{"zone": grant.Zone, "expires": grant.Expires}).Warn("Deletion guard override granted")
+		body = grant
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warn("Could not answer to a deletion guard override request: ", err.Error())
+	}
+}
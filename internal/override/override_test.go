@@ -0,0 +1,128 @@
+/*
+ * Override - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package override
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewOptions(t *testing.T) {
+	t.Setenv("MASS_DELETION_OVERRIDE_TOKEN", "s3cret")
+
+	for address, valid := range map[string]bool{
+		"127.0.0.1:8081": true,
+		"[::1]:8081":     true,
+		"localhost:8081": true,
+		"0.0.0.0:8081":   false,
+		"10.0.0.1:8081":  false,
+		":8081":          false,
+	} {
+		t.Setenv("MASS_DELETION_OVERRIDE_ADDRESS", address)
+		opt, err := NewOptions()
+		if valid {
+			assert.NoError(t, err, address)
+			assert.Equal(t, address, opt.Address)
+		} else {
+			assert.Error(t, err, address)
+		}
+	}
+
+	// Without a token the overrides cannot be granted, wherever the socket
+	// listens
+	t.Setenv("MASS_DELETION_OVERRIDE_TOKEN", "")
+	_, err := NewOptions()
+	assert.NoError(t, err)
+}
+
+func Test_Overrides_Use(t *testing.T) {
+	o := New("s3cret", time.Minute)
+	o.Grant("Alpha.com.")
+
+	assert.False(t, o.Use([]string{"alpha.com", "beta.com"}))
+	assert.True(t, o.Granted([]string{"alpha.com"}))
+	assert.True(t, o.Use([]string{"alpha.com"}))
+	assert.False(t, o.Use([]string{"alpha.com"}))
+
+	o.Grant("")
+	assert.True(t, o.Use([]string{"alpha.com", "beta.com"}))
+	assert.Empty(t, o.List())
+}
+
+func Test_Overrides_expired(t *testing.T) {
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	o := New("s3cret", time.Minute)
+	o.now = func() time.Time { return now }
+	o.Grant("alpha.com")
+
+	now = now.Add(time.Minute)
+	assert.False(t, o.Granted([]string{"alpha.com"}))
+	assert.Empty(t, o.List())
+}
+
+func Test_Overrides_nil(t *testing.T) {
+	var o *Overrides
+	assert.False(t, o.Granted([]string{"alpha.com"}))
+	assert.False(t, o.Use([]string{"alpha.com"}))
+}
+
+func Test_Overrides_Handler(t *testing.T) {
+	type testCase struct {
+		name   string
+		token  string
+		method string
+		auth   string
+		status int
+		grants int
+	}
+
+	testCases := []testCase{
+		{name: "granted", token: "s3cret", method: http.MethodPost, auth: "Bearer s3cret", status: http.StatusOK, grants: 1},
+		{name: "wrong token", token: "s3cret", method: http.MethodPost, auth: "Bearer guess", status: http.StatusForbidden},
+		{name: "no token", token: "s3cret", method: http.MethodPost, status: http.StatusForbidden},
+		{name: "disabled", method: http.MethodPost, auth: "Bearer ", status: http.StatusNotFound},
+		{name: "list", token: "s3cret", method: http.MethodGet, status: http.StatusOK},
+		{name: "wrong method", token: "s3cret", method: http.MethodDelete, auth: "Bearer s3cret", status: http.StatusMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := New(tc.token, time.Minute)
+			req := httptest.NewRequest(tc.method, "/debug/deletion-guard?zone=alpha.com", nil)
+			if tc.auth != "" {
+				req.Header.Set("Authorization", tc.auth)
+			}
+			rec := httptest.NewRecorder()
+
+			o.Handler(rec, req)
+
+			assert.Equal(t, tc.status, rec.Code)
+			assert.Len(t, o.List(), tc.grants)
+			if tc.grants > 0 {
+				var grant Grant
+				assert.NoError(t, json.NewDecoder(rec.Body).Decode(&grant))
+				assert.Equal(t, "alpha.com", grant.Zone)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+/*
+ * Queue - asynchronous application of the DNS changes.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	"github.com/codingconcepts/env"
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// Statuses of a batch.
+const (
+	StatusQueued  = "queued"
+	StatusRunning = "running"
+	StatusDone    = "done"
+	StatusFailed  = "failed"
+)
+
+// ErrClosed is returned by ApplyChanges once the queue has been shut down.
+var ErrClosed = errors.New("the apply queue is shut down")
+
+// Options contains the apply queue configuration.
+type Options struct {
+	// Apply the changes asynchronously
+	Async bool `env:"ASYNC_APPLY" default:"false"`
+	// Number of finished batches kept for the status endpoint
+	History int `env:"ASYNC_HISTORY" default:"20"`
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// Validator is implemented by the providers that check the changes before
+// they are queued. The changes checked are the ones of the whole batch the
+// changes of a request are coalesced into.
+type Validator interface {
+	ValidateChanges(ctx context.Context, changes *plan.Changes) error
+}
+
+// Batch is a set of changes applied at once. The changes of the requests
+// received while a batch is queued are coalesced into it.
+type Batch struct {
+	ID         int       `json:"id"`
+	RequestIDs []string  `json:"requestIds,omitempty"`
+	Status     string    `json:"status"`
+	Queued     time.Time `json:"queued"`
+	Started    time.Time `json:"started,omitzero"`
+	Finished   time.Time `json:"finished,omitzero"`
+	Create     int       `json:"create"`
+	Update     int       `json:"update"`
+	Delete     int       `json:"delete"`
+	Error      string    `json:"error,omitempty"`
+
+	// pending are the coalesced changes, by record set key
+	pending map[string]*change
+	// keys are the record set keys in the order they were first changed
+	keys []string
+}
+
+// change is the coalesced change of a record set: the record set before the
+// batch, nil if it did not exist, and the one after it, nil if it is deleted.
+type change struct {
+	old *endpoint.Endpoint
+	new *endpoint.Endpoint
+}
+
+// key returns the key of the record set of an endpoint.
+func key(ep *endpoint.Endpoint) string {
+	return ep.DNSName + " " + ep.RecordType + " " + ep.SetIdentifier
+}
+
+// add coalesces a change into the batch. A change of a record set already
+// changed by the batch supersedes the previous one: the record set goes from
+// its state before the batch straight to the new one, and a record set created
+// and then deleted is dropped.
+func (b *Batch) add(old, new *endpoint.Endpoint) {
+	ep := new
+	if ep == nil {
+		ep = old
+	}
+	k := key(ep)
+
+	previous, ok := b.pending[k]
+	if !ok {
+		b.pending[k] = &change{old: old, new: new}
+		b.keys = append(b.keys, k)
+		return
+	}
+	previous.new = new
+	if previous.old == nil && previous.new == nil {
+		delete(b.pending, k)
+	}
+}
+
+// coalesce returns a batch with the pending changes of the batch and the ones
+// of a request coalesced into them, leaving the batch unchanged. The batch may
+// be nil.
+func (b *Batch) coalesce(changes *plan.Changes) *Batch {
+	next := &Batch{pending: map[string]*change{}}
+	if b != nil {
+		for k, c := range b.pending {
+			copied := *c
+			next.pending[k] = &copied
+		}
+		next.keys = append([]string{}, b.keys...)
+	}
+	next.addChanges(changes)
+	return next
+}
+
+// addChanges coalesces the changes of a request into the batch.
+func (b *Batch) addChanges(changes *plan.Changes) {
+	for _, ep := range changes.Create {
+		b.add(nil, ep)
+	}
+
+	olds := map[string]*endpoint.Endpoint{}
+	for _, ep := range changes.UpdateOld {
+		olds[key(ep)] = ep
+	}
+	for _, ep := range changes.UpdateNew {
+		k := key(ep)
+		b.add(olds[k], ep)
+		delete(olds, k)
+	}
+	for _, ep := range changes.UpdateOld {
+		if _, ok := olds[key(ep)]; ok {
+			b.add(ep, nil)
+		}
+	}
+
+	for _, ep := range changes.Delete {
+		b.add(ep, nil)
+	}
+	b.count()
+}
+
+// count updates the number of creations, updates and deletions of the batch.
+func (b *Batch) count() {
+	b.Create, b.Update, b.Delete = 0, 0, 0
+	for _, c := range b.pending {
+		switch {
+		case c.old == nil:
+			b.Create++
+		case c.new == nil:
+			b.Delete++
+		default:
+			b.Update++
+		}
+	}
+}
+
+// changes returns the coalesced changes of the batch.
+func (b *Batch) changes() *plan.Changes {
+	result := &plan.Changes{}
+	for _, k := range b.keys {
+		c, ok := b.pending[k]
+		if !ok {
+			continue
+		}
+		switch {
+		case c.old == nil:
+			result.Create = append(result.Create, c.new)
+		case c.new == nil:
+			result.Delete = append(result.Delete, c.old)
+		default:
+			result.UpdateOld = append(result.UpdateOld, c.old)
+			result.UpdateNew = append(result.UpdateNew, c.new)
+		}
+	}
+	return result
+}
+
+// overlay applies the changes of the batch to the endpoints, indexed by key.
+func (b *Batch) overlay(endpoints map[string]*endpoint.Endpoint) {
+	for k, c := range b.pending {
+		if c.new == nil {
+			delete(endpoints, k)
+		} else {
+			endpoints[k] = c.new
+		}
+	}
+}
+
+// Queue applies the changes asynchronously, one batch at a time, and keeps
+// the status of the latest batches. It is safe for concurrent use.
+type Queue struct {
+	// enqueuing serializes the requests being enqueued
+	enqueuing sync.Mutex
+
+	m       sync.Mutex
+	history int
+	nextID  int
+	queued  *Batch
+	running *Batch
+	done    []*Batch
+	closed  bool
+	started bool
+
+	wake    chan struct{}
+	stopped chan struct{}
+}
+
+// New creates a Queue keeping the status of up to history finished batches.
+func New(history int) *Queue {
+	return &Queue{
+		history: history,
+		wake:    make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+}
+
+// Wrap returns a provider that queues the changes and applies them with the
+// given provider in the background, and starts the background worker. It must
+// be called only once.
+func (q *Queue) Wrap(p provider.Provider) provider.Provider {
+	q.m.Lock()
+	q.started = true
+	q.m.Unlock()
+	go q.run(p)
+	return &asyncProvider{Provider: p, queue: q}
+}
+
+// enqueue coalesces the changes into the queued batch, creating it if needed.
+// If validate is not nil, the coalesced batch is checked first and the changes
+// are refused with its error, so that the request fails rather than the batch
+// it would be coalesced into. The check runs without holding the lock of the
+// queue, so the requests are enqueued one at a time; if the worker starts the
+// queued batch meanwhile, the changes are checked again on their own.
+func (q *Queue) enqueue(ctx context.Context, changes *plan.Changes, validate func(context.Context, *plan.Changes) error) (*Batch, error) {
+	q.enqueuing.Lock()
+	defer q.enqueuing.Unlock()
+
+	q.m.Lock()
+	defer q.m.Unlock()
+	for {
+		if q.closed {
+			return nil, ErrClosed
+		}
+		queued := q.queued
+		next := queued.coalesce(changes)
+		if validate == nil {
+			break
+		}
+
+		q.m.Unlock()
+		err := validate(ctx, next.changes())
+		q.m.Lock()
+		if err != nil {
+			return nil, err
+		}
+		if q.queued == queued {
+			break
+		}
+	}
+
+	if q.queued == nil {
+		q.nextID++
+		q.queued = &Batch{
+			ID:      q.nextID,
+			Status:  StatusQueued,
+			Queued:  time.Now().UTC(),
+			pending: map[string]*change{},
+		}
+	}
+	if requestID := logging.CorrelationID(ctx); requestID != "" {
+		q.queued.RequestIDs = append(q.queued.RequestIDs, requestID)
+	}
+	q.queued.addChanges(changes)
+	batch := *q.queued
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return &batch, nil
+}
+
+// run applies the queued batches until the queue is shut down and empty.
+func (q *Queue) run(p provider.Provider) {
+	defer close(q.stopped)
+	for range q.wake {
+		for {
+			batch := q.start()
+			if batch == nil {
+				break
+			}
+			ctx := logging.WithCorrelationID(context.Background(), fmt.Sprintf("batch-%d", batch.ID))
+			q.finish(batch, p.ApplyChanges(ctx, batch.changes()))
+		}
+		if q.isDrained() {
+			return
+		}
+	}
+}
+
+// start moves the queued batch, if any, to running and returns it.
+func (q *Queue) start() *Batch {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.queued == nil {
+		return nil
+	}
+	q.running, q.queued = q.queued, nil
+	q.running.Status = StatusRunning
+	q.running.Started = time.Now().UTC()
+	return q.running
+}
+
+// finish records the outcome of the running batch.
+func (q *Queue) finish(batch *Batch, err error) {
+	logger := log.WithFields(log.Fields{"batch": batch.ID, "create": batch.Create, "update": batch.Update, "delete": batch.Delete})
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	batch.Finished = time.Now().UTC()
+	batch.Status = StatusDone
+	if err != nil {
+		batch.Status = StatusFailed
+		batch.Error = err.Error()
+		logger.WithError(err).Errorf("Batch %d failed", batch.ID)
+	} else {
+		logger.Infof("Batch %d applied", batch.ID)
+	}
+
+	q.running = nil
+	if q.history > 0 {
+		q.done = append(q.done, batch)
+		if len(q.done) > q.history {
+			q.done = q.done[len(q.done)-q.history:]
+		}
+	}
+}
+
+// isDrained returns true if the queue is shut down and no batch is left.
+func (q *Queue) isDrained() bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.closed && q.queued == nil && q.running == nil
+}
+
+// pending returns the running and the queued batch, nil if there is none.
+func (q *Queue) pending() (*Batch, *Batch) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.running, q.queued
+}
+
+// overlay returns the endpoints with the pending changes applied, first the
+// ones of the running batch and then the ones of the queued batch.
+func (q *Queue) overlay(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.running == nil && q.queued == nil {
+		return endpoints
+	}
+
+	byKey := map[string]*endpoint.Endpoint{}
+	keys := []string{}
+	for _, ep := range endpoints {
+		k := key(ep)
+		byKey[k] = ep
+		keys = append(keys, k)
+	}
+	for _, batch := range []*Batch{q.running, q.queued} {
+		if batch == nil {
+			continue
+		}
+		batch.overlay(byKey)
+		keys = append(keys, batch.keys...)
+	}
+
+	result := []*endpoint.Endpoint{}
+	for _, k := range keys {
+		if ep, ok := byKey[k]; ok {
+			result = append(result, ep)
+			delete(byKey, k)
+		}
+	}
+	return result
+}
+
+// Batches returns the queued and the running batch, followed by the finished
+// ones, the latest first.
+func (q *Queue) Batches() []Batch {
+	q.m.Lock()
+	defer q.m.Unlock()
+	result := []Batch{}
+	for _, batch := range []*Batch{q.queued, q.running} {
+		if batch != nil {
+			result = append(result, *batch)
+		}
+	}
+	for i := len(q.done) - 1; i >= 0; i-- {
+		result = append(result, *q.done[i])
+	}
+	return result
+}
+
+// Handler serves the batches as a JSON array.
+func (q *Queue) Handler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(q.Batches()); err != nil {
+		log.Warn("Could not answer to an apply queue request: ", err.Error())
+	}
+}
+
+// Shutdown stops accepting changes and waits until the queued ones are
+// applied or the context expires.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.m.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.wake)
+	}
+	started := q.started
+	q.m.Unlock()
+	if !started {
+		return nil
+	}
+
+	select {
+	case <-q.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextAdjuster is implemented by the providers adjusting the endpoints
+// within the context of the request.
+type contextAdjuster interface {
+	AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error)
+}
+
+// asyncProvider is the provider returned by Queue.Wrap.
+type asyncProvider struct {
+	provider.Provider
+	queue *Queue
+}
+
+// Records returns the records of the wrapped provider with the changes that
+// are queued or running applied, so that ExternalDNS does not plan them again.
+func (p *asyncProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	endpoints, err := p.Provider.Records(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p.queue.overlay(endpoints), nil
+}
+
+// AdjustEndpointsContext adjusts the endpoints with the wrapped provider,
+// within the context of the request if the provider supports it.
+func (p *asyncProvider) AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	if adjuster, ok := p.Provider.(contextAdjuster); ok {
+		return adjuster.AdjustEndpointsContext(ctx, endpoints)
+	}
+	return p.Provider.AdjustEndpoints(endpoints)
+}
+
+// ApplyChanges queues the changes, once the wrapped provider, if it can, has
+// validated the batch they are coalesced into. It returns without waiting for
+// the changes to be applied.
+func (p *asyncProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	var validate func(context.Context, *plan.Changes) error
+	if validator, ok := p.Provider.(Validator); ok {
+		validate = validator.ValidateChanges
+	}
+
+	batch, err := p.queue.enqueue(ctx, changes, validate)
+	if err != nil {
+		return err
+	}
+	logging.FromContext(ctx).WithField("batch", batch.ID).Infof("Changes queued in batch %d", batch.ID)
+	return nil
+}
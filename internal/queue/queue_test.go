@@ -0,0 +1,316 @@
+/*
+ * Queue - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// fakeProvider records the applied changes. Each ApplyChanges call waits for
+// a value on release, if it is set. The changes are refused with validate, or
+// when they delete more than maxDeletions records if it is set.
+type fakeProvider struct {
+	provider.BaseProvider
+	records      []*endpoint.Endpoint
+	applied      chan *plan.Changes
+	release      chan error
+	validate     error
+	maxDeletions int
+}
+
+func (p *fakeProvider) Records(_ context.Context) ([]*endpoint.Endpoint, error) {
+	return p.records, nil
+}
+
+func (p *fakeProvider) ApplyChanges(_ context.Context, changes *plan.Changes) error {
+	p.applied <- changes
+	if p.release != nil {
+		return <-p.release
+	}
+	return nil
+}
+
+func (p *fakeProvider) ValidateChanges(_ context.Context, changes *plan.Changes) error {
+	if p.maxDeletions > 0 && len(changes.Delete) > p.maxDeletions {
+		return errors.New("too many deletions")
+	}
+	return p.validate
+}
+
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{applied: make(chan *plan.Changes, 10)}
+}
+
+// waitFor waits until the condition is true or a second has elapsed.
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	assert.Eventually(t, condition, time.Second, time.Millisecond)
+}
+
+func Test_Batch_addChanges(t *testing.T) {
+	b := &Batch{pending: map[string]*change{}}
+	b.addChanges(&plan.Changes{
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "1.1.1.1")},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "2.2.2.2")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "3.3.3.3")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("old.alpha.com", "A", "4.4.4.4")},
+	})
+	assert.Equal(t, 1, b.Create)
+	assert.Equal(t, 1, b.Update)
+	assert.Equal(t, 1, b.Delete)
+
+	// The later changes supersede the earlier ones
+	b.addChanges(&plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "1.1.1.1")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "5.5.5.5")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "3.3.3.3")},
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpoint("old.alpha.com", "A", "6.6.6.6")},
+	})
+	changes := b.changes()
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "5.5.5.5")}, changes.Create)
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "2.2.2.2")}, changes.Delete)
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("old.alpha.com", "A", "4.4.4.4")}, changes.UpdateOld)
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("old.alpha.com", "A", "6.6.6.6")}, changes.UpdateNew)
+
+	// A record created and deleted in the same batch is dropped
+	b.addChanges(&plan.Changes{Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "5.5.5.5")}})
+	assert.Empty(t, b.changes().Create)
+	assert.Equal(t, 0, b.Create)
+}
+
+func Test_Queue_ApplyChanges(t *testing.T) {
+	p := newFakeProvider()
+	p.release = make(chan error)
+	q := New(5)
+	async := q.Wrap(p)
+
+	ctx := logging.WithCorrelationID(context.Background(), "first")
+	assert.NoError(t, async.ApplyChanges(ctx, &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("one.alpha.com", "A", "1.1.1.1")},
+	}))
+	<-p.applied
+
+	// The changes received while a batch is running are coalesced in the
+	// next one
+	for _, target := range []string{"2.2.2.2", "3.3.3.3"} {
+		assert.NoError(t, async.ApplyChanges(context.Background(), &plan.Changes{
+			Create: []*endpoint.Endpoint{endpoint.NewEndpoint("two.alpha.com", "A", target)},
+		}))
+	}
+	batches := q.Batches()
+	assert.Len(t, batches, 2)
+	assert.Equal(t, StatusQueued, batches[0].Status)
+	assert.Equal(t, 1, batches[0].Create)
+	assert.Equal(t, StatusRunning, batches[1].Status)
+	assert.Equal(t, []string{"first"}, batches[1].RequestIDs)
+
+	p.release <- errors.New("rate limited")
+	changes := <-p.applied
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("two.alpha.com", "A", "3.3.3.3")}, changes.Create)
+	p.release <- nil
+
+	waitFor(t, func() bool { return len(q.Batches()) == 2 && q.Batches()[0].Status == StatusDone })
+	batches = q.Batches()
+	assert.Equal(t, 2, batches[0].ID)
+	assert.Equal(t, StatusFailed, batches[1].Status)
+	assert.Equal(t, "rate limited", batches[1].Error)
+
+	assert.NoError(t, q.Shutdown(context.Background()))
+	assert.ErrorIs(t, async.ApplyChanges(context.Background(), &plan.Changes{}), ErrClosed)
+}
+
+func Test_Queue_ApplyChanges_invalid(t *testing.T) {
+	p := newFakeProvider()
+	p.validate = errors.New("too many deletions")
+	q := New(5)
+	async := q.Wrap(p)
+
+	assert.EqualError(t, async.ApplyChanges(context.Background(), &plan.Changes{}), "too many deletions")
+	assert.Empty(t, q.Batches())
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
+
+func Test_Queue_ApplyChanges_coalescedInvalid(t *testing.T) {
+	p := newFakeProvider()
+	p.release = make(chan error)
+	p.maxDeletions = 3
+	q := New(5)
+	async := q.Wrap(p)
+
+	deletions := func(names ...string) *plan.Changes {
+		changes := &plan.Changes{}
+		for _, name := range names {
+			changes.Delete = append(changes.Delete, endpoint.NewEndpoint(name, "A", "1.1.1.1"))
+		}
+		return changes
+	}
+
+	assert.NoError(t, async.ApplyChanges(context.Background(), deletions("one.alpha.com")))
+	<-p.applied
+
+	// Each request is within the limit, but the batch they would be
+	// coalesced into is not
+	assert.NoError(t, async.ApplyChanges(logging.WithCorrelationID(context.Background(), "second"), deletions("two.alpha.com", "three.alpha.com")))
+	assert.EqualError(t, async.ApplyChanges(logging.WithCorrelationID(context.Background(), "third"), deletions("four.alpha.com", "five.alpha.com")), "too many deletions")
+
+	batches := q.Batches()
+	assert.Equal(t, StatusQueued, batches[0].Status)
+	assert.Equal(t, 2, batches[0].Delete)
+	assert.Equal(t, []string{"second"}, batches[0].RequestIDs)
+
+	p.release <- nil
+	assert.Len(t, (<-p.applied).Delete, 2)
+	p.release <- nil
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
+
+// adjustingProvider is a fakeProvider adjusting the endpoints within the
+// context, which it records.
+type adjustingProvider struct {
+	*fakeProvider
+	ctx context.Context
+}
+
+func (p *adjustingProvider) AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	p.ctx = ctx
+	return endpoints[:1], nil
+}
+
+func Test_Queue_AdjustEndpointsContext(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "request")
+	endpoints := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.alpha.com", "A", "1.1.1.1"),
+		endpoint.NewEndpoint("api.alpha.com", "A", "2.2.2.2"),
+	}
+
+	// The context is passed on to the providers supporting it
+	p := &adjustingProvider{fakeProvider: newFakeProvider()}
+	q := New(5)
+	adjusted, err := q.Wrap(p).(contextAdjuster).AdjustEndpointsContext(ctx, endpoints)
+	assert.NoError(t, err)
+	assert.Equal(t, endpoints[:1], adjusted)
+	assert.Equal(t, ctx, p.ctx)
+	assert.NoError(t, q.Shutdown(context.Background()))
+
+	// The other providers adjust the endpoints without it
+	q = New(5)
+	adjusted, err = q.Wrap(newFakeProvider()).(contextAdjuster).AdjustEndpointsContext(ctx, endpoints)
+	assert.NoError(t, err)
+	assert.Equal(t, endpoints, adjusted)
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
+
+func Test_Queue_Records(t *testing.T) {
+	p := newFakeProvider()
+	p.release = make(chan error)
+	p.records = []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.alpha.com", "A", "1.1.1.1"),
+		endpoint.NewEndpoint("old.alpha.com", "A", "2.2.2.2"),
+	}
+	q := New(5)
+	async := q.Wrap(p)
+
+	assert.NoError(t, async.ApplyChanges(context.Background(), &plan.Changes{
+		Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("old.alpha.com", "A", "2.2.2.2")},
+	}))
+	<-p.applied
+	assert.NoError(t, async.ApplyChanges(context.Background(), &plan.Changes{
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "1.1.1.1")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("www.alpha.com", "A", "3.3.3.3")},
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpoint("new.alpha.com", "A", "4.4.4.4")},
+	}))
+
+	records, err := async.Records(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("www.alpha.com", "A", "3.3.3.3"),
+		endpoint.NewEndpoint("new.alpha.com", "A", "4.4.4.4"),
+	}, records)
+
+	p.release <- nil
+	<-p.applied
+	p.release <- nil
+	waitFor(t, func() bool { return len(q.Batches()) == 2 && q.Batches()[0].Status == StatusDone })
+
+	records, err = async.Records(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, p.records, records)
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
+
+func Test_Queue_Shutdown(t *testing.T) {
+	// A queue that was never started shuts down at once
+	assert.NoError(t, New(5).Shutdown(context.Background()))
+
+	// The queued changes are applied before the worker stops
+	p := newFakeProvider()
+	p.release = make(chan error)
+	q := New(5)
+	async := q.Wrap(p)
+	assert.NoError(t, async.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("one.alpha.com", "A", "1.1.1.1")},
+	}))
+	<-p.applied
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, q.Shutdown(ctx), context.DeadlineExceeded)
+
+	p.release <- nil
+	assert.NoError(t, q.Shutdown(context.Background()))
+	assert.Equal(t, StatusDone, q.Batches()[0].Status)
+}
+
+func Test_Queue_Handler(t *testing.T) {
+	q := New(5)
+	w := httptest.NewRecorder()
+	q.Handler(w, httptest.NewRequest(http.MethodGet, "/debug/queue", nil))
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.JSONEq(t, "[]", w.Body.String())
+
+	p := newFakeProvider()
+	async := q.Wrap(p)
+	assert.NoError(t, async.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("one.alpha.com", "A", "1.1.1.1")},
+	}))
+	<-p.applied
+	waitFor(t, func() bool { return len(q.Batches()) == 1 && q.Batches()[0].Status == StatusDone })
+
+	w = httptest.NewRecorder()
+	q.Handler(w, httptest.NewRequest(http.MethodGet, "/debug/queue", nil))
+	var batches []map[string]any
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &batches))
+	assert.Len(t, batches, 1)
+	assert.Equal(t, "done", batches[0]["status"])
+	assert.Equal(t, float64(1), batches[0]["create"])
+	assert.NoError(t, q.Shutdown(context.Background()))
+}
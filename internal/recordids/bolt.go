@@ -0,0 +1,119 @@
+/*
+ * Record IDs - BoltDB store.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltLockTimeout is how long Open waits for the lock of the database file,
+// which is held by another webhook using the same file.
+const boltLockTimeout = 5 * time.Second
+
+// Bolt is a Store that keeps the IDs in a BoltDB file, so that they survive
+// the restarts of the webhook. The records of every zone are kept in a bucket
+// named after the zone.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the BoltDB file at the given path, creating it if needed.
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: boltLockTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+// boltKey returns the key of a record within the bucket of its zone.
+func boltKey(key Key) []byte {
+	return []byte(strings.Join([]string{key.Host, key.Type, key.Target}, "\x00"))
+}
+
+// Get returns the ID of a record, if it is known.
+func (s *Bolt) Get(key Key) (int, bool) {
+	id := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(key.Zone))
+		if bucket == nil {
+			return nil
+		}
+		value := bucket.Get(boltKey(key))
+		if value == nil {
+			return nil
+		}
+		var err error
+		id, err = strconv.Atoi(string(value))
+		return err
+	})
+	if err != nil {
+		log.Warn("Cannot read the record ID store: ", err.Error())
+		return 0, false
+	}
+	return id, id != 0
+}
+
+// Delete forgets the ID of a record.
+func (s *Bolt) Delete(key Key) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(key.Zone))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete(boltKey(key))
+	})
+	if err != nil {
+		log.Warn("Cannot update the record ID store: ", err.Error())
+	}
+}
+
+// ReplaceZone replaces the IDs of the records of a zone.
+func (s *Bolt) ReplaceZone(zone string, ids map[Key]int) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(zone)) != nil {
+			if err := tx.DeleteBucket([]byte(zone)); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket([]byte(zone))
+		if err != nil {
+			return err
+		}
+		for key, id := range ids {
+			if err := bucket.Put(boltKey(key), []byte(strconv.Itoa(id))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warn("Cannot update the record ID store: ", err.Error())
+	}
+}
+
+// Shutdown closes the BoltDB file.
+func (s *Bolt) Shutdown(context.Context) error {
+	return s.db.Close()
+}
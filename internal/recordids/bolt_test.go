@@ -0,0 +1,56 @@
+/*
+ * Record IDs - Unit tests of the BoltDB store.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Bolt(t *testing.T) {
+	s, err := OpenBolt(filepath.Join(t.TempDir(), "record-ids.db"))
+	assert.NoError(t, err)
+	testStore(t, s)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func Test_Bolt_persistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record-ids.db")
+	key := Key{Zone: "alpha.com", Host: "txt", Type: "TXT", Target: "heritage=external-dns"}
+
+	s, err := OpenBolt(path)
+	assert.NoError(t, err)
+	s.ReplaceZone("alpha.com", map[Key]int{key: 42})
+	assert.NoError(t, s.Shutdown(context.Background()))
+
+	// The IDs survive a restart
+	s, err = OpenBolt(path)
+	assert.NoError(t, err)
+	id, ok := s.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, 42, id)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func Test_OpenBolt_error(t *testing.T) {
+	_, err := OpenBolt(filepath.Join(t.TempDir(), "missing", "record-ids.db"))
+	assert.Error(t, err)
+}
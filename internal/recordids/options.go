@@ -0,0 +1,66 @@
+/*
+ * Record IDs - configuration.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"fmt"
+
+	"github.com/codingconcepts/env"
+)
+
+// Kinds of record ID store.
+const (
+	StoreNone   = "none"
+	StoreMemory = "memory"
+	StoreBolt   = "bolt"
+)
+
+// Options contains the record ID store configuration.
+type Options struct {
+	// Kind of store: none, memory or bolt
+	Store string `env:"RECORD_ID_STORE" default:"none"`
+	// Path of the BoltDB file of the bolt store
+	File string `env:"RECORD_ID_STORE_FILE" default:"/var/lib/cloudns-webhook/record-ids.db"`
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// Setup creates the record ID store described by the options.
+func Setup(options Options) (Store, error) {
+	switch options.Store {
+	case StoreNone:
+		return Noop{}, nil
+	case StoreMemory:
+		return NewMemory(), nil
+	case StoreBolt:
+		return OpenBolt(options.File)
+	default:
+		return nil, fmt.Errorf("RECORD_ID_STORE must be one of '%s', '%s' or '%s', but was: %s", StoreNone, StoreMemory, StoreBolt, options.Store)
+	}
+}
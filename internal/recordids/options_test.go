@@ -0,0 +1,58 @@
+/*
+ * Record IDs - Unit tests of the configuration.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewOptions(t *testing.T) {
+	options, err := NewOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, StoreNone, options.Store)
+	assert.Equal(t, "/var/lib/cloudns-webhook/record-ids.db", options.File)
+
+	t.Setenv("RECORD_ID_STORE", "bolt")
+	t.Setenv("RECORD_ID_STORE_FILE", "/data/ids.db")
+	options, err = NewOptions()
+	assert.NoError(t, err)
+	assert.Equal(t, StoreBolt, options.Store)
+	assert.Equal(t, "/data/ids.db", options.File)
+}
+
+func Test_Setup(t *testing.T) {
+	s, err := Setup(Options{Store: StoreNone})
+	assert.NoError(t, err)
+	assert.IsType(t, Noop{}, s)
+
+	s, err = Setup(Options{Store: StoreMemory})
+	assert.NoError(t, err)
+	assert.IsType(t, &Memory{}, s)
+
+	s, err = Setup(Options{Store: StoreBolt, File: filepath.Join(t.TempDir(), "record-ids.db")})
+	assert.NoError(t, err)
+	assert.IsType(t, &Bolt{}, s)
+	assert.NoError(t, s.Shutdown(context.Background()))
+
+	_, err = Setup(Options{Store: "sqlite"})
+	assert.EqualError(t, err, "RECORD_ID_STORE must be one of 'none', 'memory' or 'bolt', but was: sqlite")
+}
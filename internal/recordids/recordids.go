@@ -0,0 +1,106 @@
+/*
+ * Record IDs - store of the ClouDNS record IDs.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"context"
+	"sync"
+)
+
+// Key identifies a ClouDNS record by its zone, host, type and value.
+type Key struct {
+	Zone   string
+	Host   string
+	Type   string
+	Target string
+}
+
+// Store maps the records to their ClouDNS IDs. A store is a cache: the IDs it
+// returns may be stale, and its failures are logged rather than returned, so
+// that the caller can always fall back to listing the records.
+type Store interface {
+	// Get returns the ID of a record, if it is known.
+	Get(key Key) (int, bool)
+	// Delete forgets the ID of a record.
+	Delete(key Key)
+	// ReplaceZone replaces the IDs of the records of a zone.
+	ReplaceZone(zone string, ids map[Key]int)
+	// Shutdown releases the resources of the store.
+	Shutdown(ctx context.Context) error
+}
+
+// Noop is a Store that keeps no ID.
+type Noop struct{}
+
+// Get returns no ID.
+func (Noop) Get(Key) (int, bool) {
+	return 0, false
+}
+
+// Delete does nothing.
+func (Noop) Delete(Key) {}
+
+// ReplaceZone does nothing.
+func (Noop) ReplaceZone(string, map[Key]int) {}
+
+// Shutdown does nothing.
+func (Noop) Shutdown(context.Context) error {
+	return nil
+}
+
+// Memory is a Store that keeps the IDs in memory, until the webhook stops.
+type Memory struct {
+	m     sync.Mutex
+	zones map[string]map[Key]int
+}
+
+// NewMemory creates an empty Memory store.
+func NewMemory() *Memory {
+	return &Memory{zones: map[string]map[Key]int{}}
+}
+
+// Get returns the ID of a record, if it is known.
+func (s *Memory) Get(key Key) (int, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	id, ok := s.zones[key.Zone][key]
+	return id, ok
+}
+
+// Delete forgets the ID of a record.
+func (s *Memory) Delete(key Key) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.zones[key.Zone], key)
+}
+
+// ReplaceZone replaces the IDs of the records of a zone.
+func (s *Memory) ReplaceZone(zone string, ids map[Key]int) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	records := make(map[Key]int, len(ids))
+	for key, id := range ids {
+		records[key] = id
+	}
+	s.zones[zone] = records
+}
+
+// Shutdown does nothing.
+func (s *Memory) Shutdown(context.Context) error {
+	return nil
+}
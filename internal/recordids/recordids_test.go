@@ -0,0 +1,68 @@
+/*
+ * Record IDs - Unit tests.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package recordids
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore checks the behaviour shared by the stores keeping the IDs.
+func testStore(t *testing.T, s Store) {
+	www := Key{Zone: "alpha.com", Host: "www", Type: "A", Target: "1.1.1.1"}
+	mail := Key{Zone: "alpha.com", Host: "mail", Type: "A", Target: "2.2.2.2"}
+	apex := Key{Zone: "beta.com", Host: "", Type: "A", Target: "3.3.3.3"}
+
+	_, ok := s.Get(www)
+	assert.False(t, ok)
+
+	s.ReplaceZone("alpha.com", map[Key]int{www: 1, mail: 2})
+	s.ReplaceZone("beta.com", map[Key]int{apex: 3})
+	id, ok := s.Get(www)
+	assert.True(t, ok)
+	assert.Equal(t, 1, id)
+
+	s.Delete(www)
+	_, ok = s.Get(www)
+	assert.False(t, ok)
+
+	// Replacing a zone forgets its records that are not listed anymore
+	s.ReplaceZone("alpha.com", map[Key]int{www: 4})
+	_, ok = s.Get(mail)
+	assert.False(t, ok)
+	id, _ = s.Get(www)
+	assert.Equal(t, 4, id)
+	id, _ = s.Get(apex)
+	assert.Equal(t, 3, id)
+}
+
+func Test_Memory(t *testing.T) {
+	s := NewMemory()
+	testStore(t, s)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
+
+func Test_Noop(t *testing.T) {
+	s := Noop{}
+	s.ReplaceZone("alpha.com", map[Key]int{{Zone: "alpha.com", Host: "www"}: 1})
+	_, ok := s.Get(Key{Zone: "alpha.com", Host: "www"})
+	assert.False(t, ok)
+	assert.NoError(t, s.Shutdown(context.Background()))
+}
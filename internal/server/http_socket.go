@@ -0,0 +1,78 @@
+/*
+ * HTTP socket - common listener handling.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// httpSocket holds the HTTP server of a socket, so that it can be shut down
+// from a different goroutine than the one serving it.
+type httpSocket struct {
+	m   sync.Mutex
+	srv *http.Server
+}
+
+// serve listens on the server address and serves the requests until the
+// server is shut down. The startedChan channel, if not nil, is notified as
+// soon as the socket is listening.
+func (s *httpSocket) serve(startedChan chan struct{}, srv *http.Server) {
+	l, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	s.m.Lock()
+	s.srv = srv
+	s.m.Unlock()
+
+	if startedChan != nil {
+		startedChan <- struct{}{}
+	}
+
+	if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+}
+
+// Shutdown stops accepting new connections and waits for the requests in
+// flight to complete. If the context expires first, the remaining connections
+// are closed and the context error is returned.
+func (s *httpSocket) Shutdown(ctx context.Context) error {
+	s.m.Lock()
+	srv := s.srv
+	s.m.Unlock()
+
+	if srv == nil {
+		return nil
+	}
+
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		if closeErr := srv.Close(); closeErr != nil {
+			log.Warn("Could not close the socket: ", closeErr.Error())
+		}
+	}
+	return err
+}
@@ -16,10 +16,13 @@
 package server
 
 import (
-	"net"
+	"encoding/json"
 	"net/http"
 
+	"external-dns-cloudns-webhook/internal/dryrun"
+	"external-dns-cloudns-webhook/internal/health"
 	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/queue"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
@@ -28,20 +31,50 @@ import (
 // MetricsSocket represents the socket that serves the Open Metrics, as well as
 // the liveness and readiness probes.
 type MetricsSocket struct {
-	status *Status
+	httpSocket
+	status  *Status
+	tracker *health.Tracker
+	metrics metrics.Metrics
+	reports *dryrun.Reports
+	queue   *queue.Queue
 }
 
-// NewMetricsSocket initializes a new MetricsSocket intance.
-func NewMetricsSocket(status *Status) *MetricsSocket {
+// healthzReport is the detailed answer of the healthz probe.
+type healthzReport struct {
+	Healthy  bool           `json:"healthy"`
+	Ready    bool           `json:"ready"`
+	Upstream *health.Report `json:"upstream,omitempty"`
+}
+
+// NewMetricsSocket initializes a new MetricsSocket intance exposing the given
+// upstream health, metrics, dry-run reports and apply queue status. Without a
+// tracker, the probes only reflect the status.
+func NewMetricsSocket(status *Status, tracker *health.Tracker, metrics metrics.Metrics, reports *dryrun.Reports, queue *queue.Queue) *MetricsSocket {
 	return &MetricsSocket{
-		status: status,
+		status:  status,
+		tracker: tracker,
+		metrics: metrics,
+		reports: reports,
+		queue:   queue,
 	}
 }
 
+// isHealthy returns true if the healthy flag is set and the ClouDNS API has
+// not been failing for too long.
+func (s *MetricsSocket) isHealthy() bool {
+	return s.status.IsHealthy() && (s.tracker == nil || s.tracker.IsHealthy())
+}
+
+// isReady returns true if the ready flag is set and the ClouDNS API calls did
+// not fail too many times in a row.
+func (s *MetricsSocket) isReady() bool {
+	return s.status.IsReady() && (s.tracker == nil || s.tracker.IsReady())
+}
+
 // livenessHandler checks if the server is healthy. It writes 200/OK if the
 // healthy flag is set to "true" and 503/Service Unavailable otherwise.
-func (s MetricsSocket) livenessHandler(w http.ResponseWriter, r *http.Request) {
-	healthy := s.status.IsHealthy()
+func (s *MetricsSocket) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	healthy := s.isHealthy()
 	var err error
 	if healthy {
 		_, err = w.Write([]byte(http.StatusText(http.StatusOK)))
@@ -56,8 +89,8 @@ func (s MetricsSocket) livenessHandler(w http.ResponseWriter, r *http.Request) {
 
 // readinessHandler checks if the server is ready. It writes 200/OK if the
 // healthy flag is set to "true" and 503/Service Unavailable otherwise.
-func (s MetricsSocket) readinessHandler(w http.ResponseWriter, r *http.Request) {
-	ready := s.status.IsReady()
+func (s *MetricsSocket) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	ready := s.isReady()
 	var err error
 	if ready {
 		_, err = w.Write([]byte(http.StatusText(http.StatusOK)))
@@ -75,10 +108,27 @@ func (s MetricsSocket) readinessHandler(w http.ResponseWriter, r *http.Request)
 // Unavailable otherwise. It is provided to ensure compatibility with
 // ExternalDNS Webhook requirements:
 // https://github.com/kubernetes-sigs/external-dns/blob/master/docs/tutorials/webhook-provider.md
-func (s MetricsSocket) healthzHandler(w http.ResponseWriter, r *http.Request) {
-	healthz := s.status.IsHealthy() && s.status.IsReady()
+//
+// If the "verbose" query parameter is present, the answer is a JSON document
+// that also contains the upstream health, including the last error of every
+// ClouDNS API action.
+func (s *MetricsSocket) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	healthy := s.isHealthy()
+	ready := s.isReady()
+	healthz := healthy && ready
 	var err error
-	if healthz {
+	if r.URL != nil && r.URL.Query().Has("verbose") {
+		report := healthzReport{Healthy: healthy, Ready: ready}
+		if s.tracker != nil {
+			upstream := s.tracker.Report()
+			report.Upstream = &upstream
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !healthz {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err = json.NewEncoder(w).Encode(report)
+	} else if healthz {
 		_, err = w.Write([]byte(http.StatusText(http.StatusOK)))
 	} else {
 		w.WriteHeader(http.StatusServiceUnavailable)
@@ -91,8 +141,7 @@ func (s MetricsSocket) healthzHandler(w http.ResponseWriter, r *http.Request) {
 
 // Start starts the exposed endpoints server.
 func (s *MetricsSocket) Start(startedChan chan struct{}, options SocketOptions) {
-	metrics := metrics.GetOpenMetricsInstance()
-	reg := metrics.GetRegistry()
+	reg := s.metrics.GetRegistry()
 
 	mux := http.NewServeMux()
 
@@ -104,26 +153,15 @@ func (s *MetricsSocket) Start(startedChan chan struct{}, options SocketOptions)
 		"/metrics",
 		promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}),
 	)
-
-	address := options.GetMetricsAddress()
+	mux.HandleFunc("/debug/dryrun", s.reports.Handler)
+	mux.HandleFunc("/debug/queue", s.queue.Handler)
 
 	srv := &http.Server{
-		Addr:         address,
+		Addr:         options.GetMetricsAddress(),
 		Handler:      mux,
 		ReadTimeout:  options.GetReadTimeout(),
 		WriteTimeout: options.GetWriteTimeout(),
 	}
 
-	l, err := net.Listen("tcp", address)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if startedChan != nil {
-		startedChan <- struct{}{}
-	}
-
-	if err := srv.Serve(l); err != nil {
-		log.Fatal(err)
-	}
+	s.serve(startedChan, srv)
 }
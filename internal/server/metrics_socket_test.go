@@ -17,10 +17,19 @@ package server
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/dryrun"
+	"external-dns-cloudns-webhook/internal/health"
+	"external-dns-cloudns-webhook/internal/metrics"
+	"external-dns-cloudns-webhook/internal/queue"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -156,6 +165,176 @@ func Test_MetricsSocket_readinessHandler(t *testing.T) {
 	}
 }
 
+// failingTracker returns a tracker that recorded the given number of failures,
+// with the readiness threshold set to 3 and the liveness threshold to 1ns.
+func failingTracker(failures int) *health.Tracker {
+	tracker := health.NewTracker()
+	tracker.SetThresholds(3, time.Nanosecond)
+	for i := 0; i < failures; i++ {
+		tracker.RecordFailure("default", "get_zones", fmt.Errorf("unauthorized"))
+	}
+	if failures > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return tracker
+}
+
+func Test_MetricsSocket_upstreamHealth(t *testing.T) {
+	type testCase struct {
+		name     string
+		failures int
+		healthy  int
+		ready    int
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		obj := &MetricsSocket{
+			status: &Status{
+				healthy: mutexedBool{v: true},
+				ready:   mutexedBool{v: true},
+			},
+			tracker: failingTracker(tc.failures),
+		}
+		w, r := testHandlerArgs()
+		obj.livenessHandler(w, r)
+		assert.Equal(t, tc.healthy, w.Code)
+		w, r = testHandlerArgs()
+		obj.readinessHandler(w, r)
+		assert.Equal(t, tc.ready, w.Code)
+	}
+
+	testCases := []testCase{
+		{
+			name:     "upstream never failed",
+			failures: 0,
+			healthy:  http.StatusOK,
+			ready:    http.StatusOK,
+		},
+		{
+			name:     "upstream failing below readiness threshold",
+			failures: 2,
+			healthy:  http.StatusServiceUnavailable,
+			ready:    http.StatusOK,
+		},
+		{
+			name:     "upstream failing beyond readiness threshold",
+			failures: 3,
+			healthy:  http.StatusServiceUnavailable,
+			ready:    http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_MetricsSocket_healthzHandler(t *testing.T) {
+	type testCase struct {
+		name     string
+		instance *MetricsSocket
+		verbose  bool
+		expected struct {
+			status int
+			text   string
+		}
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		obj := tc.instance
+		exp := tc.expected
+		w, r := testHandlerArgs()
+		if tc.verbose {
+			r.URL = &url.URL{Path: "/healthz", RawQuery: "verbose"}
+		}
+		obj.healthzHandler(w, r)
+		assert.Equal(t, exp.status, w.Code)
+		assert.Equal(t, exp.text, w.Body.String())
+	}
+
+	testCases := []testCase{
+		{
+			name: "healthy and ready",
+			instance: &MetricsSocket{
+				status: &Status{
+					healthy: mutexedBool{v: true},
+					ready:   mutexedBool{v: true},
+				},
+			},
+			expected: struct {
+				status int
+				text   string
+			}{
+				status: http.StatusOK,
+				text:   http.StatusText(http.StatusOK),
+			},
+		},
+		{
+			name: "healthy but not ready",
+			instance: &MetricsSocket{
+				status: &Status{
+					healthy: mutexedBool{v: true},
+				},
+			},
+			expected: struct {
+				status int
+				text   string
+			}{
+				status: http.StatusServiceUnavailable,
+				text:   http.StatusText(http.StatusServiceUnavailable),
+			},
+		},
+		{
+			name: "verbose without tracker",
+			instance: &MetricsSocket{
+				status: &Status{
+					healthy: mutexedBool{v: true},
+					ready:   mutexedBool{v: true},
+				},
+			},
+			verbose: true,
+			expected: struct {
+				status int
+				text   string
+			}{
+				status: http.StatusOK,
+				text:   "{\"healthy\":true,\"ready\":true}\n",
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+func Test_MetricsSocket_healthzHandler_verbose(t *testing.T) {
+	obj := &MetricsSocket{
+		status: &Status{
+			healthy: mutexedBool{v: true},
+			ready:   mutexedBool{v: true},
+		},
+		tracker: failingTracker(3),
+	}
+	w, r := testHandlerArgs()
+	r.URL = &url.URL{Path: "/healthz", RawQuery: "verbose"}
+
+	obj.healthzHandler(w, r)
+
+	var report healthzReport
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.False(t, report.Healthy)
+	assert.False(t, report.Ready)
+	assert.Equal(t, 3, report.Upstream.ConsecutiveFailures)
+	assert.Equal(t, "unauthorized", report.Upstream.Actions[0].LastError)
+}
+
 func Test_Start(t *testing.T) {
 	status := &Status{
 		healthy: mutexedBool{v: true},
@@ -168,9 +347,12 @@ func Test_Start(t *testing.T) {
 
 	startedChan := make(chan struct{})
 
-	metricsSocket := MetricsSocket{
-		status: status,
-	}
+	m, err := metrics.NewOpenMetrics(metrics.DefaultOptions())
+	assert.NoError(t, err)
+	m.IncSuccessfulApiCallsTotal("default", "login")
+	reports := dryrun.NewReports(5)
+	reports.Add(dryrun.Report{RequestID: "abc123"})
+	metricsSocket := NewMetricsSocket(status, health.NewTracker(), m, reports, queue.New(5))
 
 	go metricsSocket.Start(startedChan, options)
 	<-startedChan
@@ -181,4 +363,28 @@ func Test_Start(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, res.StatusCode, http.StatusOK)
+
+	// The metrics of the injected instance are exposed
+	url = fmt.Sprintf("http://%s:%d/metrics", testHost, testPort)
+	res, err = http.Get(url)
+	assert.Nil(t, err)
+	body, err := io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `cloudns_webhook_successful_api_calls_total{account="default",action="login"} 1`)
+
+	// The dry-run reports are exposed
+	url = fmt.Sprintf("http://%s:%d/debug/dryrun", testHost, testPort)
+	res, err = http.Get(url)
+	assert.Nil(t, err)
+	body, err = io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.Contains(t, string(body), `"requestId":"abc123"`)
+
+	// The apply queue status is exposed
+	url = fmt.Sprintf("http://%s:%d/debug/queue", testHost, testPort)
+	res, err = http.Get(url)
+	assert.Nil(t, err)
+	body, err = io.ReadAll(res.Body)
+	assert.Nil(t, err)
+	assert.JSONEq(t, "[]", string(body))
 }
@@ -48,6 +48,15 @@ type SocketOptions struct {
 	ReadTimeout int `env:"READ_TIMEOUT" default:"60000"`
 	// Write timeout in milliseconds
 	WriteTimeout int `env:"WRITE_TIMEOUT" default:"60000"`
+	// Time in milliseconds given to the requests in flight to complete when
+	// shutting down
+	ShutdownTimeout int `env:"SHUTDOWN_TIMEOUT" default:"30000"`
+	// Consecutive failed ClouDNS API calls after which the webhook is not
+	// ready (0 disables the check)
+	ReadinessMaxFailures int `env:"READINESS_MAX_FAILURES" default:"5"`
+	// Time in milliseconds the ClouDNS API may keep failing before the
+	// webhook is not healthy (0 disables the check)
+	LivenessMaxFailureDuration int `env:"LIVENESS_MAX_FAILURE_DURATION" default:"0"`
 }
 
 // NewSocketOptions returns a pointer to a new SocketOptions instance. This
@@ -97,3 +106,15 @@ func (o SocketOptions) GetReadTimeout() time.Duration {
 func (o SocketOptions) GetWriteTimeout() time.Duration {
 	return time.Duration(o.WriteTimeout) * time.Millisecond
 }
+
+// GetShutdownTimeout returns the time given to the requests in flight to
+// complete when shutting down.
+func (o SocketOptions) GetShutdownTimeout() time.Duration {
+	return time.Duration(o.ShutdownTimeout) * time.Millisecond
+}
+
+// GetLivenessMaxFailureDuration returns how long the ClouDNS API may keep
+// failing before the webhook is not healthy.
+func (o SocketOptions) GetLivenessMaxFailureDuration() time.Duration {
+	return time.Duration(o.LivenessMaxFailureDuration) * time.Millisecond
+}
@@ -114,3 +114,19 @@ func Test_SocketOptions_timeouts(t *testing.T) {
 	assert.Equal(t, r, testReadTimeout)
 	assert.Equal(t, w, testWriteTimeout)
 }
+
+func Test_SocketOptions_GetLivenessMaxFailureDuration(t *testing.T) {
+	s := SocketOptions{
+		LivenessMaxFailureDuration: 30000,
+	}
+
+	assert.Equal(t, 30*time.Second, s.GetLivenessMaxFailureDuration())
+}
+
+func Test_SocketOptions_GetShutdownTimeout(t *testing.T) {
+	s := SocketOptions{
+		ShutdownTimeout: 2500,
+	}
+
+	assert.Equal(t, 2500*time.Millisecond, s.GetShutdownTimeout())
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"net/http"
+
+	"external-dns-cloudns-webhook/internal/override"
+)
+
+// OverrideSocket represents the socket that grants the one-shot overrides of
+// the deletion guard. It is kept apart from the metrics socket, which is
+// reachable from the network, so that it can listen on a loopback address.
+type OverrideSocket struct {
+	httpSocket
+	overrides *override.Overrides
+}
+
+// NewOverrideSocket initializes a new OverrideSocket instance granting the
+// given overrides.
+func NewOverrideSocket(overrides *override.Overrides) *OverrideSocket {
+	return &OverrideSocket{overrides: overrides}
+}
+
+// Start starts the override server on the given address.
+func (s *OverrideSocket) Start(startedChan chan struct{}, address string, options SocketOptions) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/deletion-guard", s.overrides.Handler)
+
+	srv := &http.Server{
+		Addr:         address,
+		Handler:      mux,
+		ReadTimeout:  options.GetReadTimeout(),
+		WriteTimeout: options.GetWriteTimeout(),
+	}
+
+	s.serve(startedChan, srv)
+}
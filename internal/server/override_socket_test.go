@@ -0,0 +1,58 @@
+/*
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/override"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_OverrideSocket(t *testing.T) {
+	overrides := override.New("s3cret", time.Minute)
+	socket := NewOverrideSocket(overrides)
+	address := fmt.Sprintf("127.0.0.1:%d", testPort+3)
+
+	startedChan := make(chan struct{})
+	go socket.Start(startedChan, address, SocketOptions{})
+	<-startedChan
+	defer func() {
+		assert.NoError(t, socket.Shutdown(context.Background()))
+	}()
+
+	// An override is granted with the token
+	req, err := http.NewRequest(http.MethodPost, "http://"+address+"/debug/deletion-guard?zone=alpha.com", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer s3cret")
+	res, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.True(t, overrides.Granted([]string{"alpha.com"}))
+
+	// The pending overrides are listed
+	res, err = http.Get("http://" + address + "/debug/deletion-guard")
+	assert.NoError(t, err)
+	body, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(body), `"zone":"alpha.com"`)
+}
@@ -0,0 +1,189 @@
+/*
+ * Webhook socket - ExternalDNS webhook API.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/logging"
+	"external-dns-cloudns-webhook/internal/tracing"
+
+	log "github.com/sirupsen/logrus"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+	"sigs.k8s.io/external-dns/provider/webhook/api"
+)
+
+// CorrelationIDHeader is the HTTP header carrying the correlation ID of a
+// webhook request. An incoming value is reused, otherwise a new one is
+// generated; in both cases it is returned in the response.
+const CorrelationIDHeader = "X-Request-Id"
+
+// ContextAdjuster is implemented by the providers that adjust the desired
+// endpoints within the context of the request, so that the API calls they make
+// carry its correlation ID and span and stop when it is canceled.
+type ContextAdjuster interface {
+	AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error)
+}
+
+// WebhookSocket represents the socket that serves the ExternalDNS webhook API.
+// Unlike api.StartHTTPApi, it can be shut down gracefully.
+type WebhookSocket struct {
+	httpSocket
+	provider provider.Provider
+}
+
+// NewWebhookSocket initializes a new WebhookSocket instance.
+func NewWebhookSocket(provider provider.Provider) *WebhookSocket {
+	return &WebhookSocket{
+		provider: provider,
+	}
+}
+
+// handler returns the handler serving the webhook API endpoints.
+func (s *WebhookSocket) handler() http.Handler {
+	p := api.WebhookServer{
+		Provider: s.provider,
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", tracing.Handler("webhook.negotiate", http.HandlerFunc(p.NegotiateHandler)))
+	mux.Handle(api.UrlRecords, tracing.Handler("webhook.records", http.HandlerFunc(s.recordsHandler)))
+	mux.Handle(api.UrlAdjustEndpoints, tracing.Handler("webhook.adjust_endpoints", http.HandlerFunc(s.adjustEndpointsHandler)))
+
+	return correlationHandler(mux)
+}
+
+// correlationHandler assigns a correlation ID to each request, stores it in
+// the request context and logs the request once it has been served.
+func correlationHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(CorrelationIDHeader)
+		if id == "" {
+			id = logging.NewCorrelationID()
+		}
+		w.Header().Set(CorrelationIDHeader, id)
+
+		ctx := logging.WithCorrelationID(r.Context(), id)
+		start := time.Now()
+		next.ServeHTTP(w, r.WithContext(ctx))
+
+		logging.FromContext(ctx).WithFields(log.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"duration": time.Since(start).Milliseconds(),
+		}).Debug("Webhook request served")
+	})
+}
+
+// recordsHandler serves the records endpoint like api.WebhookServer does, but
+// passes the correlation ID and the span of the request on to the provider.
+// The provider context is not canceled with the request, so a client
+// disconnecting, or the server closing the connections at the shutdown
+// deadline, does not cancel the API calls of a batch being applied.
+// The batch keeps running only while the process does, though: once the
+// shutdown deadline has passed the webhook exits, and the changes not applied
+// yet are planned again by ExternalDNS at its next synchronization.
+func (s *WebhookSocket) recordsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.WithoutCancel(r.Context())
+	logger := logging.FromContext(ctx)
+
+	switch r.Method {
+	case http.MethodGet:
+		records, err := s.provider.Records(ctx)
+		if err != nil {
+			logger.Errorf("Failed to get Records: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
+		w.WriteHeader(http.StatusOK)
+		if err := json.NewEncoder(w).Encode(records); err != nil {
+			logger.Errorf("Failed to encode records: %v", err)
+		}
+	case http.MethodPost:
+		var changes plan.Changes
+		if err := json.NewDecoder(r.Body).Decode(&changes); err != nil {
+			logger.Errorf("Failed to decode changes: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := s.provider.ApplyChanges(ctx, &changes); err != nil {
+			logger.Errorf("Failed to apply changes: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		logger.Errorf("Unsupported method %s", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// adjustEndpointsHandler serves the adjust endpoints endpoint like
+// api.WebhookServer does, but passes the request context on to the provider if
+// it is a ContextAdjuster.
+func (s *WebhookSocket) adjustEndpointsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx)
+
+	if r.Method != http.MethodPost {
+		logger.Errorf("Unsupported method %s", r.Method)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var endpoints []*endpoint.Endpoint
+	if err := json.NewDecoder(r.Body).Decode(&endpoints); err != nil {
+		logger.Errorf("Failed to decode endpoints: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if adjuster, ok := s.provider.(ContextAdjuster); ok {
+		endpoints, err = adjuster.AdjustEndpointsContext(ctx, endpoints)
+	} else {
+		endpoints, err = s.provider.AdjustEndpoints(endpoints)
+	}
+	if err != nil {
+		logger.Errorf("Failed to adjust endpoints: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(api.ContentTypeHeader, api.MediaTypeFormatAndVersion)
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(endpoints); err != nil {
+		logger.Errorf("Failed to encode endpoints: %v", err)
+	}
+}
+
+// Start starts the webhook server.
+func (s *WebhookSocket) Start(startedChan chan struct{}, options SocketOptions) {
+	srv := &http.Server{
+		Addr:         options.GetWebhookAddress(),
+		Handler:      s.handler(),
+		ReadTimeout:  options.GetReadTimeout(),
+		WriteTimeout: options.GetWriteTimeout(),
+	}
+
+	s.serve(startedChan, srv)
+}
@@ -0,0 +1,327 @@
+/*
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"external-dns-cloudns-webhook/internal/logging"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+// slowProvider is a provider whose ApplyChanges takes the configured delay.
+type slowProvider struct {
+	provider.BaseProvider
+	delay   time.Duration
+	started chan struct{}
+	applied chan struct{}
+}
+
+func (p *slowProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return []*endpoint.Endpoint{}, nil
+}
+
+func (p *slowProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	p.started <- struct{}{}
+	time.Sleep(p.delay)
+	close(p.applied)
+	return nil
+}
+
+// startWebhookSocket starts a webhook socket on the given port with a slow
+// provider and sends an ApplyChanges request to it. It returns once the
+// provider started applying the changes. The response is nil if the request
+// failed.
+func startWebhookSocket(port uint16, delay time.Duration) (*WebhookSocket, *slowProvider, chan *http.Response) {
+	p := &slowProvider{
+		delay:   delay,
+		started: make(chan struct{}),
+		applied: make(chan struct{}),
+	}
+	socket := NewWebhookSocket(p)
+	startedChan := make(chan struct{})
+	go socket.Start(startedChan, SocketOptions{WebhookHost: testHost, WebhookPort: port})
+	<-startedChan
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		url := fmt.Sprintf("http://%s:%d/records", testHost, port)
+		res, err := http.Post(url, "application/json", strings.NewReader("{}"))
+		if err != nil {
+			res = nil
+		}
+		responses <- res
+	}()
+	<-p.started
+
+	return socket, p, responses
+}
+
+func Test_WebhookSocket_Shutdown(t *testing.T) {
+	socket, p, responses := startWebhookSocket(testPort+1, 200*time.Millisecond)
+
+	err := socket.Shutdown(context.Background())
+
+	assert.Nil(t, err)
+	select {
+	case <-p.applied:
+	default:
+		t.Error("Shutdown returned before the changes were applied")
+	}
+	res := <-responses
+	if assert.NotNil(t, res) {
+		assert.Equal(t, http.StatusNoContent, res.StatusCode)
+	}
+
+	_, err = http.Get(fmt.Sprintf("http://%s:%d/", testHost, testPort+1))
+	assert.NotNil(t, err)
+}
+
+func Test_WebhookSocket_Shutdown_deadline(t *testing.T) {
+	socket, p, responses := startWebhookSocket(testPort+2, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := socket.Shutdown(ctx)
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Nil(t, <-responses)
+	<-p.applied
+}
+
+func Test_WebhookSocket_Shutdown_notStarted(t *testing.T) {
+	socket := NewWebhookSocket(&slowProvider{})
+
+	assert.Nil(t, socket.Shutdown(context.Background()))
+}
+
+// contextProvider is a provider that records the correlation ID and the span
+// found in the context of its calls.
+type contextProvider struct {
+	provider.BaseProvider
+	correlationID string
+	spanContext   trace.SpanContext
+}
+
+func (p *contextProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	p.correlationID = logging.CorrelationID(ctx)
+	p.spanContext = trace.SpanContextFromContext(ctx)
+	return []*endpoint.Endpoint{}, nil
+}
+
+func (p *contextProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	p.correlationID = logging.CorrelationID(ctx)
+	p.spanContext = trace.SpanContextFromContext(ctx)
+	return nil
+}
+
+func (p *contextProvider) AdjustEndpointsContext(ctx context.Context, endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	p.correlationID = logging.CorrelationID(ctx)
+	p.spanContext = trace.SpanContextFromContext(ctx)
+	return endpoints, nil
+}
+
+func Test_WebhookSocket_correlationID(t *testing.T) {
+	type testCase struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		header   string
+		status   int
+		expected string
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		p := &contextProvider{}
+		socket := NewWebhookSocket(p)
+		path := "/records"
+		if tc.path != "" {
+			path = tc.path
+		}
+		req := httptest.NewRequest(tc.method, path, strings.NewReader(tc.body))
+		if tc.header != "" {
+			req.Header.Set(CorrelationIDHeader, tc.header)
+		}
+		rec := httptest.NewRecorder()
+
+		socket.handler().ServeHTTP(rec, req)
+
+		assert.Equal(t, tc.status, rec.Code)
+		id := rec.Header().Get(CorrelationIDHeader)
+		assert.NotEmpty(t, id)
+		assert.Equal(t, id, p.correlationID)
+		if tc.expected != "" {
+			assert.Equal(t, tc.expected, id)
+		}
+	}
+
+	testCases := []testCase{
+		{
+			name:   "records generated id",
+			method: http.MethodGet,
+			status: http.StatusOK,
+		},
+		{
+			name:     "records incoming id",
+			method:   http.MethodGet,
+			header:   "abc123",
+			status:   http.StatusOK,
+			expected: "abc123",
+		},
+		{
+			name:     "apply changes incoming id",
+			method:   http.MethodPost,
+			body:     "{}",
+			header:   "def456",
+			status:   http.StatusNoContent,
+			expected: "def456",
+		},
+		{
+			name:     "adjust endpoints incoming id",
+			method:   http.MethodPost,
+			path:     "/adjustendpoints",
+			body:     "[]",
+			header:   "ghi789",
+			status:   http.StatusOK,
+			expected: "ghi789",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}
+
+// cancelProvider is a provider recording whether the context of ApplyChanges
+// was canceled while the changes were applied.
+type cancelProvider struct {
+	provider.BaseProvider
+	canceled chan struct{}
+	err      error
+}
+
+func (p *cancelProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return []*endpoint.Endpoint{}, nil
+}
+
+func (p *cancelProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	<-p.canceled
+	p.err = ctx.Err()
+	return p.err
+}
+
+func Test_WebhookSocket_recordsHandler_canceled(t *testing.T) {
+	p := &cancelProvider{canceled: make(chan struct{})}
+	socket := NewWebhookSocket(p)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader("{}")).WithContext(ctx)
+	rec := httptest.NewRecorder()
+
+	// The request is canceled while the changes are applied
+	go func() {
+		cancel()
+		close(p.canceled)
+	}()
+	socket.handler().ServeHTTP(rec, req)
+
+	assert.Nil(t, p.err)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+}
+
+func Test_WebhookSocket_recordsHandler_errors(t *testing.T) {
+	socket := NewWebhookSocket(&contextProvider{})
+
+	rec := httptest.NewRecorder()
+	socket.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	socket.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/records", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+// adjustProvider is a provider without AdjustEndpointsContext whose
+// AdjustEndpoints fails if err is set.
+type adjustProvider struct {
+	provider.BaseProvider
+	err error
+}
+
+func (p *adjustProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return []*endpoint.Endpoint{}, nil
+}
+
+func (p *adjustProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	return nil
+}
+
+func (p *adjustProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	return endpoints[:1], p.err
+}
+
+func Test_WebhookSocket_adjustEndpointsHandler(t *testing.T) {
+	body := `[{"dnsName":"a.test1.com","recordType":"A","targets":["1.1.1.1"]},{"dnsName":"b.test1.com","recordType":"A","targets":["2.2.2.2"]}]`
+
+	rec := httptest.NewRecorder()
+	NewWebhookSocket(&adjustProvider{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/adjustendpoints", strings.NewReader(body)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[{"dnsName":"a.test1.com","recordType":"A","targets":["1.1.1.1"]}]`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	NewWebhookSocket(&adjustProvider{err: fmt.Errorf("failed")}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/adjustendpoints", strings.NewReader(body)))
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	rec = httptest.NewRecorder()
+	NewWebhookSocket(&adjustProvider{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/adjustendpoints", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	NewWebhookSocket(&adjustProvider{}).handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/adjustendpoints", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func Test_WebhookSocket_tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	bkpProvider := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer otel.SetTracerProvider(bkpProvider)
+
+	p := &contextProvider{}
+	socket := NewWebhookSocket(p)
+	socket.handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/records", nil))
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "webhook.records", spans[0].Name)
+	assert.Equal(t, spans[0].SpanContext, p.spanContext)
+}
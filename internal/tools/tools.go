@@ -6,4 +6,5 @@ import (
 	_ "github.com/golang/mock/mockgen"
 	_ "github.com/google/go-licenses"
 	_ "gotest.tools/gotestsum"
+	_ "mvdan.cc/gofumpt"
 )
@@ -0,0 +1,162 @@
+/*
+ * Tracing - OpenTelemetry tracing of webhook requests and ClouDNS API calls.
+ *
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/codingconcepts/env"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusRecorder captures the status code written by an HTTP handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status code and forwards it.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// tracerName is the instrumentation scope of the spans.
+const tracerName = "external-dns-cloudns-webhook"
+
+// Span attributes.
+const (
+	// AccountKey is the ClouDNS account a span refers to.
+	AccountKey = attribute.Key("cloudns.account")
+	// ActionKey is the ClouDNS API action a span refers to.
+	ActionKey = attribute.Key("cloudns.action")
+	// ZoneKey is the ClouDNS zone a span refers to.
+	ZoneKey = attribute.Key("cloudns.zone")
+)
+
+// Options contains the tracing configuration. The OTLP exporter itself is
+// configured with the standard OTEL_EXPORTER_OTLP_* environment variables.
+type Options struct {
+	// Enables the export of traces
+	Enabled bool `env:"TRACING_ENABLED" default:"false"`
+	// Service name reported with the traces
+	ServiceName string `env:"OTEL_SERVICE_NAME" default:"external-dns-cloudns-webhook"`
+}
+
+// Shutdowner flushes and stops the export of traces.
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// noopShutdowner is returned when tracing is disabled.
+type noopShutdowner struct{}
+
+// Shutdown does nothing.
+func (noopShutdowner) Shutdown(context.Context) error {
+	return nil
+}
+
+// NewOptions returns a pointer to a new Options instance populated with the
+// values taken from the environment variables.
+func NewOptions() (*Options, error) {
+	opt := &Options{}
+
+	// Populate with values from environment.
+	if err := env.Set(opt); err != nil {
+		return nil, err
+	}
+
+	return opt, nil
+}
+
+// Setup installs the global tracer provider exporting the spans through OTLP
+// over HTTP, and the W3C trace context propagator. If tracing is disabled,
+// spans are not recorded and the returned Shutdowner does nothing.
+func Setup(ctx context.Context, options Options) (Shutdowner, error) {
+	if !options.Enabled {
+		return noopShutdowner{}, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			semconv.ServiceName(options.ServiceName),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return tp, nil
+}
+
+// Tracer returns the tracer of the webhook, taken from the global tracer
+// provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// RecordError marks the span as failed if err is not nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Handler wraps an HTTP handler in a server span with the given name. The
+// span continues the trace of the caller if the request carries one, and is
+// marked as failed if the handler answers with a server error.
+func Handler(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+			),
+		)
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright 2023 Marco Confalonieri.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// installExporter installs a tracer provider exporting to memory for the
+// duration of the test.
+func installExporter(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	bkpProvider, bkpPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(bkpProvider)
+		otel.SetTextMapPropagator(bkpPropagator)
+	})
+	return exporter
+}
+
+func Test_Setup_disabled(t *testing.T) {
+	shutdowner, err := Setup(context.Background(), Options{Enabled: false})
+	assert.NoError(t, err)
+	assert.Equal(t, noopShutdowner{}, shutdowner)
+	assert.NoError(t, shutdowner.Shutdown(context.Background()))
+}
+
+func Test_Setup_enabled(t *testing.T) {
+	bkpProvider, bkpPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	defer func() {
+		otel.SetTracerProvider(bkpProvider)
+		otel.SetTextMapPropagator(bkpPropagator)
+	}()
+
+	shutdowner, err := Setup(context.Background(), Options{Enabled: true, ServiceName: "test"})
+	assert.NoError(t, err)
+	assert.IsType(t, &sdktrace.TracerProvider{}, shutdowner)
+	assert.Equal(t, shutdowner, otel.GetTracerProvider())
+	assert.NoError(t, shutdowner.Shutdown(context.Background()))
+}
+
+func Test_RecordError(t *testing.T) {
+	exporter := installExporter(t)
+
+	_, span := Tracer().Start(context.Background(), "ok")
+	RecordError(span, nil)
+	span.End()
+	_, span = Tracer().Start(context.Background(), "failed")
+	RecordError(span, errors.New("boom"))
+	span.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, codes.Unset, spans[0].Status.Code)
+	assert.Equal(t, codes.Error, spans[1].Status.Code)
+	assert.Equal(t, "boom", spans[1].Status.Description)
+}
+
+func Test_Handler(t *testing.T) {
+	type testCase struct {
+		name        string
+		status      int
+		traceparent string
+		statusCode  codes.Code
+	}
+
+	run := func(t *testing.T, tc testCase) {
+		exporter := installExporter(t)
+		var handlerSpan trace.SpanContext
+		handler := Handler("webhook.test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerSpan = trace.SpanContextFromContext(r.Context())
+			w.WriteHeader(tc.status)
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/records", nil)
+		if tc.traceparent != "" {
+			req.Header.Set("traceparent", tc.traceparent)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		spans := exporter.GetSpans()
+		assert.Len(t, spans, 1)
+		span := spans[0]
+		assert.Equal(t, "webhook.test", span.Name)
+		assert.Equal(t, trace.SpanKindServer, span.SpanKind)
+		assert.Equal(t, handlerSpan, span.SpanContext)
+		assert.Equal(t, tc.statusCode, span.Status.Code)
+		assert.Contains(t, span.Attributes, attribute.Int("http.response.status_code", tc.status))
+		assert.Contains(t, span.Attributes, attribute.String("http.request.method", http.MethodGet))
+		if tc.traceparent != "" {
+			assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext.TraceID().String())
+			assert.Equal(t, "00f067aa0ba902b7", span.Parent.SpanID().String())
+		} else {
+			assert.False(t, span.Parent.IsValid())
+		}
+	}
+
+	testCases := []testCase{
+		{
+			name:       "success",
+			status:     http.StatusOK,
+			statusCode: codes.Unset,
+		},
+		{
+			name:       "server error",
+			status:     http.StatusInternalServerError,
+			statusCode: codes.Error,
+		},
+		{
+			name:        "remote parent",
+			status:      http.StatusNoContent,
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			statusCode:  codes.Unset,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			run(t, tc)
+		})
+	}
+}